@@ -428,6 +428,7 @@ type (
 		Json         bool             `help:"Return replay profiling data as JSON instead of text"`
 		DisabledCmds []flags.U64Slice `help:"command/subcommand index (e.g. '[123, 0, 0, 4]') for disabling a draw call (repeatable)"`
 		DisableAF    bool             `help:"Disable Anisotropic Filtering for all samplers"`
+		Attribution  string           `help:"strategy attributing the GPU counters to the commands (proportional, majority, overlap or intensity)"`
 	}
 
 	CreateGraphVisualizationFlags struct {
@@ -83,6 +83,7 @@ func (verb *profileVerb) Run(ctx context.Context, flags flag.FlagSet) error {
 		Experiments: &service.ProfileExperiments{
 			DisabledCommands:            commands,
 			DisableAnisotropicFiltering: verb.DisableAF,
+			CounterAttribution:          verb.Attribution,
 		},
 	}
 
@@ -71,6 +71,10 @@ public class Capture extends ModelBase<Capture.Data, File, Loadable.Message, Cap
 
   public void loadCapture(File file) {
     LOG.log(INFO, "Loading capture " + file + "...");
+    if (isLoaded()) {
+      // Drop the results the server cached for the capture being replaced.
+      client.unloadCapture(getData().path);
+    }
     name = file.getName();
     load(file, true);
   }
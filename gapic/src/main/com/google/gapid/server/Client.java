@@ -42,6 +42,7 @@ import com.google.gapid.proto.service.Service.Release;
 import com.google.gapid.proto.service.Service.SaveCaptureRequest;
 import com.google.gapid.proto.service.Service.ServerInfo;
 import com.google.gapid.proto.service.Service.SetRequest;
+import com.google.gapid.proto.service.Service.UnloadCaptureRequest;
 import com.google.gapid.proto.service.Service.Value;
 import com.google.gapid.proto.service.path.Path;
 import com.google.gapid.proto.stringtable.Stringtable;
@@ -174,6 +175,15 @@ public class Client {
             in -> immediateFuture(throwIfError(null, in.getError(), stack))));
   }
 
+  public ListenableFuture<Void> unloadCapture(Path.Capture capture) {
+    return call(() -> String.format("RPC->unloadCapture(%s)", shortDebugString(capture)),
+        stack -> MoreFutures.transformAsync(
+            client.unloadCapture(UnloadCaptureRequest.newBuilder()
+                .setCapture(capture)
+                .build()),
+            in -> immediateFuture(throwIfError(null, in.getError(), stack))));
+  }
+
   public ListenableFuture<List<Path.Device>> getDevices() {
     return call(() -> "RPC->getDevices()",
         stack -> MoreFutures.transformAsync(
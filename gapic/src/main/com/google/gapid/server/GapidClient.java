@@ -46,6 +46,8 @@ public interface GapidClient {
       Service.LoadCaptureRequest request);
   public ListenableFuture<Service.SaveCaptureResponse> saveCapture(
       Service.SaveCaptureRequest request);
+  public ListenableFuture<Service.UnloadCaptureResponse> unloadCapture(
+      Service.UnloadCaptureRequest request);
   public ListenableFuture<Service.GetDevicesResponse> getDevices(Service.GetDevicesRequest request);
   public ListenableFuture<Service.GetDevicesForReplayResponse> getDevicesForReplay(
       Service.GetDevicesForReplayRequest request);
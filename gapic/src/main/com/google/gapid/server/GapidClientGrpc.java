@@ -121,6 +121,12 @@ public class GapidClientGrpc implements GapidClient {
     return client.saveCapture(request);
   }
 
+  @Override
+  public ListenableFuture<Service.UnloadCaptureResponse> unloadCapture(
+      Service.UnloadCaptureRequest request) {
+    return client.unloadCapture(request);
+  }
+
   @Override
   public ListenableFuture<Service.LoadCaptureResponse> loadCapture(
       Service.LoadCaptureRequest request) {
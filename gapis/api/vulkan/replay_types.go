@@ -206,6 +206,6 @@ func (a API) QueryProfile(
 		return nil, err
 	}
 
-	d, err := trace.ProcessProfilingData(ctx, intent.Device, intent.Capture, &buffer, &handleMappings, s)
+	d, err := trace.ProcessProfilingData(ctx, intent.Device, intent.Capture, &buffer, &handleMappings, s, experiments.CounterAttribution)
 	return d, err
 }
@@ -337,6 +337,19 @@ func (c *client) SaveCapture(ctx context.Context, capture *path.Capture, path st
 	return nil
 }
 
+func (c *client) UnloadCapture(ctx context.Context, capture *path.Capture) error {
+	res, err := c.client.UnloadCapture(ctx, &service.UnloadCaptureRequest{
+		Capture: capture,
+	})
+	if err != nil {
+		return err
+	}
+	if err := res.GetError(); err != nil {
+		return err.Get()
+	}
+	return nil
+}
+
 func (c *client) ExportReplay(ctx context.Context, capture *path.Capture, device *path.Device, path string, opts *service.ExportReplayOptions) error {
 	res, err := c.client.ExportReplay(ctx, &service.ExportReplayRequest{
 		Capture: capture,
@@ -527,6 +540,39 @@ func (c *client) GpuProfile(ctx context.Context, req *service.GpuProfileRequest)
 	return res.GetProfilingData(), nil
 }
 
+func (c *client) TopCommands(ctx context.Context, req *service.TopCommandsRequest) (*service.TopCommands, error) {
+	res, err := c.client.TopCommands(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.GetError(); err != nil {
+		return nil, err.Get()
+	}
+	return res.GetTopCommands(), nil
+}
+
+func (c *client) RangeCounters(ctx context.Context, req *service.RangeCountersRequest) (*service.RangeCounters, error) {
+	res, err := c.client.RangeCounters(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.GetError(); err != nil {
+		return nil, err.Get()
+	}
+	return res.GetRangeCounters(), nil
+}
+
+func (c *client) ProfileDiff(ctx context.Context, req *service.ProfileDiffRequest) (*service.ProfileDiff, error) {
+	res, err := c.client.ProfileDiff(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.GetError(); err != nil {
+		return nil, err.Get()
+	}
+	return res.GetDiff(), nil
+}
+
 func (c *client) GetTimestamps(ctx context.Context, req *service.GetTimestampsRequest, handler service.TimeStampsHandler) error {
 	stream, err := c.client.GetTimestamps(ctx, req)
 	if err != nil {
@@ -536,6 +582,15 @@ func (c *client) GetTimestamps(ctx context.Context, req *service.GetTimestampsRe
 	return event.Feed(ctx, event.AsHandler(ctx, h), grpcutil.ToProducer(stream))
 }
 
+func (c *client) GpuProfileStream(ctx context.Context, req *service.GpuProfileStreamRequest, handler service.ProfilingDataChunkHandler) error {
+	stream, err := c.client.GpuProfileStream(ctx, req)
+	if err != nil {
+		return err
+	}
+	h := func(ctx context.Context, m *service.GpuProfileStreamResponse) error { return handler(m) }
+	return event.Feed(ctx, event.AsHandler(ctx, h), grpcutil.ToProducer(stream))
+}
+
 func (c *client) GetGraphVisualization(ctx context.Context, capture *path.Capture, format service.GraphFormat) ([]byte, error) {
 	res, err := c.client.GetGraphVisualization(ctx, &service.GraphVisualizationRequest{
 		Capture: capture,
@@ -73,8 +73,25 @@ func getPerfettoConfig(ctx context.Context, device *path.Device) (*perfetto_pb.T
 	return conf, nil
 }
 
-// GpuProfile replays the trace and writes a Perfetto trace of the replay
+// GpuProfile returns the profiling data of a replay of the trace on the device,
+// replaying the trace only if the data of the capture for the device and the
+// experiments isn't in Profiles already. The data is shared and must
+// not be modified.
 func GpuProfile(ctx context.Context, capturePath *path.Capture, device *path.Device, experiments *service.ProfileExperiments) (*service.ProfilingData, error) {
+	id, key := capturePath.GetID().ID(), profileKey(device, experiments)
+	if data, ok := Profiles.Get(id, key); ok {
+		return data, nil
+	}
+	data, err := gpuProfile(ctx, capturePath, device, experiments)
+	if err != nil {
+		return nil, err
+	}
+	Profiles.Put(id, key, data)
+	return data, nil
+}
+
+// gpuProfile replays the trace and writes a Perfetto trace of the replay
+func gpuProfile(ctx context.Context, capturePath *path.Capture, device *path.Device, experiments *service.ProfileExperiments) (*service.ProfilingData, error) {
 	c, err := capture.ResolveGraphicsFromPath(ctx, capturePath)
 	if err != nil {
 		return nil, err
@@ -112,6 +129,7 @@ func GpuProfile(ctx context.Context, capturePath *path.Capture, device *path.Dev
 			}
 			profilingExperiments.DisabledCmds = disabledCmdsIndices
 			profilingExperiments.DisableAnisotropicFiltering = experiments.DisableAnisotropicFiltering
+			profilingExperiments.CounterAttribution = experiments.CounterAttribution
 		}
 
 		mgr := GetManager(ctx)
@@ -0,0 +1,132 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/gapid/core/data/id"
+	"github.com/google/gapid/gapis/service"
+	"github.com/google/gapid/gapis/service/path"
+)
+
+// DefaultProfileCacheSize is the capacity of Profiles, in encoded bytes.
+const DefaultProfileCacheSize = 1024 * 1024 * 1024
+
+// Profiles is the cache of the profiling data of the replays shared by the
+// resolvers, see GpuProfile, for a capture not to be replayed again every time
+// the client switches views. The profiles of a capture are evicted once it is
+// unloaded.
+var Profiles = NewProfileCache(DefaultProfileCacheSize)
+
+// ProfileCache holds the profiling data of the replays by capture and by key
+// of the replay, see profileKey. The least recently used profiles are evicted
+// once the encoded size of all the profiles exceeds the capacity. The profiles
+// are shared by all the users of the cache and must not be modified. It is
+// safe for concurrent use.
+type ProfileCache struct {
+	mutex    sync.Mutex
+	capacity int
+	size     int
+	lru      *list.List // Of *profileCacheEntry, the most recently used first.
+	entries  map[profileCacheKey]*list.Element
+}
+
+type profileCacheKey struct {
+	capture, replay id.ID
+}
+
+type profileCacheEntry struct {
+	key  profileCacheKey
+	data *service.ProfilingData
+	size int
+}
+
+// NewProfileCache returns an empty cache holding up to capacity bytes of
+// encoded profiles.
+func NewProfileCache(capacity int) *ProfileCache {
+	return &ProfileCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  map[profileCacheKey]*list.Element{},
+	}
+}
+
+// profileKey returns the key of the profiling data of the replays on the
+// device with the experiments.
+func profileKey(device *path.Device, experiments *service.ProfileExperiments) id.ID {
+	return id.OfString(proto.CompactTextString(device), proto.CompactTextString(experiments))
+}
+
+// Get returns the profiling data cached for the capture under the replay key,
+// and whether there is one.
+func (c *ProfileCache) Get(capture, replay id.ID) (*service.ProfilingData, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.entries[profileCacheKey{capture, replay}]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*profileCacheEntry).data, true
+}
+
+// Put caches the profiling data for the capture under the replay key, evicting
+// the least recently used profiles past the capacity. The data must not be
+// modified afterwards. Data larger than the capacity isn't cached.
+func (c *ProfileCache) Put(capture, replay id.ID, data *service.ProfilingData) {
+	size := proto.Size(data)
+	if size > c.capacity {
+		return
+	}
+	entry := &profileCacheEntry{key: profileCacheKey{capture, replay}, data: data, size: size}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+	for c.size > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Evict drops all the profiles cached for the capture, such as once it is
+// unloaded.
+func (c *ProfileCache) Evict(capture id.ID) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, elem := range c.entries {
+		if key.capture == capture {
+			c.remove(elem)
+		}
+	}
+}
+
+// Len returns the number of cached profiles.
+func (c *ProfileCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
+
+func (c *ProfileCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*profileCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/data/id"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+	"github.com/google/gapid/gapis/service/path"
+)
+
+func profilingDataFixture() *service.ProfilingData {
+	return &service.ProfilingData{
+		Slices: &service.ProfilingData_GpuSlices{
+			Slices: []*service.ProfilingData_GpuSlices_Slice{{Ts: 0, Dur: 10, Label: "draw"}},
+		},
+		Counters: []*service.ProfilingData_Counter{
+			{Name: "Busy", Timestamps: []uint64{0, 10}, Values: []float64{0, 5}},
+		},
+		GpuCounters: &service.ProfilingData_GpuCounters{
+			Metrics: []*service.ProfilingData_GpuCounters_Metric{{Id: 0, Name: "GPU Time"}},
+			Entries: []*service.ProfilingData_GpuCounters_Entry{{
+				CommandIndex:  []uint64{0},
+				MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{0: {Estimate: 10, Min: 10, Max: 10}},
+			}},
+		},
+	}
+}
+
+func TestProfileCache(t *testing.T) {
+	ctx := log.Testing(t)
+	data := profilingDataFixture()
+	capture := id.OfString("capture")
+	device := &path.Device{ID: path.NewID(id.OfString("device"))}
+	key := profileKey(device, nil)
+	cache := NewProfileCache(DefaultProfileCacheSize)
+
+	_, ok := cache.Get(capture, key)
+	assert.For(ctx, "empty").That(ok).Equals(false)
+	cache.Put(capture, key, data)
+	cached, ok := cache.Get(capture, key)
+	assert.For(ctx, "cached").That(ok).Equals(true)
+	assert.For(ctx, "shared").That(cached == data).Equals(true)
+
+	// The same replay has the same key, another device or other experiments
+	// another one.
+	assert.For(ctx, "same").That(profileKey(&path.Device{ID: path.NewID(id.OfString("device"))}, nil)).Equals(key)
+	other := profileKey(&path.Device{ID: path.NewID(id.OfString("other"))}, nil)
+	experiments := profileKey(device, &service.ProfileExperiments{CounterAttribution: "overlap"})
+	assert.For(ctx, "device").That(other == key).Equals(false)
+	assert.For(ctx, "experiments").That(experiments == key).Equals(false)
+
+	cache.Put(capture, other, data)
+	cache.Put(id.OfString("other"), key, data)
+	assert.For(ctx, "len").That(cache.Len()).Equals(3)
+
+	cache.Evict(capture)
+	assert.For(ctx, "evicted").That(cache.Len()).Equals(1)
+	_, ok = cache.Get(capture, key)
+	assert.For(ctx, "evicted").That(ok).Equals(false)
+}
+
+func TestProfileCacheEviction(t *testing.T) {
+	ctx := log.Testing(t)
+	data := profilingDataFixture()
+	size := proto.Size(data)
+	cache := NewProfileCache(2 * size)
+	a, b, c := id.OfString("a"), id.OfString("b"), id.OfString("c")
+	key := profileKey(nil, nil)
+	cache.Put(a, key, data)
+	cache.Put(b, key, data)
+	cache.Get(a, key) // a becomes the most recently used.
+	cache.Put(c, key, data)
+
+	_, ok := cache.Get(a, key)
+	assert.For(ctx, "a").That(ok).Equals(true)
+	_, ok = cache.Get(b, key)
+	assert.For(ctx, "b").That(ok).Equals(false)
+	_, ok = cache.Get(c, key)
+	assert.For(ctx, "c").That(ok).Equals(true)
+
+	small := NewProfileCache(size - 1)
+	small.Put(a, key, data)
+	assert.For(ctx, "too large").That(small.Len()).Equals(0)
+}
@@ -487,6 +487,15 @@ func (s *grpcServer) SaveCapture(ctx xctx.Context, req *service.SaveCaptureReque
 	return &service.SaveCaptureResponse{}, nil
 }
 
+func (s *grpcServer) UnloadCapture(ctx xctx.Context, req *service.UnloadCaptureRequest) (*service.UnloadCaptureResponse, error) {
+	defer s.inRPC()()
+	err := s.handler.UnloadCapture(s.bindCtx(ctx), req.Capture)
+	if err := service.NewError(err); err != nil {
+		return &service.UnloadCaptureResponse{Error: err}, nil
+	}
+	return &service.UnloadCaptureResponse{}, nil
+}
+
 func (s *grpcServer) ExportReplay(ctx xctx.Context, req *service.ExportReplayRequest) (*service.ExportReplayResponse, error) {
 	defer s.inRPC()()
 	err := s.handler.ExportReplay(s.bindCtx(ctx), req.Capture, req.Device, req.Path, req.Options)
@@ -564,6 +573,33 @@ func (s *grpcServer) GpuProfile(ctx xctx.Context, req *service.GpuProfileRequest
 	return &service.GpuProfileResponse{Res: &service.GpuProfileResponse_ProfilingData{ProfilingData: res}}, nil
 }
 
+func (s *grpcServer) TopCommands(ctx xctx.Context, req *service.TopCommandsRequest) (*service.TopCommandsResponse, error) {
+	defer s.inRPC()()
+	res, err := s.handler.TopCommands(s.bindCtx(ctx), req)
+	if err := service.NewError(err); err != nil {
+		return &service.TopCommandsResponse{Res: &service.TopCommandsResponse_Error{Error: err}}, nil
+	}
+	return &service.TopCommandsResponse{Res: &service.TopCommandsResponse_TopCommands{TopCommands: res}}, nil
+}
+
+func (s *grpcServer) RangeCounters(ctx xctx.Context, req *service.RangeCountersRequest) (*service.RangeCountersResponse, error) {
+	defer s.inRPC()()
+	res, err := s.handler.RangeCounters(s.bindCtx(ctx), req)
+	if err := service.NewError(err); err != nil {
+		return &service.RangeCountersResponse{Res: &service.RangeCountersResponse_Error{Error: err}}, nil
+	}
+	return &service.RangeCountersResponse{Res: &service.RangeCountersResponse_RangeCounters{RangeCounters: res}}, nil
+}
+
+func (s *grpcServer) ProfileDiff(ctx xctx.Context, req *service.ProfileDiffRequest) (*service.ProfileDiffResponse, error) {
+	defer s.inRPC()()
+	res, err := s.handler.ProfileDiff(s.bindCtx(ctx), req)
+	if err := service.NewError(err); err != nil {
+		return &service.ProfileDiffResponse{Res: &service.ProfileDiffResponse_Error{Error: err}}, nil
+	}
+	return &service.ProfileDiffResponse{Res: &service.ProfileDiffResponse_Diff{Diff: res}}, nil
+}
+
 func (s *grpcServer) UpdateSettings(ctx xctx.Context, req *service.UpdateSettingsRequest) (*service.UpdateSettingsResponse, error) {
 	defer s.inRPC()()
 	err := s.handler.UpdateSettings(s.bindCtx(ctx), req)
@@ -666,6 +702,16 @@ func (s *grpcServer) GetTimestamps(req *service.GetTimestampsRequest, server ser
 	return s.handler.GetTimestamps(s.bindCtx(ctx), req, server.Send)
 }
 
+func (s *grpcServer) GpuProfileStream(req *service.GpuProfileStreamRequest, server service.Gapid_GpuProfileStreamServer) error {
+	defer s.inRPC()()
+	ctx := server.Context()
+	err := s.handler.GpuProfileStream(s.bindCtx(ctx), req, server.Send)
+	if err := service.NewError(err); err != nil {
+		return server.Send(&service.GpuProfileStreamResponse{Res: &service.GpuProfileStreamResponse_Error{Error: err}})
+	}
+	return nil
+}
+
 func (s *grpcServer) PerfettoQuery(ctx xctx.Context, req *service.PerfettoQueryRequest) (*service.PerfettoQueryResponse, error) {
 	data, err := s.handler.PerfettoQuery(s.bindCtx(ctx), req.Capture, req.Query)
 	if err := service.NewError(err); err != nil {
@@ -55,6 +55,7 @@ import (
 	"github.com/google/gapid/gapis/service/path"
 	"github.com/google/gapid/gapis/stringtable"
 	"github.com/google/gapid/gapis/trace"
+	"github.com/google/gapid/gapis/trace/android/profile"
 
 	"github.com/google/go-github/github"
 
@@ -318,6 +319,14 @@ func (s *server) SaveCapture(ctx context.Context, c *path.Capture, path string)
 	defer f.Close()
 	return capture.Export(ctx, c, f)
 }
+func (s *server) UnloadCapture(ctx context.Context, c *path.Capture) error {
+	ctx = status.Start(ctx, "RPC UnloadCapture")
+	defer status.Finish(ctx)
+	ctx = log.Enter(ctx, "UnloadCapture")
+	replay.Profiles.Evict(c.GetID().ID())
+	return nil
+}
+
 func (s *server) ExportReplay(ctx context.Context, c *path.Capture, d *path.Device, out string, opts *service.ExportReplayOptions) error {
 	ctx = status.Start(ctx, "RPC ExportReplay")
 	defer status.Finish(ctx)
@@ -933,6 +942,73 @@ func (s *server) GpuProfile(ctx context.Context, req *service.GpuProfileRequest)
 	return res, nil
 }
 
+func (s *server) TopCommands(ctx context.Context, req *service.TopCommandsRequest) (*service.TopCommands, error) {
+	ctx = status.Start(ctx, "RPC TopCommands")
+	defer status.Finish(ctx)
+	ctx = log.Enter(ctx, "TopCommands")
+	counters, err := profiledCounters(ctx, req.Profile)
+	if err != nil {
+		return nil, err
+	}
+	return profile.TopCommands(ctx, counters, req.MetricId, int(req.Count))
+}
+
+// profiledCounters returns the GPU counters of the profile of the request, the
+// one returned by GpuProfile for the same capture, device and experiments. The
+// profile cached by replay.GpuProfile is used, the trace being replayed only if
+// it isn't cached yet.
+func profiledCounters(ctx context.Context, req *service.GpuProfileRequest) (*service.ProfilingData_GpuCounters, error) {
+	data, err := replay.GpuProfile(ctx, req.GetCapture(), req.GetDevice(), req.GetExperiments())
+	if err != nil {
+		return nil, err
+	}
+	if data.GpuCounters == nil {
+		return nil, log.Err(ctx, nil, "No GPU counters in the profile")
+	}
+	return data.GpuCounters, nil
+}
+
+func (s *server) RangeCounters(ctx context.Context, req *service.RangeCountersRequest) (*service.RangeCounters, error) {
+	ctx = status.Start(ctx, "RPC RangeCounters")
+	defer status.Finish(ctx)
+	ctx = log.Enter(ctx, "RangeCounters")
+	counters, err := profiledCounters(ctx, req.Profile)
+	if err != nil {
+		return nil, err
+	}
+	return profile.RangeCounters(ctx, counters, req.GpuId, req.First, req.Last, req.MetricIds)
+}
+
+func (s *server) GpuProfileStream(ctx context.Context, req *service.GpuProfileStreamRequest, h service.ProfilingDataChunkHandler) error {
+	ctx = status.Start(ctx, "RPC GpuProfileStream")
+	defer status.Finish(ctx)
+	ctx = log.Enter(ctx, "GpuProfileStream")
+	// The profile cached for the request, if any, is streamed as is.
+	data, err := replay.GpuProfile(ctx, req.Profile.GetCapture(), req.Profile.GetDevice(), req.Profile.GetExperiments())
+	if err != nil {
+		return err
+	}
+	return profile.ChunkProfilingData(data, int(req.ChunkSize), func(chunk *service.ProfilingDataChunk) error {
+		status.UpdateProgress(ctx, chunk.Sent, chunk.Total)
+		return h(&service.GpuProfileStreamResponse{Res: &service.GpuProfileStreamResponse_Chunk{Chunk: chunk}})
+	})
+}
+
+func (s *server) ProfileDiff(ctx context.Context, req *service.ProfileDiffRequest) (*service.ProfileDiff, error) {
+	ctx = status.Start(ctx, "RPC ProfileDiff")
+	defer status.Finish(ctx)
+	ctx = log.Enter(ctx, "ProfileDiff")
+	base, err := profiledCounters(ctx, req.Base)
+	if err != nil {
+		return nil, err
+	}
+	other, err := profiledCounters(ctx, req.Other)
+	if err != nil {
+		return nil, err
+	}
+	return profile.DiffCounters(base, other), nil
+}
+
 func (s *server) PerfettoQuery(ctx context.Context, c *path.Capture, query string) (*perfetto.QueryResult, error) {
 	ctx = status.Start(ctx, "RPC PerfettoQuery")
 	defer status.Finish(ctx)
@@ -82,6 +82,10 @@ type Service interface {
 	// SaveCapture saves the capture to a local file.
 	SaveCapture(ctx context.Context, c *path.Capture, path string) error
 
+	// UnloadCapture drops the results cached for the capture, such as its GPU
+	// profiles, once the client closes it.
+	UnloadCapture(ctx context.Context, c *path.Capture) error
+
 	// ExportReplay saves replay commands and assets to file.
 	ExportReplay(ctx context.Context, c *path.Capture, d *path.Device, path string, opts *ExportReplayOptions) error
 
@@ -178,6 +182,22 @@ type Service interface {
 	// Get timestamps from GPU for commands.
 	GpuProfile(ctx context.Context, req *GpuProfileRequest) (*ProfilingData, error)
 
+	// Return the most expensive commands of the GPU profile of a trace, the
+	// one returned by GpuProfile.
+	TopCommands(ctx context.Context, req *TopCommandsRequest) (*TopCommands, error)
+
+	// Return the performance of a range of commands of the GPU profile of a
+	// trace, the one returned by GpuProfile.
+	RangeCounters(ctx context.Context, req *RangeCountersRequest) (*RangeCounters, error)
+
+	// Stream the GPU profile of a trace, the one returned by GpuProfile, in
+	// chunks.
+	GpuProfileStream(ctx context.Context, req *GpuProfileStreamRequest, h ProfilingDataChunkHandler) error
+
+	// Return the differences of the performance of the commands of two GPU
+	// profiles, the ones returned by GpuProfile.
+	ProfileDiff(ctx context.Context, req *ProfileDiffRequest) (*ProfileDiff, error)
+
 	// Run a perfetto query
 	PerfettoQuery(ctx context.Context, c *path.Capture, query string) (*perfetto.QueryResult, error)
 
@@ -201,6 +221,10 @@ type FindHandler func(*FindResponse) error
 // TimeStampsHandler is the handler of queried timestamps suing Service.GetTimestamps.
 type TimeStampsHandler func(*GetTimestampsResponse) error
 
+// ProfilingDataChunkHandler is the handler of the chunks of profiling data
+// using Service.GpuProfileStream.
+type ProfilingDataChunkHandler func(*GpuProfileStreamResponse) error
+
 // NewError attempts to box and return err into an Error.
 // If err cannot be boxed into an Error then nil is returned.
 func NewError(err error) *Error {
@@ -0,0 +1,75 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adreno
+
+import (
+	"strconv"
+
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+	"github.com/google/gapid/gapis/trace/android/profile"
+)
+
+var (
+	nanoseconds = strconv.Itoa(int(device.GpuCounterDescriptor_NANOSECOND))
+
+	// The times spent by each command in the shader stages, from the shares
+	// of the GPU time reported by the counters.
+	derivedMetrics = []profile.DerivedMetric{
+		{
+			Name:     "Shaders Busy Time",
+			Unit:     nanoseconds,
+			Formula:  "{% Shaders Busy} / 100 * {GPU Time}",
+			Polarity: service.ProfilingData_GpuCounters_Metric_LowerIsBetter,
+		},
+		{
+			Name:     "Fragment Shading Time",
+			Unit:     nanoseconds,
+			Formula:  "{% Time Shading Fragments} / 100 * {GPU Time}",
+			Polarity: service.ProfilingData_GpuCounters_Metric_LowerIsBetter,
+		},
+		{
+			Name:     "Vertex Shading Time",
+			Unit:     nanoseconds,
+			Formula:  "{% Time Shading Vertices} / 100 * {GPU Time}",
+			Polarity: service.ProfilingData_GpuCounters_Metric_LowerIsBetter,
+		},
+		{
+			Name:     "Compute Time",
+			Unit:     nanoseconds,
+			Formula:  "{% Time Compute} / 100 * {GPU Time}",
+			Polarity: service.ProfilingData_GpuCounters_Metric_LowerIsBetter,
+		},
+	}
+
+	// The utilizations and the per-stage ratios are averaged over the time
+	// of the commands, even when the descriptor reports no unit for them.
+	aggregations = map[string]service.ProfilingData_GpuCounters_Metric_AggregationOperator{
+		"Clocks / Second":                        service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		"GPU % Utilization":                      service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		"% Shaders Busy":                         service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		"Fragment ALU Instructions / Sec (Full)": service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		"Textures / Vertex":                      service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		"Textures / Fragment":                    service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		"% Time Shading Fragments":               service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		"% Time Shading Vertices":                service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		"% Time Compute":                         service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+	}
+)
+
+func init() {
+	profile.RegisterDerivedMetrics("adreno", derivedMetrics)
+	profile.RegisterVendorAggregations("adreno", aggregations)
+}
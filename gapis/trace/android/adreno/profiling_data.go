@@ -31,21 +31,27 @@ import (
 
 var (
 	slicesQuery = "" +
-		"SELECT s.context_id, s.render_target, s.frame_id, s.submission_id, s.hw_queue_id, s.command_buffer, s.render_pass, s.ts, s.dur, s.id, s.name, depth, arg_set_id, track_id, t.name " +
+		"SELECT s.context_id, s.render_target, s.frame_id, s.submission_id, s.hw_queue_id, s.command_buffer, s.render_pass, s.ts, s.dur, s.id, s.name, depth, arg_set_id, track_id, t.name, t.gpu_id " +
 		"FROM gpu_track t LEFT JOIN gpu_slice s " +
-		"ON s.track_id = t.id WHERE t.scope = 'gpu_render_stage' ORDER BY s.ts"
+		"ON s.track_id = t.id WHERE t.scope = 'gpu_render_stage' ORDER BY s.id"
 	argsQueryFmt = "" +
 		"SELECT key, string_value FROM args WHERE args.arg_set_id = %d"
 	queueSubmitQuery = "" +
 		"SELECT submission_id FROM gpu_slice s JOIN track t ON s.track_id = t.id WHERE s.name = 'vkQueueSubmit' AND t.name = 'Vulkan Events' ORDER BY submission_id"
 	counterTracksQuery = "" +
-		"SELECT id, name, unit, description FROM gpu_counter_track ORDER BY id"
+		"SELECT id, name, unit, description, gpu_id FROM gpu_counter_track ORDER BY id"
 	countersQueryFmt = "" +
-		"SELECT ts, value FROM counter c WHERE c.track_id = %d ORDER BY ts"
+		"SELECT ts, value FROM counter c WHERE c.track_id = %d ORDER BY c.id"
+	clockSnapshotsQuery = "" +
+		"SELECT snapshot_id, clock_id, clock_value, ts FROM clock_snapshot ORDER BY snapshot_id"
 	renderPassSliceName = "Surface"
 )
 
-func ProcessProfilingData(ctx context.Context, processor *perfetto.Processor, capture *path.Capture, desc *device.GpuCounterDescriptor, handleMapping *map[uint64][]service.VulkanHandleMappingItem, syncData *sync.Data) (*service.ProfilingData, error) {
+// gpuClock is the clock of the GPU render stages and counters, the Perfetto
+// BUILTIN_CLOCK_BOOTTIME, translated into the trace time of the CPU events.
+const gpuClock = 6
+
+func ProcessProfilingData(ctx context.Context, processor *perfetto.Processor, capture *path.Capture, desc *device.GpuCounterDescriptor, handleMapping *map[uint64][]service.VulkanHandleMappingItem, syncData *sync.Data, attribution string) (*service.ProfilingData, error) {
 	slices, err := processGpuSlices(ctx, processor, capture, handleMapping, syncData)
 	if err != nil {
 		log.Err(ctx, err, "Failed to get GPU slices")
@@ -54,7 +60,13 @@ func ProcessProfilingData(ctx context.Context, processor *perfetto.Processor, ca
 	if err != nil {
 		log.Err(ctx, err, "Failed to get GPU counters")
 	}
-	gpuCounters, err := profile.ComputeCounters(ctx, slices, counters)
+	snapshots, err := processClockSnapshots(ctx, processor)
+	if err != nil {
+		log.Err(ctx, err, "Failed to get clock snapshots")
+	}
+	slices, counters = profile.SyncTraceClocks(slices, counters, snapshots, gpuClock)
+	options := &profile.Options{CounterDescriptor: desc, Vendor: "adreno", Attribution: attribution, MonotonicTimestamps: true, StableMetricIds: true}
+	gpuCounters, err := profile.ComputeCounters(ctx, slices, counters, options)
 	if err != nil {
 		log.Err(ctx, err, "Failed to calculate performance data based on GPU slices and counters")
 	}
@@ -140,6 +152,7 @@ func processGpuSlices(ctx context.Context, processor *perfetto.Processor, captur
 	argSetIds := slicesColumns[12].GetLongValues()
 	trackIds := slicesColumns[13].GetLongValues()
 	trackNames := slicesColumns[14].GetStringValues()
+	trackGpuIds := slicesColumns[15].GetLongValues()
 
 	subCommandGroupMap := make(map[api.CmdSubmissionKey]int)
 	for i, v := range submissionIds {
@@ -241,8 +254,9 @@ func processGpuSlices(ctx context.Context, processor *perfetto.Processor, captur
 		if _, ok := trackIdCache[trackIds[i]]; !ok {
 			trackIdCache[trackIds[i]] = true
 			tracks = append(tracks, &service.ProfilingData_GpuSlices_Track{
-				Id:   int32(trackIds[i]),
-				Name: trackNames[i],
+				Id:    int32(trackIds[i]),
+				Name:  trackNames[i],
+				GpuId: int32(trackGpuIds[i]),
 			})
 		}
 	}
@@ -259,7 +273,7 @@ func processCounters(ctx context.Context, processor *perfetto.Processor, desc *d
 	if err != nil {
 		return nil, log.Errf(ctx, err, "SQL query failed: %v", counterTracksQuery)
 	}
-	// t.id, name, unit, description, ts, value
+	// t.id, name, unit, description, gpu_id, ts, value
 	tracksColumns := counterTracksQueryResult.GetColumns()
 	numTracksRows := counterTracksQueryResult.GetNumRecords()
 	counters := make([]*service.ProfilingData_Counter, numTracksRows)
@@ -268,6 +282,7 @@ func processCounters(ctx context.Context, processor *perfetto.Processor, desc *d
 	names := tracksColumns[1].GetStringValues()
 	units := tracksColumns[2].GetStringValues()
 	descriptions := tracksColumns[3].GetStringValues()
+	gpuIds := tracksColumns[4].GetLongValues()
 
 	for i := uint64(0); i < numTracksRows; i++ {
 		countersQuery := fmt.Sprintf(countersQueryFmt, trackIds[i])
@@ -290,7 +305,18 @@ func processCounters(ctx context.Context, processor *perfetto.Processor, desc *d
 			Description: descriptions[i],
 			Timestamps:  timestamps,
 			Values:      values,
+			GpuId:       int32(gpuIds[i]),
 		}
 	}
 	return counters, nil
 }
+
+func processClockSnapshots(ctx context.Context, processor *perfetto.Processor) ([]profile.ClockSnapshot, error) {
+	clockSnapshotsQueryResult, err := processor.Query(clockSnapshotsQuery)
+	if err != nil {
+		return nil, log.Errf(ctx, err, "SQL query failed: %v", clockSnapshotsQuery)
+	}
+	// Depends on the order of columns selected in clockSnapshotsQuery
+	columns := clockSnapshotsQueryResult.GetColumns()
+	return profile.NewClockSnapshots(columns[0].GetLongValues(), columns[1].GetLongValues(), columns[2].GetLongValues(), columns[3].GetLongValues()), nil
+}
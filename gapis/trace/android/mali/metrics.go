@@ -0,0 +1,57 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mali
+
+import (
+	"strconv"
+
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+	"github.com/google/gapid/gapis/trace/android/profile"
+)
+
+var (
+	// The share of the active cycles of each command spent in the fragment
+	// jobs, and the cost of its fragment jobs.
+	derivedMetrics = []profile.DerivedMetric{
+		{
+			Name:    "Fragment Cycles Share",
+			Unit:    strconv.Itoa(int(device.GpuCounterDescriptor_PERCENT)),
+			Formula: "{Fragment active cycles} / {GPU active cycles} * 100",
+		},
+		{
+			Name:     "Cycles / Fragment Job",
+			Unit:     strconv.Itoa(int(device.GpuCounterDescriptor_NONE)),
+			Formula:  "{Fragment active cycles} / {Fragment jobs}",
+			Polarity: service.ProfilingData_GpuCounters_Metric_LowerIsBetter,
+		},
+	}
+
+	// The cycles and the jobs are counted over the sampling periods, so they
+	// are summed for each command, and the utilizations averaged.
+	aggregations = map[string]service.ProfilingData_GpuCounters_Metric_AggregationOperator{
+		"GPU active cycles":          service.ProfilingData_GpuCounters_Metric_Summation,
+		"Fragment jobs":              service.ProfilingData_GpuCounters_Metric_Summation,
+		"Fragment active cycles":     service.ProfilingData_GpuCounters_Metric_Summation,
+		"GPU utilization":            service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		"Fragment queue utilization": service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		"Execution core utilization": service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+	}
+)
+
+func init() {
+	profile.RegisterDerivedMetrics("mali", derivedMetrics)
+	profile.RegisterVendorAggregations("mali", aggregations)
+}
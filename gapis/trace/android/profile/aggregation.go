@@ -0,0 +1,366 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/google/gapid/core/math/f64"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+// Aggregator implements an aggregation operator, in the two stages of the
+// computation: the aggregation of the counter samples attributed to a leaf
+// group, and the merge of the leaf groups into their command nodes.
+type Aggregator struct {
+	// Aggregate reduces the weighted counter samples of a group, mapping
+	// {sample index} to {sample weight}, to a single value. It returns -1 if
+	// there is no data to aggregate.
+	Aggregate func(sampleWeight map[int]float64, counter *service.ProfilingData_Counter) float64
+	// Merge combines the performance values of the leaf groups contained in a
+	// command. weights holds the rollup weight of each leaf, see RollupWeight.
+	// Unavailable values, see unavailablePerf, should not contribute to the
+	// result.
+	Merge func(perfs []*service.ProfilingData_GpuCounters_Perf, weights []float64) *service.ProfilingData_GpuCounters_Perf
+}
+
+var aggregators = map[service.ProfilingData_GpuCounters_Metric_AggregationOperator]Aggregator{
+	service.ProfilingData_GpuCounters_Metric_Summation:       {aggregateSum, mergeSum},
+	service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg: {aggregateTimeWeightedAvg, mergeWeightedAvg},
+	service.ProfilingData_GpuCounters_Metric_Maximum:         {aggregateMax, mergeMax},
+	service.ProfilingData_GpuCounters_Metric_Minimum:         {aggregateMin, mergeMin},
+	service.ProfilingData_GpuCounters_Metric_Percentile90:    {aggregatePercentile(0.90), mergeWeightedAvg},
+	service.ProfilingData_GpuCounters_Metric_Percentile95:    {aggregatePercentile(0.95), mergeWeightedAvg},
+	service.ProfilingData_GpuCounters_Metric_Percentile99:    {aggregatePercentile(0.99), mergeWeightedAvg},
+	service.ProfilingData_GpuCounters_Metric_Median:          {aggregatePercentile(0.5), mergeWeightedAvg},
+}
+
+// RegisterAggregator registers the Aggregator implementing the aggregation
+// operator op. It is illegal to register the same operator twice.
+func RegisterAggregator(op service.ProfilingData_GpuCounters_Metric_AggregationOperator, a Aggregator) {
+	if _, found := aggregators[op]; found {
+		panic(fmt.Errorf("Aggregator for operator %v already registered", op))
+	}
+	aggregators[op] = a
+}
+
+// vendorAggregations maps the vendors to the aggregation operators of their
+// counters by name, see RegisterVendorAggregations.
+var vendorAggregations = map[string]map[string]service.ProfilingData_GpuCounters_Metric_AggregationOperator{}
+
+// RegisterVendorAggregations registers the aggregation operators of the
+// vendor's counters, by counter name, overriding the ones derived from the
+// counter descriptor, see Options.Vendor. It is illegal to register the same
+// vendor twice.
+func RegisterVendorAggregations(vendor string, ops map[string]service.ProfilingData_GpuCounters_Metric_AggregationOperator) {
+	if _, found := vendorAggregations[vendor]; found {
+		panic(fmt.Errorf("Aggregations for vendor %v already registered", vendor))
+	}
+	vendorAggregations[vendor] = ops
+}
+
+// cumulativeUnits are the units of the counters counting the amount of
+// events, or of time, over each sample interval, which are summed. The
+// counters of other units, such as frequencies, temperatures or power, are
+// gauges, averaged like the rates.
+var cumulativeUnits = map[device.GpuCounterDescriptor_MeasureUnit]bool{
+	device.GpuCounterDescriptor_BIT:         true,
+	device.GpuCounterDescriptor_KILOBIT:     true,
+	device.GpuCounterDescriptor_MEGABIT:     true,
+	device.GpuCounterDescriptor_GIGABIT:     true,
+	device.GpuCounterDescriptor_TERABIT:     true,
+	device.GpuCounterDescriptor_PETABIT:     true,
+	device.GpuCounterDescriptor_BYTE:        true,
+	device.GpuCounterDescriptor_KILOBYTE:    true,
+	device.GpuCounterDescriptor_MEGABYTE:    true,
+	device.GpuCounterDescriptor_GIGABYTE:    true,
+	device.GpuCounterDescriptor_TERABYTE:    true,
+	device.GpuCounterDescriptor_PETABYTE:    true,
+	device.GpuCounterDescriptor_NANOSECOND:  true,
+	device.GpuCounterDescriptor_MICROSECOND: true,
+	device.GpuCounterDescriptor_MILLISECOND: true,
+	device.GpuCounterDescriptor_SECOND:      true,
+	device.GpuCounterDescriptor_MINUTE:      true,
+	device.GpuCounterDescriptor_HOUR:        true,
+	device.GpuCounterDescriptor_VERTEX:      true,
+	device.GpuCounterDescriptor_PIXEL:       true,
+	device.GpuCounterDescriptor_TRIANGLE:    true,
+	device.GpuCounterDescriptor_PRIMITIVE:   true,
+	device.GpuCounterDescriptor_FRAGMENT:    true,
+	device.GpuCounterDescriptor_JOULE:       true,
+	device.GpuCounterDescriptor_INSTRUCTION: true,
+}
+
+// Return the aggregation operator of the counter of the descriptor spec: the
+// rates, which have a denominator unit, and the gauges are averaged, the
+// cumulative counters summed. The counters without unit aren't classified.
+func specAggregation(spec *device.GpuCounterDescriptor_GpuCounterSpec) (service.ProfilingData_GpuCounters_Metric_AggregationOperator, bool) {
+	if len(spec.DenominatorUnits) != 0 {
+		return service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg, true
+	}
+	cumulative := false
+	for _, unit := range spec.NumeratorUnits {
+		if unit == device.GpuCounterDescriptor_NONE {
+			continue
+		}
+		if !cumulativeUnits[unit] {
+			return service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg, true
+		}
+		cumulative = true
+	}
+	return service.ProfilingData_GpuCounters_Metric_Summation, cumulative
+}
+
+// Return the performance value standing for "no data".
+func unavailablePerf() *service.ProfilingData_GpuCounters_Perf {
+	return &service.ProfilingData_GpuCounters_Perf{Estimate: -1, Min: -1, Max: -1}
+}
+
+func isUnavailable(perf *service.ProfilingData_GpuCounters_Perf) bool {
+	return perf.Estimate == -1
+}
+
+// Return the indices of the weighted samples in increasing order, so that the
+// floating point aggregations don't depend on the map iteration order.
+func sortedSamples(sampleWeight map[int]float64) []int {
+	indices := make([]int, 0, len(sampleWeight))
+	for idx := range sampleWeight {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+func aggregateSum(sampleWeight map[int]float64, counter *service.ProfilingData_Counter) float64 {
+	valueSum := float64(0)
+	for _, idx := range sortedSamples(sampleWeight) {
+		valueSum += counter.Values[idx] * sampleWeight[idx]
+	}
+	return valueSum
+}
+
+// minTimeWeight is the smallest total sample time, in nanoseconds, for which a
+// time-weighted average is meaningful. Below it the weights are only rounding
+// noise of negligible overlaps, and the group is reported as having no data.
+const minTimeWeight = 1e-6
+
+func aggregateTimeWeightedAvg(sampleWeight map[int]float64, counter *service.ProfilingData_Counter) float64 {
+	avg := weightedMean{}
+	for _, idx := range sortedSamples(sampleWeight) {
+		avg.add(counter.Values[idx], float64(counter.Timestamps[idx]-counter.Timestamps[idx-1])*sampleWeight[idx])
+	}
+	if avg.weight < minTimeWeight {
+		return -1
+	}
+	return avg.mean
+}
+
+func aggregateMax(sampleWeight map[int]float64, counter *service.ProfilingData_Counter) float64 {
+	max, found := float64(0), false
+	for idx, weight := range sampleWeight {
+		if weight > 0 && (!found || counter.Values[idx] > max) {
+			max, found = counter.Values[idx], true
+		}
+	}
+	if !found {
+		return -1
+	}
+	return max
+}
+
+func aggregateMin(sampleWeight map[int]float64, counter *service.ProfilingData_Counter) float64 {
+	min, found := float64(0), false
+	for idx, weight := range sampleWeight {
+		if weight > 0 && (!found || counter.Values[idx] < min) {
+			min, found = counter.Values[idx], true
+		}
+	}
+	if !found {
+		return -1
+	}
+	return min
+}
+
+// Return the aggregation of the time-weighted p-quantile of the samples, the
+// smallest value such that the samples of smaller or equal values hold at
+// least the fraction p of the total sample time, each sample weighing its
+// duration times its attributed weight, the overlap and concurrency share of
+// the group, see mapCounterSamples. The median is the 0.5-quantile, a single
+// spike sample not moving it unless it holds half of the time. The
+// percentiles of the commands are merged as the weighted average of their
+// leaves' percentiles, which only approximates the percentile of all their
+// samples.
+func aggregatePercentile(p float64) func(sampleWeight map[int]float64, counter *service.ProfilingData_Counter) float64 {
+	return func(sampleWeight map[int]float64, counter *service.ProfilingData_Counter) float64 {
+		indices := sortedSamples(sampleWeight)
+		weights := make(map[int]float64, len(indices))
+		total := float64(0)
+		for _, idx := range indices {
+			weights[idx] = float64(counter.Timestamps[idx]-counter.Timestamps[idx-1]) * sampleWeight[idx]
+			total += weights[idx]
+		}
+		if total < minTimeWeight {
+			return -1
+		}
+		sort.SliceStable(indices, func(i, j int) bool {
+			return counter.Values[indices[i]] < counter.Values[indices[j]]
+		})
+		cumulated := float64(0)
+		for _, idx := range indices {
+			cumulated += weights[idx]
+			if cumulated >= p*total {
+				return counter.Values[idx]
+			}
+		}
+		return counter.Values[indices[len(indices)-1]]
+	}
+}
+
+func mergeSum(perfs []*service.ProfilingData_GpuCounters_Perf, weights []float64) *service.ProfilingData_GpuCounters_Perf {
+	merged := &service.ProfilingData_GpuCounters_Perf{}
+	available := false
+	for _, perf := range perfs {
+		if isUnavailable(perf) {
+			continue
+		}
+		available = true
+		merged.Estimate += perf.Estimate
+		merged.Min += perf.Min
+		merged.Max += perf.Max
+	}
+	if !available && len(perfs) > 0 {
+		return unavailablePerf()
+	}
+	return merged
+}
+
+func mergeWeightedAvg(perfs []*service.ProfilingData_GpuCounters_Perf, weights []float64) *service.ProfilingData_GpuCounters_Perf {
+	estimate, min, max := weightedMean{}, weightedMean{}, weightedMean{}
+	for i, perf := range perfs {
+		if isUnavailable(perf) {
+			continue
+		}
+		estimate.add(perf.Estimate, weights[i])
+		min.add(perf.Min, weights[i])
+		max.add(perf.Max, weights[i])
+	}
+	if estimate.weight == 0 {
+		return unavailablePerf()
+	}
+	return &service.ProfilingData_GpuCounters_Perf{
+		Estimate: estimate.mean,
+		Min:      min.mean,
+		Max:      max.mean,
+	}
+}
+
+func mergeMax(perfs []*service.ProfilingData_GpuCounters_Perf, weights []float64) *service.ProfilingData_GpuCounters_Perf {
+	var merged *service.ProfilingData_GpuCounters_Perf
+	for _, perf := range perfs {
+		if isUnavailable(perf) {
+			continue
+		}
+		if merged == nil {
+			merged = &service.ProfilingData_GpuCounters_Perf{Estimate: perf.Estimate, Min: perf.Min, Max: perf.Max}
+			continue
+		}
+		merged.Estimate = f64.MaxOf(merged.Estimate, perf.Estimate)
+		merged.Min = f64.MaxOf(merged.Min, perf.Min)
+		merged.Max = f64.MaxOf(merged.Max, perf.Max)
+	}
+	if merged == nil {
+		return unavailablePerf()
+	}
+	return merged
+}
+
+func mergeMin(perfs []*service.ProfilingData_GpuCounters_Perf, weights []float64) *service.ProfilingData_GpuCounters_Perf {
+	var merged *service.ProfilingData_GpuCounters_Perf
+	for _, perf := range perfs {
+		if isUnavailable(perf) {
+			continue
+		}
+		if merged == nil {
+			merged = &service.ProfilingData_GpuCounters_Perf{Estimate: perf.Estimate, Min: perf.Min, Max: perf.Max}
+			continue
+		}
+		merged.Estimate = f64.MinOf(merged.Estimate, perf.Estimate)
+		merged.Min = f64.MinOf(merged.Min, perf.Min)
+		merged.Max = f64.MinOf(merged.Max, perf.Max)
+	}
+	if merged == nil {
+		return unavailablePerf()
+	}
+	return merged
+}
+
+// Set the time-weighted standard deviation of the values of the weighted
+// samples around their mean, and the number of samples of positive weight,
+// see Options.SampleStatistics.
+func setSampleStatistics(perf *service.ProfilingData_GpuCounters_Perf, sampleWeight map[int]float64, counter *service.ProfilingData_Counter) {
+	mean, m2 := weightedMean{}, float64(0)
+	perf.SampleCount = 0
+	for _, idx := range sortedSamples(sampleWeight) {
+		weight := float64(counter.Timestamps[idx]-counter.Timestamps[idx-1]) * sampleWeight[idx]
+		if weight <= 0 {
+			continue
+		}
+		perf.SampleCount++
+		value, previous := counter.Values[idx], mean.mean
+		mean.add(value, weight)
+		m2 += weight * (value - previous) * (value - mean.mean)
+	}
+	perf.StdDev = 0
+	if mean.weight >= minTimeWeight {
+		perf.StdDev = math.Sqrt(math.Max(m2, 0) / mean.weight)
+	}
+}
+
+// Set the sample statistics of a merged performance value from the ones of
+// the merged values: the sample counts are summed, and the standard deviation
+// is the weighted quadratic mean of theirs. It thus measures the spread of
+// the samples within the leaves, not across them.
+func mergeSampleStatistics(merged *service.ProfilingData_GpuCounters_Perf, perfs []*service.ProfilingData_GpuCounters_Perf, weights []float64) {
+	variance := weightedMean{}
+	merged.SampleCount = 0
+	for i, perf := range perfs {
+		if isUnavailable(perf) {
+			continue
+		}
+		merged.SampleCount += perf.SampleCount
+		variance.add(perf.StdDev*perf.StdDev, weights[i])
+	}
+	merged.StdDev = math.Sqrt(variance.mean)
+}
+
+// weightedMean is a running weighted mean. Rather than the sum of the
+// value × weight products, which loses precision for the huge nanosecond
+// weights of long captures, it updates the mean incrementally following
+// West's algorithm.
+type weightedMean struct {
+	mean   float64
+	weight float64 // The sum of the weights.
+}
+
+func (m *weightedMean) add(value, weight float64) {
+	if weight == 0 {
+		return
+	}
+	m.weight += weight
+	m.mean += (value - m.mean) * weight / m.weight
+}
@@ -0,0 +1,241 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/math/f64"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestCustomAggregator(t *testing.T) {
+	ctx := log.Testing(t)
+	peak := service.ProfilingData_GpuCounters_Metric_AggregationOperator(100)
+	RegisterAggregator(peak, Aggregator{
+		Aggregate: func(sampleWeight map[int]float64, counter *service.ProfilingData_Counter) float64 {
+			res := float64(-1)
+			for idx := range sampleWeight {
+				res = f64.MaxOf(res, counter.Values[idx])
+			}
+			return res
+		},
+		Merge: func(perfs []*service.ProfilingData_GpuCounters_Perf, weights []float64) *service.ProfilingData_GpuCounters_Perf {
+			merged := &service.ProfilingData_GpuCounters_Perf{Estimate: -1, Min: -1, Max: -1}
+			for _, perf := range perfs {
+				merged.Estimate = f64.MaxOf(merged.Estimate, perf.Estimate)
+				merged.Min = f64.MaxOf(merged.Min, perf.Min)
+				merged.Max = f64.MaxOf(merged.Max, perf.Max)
+			}
+			return merged
+		},
+	})
+	defer delete(aggregators, peak)
+
+	c := counter("Temperature", []uint64{0, 10, 20, 30}, []float64{0, 40, 70, 50})
+	assert.For(ctx, "aggregate").ThatFloat(aggregateCounterSamples(map[int]float64{1: 1, 3: 0.5}, c, peak)).Equals(50, 0)
+
+	metrics := []*service.ProfilingData_GpuCounters_Metric{{Id: gpuTimeMetricId}, {Id: 1, Op: peak}}
+	groupToEntry := map[int32]*service.ProfilingData_GpuCounters_Entry{
+		0: {CommandIndex: []uint64{0, 0}, MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{gpuTimeMetricId: perf(10), 1: perf(40)}},
+		1: {CommandIndex: []uint64{0, 1}, MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{gpuTimeMetricId: perf(10), 1: perf(70)}},
+	}
+	merged := entriesByIndex(&service.ProfilingData_GpuCounters{Entries: mergeLeafEntries(ctx, metrics, newMetricIds(0, &Options{}), groupToEntry, &Options{})})
+	assert.For(ctx, "merged leaf").That(merged["0,1"][1]).DeepEquals(perf(70))
+	assert.For(ctx, "merged parent").That(merged["0"][1]).DeepEquals(perf(70))
+	assert.For(ctx, "gpu time").That(merged["0"][gpuTimeMetricId]).DeepEquals(perf(20))
+}
+
+func TestRegisterAggregatorTwice(t *testing.T) {
+	ctx := log.Testing(t)
+	defer func() {
+		assert.For(ctx, "panic").That(recover()).IsNotNil()
+	}()
+	RegisterAggregator(service.ProfilingData_GpuCounters_Metric_Summation, Aggregator{aggregateSum, mergeSum})
+}
+
+func TestMergeSkipsUnavailable(t *testing.T) {
+	ctx := log.Testing(t)
+	perfs := []*service.ProfilingData_GpuCounters_Perf{perf(4), unavailablePerf(), perf(2)}
+	weights := []float64{10, 10, 30}
+	assert.For(ctx, "sum").That(mergeSum(perfs, weights)).DeepEquals(perf(6))
+	assert.For(ctx, "weighted avg").That(mergeWeightedAvg(perfs, weights)).DeepEquals(perf(2.5))
+
+	perfs = []*service.ProfilingData_GpuCounters_Perf{unavailablePerf(), unavailablePerf()}
+	assert.For(ctx, "unavailable sum").That(mergeSum(perfs, weights)).DeepEquals(unavailablePerf())
+	assert.For(ctx, "unavailable weighted avg").That(mergeWeightedAvg(perfs, weights)).DeepEquals(unavailablePerf())
+}
+
+func TestMaximum(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Temperature", []uint64{0, 10, 20, 30}, []float64{0, 40, 70, 50})
+	assert.For(ctx, "aggregate").ThatFloat(aggregateMax(map[int]float64{1: 1, 2: 0, 3: 0.5}, c)).Equals(50, 0)
+	assert.For(ctx, "no samples").ThatFloat(aggregateMax(map[int]float64{}, c)).Equals(-1, 0)
+
+	perfs := []*service.ProfilingData_GpuCounters_Perf{perf(4), unavailablePerf(), {Estimate: 2, Min: 1, Max: 9}}
+	assert.For(ctx, "merge").That(mergeMax(perfs, nil)).DeepEquals(&service.ProfilingData_GpuCounters_Perf{Estimate: 4, Min: 4, Max: 9})
+	assert.For(ctx, "unavailable").That(mergeMax([]*service.ProfilingData_GpuCounters_Perf{unavailablePerf()}, nil)).DeepEquals(unavailablePerf())
+}
+
+func TestMinimum(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Temperature", []uint64{0, 10, 20, 30}, []float64{0, 40, 70, 50})
+	assert.For(ctx, "aggregate").ThatFloat(aggregateMin(map[int]float64{1: 0, 2: 1, 3: 0.5}, c)).Equals(50, 0)
+	assert.For(ctx, "no samples").ThatFloat(aggregateMin(map[int]float64{}, c)).Equals(-1, 0)
+
+	perfs := []*service.ProfilingData_GpuCounters_Perf{perf(4), unavailablePerf(), {Estimate: 2, Min: 1, Max: 9}}
+	assert.For(ctx, "merge").That(mergeMin(perfs, nil)).DeepEquals(&service.ProfilingData_GpuCounters_Perf{Estimate: 2, Min: 1, Max: 4})
+	assert.For(ctx, "unavailable").That(mergeMin([]*service.ProfilingData_GpuCounters_Perf{unavailablePerf()}, nil)).DeepEquals(unavailablePerf())
+}
+
+func TestPercentiles(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Bandwidth", []uint64{0, 10, 20, 30, 40, 50}, []float64{0, 10, 50, 20, 30, 90})
+	// 10ns of each of 10, 20, 30 and 50, then 1ns of 90.
+	sampleWeight := map[int]float64{1: 1, 2: 1, 3: 1, 4: 1, 5: 0.1}
+	for _, test := range []struct {
+		op       service.ProfilingData_GpuCounters_Metric_AggregationOperator
+		expected float64
+	}{
+		{service.ProfilingData_GpuCounters_Metric_Percentile90, 50},
+		{service.ProfilingData_GpuCounters_Metric_Percentile95, 50},
+		{service.ProfilingData_GpuCounters_Metric_Percentile99, 90},
+		{service.ProfilingData_GpuCounters_Metric_Median, 30},
+	} {
+		assert.For(ctx, "%v", test.op).ThatFloat(aggregateCounterSamples(sampleWeight, c, test.op)).Equals(test.expected, 0)
+	}
+	median := aggregatePercentile(0.5)
+	assert.For(ctx, "median").ThatFloat(median(sampleWeight, c)).Equals(30, 0)
+	assert.For(ctx, "single").ThatFloat(median(map[int]float64{2: 0.5}, c)).Equals(50, 0)
+	assert.For(ctx, "no samples").ThatFloat(median(map[int]float64{}, c)).Equals(-1, 0)
+	assert.For(ctx, "negligible").ThatFloat(median(map[int]float64{1: 1e-12}, c)).Equals(-1, 0)
+
+	// A spike sample shared with a concurrent command skews the average of a
+	// short command, but not its median.
+	spiky := counter("Utilization", []uint64{0, 10, 20, 30}, []float64{0, 20, 1000, 30})
+	short := map[int]float64{1: 1, 2: 0.5, 3: 1}
+	assert.For(ctx, "spike average").ThatFloat(aggregateCounterSamples(short, spiky, service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg)).Equals(220, 1e-9)
+	assert.For(ctx, "spike median").ThatFloat(aggregateCounterSamples(short, spiky, service.ProfilingData_GpuCounters_Metric_Median)).Equals(30, 0)
+}
+
+func TestSampleStatisticsAggregation(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Busy", []uint64{0, 10, 20, 40}, []float64{0, 3, 9, 6})
+	// 10ns of 3, 5ns of 9 and 15ns of 6: a mean of 5.5.
+	p := perf(0)
+	setSampleStatistics(p, map[int]float64{1: 1, 2: 0.5, 3: 0.75}, c)
+	assert.For(ctx, "count").That(p.SampleCount).Equals(uint64(3))
+	variance := (10*2.5*2.5 + 5*3.5*3.5 + 15*0.5*0.5) / 30
+	assert.For(ctx, "std dev").ThatFloat(p.StdDev).Equals(math.Sqrt(variance), 1e-9)
+
+	merged := perf(0)
+	perfs := []*service.ProfilingData_GpuCounters_Perf{
+		{StdDev: 1, SampleCount: 2}, unavailablePerf(), {StdDev: 3, SampleCount: 4},
+	}
+	mergeSampleStatistics(merged, perfs, []float64{30, 10, 10})
+	assert.For(ctx, "merged count").That(merged.SampleCount).Equals(uint64(6))
+	assert.For(ctx, "merged std dev").ThatFloat(merged.StdDev).Equals(math.Sqrt((30*1+10*9)/40.0), 1e-9)
+}
+
+func TestWeightedMeanStability(t *testing.T) {
+	ctx := log.Testing(t)
+	// Values alternating around 3.3 with equal nanosecond scale weights per
+	// pair, so the analytic mean is exactly 3.3.
+	const expected = 3.3
+	naiveValueSum, naiveWeightSum := float64(0), float64(0)
+	stable := weightedMean{}
+	for i := 0; i < 1000000; i++ {
+		value, weight := expected+0.01, float64(1e6+i%7)
+		if i%2 == 1 {
+			value, weight = expected-0.01, float64(1e6+(i-1)%7)
+		}
+		naiveValueSum += value * weight
+		naiveWeightSum += weight
+		stable.add(value, weight)
+	}
+	naiveErr := math.Abs(naiveValueSum/naiveWeightSum - expected)
+	stableErr := math.Abs(stable.mean - expected)
+	assert.For(ctx, "naive error").ThatFloat(naiveErr).IsAtLeast(1e-12)
+	assert.For(ctx, "stable error").ThatFloat(stableErr).IsAtMost(naiveErr / 100)
+	assert.For(ctx, "weight").ThatFloat(stable.weight).Equals(naiveWeightSum, 0)
+}
+
+func TestTimeWeightedAvgNegligibleTime(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Busy", []uint64{0, 1, 2, 1000}, []float64{0, 5, 7, 9})
+	// Tiny weights on 1ns samples sum to a negligible time.
+	assert.For(ctx, "negligible").That(aggregateTimeWeightedAvg(map[int]float64{1: 1e-12, 2: 1e-300}, c)).Equals(-1.0)
+	assert.For(ctx, "no weight").That(aggregateTimeWeightedAvg(map[int]float64{1: 0}, c)).Equals(-1.0)
+	// A tiny weight on a long sample is still a meaningful time.
+	assert.For(ctx, "long sample").That(aggregateTimeWeightedAvg(map[int]float64{3: 1e-6}, c)).Equals(9.0)
+	// Negligible weights don't skew the average of meaningful ones.
+	avg := aggregateTimeWeightedAvg(map[int]float64{1: 1e-12, 3: 0.5}, c)
+	assert.For(ctx, "mixed").ThatFloat(avg).Equals(9, 1e-9)
+}
+
+func TestCounterAggregation(t *testing.T) {
+	ctx := log.Testing(t)
+	spec := func(name string, numerators []device.GpuCounterDescriptor_MeasureUnit, denominators ...device.GpuCounterDescriptor_MeasureUnit) *device.GpuCounterDescriptor_GpuCounterSpec {
+		return &device.GpuCounterDescriptor_GpuCounterSpec{Name: name, NumeratorUnits: numerators, DenominatorUnits: denominators}
+	}
+	units := func(units ...device.GpuCounterDescriptor_MeasureUnit) []device.GpuCounterDescriptor_MeasureUnit {
+		return units
+	}
+	RegisterVendorAggregations("test vendor", map[string]service.ProfilingData_GpuCounters_Metric_AggregationOperator{
+		"Temperature": service.ProfilingData_GpuCounters_Metric_Maximum,
+	})
+	defer delete(vendorAggregations, "test vendor")
+	options := &Options{
+		SummedCounters: []string{"Custom"},
+		Vendor:         "test vendor",
+		CounterDescriptor: &device.GpuCounterDescriptor{Specs: []*device.GpuCounterDescriptor_GpuCounterSpec{
+			spec("Bytes Written", units(device.GpuCounterDescriptor_BYTE)),
+			spec("Read Bandwidth", units(device.GpuCounterDescriptor_BYTE), device.GpuCounterDescriptor_SECOND),
+			spec("Frequency", units(device.GpuCounterDescriptor_MEGAHERTZ)),
+			spec("Utilization", units(device.GpuCounterDescriptor_PERCENT)),
+			spec("Temperature", units(device.GpuCounterDescriptor_CELSIUS)),
+			spec("Custom", units(device.GpuCounterDescriptor_PERCENT)),
+			spec("Unitless", units(device.GpuCounterDescriptor_NONE)),
+		}},
+	}
+	for _, test := range []struct {
+		name   string
+		op     service.ProfilingData_GpuCounters_Metric_AggregationOperator
+		source string
+	}{
+		{"Bytes Written", service.ProfilingData_GpuCounters_Metric_Summation, "descriptor"},
+		{"Read Bandwidth", service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg, "descriptor"},
+		{"Frequency", service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg, "descriptor"},
+		{"Utilization", service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg, "descriptor"},
+		{"Temperature", service.ProfilingData_GpuCounters_Metric_Maximum, "vendor"},
+		{"Custom", service.ProfilingData_GpuCounters_Metric_Summation, "options"},
+		{"Unitless", service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg, "fallback"},
+		{"Unknown", service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg, "fallback"},
+	} {
+		op, source := counterAggregation(&service.ProfilingData_Counter{Name: test.name}, options)
+		assert.For(ctx, "op %v", test.name).That(op).Equals(test.op)
+		assert.For(ctx, "source %v", test.name).That(source).Equals(test.source)
+	}
+
+	// The chosen operator is the one of the metric.
+	counters := []*service.ProfilingData_Counter{{Name: "Bytes Written"}, {Name: "Utilization"}}
+	metrics := MetricCatalog(counters, options)
+	assert.For(ctx, "summed metric").That(metrics[len(metrics)-2].Op).Equals(service.ProfilingData_GpuCounters_Metric_Summation)
+	assert.For(ctx, "averaged metric").That(metrics[len(metrics)-1].Op).Equals(service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg)
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// StalledCommand is a command whose GPU wall time is suspiciously larger than
+// its GPU busy time, which hints that its GPU work got stalled or serialized.
+type StalledCommand struct {
+	CommandIndex []uint64
+	Ratio        float64 // GPU wall time / GPU time.
+}
+
+// FindStalledCommands returns the commands of the merged entries whose GPU
+// wall time to GPU time ratio exceeds maxRatio, sorted by decreasing ratio.
+// Entries without GPU time are ignored. The wall time only exceeds the GPU
+// time once the idle gaps between the slices of a group count as busy, see
+// Options.WallTimeGapThreshold.
+func FindStalledCommands(entries []*service.ProfilingData_GpuCounters_Entry, maxRatio float64) []StalledCommand {
+	stalled := []StalledCommand{}
+	for _, entry := range entries {
+		gpuTime, ok := entry.MetricToValue[gpuTimeMetricId]
+		if !ok || gpuTime.Estimate <= 0 {
+			continue
+		}
+		wallTime, ok := entry.MetricToValue[gpuWallTimeMetricId]
+		if !ok {
+			continue
+		}
+		if ratio := wallTime.Estimate / gpuTime.Estimate; ratio > maxRatio {
+			stalled = append(stalled, StalledCommand{entry.CommandIndex, ratio})
+		}
+	}
+	sort.SliceStable(stalled, func(i, j int) bool {
+		return stalled[i].Ratio > stalled[j].Ratio
+	})
+	return stalled
+}
+
+// LabelGroup is the combined performance of the commands sharing a label,
+// such as the sibling draws of the same shader.
+type LabelGroup struct {
+	Label          string
+	CommandIndices [][]uint64
+	MetricToValue  map[int32]*service.ProfilingData_GpuCounters_Perf
+}
+
+// GroupEntriesByLabel combines the performance of the entries sharing the same
+// label, as resolved by label. The metrics are merged by their aggregation
+// operator, weighted by the GPU time of the entries, like the leaves of a
+// command. The entries with an empty label are ignored, as are the entries
+// nested in an entry of the same label, whose performance that outermost
+// entry already includes. The groups are sorted by label, and their commands
+// keep the order of the entries.
+func GroupEntriesByLabel(ctx context.Context, metrics []*service.ProfilingData_GpuCounters_Metric, entries []*service.ProfilingData_GpuCounters_Entry, label func(commandIndex []uint64) string) []LabelGroup {
+	indexToLabel := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		indexToLabel[encodeIndex(entry.CommandIndex)] = label(entry.CommandIndex)
+	}
+	nested := func(commandIndex []uint64, l string) bool {
+		for depth := 1; depth < len(commandIndex); depth++ {
+			if indexToLabel[encodeIndex(commandIndex[:depth])] == l {
+				return true
+			}
+		}
+		return false
+	}
+	labelToEntries := map[string][]*service.ProfilingData_GpuCounters_Entry{}
+	labels := []string{}
+	for _, entry := range entries {
+		l := indexToLabel[encodeIndex(entry.CommandIndex)]
+		if l == "" || nested(entry.CommandIndex, l) {
+			continue
+		}
+		if _, ok := labelToEntries[l]; !ok {
+			labels = append(labels, l)
+		}
+		labelToEntries[l] = append(labelToEntries[l], entry)
+	}
+	sort.Strings(labels)
+
+	groups := make([]LabelGroup, len(labels))
+	for i, l := range labels {
+		group := LabelGroup{Label: l}
+		for _, entry := range labelToEntries[l] {
+			group.CommandIndices = append(group.CommandIndices, entry.CommandIndex)
+		}
+		group.MetricToValue = mergeEntryValues(ctx, metrics, labelToEntries[l])
+		groups[i] = group
+	}
+	return groups
+}
+
+// Merge the values of the entries by the aggregation operator of their metrics,
+// weighted by the GPU time of the entries, like the leaves of a command. The
+// metrics the entries have no value of are left out.
+func mergeEntryValues(ctx context.Context, metrics []*service.ProfilingData_GpuCounters_Metric, entries []*service.ProfilingData_GpuCounters_Entry) map[int32]*service.ProfilingData_GpuCounters_Perf {
+	values := map[int32]*service.ProfilingData_GpuCounters_Perf{}
+	for _, metric := range metrics {
+		aggregator, ok := aggregators[metric.Op]
+		if !ok {
+			warn(ctx, service.ProfilingData_GpuCounters_Warning_UnsupportedAggregation, metric.Name, "Counter aggregation method not implemented yet. Operation: %v", metric.Op)
+			values[metric.Id] = unavailablePerf()
+			continue
+		}
+		perfs, weights := []*service.ProfilingData_GpuCounters_Perf{}, []float64{}
+		for _, entry := range entries {
+			perf, ok := entry.MetricToValue[metric.Id]
+			if !ok {
+				continue
+			}
+			weight := float64(0)
+			if gpuTime, ok := entry.MetricToValue[gpuTimeMetricId]; ok {
+				weight = gpuTime.Estimate
+			}
+			perfs, weights = append(perfs, perf), append(weights, weight)
+		}
+		if len(perfs) != 0 {
+			values[metric.Id] = aggregator.Merge(perfs, weights)
+		}
+	}
+	return values
+}
+
+// SliceIndex indexes the GPU slices by time, to find the commands of the
+// slices overlapping time ranges, such as a timeline selection.
+type SliceIndex struct {
+	slices   []*service.ProfilingData_GpuSlices_Slice // Sorted by start time.
+	maxEnds  []uint64                                 // The latest end of slices[:i+1].
+	commands map[int32][]uint64                       // Group id -> command index.
+}
+
+// NewSliceIndex returns the SliceIndex of the slices. The slices of the
+// groups that aren't linked to a command are ignored.
+func NewSliceIndex(slices *service.ProfilingData_GpuSlices) *SliceIndex {
+	index := &SliceIndex{commands: map[int32][]uint64{}}
+	for _, group := range slices.Groups {
+		if group.Link != nil {
+			index.commands[group.Id] = group.Link.Indices
+		}
+	}
+	for _, slice := range slices.Slices {
+		if _, ok := index.commands[slice.GroupId]; ok {
+			index.slices = append(index.slices, slice)
+		}
+	}
+	sort.SliceStable(index.slices, func(i, j int) bool {
+		return index.slices[i].Ts < index.slices[j].Ts
+	})
+	index.maxEnds = make([]uint64, len(index.slices))
+	for i, slice := range index.slices {
+		index.maxEnds[i] = slice.Ts + slice.Dur
+		if i > 0 && index.maxEnds[i-1] > index.maxEnds[i] {
+			index.maxEnds[i] = index.maxEnds[i-1]
+		}
+	}
+	return index
+}
+
+// CommandsInRange returns the command indices of the slices overlapping the
+// time range [start, end), sorted and without duplicates. A slice spans
+// [Ts, Ts+Dur), so that a slice ending at start or starting at end doesn't
+// overlap the range.
+func (s *SliceIndex) CommandsInRange(start, end uint64) [][]uint64 {
+	// The slices before first end by start, the ones from last start after end.
+	first := sort.Search(len(s.slices), func(i int) bool { return s.maxEnds[i] > start })
+	last := sort.Search(len(s.slices), func(i int) bool { return s.slices[i].Ts >= end })
+	found := map[string]bool{}
+	commands := [][]uint64{}
+	if end <= start || last < first {
+		return commands
+	}
+	for _, slice := range s.slices[first:last] {
+		if slice.Ts+slice.Dur <= start {
+			continue
+		}
+		command := s.commands[slice.GroupId]
+		if key := encodeIndex(command); !found[key] {
+			found[key] = true
+			commands = append(commands, command)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return lessIndex(commands[i], commands[j]) })
+	return commands
+}
+
+// Tell whether the command index a comes before b, comparing their levels in
+// order, a parent coming before its children.
+func lessIndex(a, b []uint64) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
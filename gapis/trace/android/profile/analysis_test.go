@@ -0,0 +1,144 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+// perf builds a Perf whose estimate, min and max are all v.
+func perf(v float64) *service.ProfilingData_GpuCounters_Perf {
+	return &service.ProfilingData_GpuCounters_Perf{Estimate: v, Min: v, Max: v}
+}
+
+// timeEntry builds an entry holding only the GPU time and GPU wall time.
+func timeEntry(gpuTime, wallTime float64, indices ...uint64) *service.ProfilingData_GpuCounters_Entry {
+	return &service.ProfilingData_GpuCounters_Entry{
+		CommandIndex: indices,
+		MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{
+			gpuTimeMetricId:     perf(gpuTime),
+			gpuWallTimeMetricId: perf(wallTime),
+		},
+	}
+}
+
+func TestFindStalledCommands(t *testing.T) {
+	ctx := log.Testing(t)
+	entries := []*service.ProfilingData_GpuCounters_Entry{
+		timeEntry(100, 101, 0),  // busy, ratio ~1.
+		timeEntry(100, 500, 1),  // stalled, ratio 5.
+		timeEntry(100, 300, 2),  // stalled, ratio 3.
+		timeEntry(0, 100, 3),    // no GPU time.
+		timeEntry(100, 200, 4),  // exactly at the threshold.
+		timeEntry(100, 1000, 5), // stalled, ratio 10.
+	}
+	stalled := FindStalledCommands(entries, 2)
+	assert.For(ctx, "stalled").That(stalled).DeepEquals([]StalledCommand{
+		{[]uint64{5}, 10},
+		{[]uint64{1}, 5},
+		{[]uint64{2}, 3},
+	})
+	assert.For(ctx, "none stalled").ThatSlice(FindStalledCommands(entries, 20)).IsEmpty()
+
+	// The command waits 30ns between its two slices, which the threshold
+	// counts as busy, unlike the back to back slices of the other one.
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0), group(1, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(0, 40, 10),
+			slice(1, 100, 10), slice(1, 110, 10),
+		},
+	}
+	res, err := ComputeCounters(ctx, slices, nil, &Options{WallTimeGapThreshold: 100})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "computed").That(FindStalledCommands(res.Entries, 2)).DeepEquals([]StalledCommand{{[]uint64{0}, 2.5}})
+}
+
+func TestGroupEntriesByLabel(t *testing.T) {
+	ctx := log.Testing(t)
+	metrics := []*service.ProfilingData_GpuCounters_Metric{
+		{Id: gpuTimeMetricId, Op: service.ProfilingData_GpuCounters_Metric_Summation},
+		{Id: counterMetricIdOffset, Op: service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg},
+	}
+	entry := func(gpuTime, value float64, indices ...uint64) *service.ProfilingData_GpuCounters_Entry {
+		return &service.ProfilingData_GpuCounters_Entry{
+			CommandIndex: indices,
+			MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{
+				gpuTimeMetricId:       perf(gpuTime),
+				counterMetricIdOffset: perf(value),
+			},
+		}
+	}
+	entries := []*service.ProfilingData_GpuCounters_Entry{
+		entry(100, 10, 0, 0), // The parent itself.
+		entry(10, 1, 0, 0, 0),
+		entry(30, 5, 0, 0, 1),
+		entry(20, 9, 0, 0, 2),
+		entry(40, 2, 0, 0, 3),
+	}
+	labels := map[string]string{"0,0,0": "shadow", "0,0,1": "shadow", "0,0,2": "shadow", "0,0,3": "blur"}
+	groups := GroupEntriesByLabel(ctx, metrics, entries, func(idx []uint64) string { return labels[encodeIndex(idx)] })
+
+	assert.For(ctx, "groups").ThatSlice(groups).IsLength(2)
+	blur, shadow := groups[0], groups[1]
+	assert.For(ctx, "blur").That(blur.Label).Equals("blur")
+	assert.For(ctx, "blur time").That(blur.MetricToValue[gpuTimeMetricId]).DeepEquals(perf(40))
+	assert.For(ctx, "shadow").That(shadow.Label).Equals("shadow")
+	assert.For(ctx, "shadow commands").That(shadow.CommandIndices).DeepEquals([][]uint64{{0, 0, 0}, {0, 0, 1}, {0, 0, 2}})
+	assert.For(ctx, "shadow time").That(shadow.MetricToValue[gpuTimeMetricId]).DeepEquals(perf(60))
+	assert.For(ctx, "shadow value").ThatFloat(shadow.MetricToValue[counterMetricIdOffset].Estimate).Equals((10*1+30*5+20*9)/60.0, 1e-9)
+
+	// The parent of the same label already includes its children.
+	labels["0,0"] = "shadow"
+	groups = GroupEntriesByLabel(ctx, metrics, entries, func(idx []uint64) string { return labels[encodeIndex(idx)] })
+	blur, shadow = groups[0], groups[1]
+	assert.For(ctx, "outermost commands").That(shadow.CommandIndices).DeepEquals([][]uint64{{0, 0}})
+	assert.For(ctx, "outermost time").That(shadow.MetricToValue[gpuTimeMetricId]).DeepEquals(perf(100))
+	assert.For(ctx, "other label").That(blur.MetricToValue[gpuTimeMetricId]).DeepEquals(perf(40))
+}
+
+func TestCommandsInRange(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 2), group(1, 0, 1), group(2, 1, 0), group(3, 1, 1), {Id: 4}},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 100), // Long slice, starting before the others.
+			slice(1, 10, 10),
+			slice(2, 20, 10),
+			slice(1, 40, 10),
+			slice(3, 60, 10),
+			slice(4, 30, 10), // Not linked to a command.
+		},
+	}
+	index := NewSliceIndex(slices)
+	for _, test := range []struct {
+		name       string
+		start, end uint64
+		expected   [][]uint64
+	}{
+		{"all", 0, 1000, [][]uint64{{0, 1}, {0, 2}, {1, 0}, {1, 1}}},
+		{"ends at start", 20, 25, [][]uint64{{0, 2}, {1, 0}}},
+		{"starts at end", 50, 60, [][]uint64{{0, 2}}},
+		{"inside", 42, 43, [][]uint64{{0, 1}, {0, 2}}},
+		{"after", 100, 200, [][]uint64{}},
+		{"empty", 30, 30, [][]uint64{}},
+	} {
+		assert.For(ctx, test.name).That(index.CommandsInRange(test.start, test.end)).DeepEquals(test.expected)
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/gapid/core/math/f64"
+	"github.com/google/gapid/core/math/u64"
+	"github.com/google/gapid/gapis/service"
+)
+
+// CounterAttributor implements a strategy attributing the counter samples to
+// the GPU slice groups. The counters being attributed concurrently, its
+// methods must be safe for concurrent use.
+type CounterAttributor interface {
+	// Attribute prepares the attribution of the samples of the counter, given
+	// all the slices running on the GPU sorted by start time and the number
+	// of them overlapping each sample, see scanConcurrency. It returns the
+	// attribution of the samples to the slices of each group.
+	Attribute(globalSlices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter, concurrentSlicesCount []int) GroupAttribution
+}
+
+// GroupAttribution attributes the counter samples to the slices of a group.
+// It returns the best guess, minimum and maximum sets of samples, mapping
+// {sample index} to {sample weight}, see mapCounterSamples. The minimum and
+// maximum sets are nil if bands is false.
+type GroupAttribution func(groupId int32, slices []*service.ProfilingData_GpuSlices_Slice, bands bool) (map[int]float64, map[int]float64, map[int]float64)
+
+// The names of the built-in attribution strategies, see Options.Attribution.
+const (
+	// ProportionalAttribution splits the samples evenly among the
+	// overlapping slices, each getting its share of the fraction of the
+	// samples it overlaps.
+	ProportionalAttribution = "proportional"
+	// MajorityAttribution gives each sample entirely to the group overlapping
+	// the most of its interval, the ties going to the lowest group id.
+	MajorityAttribution = "majority"
+	// OverlapAttribution splits the busy part of the samples among the
+	// overlapping slices by their overlap duration, see overlapAttributor.
+	OverlapAttribution = "overlap"
+	// IntensityAttribution splits the busy part of the samples among the
+	// overlapping slices by their overlap duration and the intensity of
+	// their group, see intensityAttributor.
+	IntensityAttribution = "intensity"
+)
+
+var attributors = map[string]CounterAttributor{
+	ProportionalAttribution: proportionalAttributor{},
+	MajorityAttribution:     majorityAttributor{},
+	OverlapAttribution:      overlapAttributor{},
+	IntensityAttribution:    intensityAttributor{},
+}
+
+// RegisterCounterAttributor registers the attribution strategy under name,
+// such as a vendor's own strategy, for it to be selected by
+// Options.Attribution. It is illegal to register the same name twice.
+func RegisterCounterAttributor(name string, a CounterAttributor) {
+	if _, found := attributors[name]; found {
+		panic(fmt.Errorf("Counter attributor %v already registered", name))
+	}
+	attributors[name] = a
+}
+
+type proportionalAttributor struct{}
+
+func (proportionalAttributor) Attribute(globalSlices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter, concurrentSlicesCount []int) GroupAttribution {
+	return func(groupId int32, slices []*service.ProfilingData_GpuSlices_Slice, bands bool) (map[int]float64, map[int]float64, map[int]float64) {
+		return mapCounterSamples(slices, counter, concurrentSlicesCount, bands)
+	}
+}
+
+// majorityAttributor only changes the best guess set of the proportional
+// attribution, keeping its bands.
+type majorityAttributor struct{}
+
+func (majorityAttributor) Attribute(globalSlices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter, concurrentSlicesCount []int) GroupAttribution {
+	winners := majorityWinners(globalSlices, counter)
+	return func(groupId int32, slices []*service.ProfilingData_GpuSlices_Slice, bands bool) (map[int]float64, map[int]float64, map[int]float64) {
+		_, minSet, maxSet := mapCounterSamples(slices, counter, concurrentSlicesCount, bands)
+		return winners[groupId], minSet, maxSet
+	}
+}
+
+// overlapAttributor weights the slices overlapping a sample by their overlap
+// duration rather than evenly. Each slice s gets the weight
+//
+//	w(s) = busy × overlap(s) / Σ overlap
+//
+// where busy is the fraction of the sample covered by the union of the
+// slices. A slice overlapping a sample alone thus gets the fraction it
+// overlaps, like the proportional attribution, but a short slice running
+// next to a long one no longer gets an even share. The bands are the ones of
+// the proportional attribution.
+type overlapAttributor struct{}
+
+func (overlapAttributor) Attribute(globalSlices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter, concurrentSlicesCount []int) GroupAttribution {
+	overlaps, busy := sampleOverlaps(globalSlices, counter)
+	return func(groupId int32, slices []*service.ProfilingData_GpuSlices_Slice, bands bool) (map[int]float64, map[int]float64, map[int]float64) {
+		estimateSet := shareSamples(slices, counter, func(slice *service.ProfilingData_GpuSlices_Slice, i int, overlap uint64) float64 {
+			if overlaps[i] == 0 {
+				return 0
+			}
+			return busy[i] * float64(overlap) / float64(overlaps[i])
+		})
+		_, minSet, maxSet := mapCounterSamples(slices, counter, concurrentSlicesCount, bands)
+		return estimateSet, minSet, maxSet
+	}
+}
+
+// intensityAttributor refines the overlap attribution by the intensity of
+// the groups, so that a heavy command running next to a light one gets more
+// of their shared samples. Each slice s gets the weight
+//
+//	w(s) = busy × overlap(s)·r(s) / Σ overlap·r
+//
+// where r(s), the intensity of the group of s, is the time-weighted mean of
+// the magnitude of the samples attributed to the group by the overlap
+// attribution. The samples shared by groups of no intensity are split by
+// overlap only. The bands are the ones of the proportional attribution.
+type intensityAttributor struct{}
+
+func (intensityAttributor) Attribute(globalSlices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter, concurrentSlicesCount []int) GroupAttribution {
+	overlaps, busy := sampleOverlaps(globalSlices, counter)
+	byOverlap := overlapAttributor{}.Attribute(globalSlices, counter, concurrentSlicesCount)
+	groupToSlices := map[int32][]*service.ProfilingData_GpuSlices_Slice{}
+	for _, slice := range globalSlices {
+		groupToSlices[slice.GroupId] = append(groupToSlices[slice.GroupId], slice)
+	}
+	intensity := make(map[int32]float64, len(groupToSlices))
+	for groupId, slices := range groupToSlices {
+		weights, _, _ := byOverlap(groupId, slices, false)
+		mean := weightedMean{}
+		for _, i := range sortedSamples(weights) {
+			duration := float64(counter.Timestamps[i] - counter.Timestamps[i-1])
+			mean.add(math.Abs(counter.Values[i]), weights[i]*duration)
+		}
+		intensity[groupId] = mean.mean
+	}
+	// The total overlap of each sample weighted by intensity.
+	weighted := make([]float64, len(counter.Timestamps))
+	shareSamples(globalSlices, counter, func(slice *service.ProfilingData_GpuSlices_Slice, i int, overlap uint64) float64 {
+		weighted[i] += float64(overlap) * intensity[slice.GroupId]
+		return 0
+	})
+	return func(groupId int32, slices []*service.ProfilingData_GpuSlices_Slice, bands bool) (map[int]float64, map[int]float64, map[int]float64) {
+		estimateSet := shareSamples(slices, counter, func(slice *service.ProfilingData_GpuSlices_Slice, i int, overlap uint64) float64 {
+			switch {
+			case weighted[i] != 0:
+				return busy[i] * float64(overlap) * intensity[groupId] / weighted[i]
+			case overlaps[i] != 0:
+				return busy[i] * float64(overlap) / float64(overlaps[i])
+			}
+			return 0
+		})
+		_, minSet, maxSet := mapCounterSamples(slices, counter, concurrentSlicesCount, bands)
+		return estimateSet, minSet, maxSet
+	}
+}
+
+// Return the weights of the valid counter samples overlapping the slices,
+// share returning the weight of the sample i that the slice overlaps by the
+// given duration. The weights of the slices are accumulated and capped to 1.
+func shareSamples(slices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter, share func(slice *service.ProfilingData_GpuSlices_Slice, i int, overlap uint64) float64) map[int]float64 {
+	weights := map[int]float64{}
+	for _, slice := range slices {
+		sStart, sEnd := slice.Ts, slice.Ts+slice.Dur
+		for i := 1; i < len(counter.Timestamps); i++ {
+			cStart, cEnd := counter.Timestamps[i-1], counter.Timestamps[i]
+			if cEnd <= sStart || !validSample(counter, i) { // Sample earlier than GPU slice's span, or not trusted.
+				continue
+			} else if cStart >= sEnd { // Sample later than GPU slice's span.
+				break
+			}
+			if overlap := u64.Min(cEnd, sEnd) - u64.Max(cStart, sStart); overlap != 0 {
+				if weight := share(slice, i, overlap); weight != 0 {
+					weights[i] += weight
+				}
+			}
+		}
+	}
+	for i, weight := range weights {
+		weights[i] = f64.MinOf(weight, 1)
+	}
+	return weights
+}
+
+// Return, for each counter sample, the total overlap duration of the slices
+// with the sample, and the fraction of the sample covered by the union of the
+// slices. The slices are expected to be sorted by start time.
+func sampleOverlaps(slices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter) ([]uint64, []float64) {
+	overlaps := make([]uint64, len(counter.Timestamps))
+	covered := make([]uint64, len(counter.Timestamps))
+	lastEnd := make([]uint64, len(counter.Timestamps)) // The end of the union so far.
+	for _, slice := range slices {
+		sStart, sEnd := slice.Ts, slice.Ts+slice.Dur
+		for i := 1; i < len(counter.Timestamps); i++ {
+			cStart, cEnd := counter.Timestamps[i-1], counter.Timestamps[i]
+			if cEnd <= sStart { // Sample earlier than GPU slice's span.
+				continue
+			} else if cStart >= sEnd { // Sample later than GPU slice's span.
+				break
+			}
+			start, end := u64.Max(cStart, sStart), u64.Min(cEnd, sEnd)
+			overlaps[i] += end - start
+			// The clipped slices start in order, so the union only grows at its end.
+			start = u64.Max(start, lastEnd[i])
+			if end > start {
+				covered[i] += end - start
+				lastEnd[i] = end
+			}
+		}
+	}
+	busy := make([]float64, len(counter.Timestamps))
+	for i := 1; i < len(counter.Timestamps); i++ {
+		if duration := counter.Timestamps[i] - counter.Timestamps[i-1]; duration != 0 {
+			busy[i] = float64(covered[i]) / float64(duration)
+		}
+	}
+	return overlaps, busy
+}
+
+// Return the attribution of the samples of a queue-scoped counter, see
+// Options.QueueScopedCounters. The samples are attributed with the attributor
+// to the slices of each queue, the track of the slices, independently, only
+// the slices on the same queue competing for them. The weights of a group
+// running on several queues are accumulated and capped to 1, and its bands
+// are the union of the bands of each queue.
+func queueScopedAttribution(attributor CounterAttributor, globalSlices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter) GroupAttribution {
+	trackToSlices := map[int32][]*service.ProfilingData_GpuSlices_Slice{}
+	for _, slice := range globalSlices {
+		trackToSlices[slice.TrackId] = append(trackToSlices[slice.TrackId], slice)
+	}
+	trackToAttribution := make(map[int32]GroupAttribution, len(trackToSlices))
+	for trackId, slices := range trackToSlices {
+		trackToAttribution[trackId] = attributor.Attribute(slices, counter, scanConcurrency(slices, counter))
+	}
+	return func(groupId int32, slices []*service.ProfilingData_GpuSlices_Slice, bands bool) (map[int]float64, map[int]float64, map[int]float64) {
+		groupTracks := map[int32][]*service.ProfilingData_GpuSlices_Slice{}
+		for _, slice := range slices {
+			groupTracks[slice.TrackId] = append(groupTracks[slice.TrackId], slice)
+		}
+		if len(groupTracks) == 1 {
+			for trackId, slices := range groupTracks {
+				if attribute, ok := trackToAttribution[trackId]; ok {
+					return attribute(groupId, slices, bands)
+				}
+			}
+		}
+		estimateSet := map[int]float64{}
+		var minSet, maxSet map[int]float64
+		if bands {
+			minSet, maxSet = map[int]float64{}, map[int]float64{}
+		}
+		union := func(set, trackSet map[int]float64) {
+			for i, weight := range trackSet {
+				set[i] = f64.MaxOf(set[i], weight)
+			}
+		}
+		for trackId, slices := range groupTracks {
+			attribute, ok := trackToAttribution[trackId]
+			if !ok {
+				// The slices missing from the global slices compete with none.
+				attribute = attributor.Attribute(slices, counter, scanConcurrency(slices, counter))
+			}
+			trackEstimate, trackMin, trackMax := attribute(groupId, slices, bands)
+			for i, weight := range trackEstimate {
+				estimateSet[i] += weight
+			}
+			if bands {
+				union(minSet, trackMin)
+				union(maxSet, trackMax)
+			}
+		}
+		for i, weight := range estimateSet {
+			estimateSet[i] = f64.MinOf(weight, 1)
+		}
+		return estimateSet, minSet, maxSet
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+// firstGroupAttributor gives all the samples overlapping the slices of group
+// 0 to it, and none to the other groups, like a vendor's own strategy.
+type firstGroupAttributor struct{}
+
+func (firstGroupAttributor) Attribute(globalSlices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter, concurrentSlicesCount []int) GroupAttribution {
+	return func(groupId int32, slices []*service.ProfilingData_GpuSlices_Slice, bands bool) (map[int]float64, map[int]float64, map[int]float64) {
+		if groupId != 0 {
+			return map[int]float64{}, nil, nil
+		}
+		_, _, maxSet := mapCounterSamples(slices, counter, concurrentSlicesCount, true)
+		for i := range maxSet {
+			maxSet[i] = 1
+		}
+		return maxSet, nil, nil
+	}
+}
+
+// Registered once, as the vendors do, for the tests to be repeatable.
+func init() {
+	RegisterCounterAttributor("first group", firstGroupAttributor{})
+}
+
+// longAndShortFixture has a long command and a short one running next to it,
+// within a single counter sample of value 100.
+func longAndShortFixture() (*service.ProfilingData_GpuSlices, []*service.ProfilingData_Counter) {
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0), group(1, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 100), slice(1, 0, 10)},
+	}
+	counters := []*service.ProfilingData_Counter{counter("Fragments", []uint64{0, 100}, []float64{0, 100})}
+	return slices, counters
+}
+
+func TestOverlapAttribution(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := longAndShortFixture()
+	fragmentsId := counterMetricIdOffset
+	for _, test := range []struct {
+		attribution string
+		long, short float64
+	}{
+		// Each gets half of the fraction it overlaps.
+		{ProportionalAttribution, 100 * 0.5, 100 * 0.05},
+		// The whole sample is busy, split 100:10.
+		{OverlapAttribution, 100 * 100 / 110.0, 100 * 10 / 110.0},
+	} {
+		res, err := ComputeCounters(ctx, slices, counters, &Options{Attribution: test.attribution, SummedCounters: []string{"Fragments"}})
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "%v long", test.attribution).ThatFloat(findEntry(res, 0).MetricToValue[fragmentsId].Estimate).Equals(test.long, 1e-9)
+		assert.For(ctx, "%v short", test.attribution).ThatFloat(findEntry(res, 1).MetricToValue[fragmentsId].Estimate).Equals(test.short, 1e-9)
+	}
+}
+
+func TestSampleOverlaps(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 20), slice(1, 10, 20), slice(2, 12, 5), slice(3, 150, 10)}
+	c := counter("Busy", []uint64{0, 100, 200}, []float64{0, 1, 2})
+	overlaps, busy := sampleOverlaps(slices, c)
+	assert.For(ctx, "overlaps").That(overlaps).DeepEquals([]uint64{0, 45, 10})
+	assert.For(ctx, "busy").That(busy).DeepEquals([]float64{0, 0.3, 0.1})
+}
+
+func TestCustomAttributor(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := longAndShortFixture()
+	res, err := ComputeCounters(ctx, slices, counters, &Options{Attribution: "first group", SummedCounters: []string{"Fragments"}})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "first").ThatFloat(findEntry(res, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(100, 0)
+	assert.For(ctx, "second").ThatFloat(findEntry(res, 1).MetricToValue[counterMetricIdOffset].Estimate).Equals(0, 0)
+
+	// The unknown attributions fall back to the proportional one.
+	unknown, err := ComputeCounters(ctx, slices, counters, &Options{Attribution: "unknown"})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	proportional, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "unknown").That(unknown.Entries).DeepEquals(proportional.Entries)
+}
+
+func TestRegisterCounterAttributorTwice(t *testing.T) {
+	ctx := log.Testing(t)
+	defer func() {
+		assert.For(ctx, "panic").That(recover()).IsNotNil()
+	}()
+	RegisterCounterAttributor(ProportionalAttribution, proportionalAttributor{})
+}
+
+func TestQueueScopedCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	onTrack := func(s *service.ProfilingData_GpuSlices_Slice, trackId int32) *service.ProfilingData_GpuSlices_Slice {
+		s.TrackId = trackId
+		return s
+	}
+	// Groups 0 and 1 run on the same queue, group 2 on another one, all over
+	// the same sample.
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0), group(1, 1), group(2, 2)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			onTrack(slice(0, 0, 100), 0), onTrack(slice(1, 0, 100), 0), onTrack(slice(2, 0, 100), 1),
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Fragments", []uint64{0, 100}, []float64{0, 60}),
+		counter("Queue Fragments", []uint64{0, 100}, []float64{0, 60}),
+	}
+	res, err := ComputeCounters(ctx, slices, counters, &Options{
+		SummedCounters:      []string{"Fragments", "Queue Fragments"},
+		QueueScopedCounters: []string{"Queue Fragments"},
+	})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	global, queue := counterMetricIdOffset, counterMetricIdOffset+1
+	for _, test := range []struct {
+		command       uint64
+		global, queue float64
+	}{
+		{0, 20, 30},
+		{1, 20, 30},
+		{2, 20, 60},
+	} {
+		entry := findEntry(res, test.command)
+		assert.For(ctx, "global %v", test.command).ThatFloat(entry.MetricToValue[global].Estimate).Equals(test.global, 1e-9)
+		assert.For(ctx, "queue %v", test.command).ThatFloat(entry.MetricToValue[queue].Estimate).Equals(test.queue, 1e-9)
+	}
+	// Only the group alone on its queue surely owns the sample.
+	assert.For(ctx, "min").ThatFloat(findEntry(res, 2).MetricToValue[queue].Min).Equals(60, 1e-9)
+	assert.For(ctx, "shared min").ThatFloat(findEntry(res, 0).MetricToValue[queue].Min).Equals(0, 1e-9)
+}
+
+func TestIntensityAttribution(t *testing.T) {
+	ctx := log.Testing(t)
+	// Command 0 is heavy and command 1 light when running alone, they then
+	// share the third sample.
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0), group(1, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 100), slice(1, 100, 100), slice(0, 200, 100), slice(1, 200, 100),
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Fragments", []uint64{0, 100, 200, 300}, []float64{0, 100, 10, 55}),
+	}
+	for _, test := range []struct {
+		attribution  string
+		heavy, light float64
+	}{
+		{OverlapAttribution, 100 + 55/2.0, 10 + 55/2.0},
+		// The intensities are (100×100 + 55×50) / 150 = 85 and
+		// (10×100 + 55×50) / 150 = 25.
+		{IntensityAttribution, 100 + 55*85/110.0, 10 + 55*25/110.0},
+	} {
+		res, err := ComputeCounters(ctx, slices, counters, &Options{Attribution: test.attribution, SummedCounters: []string{"Fragments"}})
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "%v heavy", test.attribution).ThatFloat(findEntry(res, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(test.heavy, 1e-9)
+		assert.For(ctx, "%v light", test.attribution).ThatFloat(findEntry(res, 1).MetricToValue[counterMetricIdOffset].Estimate).Equals(test.light, 1e-9)
+	}
+
+	// Without any intensity, the samples are split by overlap.
+	zero := counter("Fragments", []uint64{0, 100, 200, 300}, []float64{0, 0, 0, 0})
+	attribute := intensityAttributor{}.Attribute(slices.Slices, zero, scanConcurrency(slices.Slices, zero))
+	weights, _, _ := attribute(0, []*service.ProfilingData_GpuSlices_Slice{slices.Slices[0], slices.Slices[2]}, false)
+	assert.For(ctx, "zero").That(weights).DeepEquals(map[int]float64{1: 1, 3: 0.5})
+}
@@ -0,0 +1,160 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/gapid/core/data/id"
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/gapis/service"
+)
+
+const (
+	// ErrNotCache is returned when decoding data that isn't a GPU counters
+	// cache blob.
+	ErrNotCache = fault.Const("Not a GPU counters cache")
+	// ErrCacheVersion is returned when decoding a GPU counters cache blob of
+	// another format version. The result should then be recomputed.
+	ErrCacheVersion = fault.Const("Unsupported GPU counters cache version")
+)
+
+// cacheMagic starts every GPU counters cache blob, followed by the little
+// endian cacheVersion and the encoded GpuCounters message.
+var cacheMagic = []byte("GPUC")
+
+// cacheVersion is the version of the cache format. Bump it whenever the
+// meaning of the cached results changes, such as when the attribution does.
+const cacheVersion uint32 = 2
+
+// MarshalCache encodes the result of ComputeCounters to a compact binary blob,
+// to be cached under the key returned by CacheKey.
+func MarshalCache(counters *service.ProfilingData_GpuCounters) ([]byte, error) {
+	data, err := proto.Marshal(counters)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(cacheMagic)+4+len(data)))
+	buf.Write(cacheMagic)
+	binary.Write(buf, binary.LittleEndian, cacheVersion)
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalCache decodes the GPU counters encoded by MarshalCache. It returns
+// ErrNotCache or ErrCacheVersion if the blob header doesn't match the current
+// format.
+func UnmarshalCache(data []byte) (*service.ProfilingData_GpuCounters, error) {
+	header := len(cacheMagic) + 4
+	if len(data) < header || !bytes.Equal(data[:len(cacheMagic)], cacheMagic) {
+		return nil, ErrNotCache
+	}
+	if binary.LittleEndian.Uint32(data[len(cacheMagic):]) != cacheVersion {
+		return nil, ErrCacheVersion
+	}
+	counters := &service.ProfilingData_GpuCounters{}
+	if err := proto.Unmarshal(data[header:], counters); err != nil {
+		return nil, err
+	}
+	return counters, nil
+}
+
+// CacheKey returns the key of the result of ComputeCounters for the given
+// inputs, hashing the slices, the counters, the options, the aggregations and
+// derived metrics registered for their vendor and the cache format version.
+func CacheKey(slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter, options *Options) (id.ID, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	return id.Hash(func(w io.Writer) error {
+		e := &cacheEncoder{w: w}
+		e.write(cacheVersion)
+		e.write(uint64(len(slices.Slices)))
+		for _, s := range slices.Slices {
+			e.write(s.Ts, s.Dur, s.Id, s.Depth, s.TrackId, s.GroupId)
+			e.string(s.Label)
+			e.write(uint64(len(s.Extras)))
+			for _, extra := range s.Extras {
+				e.string(extra.Name)
+				e.string(fmt.Sprintf("%T=%+v", extra.Value, extra.Value))
+			}
+		}
+		e.write(uint64(len(slices.Tracks)))
+		for _, t := range slices.Tracks {
+			e.write(t.Id, t.GpuId)
+			e.string(t.Name)
+		}
+		e.write(uint64(len(slices.Groups)))
+		for _, g := range slices.Groups {
+			e.write(g.Id, g.Parent, uint64(len(g.Link.Indices)), g.Link.Indices)
+		}
+		e.write(uint64(len(counters)))
+		for _, c := range counters {
+			e.write(c.Id, c.Default, c.GpuId)
+			e.string(c.Name)
+			e.string(c.Description)
+			e.string(c.Unit)
+			e.write(uint64(len(c.Timestamps)), c.Timestamps)
+			e.write(uint64(len(c.Values)), c.Values)
+			e.write(uint64(len(c.InvalidSamples)), c.InvalidSamples)
+		}
+		// The descriptor is hashed by value rather than by address.
+		keyed := *options
+		keyed.CounterDescriptor = nil
+		e.string(fmt.Sprintf("%+v", keyed))
+		// The vendor registrations change the result as much as the options.
+		e.string(fmt.Sprintf("%+v", vendorAggregations[options.Vendor]))
+		e.string(fmt.Sprintf("%+v", vendorDerivedMetrics[options.Vendor]))
+		if desc := options.CounterDescriptor; desc != nil {
+			e.write(uint64(len(desc.Specs)))
+			for _, spec := range desc.Specs {
+				e.write(spec.CounterId, spec.SelectByDefault)
+				e.string(spec.Name)
+				e.string(spec.Description)
+				e.string(fmt.Sprintf("%T=%+v", spec.PeakValue, spec.PeakValue))
+				e.write(uint64(len(spec.NumeratorUnits)), spec.NumeratorUnits)
+				e.write(uint64(len(spec.DenominatorUnits)), spec.DenominatorUnits)
+				e.write(uint64(len(spec.Groups)), spec.Groups)
+			}
+		}
+		return e.err
+	})
+}
+
+// cacheEncoder writes the fixed size values and strings hashed by CacheKey,
+// keeping the first error.
+type cacheEncoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *cacheEncoder) write(values ...interface{}) {
+	for _, v := range values {
+		if e.err == nil {
+			e.err = binary.Write(e.w, binary.LittleEndian, v)
+		}
+	}
+}
+
+func (e *cacheEncoder) string(s string) {
+	e.write(uint64(len(s)))
+	if e.err == nil {
+		_, e.err = io.WriteString(e.w, s)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/data/id"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestCache(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	options := &Options{IncludeGroupEntries: true, IncludeIdleEntry: true, NormalizedValues: true}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	data, err := MarshalCache(res)
+	assert.For(ctx, "marshal").ThatError(err).Succeeded()
+	reloaded, err := UnmarshalCache(data)
+	assert.For(ctx, "unmarshal").ThatError(err).Succeeded()
+	assert.For(ctx, "reloaded").That(reloaded).DeepEquals(res)
+
+	// Another format version is rejected.
+	stale := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(stale[len(cacheMagic):], cacheVersion+1)
+	_, err = UnmarshalCache(stale)
+	assert.For(ctx, "version").ThatError(err).Equals(ErrCacheVersion)
+	_, err = UnmarshalCache([]byte("GP"))
+	assert.For(ctx, "truncated").ThatError(err).Equals(ErrNotCache)
+
+	key, err := CacheKey(slices, counters, options)
+	assert.For(ctx, "key").ThatError(err).Succeeded()
+	same, _ := CacheKey(slices, counters, &Options{IncludeGroupEntries: true, IncludeIdleEntry: true, NormalizedValues: true})
+	assert.For(ctx, "same key").That(same).Equals(key)
+	otherOptions, _ := CacheKey(slices, counters, nil)
+	assert.For(ctx, "options key").That(otherOptions).NotEquals(key)
+	moved := []*service.ProfilingData_Counter{counter("Busy", []uint64{0, 10, 20, 30, 40}, []float64{0, 2, 4, 6, 9})}
+	otherCounters, _ := CacheKey(slices, moved, options)
+	assert.For(ctx, "counters key").That(otherCounters).NotEquals(key)
+	onOtherGpu := []*service.ProfilingData_Counter{counter("Busy", []uint64{0, 10, 20, 30, 40}, []float64{0, 2, 4, 6, 8})}
+	onOtherGpu[0].GpuId = 1
+	otherGpu, _ := CacheKey(slices, onOtherGpu, options)
+	assert.For(ctx, "GPU key").That(otherGpu).NotEquals(key)
+
+	// The registrations of the vendor are hashed.
+	vendor := &Options{Vendor: "cache vendor"}
+	unregistered, _ := CacheKey(slices, counters, vendor)
+	RegisterVendorAggregations("cache vendor", map[string]service.ProfilingData_GpuCounters_Metric_AggregationOperator{
+		"Busy": service.ProfilingData_GpuCounters_Metric_Maximum,
+	})
+	defer delete(vendorAggregations, "cache vendor")
+	aggregated, _ := CacheKey(slices, counters, vendor)
+	assert.For(ctx, "aggregations key").That(aggregated).NotEquals(unregistered)
+	RegisterDerivedMetrics("cache vendor", []DerivedMetric{{Name: "Double", Formula: "{Busy} * 2"}})
+	defer delete(vendorDerivedMetrics, "cache vendor")
+	derived, _ := CacheKey(slices, counters, vendor)
+	assert.For(ctx, "derived metrics key").That(derived).NotEquals(aggregated)
+
+	// Every field of the descriptor specs is hashed.
+	spec := func() *device.GpuCounterDescriptor_GpuCounterSpec {
+		return &device.GpuCounterDescriptor_GpuCounterSpec{CounterId: 1, Name: "Busy", Description: "Busy cycles"}
+	}
+	specKey := func(spec *device.GpuCounterDescriptor_GpuCounterSpec) id.ID {
+		key, _ := CacheKey(slices, counters, &Options{CounterDescriptor: &device.GpuCounterDescriptor{Specs: []*device.GpuCounterDescriptor_GpuCounterSpec{spec}}})
+		return key
+	}
+	base := specKey(spec())
+	assert.For(ctx, "same spec key").That(specKey(spec())).Equals(base)
+	described := spec()
+	described.Description = "Busy time"
+	assert.For(ctx, "description key").That(specKey(described)).NotEquals(base)
+	grouped := spec()
+	grouped.Groups = []device.GpuCounterDescriptor_GpuCounterGroup{device.GpuCounterDescriptor_FRAGMENTS}
+	assert.For(ctx, "groups key").That(specKey(grouped)).NotEquals(base)
+	peaked := spec()
+	peaked.PeakValue = &device.GpuCounterDescriptor_GpuCounterSpec_IntPeakValue{IntPeakValue: 100}
+	assert.For(ctx, "peak key").That(specKey(peaked)).NotEquals(base)
+}
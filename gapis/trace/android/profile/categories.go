@@ -0,0 +1,239 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+// OtherMetricCategory is the category of the metrics no category matches.
+const OtherMetricCategory = "other"
+
+// MetricCategory is a semantic bucket of metrics. A metric belongs to the
+// category if its name contains one of the keywords, case insensitively, or
+// if one of the units of its numerator, the structured ones if known, is
+// listed.
+type MetricCategory struct {
+	Name     string
+	Keywords []string
+	Units    []device.GpuCounterDescriptor_MeasureUnit
+}
+
+// DefaultMetricCategories are the categories of the metrics used if none
+// are given to ClassifyMetrics.
+var DefaultMetricCategories = []MetricCategory{
+	{
+		Name:     "timing",
+		Keywords: []string{"time", "cycle", "latency"},
+		Units: []device.GpuCounterDescriptor_MeasureUnit{
+			device.GpuCounterDescriptor_NANOSECOND,
+			device.GpuCounterDescriptor_MICROSECOND,
+			device.GpuCounterDescriptor_MILLISECOND,
+			device.GpuCounterDescriptor_SECOND,
+			device.GpuCounterDescriptor_MINUTE,
+			device.GpuCounterDescriptor_HOUR,
+		},
+	},
+	{
+		Name:     "memory",
+		Keywords: []string{"memory", "bandwidth", "cache"},
+		Units: []device.GpuCounterDescriptor_MeasureUnit{
+			device.GpuCounterDescriptor_BIT,
+			device.GpuCounterDescriptor_KILOBIT,
+			device.GpuCounterDescriptor_MEGABIT,
+			device.GpuCounterDescriptor_GIGABIT,
+			device.GpuCounterDescriptor_TERABIT,
+			device.GpuCounterDescriptor_PETABIT,
+			device.GpuCounterDescriptor_BYTE,
+			device.GpuCounterDescriptor_KILOBYTE,
+			device.GpuCounterDescriptor_MEGABYTE,
+			device.GpuCounterDescriptor_GIGABYTE,
+			device.GpuCounterDescriptor_TERABYTE,
+			device.GpuCounterDescriptor_PETABYTE,
+		},
+	},
+	{
+		Name:     "occupancy",
+		Keywords: []string{"occupancy", "utilization", "busy", "concurren"},
+	},
+}
+
+// ClassifyMetrics buckets the metrics by the name of the first category
+// they belong to, keeping their order. The metrics belonging to no category
+// are bucketed as OtherMetricCategory.
+// If categories is nil then DefaultMetricCategories are used.
+func ClassifyMetrics(metrics []*service.ProfilingData_GpuCounters_Metric, categories []MetricCategory) map[string][]*service.ProfilingData_GpuCounters_Metric {
+	if categories == nil {
+		categories = DefaultMetricCategories
+	}
+	buckets := map[string][]*service.ProfilingData_GpuCounters_Metric{}
+	for _, metric := range metrics {
+		category := OtherMetricCategory
+		for _, c := range categories {
+			if c.matches(metric) {
+				category = c.Name
+				break
+			}
+		}
+		buckets[category] = append(buckets[category], metric)
+	}
+	return buckets
+}
+
+func (c MetricCategory) matches(metric *service.ProfilingData_GpuCounters_Metric) bool {
+	name := strings.ToLower(metric.Name)
+	for _, keyword := range c.Keywords {
+		if strings.Contains(name, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	units := metric.NumeratorUnits
+	if len(units) == 0 {
+		units = numeratorUnits(metric.Unit)
+	}
+	for _, unit := range units {
+		for _, u := range c.Units {
+			if unit == u {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return the units of the numerator of a metric unit, formatted as the
+// colon separated numerator units, optionally followed by a slash and the
+// colon separated denominator units. The malformed units are ignored.
+func numeratorUnits(unit string) []device.GpuCounterDescriptor_MeasureUnit {
+	if p := strings.Index(unit, "/"); p >= 0 {
+		unit = unit[:p]
+	}
+	units := []device.GpuCounterDescriptor_MeasureUnit{}
+	for _, u := range strings.Split(unit, ":") {
+		if v, err := strconv.Atoi(strings.TrimSpace(u)); err == nil {
+			units = append(units, device.GpuCounterDescriptor_MeasureUnit(v))
+		}
+	}
+	return units
+}
+
+// The categories of the metrics, see the Category of the metrics.
+const (
+	MemoryCategory    = "Memory"
+	ShaderCategory    = "Shader/ALU"
+	TextureCategory   = "Texture"
+	PrimitiveCategory = "Primitive"
+	PowerCategory     = "Power"
+	SystemCategory    = "System"
+	TimingCategory    = "Timing"
+	OtherCategory     = "Other"
+)
+
+// The categories of the descriptor groups of the counters.
+var groupCategories = map[device.GpuCounterDescriptor_GpuCounterGroup]string{
+	device.GpuCounterDescriptor_SYSTEM:     SystemCategory,
+	device.GpuCounterDescriptor_VERTICES:   PrimitiveCategory,
+	device.GpuCounterDescriptor_FRAGMENTS:  ShaderCategory,
+	device.GpuCounterDescriptor_PRIMITIVES: PrimitiveCategory,
+	device.GpuCounterDescriptor_MEMORY:     MemoryCategory,
+	device.GpuCounterDescriptor_COMPUTE:    ShaderCategory,
+}
+
+// The built-in classification of the metrics described by no descriptor
+// group, the first matching category winning. The texture caches are
+// textures rather than memory, and the shader cycles are shaders rather than
+// timings.
+var builtinMetricCategories = []MetricCategory{
+	{
+		Name:     TextureCategory,
+		Keywords: []string{"textur", "texel", "sampler", "filtering"},
+	},
+	{
+		Name:     PowerCategory,
+		Keywords: []string{"power", "energy", "thermal", "temperature", "voltage"},
+		Units: []device.GpuCounterDescriptor_MeasureUnit{
+			device.GpuCounterDescriptor_MILLIWATT,
+			device.GpuCounterDescriptor_WATT,
+			device.GpuCounterDescriptor_KILOWATT,
+			device.GpuCounterDescriptor_JOULE,
+			device.GpuCounterDescriptor_VOLT,
+			device.GpuCounterDescriptor_AMPERE,
+			device.GpuCounterDescriptor_CELSIUS,
+			device.GpuCounterDescriptor_FAHRENHEIT,
+			device.GpuCounterDescriptor_KELVIN,
+		},
+	},
+	{
+		Name:     PrimitiveCategory,
+		Keywords: []string{"primitive", "vertex", "vertices", "triangle", "tiler", "culled", "clipped"},
+		Units: []device.GpuCounterDescriptor_MeasureUnit{
+			device.GpuCounterDescriptor_VERTEX,
+			device.GpuCounterDescriptor_TRIANGLE,
+			device.GpuCounterDescriptor_PRIMITIVE,
+		},
+	},
+	{
+		Name:     ShaderCategory,
+		Keywords: []string{"shader", "alu", "arithmetic", "instruction", "warp", "wave", "fragment", "compute", "fp16", "fp32"},
+		Units: []device.GpuCounterDescriptor_MeasureUnit{
+			device.GpuCounterDescriptor_FRAGMENT,
+			device.GpuCounterDescriptor_INSTRUCTION,
+		},
+	},
+	{
+		Name:     MemoryCategory,
+		Keywords: DefaultMetricCategories[1].Keywords,
+		Units:    DefaultMetricCategories[1].Units,
+	},
+	{
+		Name:     TimingCategory,
+		Keywords: append([]string{"frequency", "clock"}, DefaultMetricCategories[0].Keywords...),
+		Units: append([]device.GpuCounterDescriptor_MeasureUnit{
+			device.GpuCounterDescriptor_HERTZ,
+			device.GpuCounterDescriptor_KILOHERTZ,
+			device.GpuCounterDescriptor_MEGAHERTZ,
+			device.GpuCounterDescriptor_GIGAHERTZ,
+		}, DefaultMetricCategories[0].Units...),
+	},
+}
+
+// Return the category of the metric, in order of precedence the one of
+// Options.MetricCategories for its counter name or its name, the one of the
+// first classified descriptor group of its counter, and the first matching
+// built-in category. The metrics matching none are OtherCategory.
+func metricCategory(metric *service.ProfilingData_GpuCounters_Metric, spec *device.GpuCounterDescriptor_GpuCounterSpec, options *Options) string {
+	for _, name := range []string{metric.CounterName, metric.Name} {
+		if category, ok := options.MetricCategories[name]; ok && name != "" {
+			return category
+		}
+	}
+	if spec != nil {
+		for _, group := range spec.Groups {
+			if category, ok := groupCategories[group]; ok {
+				return category
+			}
+		}
+	}
+	for _, c := range builtinMetricCategories {
+		if c.matches(metric) {
+			return c.Name
+		}
+	}
+	return OtherCategory
+}
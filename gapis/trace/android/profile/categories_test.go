@@ -0,0 +1,104 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+// unitCounter builds a GPU counter without samples, of the given unit.
+func unitCounter(name string, unit string) *service.ProfilingData_Counter {
+	return &service.ProfilingData_Counter{Name: name, Unit: unit}
+}
+
+func TestClassifyMetrics(t *testing.T) {
+	ctx := log.Testing(t)
+	bytesPerSecond := strconv.Itoa(int(device.GpuCounterDescriptor_BYTE)) + "/" + strconv.Itoa(int(device.GpuCounterDescriptor_SECOND))
+	metrics := MetricCatalog([]*service.ProfilingData_Counter{
+		unitCounter("External Read Bytes", bytesPerSecond),
+		unitCounter("Shader Core Occupancy", strconv.Itoa(int(device.GpuCounterDescriptor_PERCENT))),
+		unitCounter("Vertices Shaded", strconv.Itoa(int(device.GpuCounterDescriptor_VERTEX))),
+		unitCounter("Malformed", "bytes"),
+	}, nil)
+	buckets := ClassifyMetrics(metrics, nil)
+
+	names := map[string][]string{}
+	for category, metrics := range buckets {
+		for _, metric := range metrics {
+			names[category] = append(names[category], metric.Name)
+		}
+	}
+	assert.For(ctx, "buckets").That(names).DeepEquals(map[string][]string{
+		"timing":            {"GPU Time", "GPU Wall Time", "GPU Self Time", "GPU Time Frame Share", "GPU Children Time", "GPU Longest Slice", "GPU Global Wall Time"},
+		"memory":            {"External Read Bytes"},
+		"occupancy":         {"GPU Busy Intervals", "GPU Max Concurrent Slices", "Shader Core Occupancy"},
+		OtherMetricCategory: {"GPU Slices", "Vertices Shaded", "Malformed"},
+	})
+
+	custom := ClassifyMetrics(metrics, []MetricCategory{
+		{Name: "geometry", Keywords: []string{"VERTICES"}},
+		{Name: "rates", Units: []device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_PERCENT}},
+	})
+	assert.For(ctx, "custom keyword").That(custom["geometry"]).DeepEquals(metrics[counterMetricIdOffset+2 : counterMetricIdOffset+3])
+	assert.For(ctx, "custom unit").ThatSlice(custom["rates"]).IsLength(2) // The frame share and the occupancy.
+	assert.For(ctx, "custom other").ThatSlice(custom[OtherMetricCategory]).IsLength(len(metrics) - 3)
+}
+
+func TestMetricCategory(t *testing.T) {
+	ctx := log.Testing(t)
+	counters := []*service.ProfilingData_Counter{
+		unitCounter("Texture Cache Misses", ""),
+		unitCounter("L2 Cache Reads", ""),
+		unitCounter("ALU Utilization", strconv.Itoa(int(device.GpuCounterDescriptor_PERCENT))),
+		unitCounter("Tiler Busy", ""),
+		unitCounter("GPU Power", strconv.Itoa(int(device.GpuCounterDescriptor_MILLIWATT))),
+		unitCounter("Vendor Grouped", ""),
+		unitCounter("Overridden", ""),
+		unitCounter("Mystery", ""),
+	}
+	options := &Options{
+		CounterDescriptor: &device.GpuCounterDescriptor{Specs: []*device.GpuCounterDescriptor_GpuCounterSpec{{
+			Name:   "Vendor Grouped",
+			Groups: []device.GpuCounterDescriptor_GpuCounterGroup{device.GpuCounterDescriptor_UNCLASSIFIED, device.GpuCounterDescriptor_MEMORY},
+		}}},
+		MetricCategories: map[string]string{"Overridden": "Custom", "GPU Slices": "Counts"},
+		RatioMetrics:     []RatioMetric{{Name: "Shader Ratio", Numerator: "ALU Utilization", Denominator: "GPU Time"}},
+	}
+	categories := map[string]string{}
+	for _, metric := range MetricCatalog(counters, options) {
+		categories[metric.Name] = metric.Category
+	}
+	for name, category := range map[string]string{
+		"GPU Time":             TimingCategory,
+		"GPU Slices":           "Counts",
+		"Texture Cache Misses": TextureCategory,
+		"L2 Cache Reads":       MemoryCategory,
+		"ALU Utilization":      ShaderCategory,
+		"Tiler Busy":           PrimitiveCategory,
+		"GPU Power":            PowerCategory,
+		"Vendor Grouped":       MemoryCategory,
+		"Overridden":           "Custom",
+		"Mystery":              OtherCategory,
+		"Shader Ratio":         ShaderCategory,
+	} {
+		assert.For(ctx, "%v", name).That(categories[name]).Equals(category)
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"sort"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// DefaultChunkSize is the number of items of the chunks of
+// ChunkProfilingData when no size is given.
+const DefaultChunkSize = 10000
+
+// ChunkProfilingData sends the profiling data in chunks of up to size items
+// each, in order: the slices, the tracks and the groups of the slices, the
+// counter samples, and the metrics, the entries and the group, render pass,
+// frame and label entries of the GPU counters, the latter by key. The counters
+// of many samples are split over several chunks. The last chunk holds the rest
+// of the GPU counters, such as the warnings, and at least one chunk is sent.
+// The chunks are appended back by AppendProfilingDataChunk.
+func ChunkProfilingData(data *service.ProfilingData, size int, send func(*service.ProfilingDataChunk) error) error {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	slices := data.Slices
+	if slices == nil {
+		slices = &service.ProfilingData_GpuSlices{}
+	}
+	total := len(slices.Slices) + len(slices.Tracks) + len(slices.Groups)
+	for _, counter := range data.Counters {
+		total += counterSamples(counter)
+	}
+	if gpuCounters := data.GpuCounters; gpuCounters != nil {
+		total += len(gpuCounters.Metrics) + len(gpuCounters.Entries) + len(gpuCounters.GroupToEntry) +
+			len(gpuCounters.RenderPassToEntry) + len(gpuCounters.FrameToEntry) + len(gpuCounters.LabelToEntry)
+	}
+
+	c := &chunker{size: size, total: uint64(total), send: send}
+	for _, slice := range slices.Slices {
+		c.current().Slices = append(c.current().Slices, slice)
+		if err := c.added(1); err != nil {
+			return err
+		}
+	}
+	for _, track := range slices.Tracks {
+		c.current().Tracks = append(c.current().Tracks, track)
+		if err := c.added(1); err != nil {
+			return err
+		}
+	}
+	for _, group := range slices.Groups {
+		c.current().Groups = append(c.current().Groups, group)
+		if err := c.added(1); err != nil {
+			return err
+		}
+	}
+	for _, counter := range data.Counters {
+		n := counterSamples(counter)
+		for start := 0; start == 0 || start < n; {
+			end := start + c.room()
+			if end > n {
+				end = n
+			}
+			chunk := c.current()
+			chunk.CounterContinued = chunk.CounterContinued || (start != 0 && len(chunk.Counters) == 0)
+			chunk.Counters = append(chunk.Counters, withSamples(counter, u64Range(counter.Timestamps, start, end), f64Range(counter.Values, start, end), boolRange(counter.InvalidSamples, start, end)))
+			if err := c.added(end - start); err != nil {
+				return err
+			}
+			if start = end; n == 0 {
+				break
+			}
+		}
+	}
+	if gpuCounters := data.GpuCounters; gpuCounters != nil {
+		for _, metric := range gpuCounters.Metrics {
+			c.current().Metrics = append(c.current().Metrics, metric)
+			if err := c.added(1); err != nil {
+				return err
+			}
+		}
+		for _, entry := range gpuCounters.Entries {
+			c.current().Entries = append(c.current().Entries, entry)
+			if err := c.added(1); err != nil {
+				return err
+			}
+		}
+		groups := make([]int, 0, len(gpuCounters.GroupToEntry))
+		for group := range gpuCounters.GroupToEntry {
+			groups = append(groups, int(group))
+		}
+		sort.Ints(groups)
+		for _, group := range groups {
+			chunk := c.current()
+			if chunk.GroupToEntry == nil {
+				chunk.GroupToEntry = map[int32]*service.ProfilingData_GpuCounters_Entry{}
+			}
+			chunk.GroupToEntry[int32(group)] = gpuCounters.GroupToEntry[int32(group)]
+			if err := c.added(1); err != nil {
+				return err
+			}
+		}
+		for _, renderPass := range sortedEntryKeys(gpuCounters.RenderPassToEntry) {
+			chunk := c.current()
+			if chunk.RenderPassToEntry == nil {
+				chunk.RenderPassToEntry = map[uint64]*service.ProfilingData_GpuCounters_Entry{}
+			}
+			chunk.RenderPassToEntry[renderPass] = gpuCounters.RenderPassToEntry[renderPass]
+			if err := c.added(1); err != nil {
+				return err
+			}
+		}
+		for _, frame := range sortedEntryKeys(gpuCounters.FrameToEntry) {
+			chunk := c.current()
+			if chunk.FrameToEntry == nil {
+				chunk.FrameToEntry = map[uint64]*service.ProfilingData_GpuCounters_Entry{}
+			}
+			chunk.FrameToEntry[frame] = gpuCounters.FrameToEntry[frame]
+			if err := c.added(1); err != nil {
+				return err
+			}
+		}
+		labels := make([]string, 0, len(gpuCounters.LabelToEntry))
+		for label := range gpuCounters.LabelToEntry {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			chunk := c.current()
+			if chunk.LabelToEntry == nil {
+				chunk.LabelToEntry = map[string]*service.ProfilingData_GpuCounters_Entry{}
+			}
+			chunk.LabelToEntry[label] = gpuCounters.LabelToEntry[label]
+			if err := c.added(1); err != nil {
+				return err
+			}
+		}
+		rest := *gpuCounters
+		rest.Metrics, rest.Entries = nil, nil
+		rest.GroupToEntry, rest.RenderPassToEntry, rest.FrameToEntry, rest.LabelToEntry = nil, nil, nil, nil
+		c.current().GpuCounters = &rest
+	}
+	if c.chunk != nil || c.chunks == 0 {
+		return c.flush()
+	}
+	return nil
+}
+
+// AppendProfilingDataChunk appends the items of the chunk, as sent by
+// ChunkProfilingData, to the profiling data.
+func AppendProfilingDataChunk(data *service.ProfilingData, chunk *service.ProfilingDataChunk) {
+	if len(chunk.Slices) != 0 || len(chunk.Tracks) != 0 || len(chunk.Groups) != 0 {
+		if data.Slices == nil {
+			data.Slices = &service.ProfilingData_GpuSlices{}
+		}
+		data.Slices.Slices = append(data.Slices.Slices, chunk.Slices...)
+		data.Slices.Tracks = append(data.Slices.Tracks, chunk.Tracks...)
+		data.Slices.Groups = append(data.Slices.Groups, chunk.Groups...)
+	}
+	counters := chunk.Counters
+	if chunk.CounterContinued && len(counters) != 0 && len(data.Counters) != 0 {
+		last := data.Counters[len(data.Counters)-1]
+		last.Timestamps = append(last.Timestamps, counters[0].Timestamps...)
+		last.Values = append(last.Values, counters[0].Values...)
+		last.InvalidSamples = append(last.InvalidSamples, counters[0].InvalidSamples...)
+		counters = counters[1:]
+	}
+	for _, counter := range counters {
+		// Copied, for the next chunks not to change the ones of this one.
+		c := *counter
+		data.Counters = append(data.Counters, &c)
+	}
+	if len(chunk.Metrics) != 0 || len(chunk.Entries) != 0 || len(chunk.GroupToEntry) != 0 ||
+		len(chunk.RenderPassToEntry) != 0 || len(chunk.FrameToEntry) != 0 || len(chunk.LabelToEntry) != 0 ||
+		chunk.GpuCounters != nil {
+		if data.GpuCounters == nil {
+			data.GpuCounters = &service.ProfilingData_GpuCounters{}
+		}
+		gpuCounters := data.GpuCounters
+		if chunk.GpuCounters != nil {
+			// The rest of the GPU counters, keeping the items of the previous
+			// chunks.
+			rest := *chunk.GpuCounters
+			rest.Metrics, rest.Entries = gpuCounters.Metrics, gpuCounters.Entries
+			rest.GroupToEntry, rest.RenderPassToEntry = gpuCounters.GroupToEntry, gpuCounters.RenderPassToEntry
+			rest.FrameToEntry, rest.LabelToEntry = gpuCounters.FrameToEntry, gpuCounters.LabelToEntry
+			*gpuCounters = rest
+		}
+		gpuCounters.Metrics = append(gpuCounters.Metrics, chunk.Metrics...)
+		gpuCounters.Entries = append(gpuCounters.Entries, chunk.Entries...)
+		for group, entry := range chunk.GroupToEntry {
+			if gpuCounters.GroupToEntry == nil {
+				gpuCounters.GroupToEntry = map[int32]*service.ProfilingData_GpuCounters_Entry{}
+			}
+			gpuCounters.GroupToEntry[group] = entry
+		}
+		for renderPass, entry := range chunk.RenderPassToEntry {
+			if gpuCounters.RenderPassToEntry == nil {
+				gpuCounters.RenderPassToEntry = map[uint64]*service.ProfilingData_GpuCounters_Entry{}
+			}
+			gpuCounters.RenderPassToEntry[renderPass] = entry
+		}
+		for frame, entry := range chunk.FrameToEntry {
+			if gpuCounters.FrameToEntry == nil {
+				gpuCounters.FrameToEntry = map[uint64]*service.ProfilingData_GpuCounters_Entry{}
+			}
+			gpuCounters.FrameToEntry[frame] = entry
+		}
+		for label, entry := range chunk.LabelToEntry {
+			if gpuCounters.LabelToEntry == nil {
+				gpuCounters.LabelToEntry = map[string]*service.ProfilingData_GpuCounters_Entry{}
+			}
+			gpuCounters.LabelToEntry[label] = entry
+		}
+	}
+}
+
+// chunker fills the chunks of ChunkProfilingData, sending each once full.
+type chunker struct {
+	size  int
+	total uint64
+	send  func(*service.ProfilingDataChunk) error
+	chunk *service.ProfilingDataChunk
+	items int // The items of the current chunk.
+	sent  uint64
+	// The number of chunks sent.
+	chunks int
+}
+
+// Return the chunk being filled.
+func (c *chunker) current() *service.ProfilingDataChunk {
+	if c.chunk == nil {
+		c.chunk = &service.ProfilingDataChunk{}
+	}
+	return c.chunk
+}
+
+// Return the number of items the current chunk still has room for.
+func (c *chunker) room() int {
+	return c.size - c.items
+}
+
+// Account for n items added to the current chunk, sending it if full.
+func (c *chunker) added(n int) error {
+	c.items += n
+	c.sent += uint64(n)
+	if c.items >= c.size {
+		return c.flush()
+	}
+	return nil
+}
+
+func (c *chunker) flush() error {
+	chunk := c.current()
+	chunk.Sent, chunk.Total = c.sent, c.total
+	c.chunk, c.items = nil, 0
+	c.chunks++
+	return c.send(chunk)
+}
+
+// Return the number of samples of the counter, its timestamps, values and
+// invalid flags being chunked by the same ranges.
+func counterSamples(counter *service.ProfilingData_Counter) int {
+	n := len(counter.Timestamps)
+	if len(counter.Values) > n {
+		n = len(counter.Values)
+	}
+	if len(counter.InvalidSamples) > n {
+		n = len(counter.InvalidSamples)
+	}
+	return n
+}
+
+// Return the keys of the entries in increasing order, for the chunks to be
+// deterministic.
+func sortedEntryKeys(entries map[uint64]*service.ProfilingData_GpuCounters_Entry) []uint64 {
+	keys := make([]uint64, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// Return the values of [start, end), clipped to the values, without the
+// capacity past end for the appends not to overwrite the next values.
+func u64Range(values []uint64, start, end int) []uint64 {
+	if start >= len(values) {
+		return nil
+	}
+	if end > len(values) {
+		end = len(values)
+	}
+	return values[start:end:end]
+}
+
+func f64Range(values []float64, start, end int) []float64 {
+	if start >= len(values) {
+		return nil
+	}
+	if end > len(values) {
+		end = len(values)
+	}
+	return values[start:end:end]
+}
+
+func boolRange(values []bool, start, end int) []bool {
+	if start >= len(values) {
+		return nil
+	}
+	if end > len(values) {
+		end = len(values)
+	}
+	return values[start:end:end]
+}
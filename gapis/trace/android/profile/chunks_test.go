@@ -0,0 +1,85 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/fault"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestChunkProfilingData(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	counters = append(counters, counter("Empty", nil, nil))
+	gpuCounters, err := ComputeCounters(ctx, slices, counters, &Options{IncludeGroupEntries: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	data := &service.ProfilingData{Slices: slices, Counters: counters, GpuCounters: gpuCounters}
+
+	// 2 slices, 2 groups, 5 samples, and the metrics, entries and group entries.
+	total := uint64(9 + len(gpuCounters.Metrics) + len(gpuCounters.Entries) + len(gpuCounters.GroupToEntry))
+	chunks := []*service.ProfilingDataChunk{}
+	err = ChunkProfilingData(data, 3, func(chunk *service.ProfilingDataChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assemble := &service.ProfilingData{}
+	sent := uint64(0)
+	for i, chunk := range chunks {
+		assert.For(ctx, "chunk %v total", i).That(chunk.Total).Equals(total)
+		assert.For(ctx, "chunk %v progress", i).That(chunk.Sent > sent || i == len(chunks)-1).Equals(true)
+		sent = chunk.Sent
+		AppendProfilingDataChunk(assemble, chunk)
+	}
+	assert.For(ctx, "sent").That(sent).Equals(total)
+	// The samples of the counter are split after the 2 slices and the first group.
+	assert.For(ctx, "split").That(chunks[1].Counters[0].Timestamps).DeepEquals([]uint64{0, 10})
+	assert.For(ctx, "continued").That(chunks[2].CounterContinued).Equals(true)
+	assert.For(ctx, "rest").That(chunks[len(chunks)-1].GpuCounters.GroupToEntry).IsNil()
+	assert.For(ctx, "assembled").That(assemble).DeepEquals(data)
+	assert.For(ctx, "original").ThatSlice(counters[0].Timestamps).IsLength(5)
+
+	// The group entries are chunked like the entries, one per item.
+	groupChunks := 0
+	ChunkProfilingData(data, 1, func(chunk *service.ProfilingDataChunk) error {
+		if len(chunk.GroupToEntry) != 0 {
+			groupChunks++
+		}
+		return nil
+	})
+	assert.For(ctx, "group entries").That(groupChunks).Equals(len(gpuCounters.GroupToEntry))
+
+	// The empty data is a single chunk.
+	chunks = nil
+	ChunkProfilingData(&service.ProfilingData{}, 0, func(chunk *service.ProfilingDataChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	assert.For(ctx, "empty").ThatSlice(chunks).IsLength(1)
+
+	// The send errors stop the stream.
+	const errSend = fault.Const("send")
+	calls := 0
+	err = ChunkProfilingData(data, 1, func(chunk *service.ProfilingDataChunk) error {
+		calls++
+		return errSend
+	})
+	assert.For(ctx, "send error").ThatError(err).Equals(errSend)
+	assert.For(ctx, "calls").That(calls).Equals(1)
+}
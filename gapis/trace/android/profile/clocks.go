@@ -0,0 +1,160 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"math"
+	"sort"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// ClockSnapshot holds the readings of several clocks at the same instant,
+// keyed by clock id, such as the Perfetto clock snapshots of a trace.
+type ClockSnapshot map[uint32]uint64
+
+// TraceClock is the clock of the trace time in the snapshots returned by
+// NewClockSnapshots. The trace processor reports the CPU trace events in the
+// trace time, which is thus the single domain the GPU timestamps are
+// translated into. It isn't a Perfetto clock id.
+const TraceClock = ^uint32(0)
+
+// NewClockSnapshots returns the clock snapshots of the rows of a trace, such as
+// the ones of the Perfetto clock_snapshot table, each reading a clock of a
+// snapshot at the trace time ts, which the snapshots read as TraceClock. The
+// rows of a snapshot are expected to be contiguous.
+func NewClockSnapshots(snapshotIds, clockIds, values, ts []int64) []ClockSnapshot {
+	snapshots := []ClockSnapshot{}
+	for i, id := range snapshotIds {
+		if i == 0 || id != snapshotIds[i-1] {
+			snapshots = append(snapshots, ClockSnapshot{TraceClock: uint64(ts[i])})
+		}
+		snapshots[len(snapshots)-1][uint32(clockIds[i])] = uint64(values[i])
+	}
+	return snapshots
+}
+
+// ClockSync translates the timestamps of a clock into the domain of another
+// clock. A nil ClockSync leaves the timestamps as they are.
+type ClockSync struct {
+	// The readings of both clocks at the same instants, by increasing
+	// reading of the clock translated from.
+	points []clockPoint
+}
+
+type clockPoint struct {
+	from, to uint64
+}
+
+// NewClockSync returns the ClockSync translating the timestamps of the clock
+// from into the domain of the clock to, from the snapshots reading both. The
+// timestamps between two snapshots are interpolated, following the drift of
+// the clocks, and the others keep the offset of the nearest snapshot. Nil is
+// returned if no snapshot reads both clocks, see EstimateClockSync.
+func NewClockSync(snapshots []ClockSnapshot, from, to uint32) *ClockSync {
+	points := []clockPoint{}
+	for _, snapshot := range snapshots {
+		f, okFrom := snapshot[from]
+		t, okTo := snapshot[to]
+		if okFrom && okTo {
+			points = append(points, clockPoint{f, t})
+		}
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].from < points[j].from })
+	return &ClockSync{points: points}
+}
+
+// EstimateClockSync returns the ClockSync translating the GPU timestamps into
+// the domain of the CPU clock when no snapshot reads both, from the CPU times
+// at which submissions were made and the GPU times at which their first slices
+// started. The GPU starting the work of a submission no sooner than it is
+// submitted, the clocks are taken to be offset by the least of the differences
+// between the two. Nil is returned if there is no submission.
+func EstimateClockSync(submits, starts []uint64) *ClockSync {
+	if len(submits) == 0 || len(submits) != len(starts) {
+		return nil
+	}
+	best := 0
+	for i := range submits {
+		if int64(starts[i]-submits[i]) < int64(starts[best]-submits[best]) {
+			best = i
+		}
+	}
+	return &ClockSync{points: []clockPoint{{starts[best], submits[best]}}}
+}
+
+// Translate returns the timestamp in the domain of the clock translated to.
+func (c *ClockSync) Translate(ts uint64) uint64 {
+	if c == nil {
+		return ts
+	}
+	i := sort.Search(len(c.points), func(i int) bool { return c.points[i].from > ts })
+	switch {
+	case i == 0:
+		return offsetTimestamp(ts, c.points[0])
+	case i == len(c.points):
+		return offsetTimestamp(ts, c.points[i-1])
+	}
+	a, b := c.points[i-1], c.points[i]
+	scale := float64(int64(b.to-a.to)) / float64(b.from-a.from)
+	return a.to + uint64(int64(math.Round(float64(ts-a.from)*scale)))
+}
+
+// Return the timestamp with the offset of the clocks at the point.
+func offsetTimestamp(ts uint64, point clockPoint) uint64 {
+	return ts - point.from + point.to
+}
+
+// SyncClocks returns the slices and the counters with their timestamps
+// translated into a single domain, such as the one of the CPU trace, before
+// they are computed by ComputeCounters: the slices by sliceClock, the GPU
+// render stage clock, and the counters by counterClock. The durations of the
+// slices are the ones of their translated intervals. The inputs are left
+// unchanged.
+func SyncClocks(slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter, sliceClock, counterClock *ClockSync) (*service.ProfilingData_GpuSlices, []*service.ProfilingData_Counter) {
+	synced := &service.ProfilingData_GpuSlices{
+		Slices: make([]*service.ProfilingData_GpuSlices_Slice, len(slices.Slices)),
+		Tracks: slices.Tracks,
+		Groups: slices.Groups,
+	}
+	for i, slice := range slices.Slices {
+		start, end := sliceClock.Translate(slice.Ts), sliceClock.Translate(slice.Ts+slice.Dur)
+		synced.Slices[i] = withTimes(slice, start, end-start)
+	}
+	syncedCounters := make([]*service.ProfilingData_Counter, len(counters))
+	for i, counter := range counters {
+		timestamps := make([]uint64, len(counter.Timestamps))
+		for j, ts := range counter.Timestamps {
+			timestamps[j] = counterClock.Translate(ts)
+		}
+		syncedCounters[i] = withSamples(counter, timestamps, counter.Values, counter.InvalidSamples)
+	}
+	return synced, syncedCounters
+}
+
+// SyncTraceClocks returns the slices and the counters with their timestamps
+// translated from the clock into the trace time by the snapshots, see
+// SyncClocks, before they are computed by ComputeCounters. The inputs are
+// returned as they are if no snapshot reads the clock.
+func SyncTraceClocks(slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter, snapshots []ClockSnapshot, clock uint32) (*service.ProfilingData_GpuSlices, []*service.ProfilingData_Counter) {
+	sync := NewClockSync(snapshots, clock, TraceClock)
+	if sync == nil || slices == nil {
+		return slices, counters
+	}
+	return SyncClocks(slices, counters, sync, sync)
+}
@@ -0,0 +1,111 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+)
+
+const (
+	testCpuClock = 6 // BOOTTIME
+	testGpuClock = 64
+)
+
+func TestClockSync(t *testing.T) {
+	ctx := log.Testing(t)
+	snapshots := []ClockSnapshot{
+		{testCpuClock: 2000, testGpuClock: 1100},
+		{testCpuClock: 1000, testGpuClock: 100},
+		{testCpuClock: 5000}, // The GPU clock isn't read.
+	}
+	sync := NewClockSync(snapshots, testGpuClock, testCpuClock)
+	for _, test := range []struct {
+		ts, expected uint64
+	}{
+		{100, 1000},
+		{600, 1500}, // Interpolated.
+		{1100, 2000},
+		{50, 950},    // Before the first snapshot.
+		{1200, 2100}, // After the last snapshot.
+	} {
+		assert.For(ctx, "translated %v", test.ts).That(sync.Translate(test.ts)).Equals(test.expected)
+	}
+
+	// The GPU clock drifting, running twice as fast as the CPU clock.
+	drift := NewClockSync([]ClockSnapshot{
+		{testCpuClock: 1000, testGpuClock: 0},
+		{testCpuClock: 2000, testGpuClock: 2000},
+	}, testGpuClock, testCpuClock)
+	assert.For(ctx, "drift").That(drift.Translate(1000)).Equals(uint64(1500))
+
+	assert.For(ctx, "no snapshot").That(NewClockSync(snapshots[2:], testGpuClock, testCpuClock)).IsNil()
+	var identity *ClockSync
+	assert.For(ctx, "identity").That(identity.Translate(42)).Equals(uint64(42))
+}
+
+func TestEstimateClockSync(t *testing.T) {
+	ctx := log.Testing(t)
+	// The second submission started the soonest after it was submitted.
+	sync := EstimateClockSync([]uint64{1000, 2000, 3000}, []uint64{150, 1120, 2200})
+	assert.For(ctx, "offset").That(sync.Translate(1120)).Equals(uint64(2000))
+	assert.For(ctx, "first").That(sync.Translate(150)).Equals(uint64(1030))
+	assert.For(ctx, "no submission").That(EstimateClockSync(nil, nil)).IsNil()
+}
+
+func TestSyncClocks(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	gpuClock := &ClockSync{points: []clockPoint{{0, 1000}}}
+	counterClock := &ClockSync{points: []clockPoint{{0, 1000}, {40, 1080}}}
+	synced, syncedCounters := SyncClocks(slices, counters, gpuClock, counterClock)
+	assert.For(ctx, "slice").That(synced.Slices[1].Ts).Equals(uint64(1025))
+	assert.For(ctx, "duration").That(synced.Slices[1].Dur).Equals(uint64(10))
+	assert.For(ctx, "samples").That(syncedCounters[0].Timestamps).DeepEquals([]uint64{1000, 1020, 1040, 1060, 1080})
+	assert.For(ctx, "original").That(slices.Slices[1].Ts).Equals(uint64(25))
+
+	res, err := ComputeCounters(ctx, synced, syncedCounters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "entries").ThatSlice(res.Entries).IsLength(3)
+}
+
+func TestSyncTraceClocks(t *testing.T) {
+	ctx := log.Testing(t)
+	// The rows of the clock_snapshot table: snapshot id, clock id, clock value
+	// and trace time.
+	snapshotIds := []int64{0, 0, 1, 1}
+	clockIds := []int64{testCpuClock, testGpuClock, testCpuClock, testGpuClock}
+	values := []int64{5000, 0, 6000, 1000}
+	ts := []int64{5000, 5000, 6000, 6000}
+	snapshots := NewClockSnapshots(snapshotIds, clockIds, values, ts)
+	assert.For(ctx, "snapshots").That(snapshots).DeepEquals([]ClockSnapshot{
+		{TraceClock: 5000, testCpuClock: 5000, testGpuClock: 0},
+		{TraceClock: 6000, testCpuClock: 6000, testGpuClock: 1000},
+	})
+
+	slices, counters := twoCommandsFixture()
+	synced, syncedCounters := SyncTraceClocks(slices, counters, snapshots, testGpuClock)
+	assert.For(ctx, "slice").That(synced.Slices[1].Ts).Equals(uint64(5025))
+	assert.For(ctx, "samples").That(syncedCounters[0].Timestamps).DeepEquals([]uint64{5000, 5010, 5020, 5030, 5040})
+
+	// The timestamps already in the trace time are left as they are.
+	same, sameCounters := SyncTraceClocks(slices, counters, snapshots, 128)
+	assert.For(ctx, "unread clock").That(same == slices).Equals(true)
+	assert.For(ctx, "unread clock counters").That(sameCounters[0] == counters[0]).Equals(true)
+	none, _ := SyncTraceClocks(nil, counters, snapshots, testGpuClock)
+	assert.For(ctx, "no slices").That(none).IsNil()
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"math"
+	"sort"
+
+	"github.com/google/gapid/core/math/u64"
+	"github.com/google/gapid/gapis/service"
+)
+
+// Calculate the confidence, in [0, 1], in the attribution of the counter to
+// the slices of a group, given the concurrency of the samples, see
+// scanConcurrency, and the resulting performance. It combines three factors:
+//
+//	confidence = coverage / concurrency / (1 + band)
+//
+// coverage is the fraction of the slices' duration covered by valid samples,
+// concurrency is the average number of slices overlapping the samples,
+// weighted by their overlap with the slices, and band is the relative width
+// (Max - Min) / Estimate of the performance. A group fully covered by samples
+// it doesn't share, with Min = Max, thus has a confidence of 1. Unavailable
+// performances have a confidence of 0.
+func attributionConfidence(slices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter, concurrentSlicesCount []int, perf *service.ProfilingData_GpuCounters_Perf) float64 {
+	if isUnavailable(perf) {
+		return 0
+	}
+	duration, covered, concurrency := uint64(0), uint64(0), float64(0)
+	for _, slice := range slices {
+		duration += slice.Dur
+		sStart, sEnd := slice.Ts, slice.Ts+slice.Dur
+		for i := 1; i < len(counter.Timestamps); i++ {
+			cStart, cEnd := counter.Timestamps[i-1], counter.Timestamps[i]
+			if cEnd <= sStart || !validSample(counter, i) { // Sample earlier than GPU slice's span, or not trusted.
+				continue
+			} else if cStart >= sEnd { // Sample later than GPU slice's span.
+				break
+			}
+			overlap := u64.Min(cEnd, sEnd) - u64.Max(cStart, sStart)
+			covered += overlap
+			concurrency += float64(overlap) * math.Max(1, float64(concurrentSlicesCount[i]))
+		}
+	}
+	if duration == 0 || covered == 0 {
+		return 0
+	}
+	coverage := float64(covered) / float64(duration)
+	concurrency /= float64(covered)
+
+	band := float64(0)
+	if perf.Max != perf.Min {
+		if perf.Estimate == 0 {
+			return 0
+		}
+		band = math.Abs((perf.Max - perf.Min) / perf.Estimate)
+	}
+	return coverage / concurrency / (1 + band)
+}
+
+// Set the confidences of a merged command entry, the mean of the ones of its
+// leaf groups weighted by their rollup weights.
+func setMergedConfidence(mergedEntry *service.ProfilingData_GpuCounters_Entry, leaves []int32, weights []float64, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry) {
+	means := map[int32]*weightedMean{}
+	for i, id := range leaves {
+		for metricId, confidence := range groupToEntry[id].MetricToConfidence {
+			mean, ok := means[metricId]
+			if !ok {
+				mean = &weightedMean{}
+				means[metricId] = mean
+			}
+			mean.add(confidence, weights[i])
+		}
+	}
+	if len(means) == 0 {
+		return
+	}
+	mergedEntry.MetricToConfidence = make(map[int32]float64, len(means))
+	for metricId, mean := range means {
+		mergedEntry.MetricToConfidence[metricId] = mean.mean
+	}
+}
+
+// Return the sampling period of the counter, the median duration of its valid
+// samples, or 0 if it has none.
+func samplingPeriod(counter *service.ProfilingData_Counter) uint64 {
+	durations := make([]uint64, 0, len(counter.Timestamps))
+	for i := 1; i < len(counter.Timestamps); i++ {
+		if start, end := counter.Timestamps[i-1], counter.Timestamps[i]; end > start && validSample(counter, i) {
+			durations = append(durations, end-start)
+		}
+	}
+	if len(durations) == 0 {
+		return 0
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2]
+}
+
+// Return the number of sampling periods of the counter covered by its valid
+// samples overlapping the slices. A group spanning less than a sampling
+// period, which can't be resolved by the counter, has a density below 1.
+func sampleDensity(slices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter, period uint64) float64 {
+	if period == 0 {
+		return 0
+	}
+	covered := uint64(0)
+	for _, slice := range slices {
+		sStart, sEnd := slice.Ts, slice.Ts+slice.Dur
+		for i := 1; i < len(counter.Timestamps); i++ {
+			cStart, cEnd := counter.Timestamps[i-1], counter.Timestamps[i]
+			if cEnd <= sStart || !validSample(counter, i) { // Sample earlier than GPU slice's span, or not trusted.
+				continue
+			} else if cStart >= sEnd { // Sample later than GPU slice's span.
+				break
+			}
+			covered += u64.Min(cEnd, sEnd) - u64.Max(cStart, sStart)
+		}
+	}
+	return float64(covered) / float64(period)
+}
+
+// Set the density confidence of a merged command entry, the sum of the ones
+// of its leaf groups capped to 1, as the leaves cover more sampling periods
+// together.
+func setMergedDensityConfidence(mergedEntry *service.ProfilingData_GpuCounters_Entry, leaves []int32, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry) {
+	sum := 0.0
+	for _, id := range leaves {
+		sum += groupToEntry[id].DensityConfidence
+	}
+	mergedEntry.DensityConfidence = math.Min(sum, 1)
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestConfidence(t *testing.T) {
+	ctx := log.Testing(t)
+	options := &Options{Confidence: true}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40, 50}, []float64{0, 2, 1, 20, 2, 4}),
+	}
+
+	// Full coverage, no concurrency and no band.
+	high := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 20)},
+	}
+	res, err := ComputeCounters(ctx, high, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "high").ThatFloat(findEntry(res, 0, 0).MetricToConfidence[counterMetricIdOffset]).Equals(1, 1e-9)
+
+	// Concurrent slices partially covered by the samples, with a wide band.
+	low := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 20, 40), slice(1, 25, 40)},
+	}
+	res, err = ComputeCounters(ctx, low, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	first := findEntry(res, 0, 0).MetricToConfidence[counterMetricIdOffset]
+	second := findEntry(res, 0, 1).MetricToConfidence[counterMetricIdOffset]
+	assert.For(ctx, "low first").ThatFloat(first).IsAtMost(0.5)
+	assert.For(ctx, "low second").ThatFloat(second).IsAtMost(0.5)
+	assert.For(ctx, "low second").ThatFloat(second).IsAtLeast(0.01)
+	// The parent command merges the confidences by GPU time.
+	assert.For(ctx, "parent").ThatFloat(findEntry(res, 0).MetricToConfidence[counterMetricIdOffset]).Equals((first+second)/2, 1e-9)
+	// The other metrics have no confidence.
+	assert.For(ctx, "metrics").ThatMap(findEntry(res, 0).MetricToConfidence).IsLength(1)
+}
+
+func TestAttributionConfidenceBoundaries(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Busy", []uint64{0, 10, 20}, []float64{0, 2, 2})
+	slices := []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 20)}
+	for _, test := range []struct {
+		name        string
+		slices      []*service.ProfilingData_GpuSlices_Slice
+		concurrency []int
+		perf        *service.ProfilingData_GpuCounters_Perf
+		expected    float64
+	}{
+		{"full", slices, []int{0, 1, 1}, perf(2), 1},
+		{"concurrent", slices, []int{0, 2, 2}, perf(2), 0.5},
+		{"half covered", []*service.ProfilingData_GpuSlices_Slice{slice(0, 10, 20)}, []int{0, 1, 1}, perf(2), 0.5},
+		{"band", slices, []int{0, 1, 1}, &service.ProfilingData_GpuCounters_Perf{Estimate: 2, Min: 1, Max: 3}, 0.5},
+		{"zero band", slices, []int{0, 1, 1}, &service.ProfilingData_GpuCounters_Perf{Estimate: 0, Min: 0, Max: 1}, 0},
+		{"unavailable", slices, []int{0, 1, 1}, unavailablePerf(), 0},
+		{"uncovered", []*service.ProfilingData_GpuSlices_Slice{slice(0, 30, 10)}, []int{0, 0, 0}, perf(2), 0},
+	} {
+		assert.For(ctx, test.name).ThatFloat(attributionConfidence(test.slices, c, test.concurrency, test.perf)).Equals(test.expected, 1e-9)
+	}
+}
+
+func TestDensityConfidence(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 1, 0), group(3, 1, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 300), slice(1, 300, 30), slice(2, 330, 20), slice(3, 350, 30)},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 100, 200, 300, 400}, []float64{0, 1, 1, 1, 1}),
+	}
+	options := &Options{DensityConfidence: true}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	for _, test := range []struct {
+		command  []uint64
+		expected float64
+	}{
+		{[]uint64{0, 0}, 1},
+		// Shorter than the sampling period.
+		{[]uint64{0, 1}, 0.3},
+		{[]uint64{1, 0}, 0.2},
+		// The parent commands sum the sampling periods of their leaves.
+		{[]uint64{0}, 1},
+		{[]uint64{1}, 0.5},
+	} {
+		assert.For(ctx, "%v", test.command).ThatFloat(findEntry(res, test.command...).DensityConfidence).Equals(test.expected, 1e-9)
+	}
+
+	// The least densely sampled counter decides.
+	counters = append(counters, counter("Slow", []uint64{0, 400}, []float64{0, 1}))
+	res, err = ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "slow").ThatFloat(findEntry(res, 0, 0).DensityConfidence).Equals(0.75, 1e-9)
+	assert.For(ctx, "slow short").ThatFloat(findEntry(res, 0, 1).DensityConfidence).Equals(30/400.0, 1e-9)
+
+	res, err = ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "not requested").ThatFloat(findEntry(res, 0, 1).DensityConfidence).Equals(0, 0)
+}
+
+func TestSamplingPeriod(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Busy", []uint64{0, 10, 30, 40, 40, 140, 150}, []float64{0, 1, 1, 1, 1, 1, 1})
+	assert.For(ctx, "median").That(samplingPeriod(c)).Equals(uint64(10))
+	c.InvalidSamples = []bool{false, true, true, true, true, false, true}
+	assert.For(ctx, "valid").That(samplingPeriod(c)).Equals(uint64(100))
+	assert.For(ctx, "empty").That(samplingPeriod(counter("Empty", nil, nil))).Equals(uint64(0))
+}
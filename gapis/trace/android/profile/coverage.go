@@ -0,0 +1,81 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"github.com/google/gapid/core/math/u64"
+	"github.com/google/gapid/gapis/service"
+)
+
+// Return the fraction, in [0, 1], of the duration of the slices covered by
+// valid samples of the counter, 0 if the slices have no duration. Like the GPU
+// time, the overlapping slices each count.
+func sampleCoverage(slices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter) float64 {
+	duration, covered := uint64(0), uint64(0)
+	for _, slice := range slices {
+		duration += slice.Dur
+		sStart, sEnd := slice.Ts, slice.Ts+slice.Dur
+		for i := 1; i < len(counter.Timestamps); i++ {
+			cStart, cEnd := counter.Timestamps[i-1], counter.Timestamps[i]
+			if cEnd <= sStart || !validSample(counter, i) { // Sample earlier than GPU slice's span, or not trusted.
+				continue
+			} else if cStart >= sEnd { // Sample later than GPU slice's span.
+				break
+			}
+			covered += u64.Min(cEnd, sEnd) - u64.Max(cStart, sStart)
+		}
+	}
+	if duration == 0 {
+		return 0
+	}
+	return float64(covered) / float64(duration)
+}
+
+// Set the coverage of the metric of the entry.
+func setCoverage(entry *service.ProfilingData_GpuCounters_Entry, metricId int32, coverage float64) {
+	if entry.MetricToCoverage == nil {
+		entry.MetricToCoverage = map[int32]float64{}
+	}
+	entry.MetricToCoverage[metricId] = coverage
+}
+
+// Set the coverages of a merged command entry, the mean of the ones of its
+// leaf groups weighted by their GPU time, the fraction of the GPU time of the
+// command covered by samples.
+func setMergedCoverage(mergedEntry *service.ProfilingData_GpuCounters_Entry, leaves []int32, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry) {
+	means := map[int32]*weightedMean{}
+	for _, id := range leaves {
+		leaf := groupToEntry[id]
+		weight := 0.0
+		if perf, ok := leaf.MetricToValue[gpuTimeMetricId]; ok {
+			weight = perf.Estimate
+		}
+		for metricId, coverage := range leaf.MetricToCoverage {
+			mean, ok := means[metricId]
+			if !ok {
+				mean = &weightedMean{}
+				means[metricId] = mean
+			}
+			mean.add(coverage, weight)
+		}
+	}
+	if len(means) == 0 {
+		return
+	}
+	mergedEntry.MetricToCoverage = make(map[int32]float64, len(means))
+	for metricId, mean := range means {
+		mergedEntry.MetricToCoverage[metricId] = mean.mean
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestCoverage(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 5, 10), slice(1, 25, 20)},
+	}
+	busy := counter("Busy", []uint64{0, 10, 20, 30, 40}, []float64{0, 2, 4, 6, 8})
+	busy.InvalidSamples = []bool{false, true, false, false, false}
+	counters := []*service.ProfilingData_Counter{busy}
+
+	res, err := ComputeCounters(ctx, slices, counters, &Options{Coverage: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	for _, test := range []struct {
+		indices  []uint64
+		expected float64
+	}{
+		// Half of the first slice is covered by the invalid sample only.
+		{[]uint64{0, 0}, 0.5},
+		// The samples stop before the end of the second slice.
+		{[]uint64{0, 1}, 0.75},
+		// The parent command merges the coverages by GPU time.
+		{[]uint64{0}, (0.5*10 + 0.75*20) / 30},
+	} {
+		entry := findEntry(res, test.indices...)
+		assert.For(ctx, "%v", test.indices).ThatFloat(entry.MetricToCoverage[counterMetricIdOffset]).Equals(test.expected, 1e-9)
+		// The time metrics have no coverage.
+		assert.For(ctx, "%v metrics", test.indices).ThatMap(entry.MetricToCoverage).IsLength(1)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+// counterIdentity identifies a counter across the producers reporting it,
+// such as a vendor producer and the generic GPU counters data source: the id
+// of its descriptor spec, 0 if it has none, its name, its unit and its GPU.
+type counterIdentity struct {
+	specId uint32
+	name   string
+	unit   string
+	gpuId  int32
+}
+
+func identify(counter *service.ProfilingData_Counter, options *Options) counterIdentity {
+	id := counterIdentity{name: counter.Name, unit: counter.Unit, gpuId: counter.GpuId}
+	if spec := counterSpec(counter, options); spec != nil {
+		id.specId = spec.CounterId
+	}
+	return id
+}
+
+// Return the counters with each counter reported by several producers only
+// once, at the position of its first report, and the number of duplicates
+// merged. The samples of a counter are the ones of the report with the most
+// samples, completed with the samples of the other reports out of its span.
+// The samples overlapping its span are dropped, their intervals not matching
+// its ones, and the intervals covered by no report are invalid samples. The
+// counters are returned as is if there is no duplicate.
+func dedupCounters(counters []*service.ProfilingData_Counter, options *Options) ([]*service.ProfilingData_Counter, int) {
+	reports := map[counterIdentity][]*service.ProfilingData_Counter{}
+	order := []counterIdentity{}
+	for _, counter := range counters {
+		id := identify(counter, options)
+		if _, ok := reports[id]; !ok {
+			order = append(order, id)
+		}
+		reports[id] = append(reports[id], counter)
+	}
+	if len(order) == len(counters) {
+		return counters, 0
+	}
+	res := make([]*service.ProfilingData_Counter, len(order))
+	for i, id := range order {
+		res[i] = mergeReports(reports[id])
+	}
+	return res, len(counters) - len(order)
+}
+
+// Merge the reports of the same counter, see dedupCounters.
+func mergeReports(reports []*service.ProfilingData_Counter) *service.ProfilingData_Counter {
+	primary := reports[0]
+	for _, report := range reports[1:] {
+		if len(report.Timestamps) > len(primary.Timestamps) {
+			primary = report
+		}
+	}
+	if len(primary.Timestamps) == 0 || len(primary.Timestamps) != len(primary.Values) {
+		return primary
+	}
+	type sample struct {
+		start, end uint64
+		value      float64
+		valid      bool
+	}
+	start, end := primary.Timestamps[0], primary.Timestamps[len(primary.Timestamps)-1]
+	samples := []sample{}
+	for _, report := range reports {
+		if report == primary || len(report.Timestamps) != len(report.Values) {
+			continue
+		}
+		for i := 1; i < len(report.Timestamps); i++ {
+			if s, e := report.Timestamps[i-1], report.Timestamps[i]; e <= start || s >= end {
+				samples = append(samples, sample{s, e, report.Values[i], validSample(report, i)})
+			}
+		}
+	}
+	if len(samples) == 0 {
+		return primary
+	}
+	for i := 1; i < len(primary.Timestamps); i++ {
+		samples = append(samples, sample{primary.Timestamps[i-1], primary.Timestamps[i], primary.Values[i], validSample(primary, i)})
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].start < samples[j].start })
+
+	res := withSamples(primary, nil, nil, nil)
+	for _, report := range reports {
+		res.Default = res.Default || report.Default
+		if res.Description == "" {
+			res.Description = report.Description
+		}
+	}
+	add := func(ts uint64, value float64, invalid bool) {
+		res.Timestamps = append(res.Timestamps, ts)
+		res.Values = append(res.Values, value)
+		res.InvalidSamples = append(res.InvalidSamples, invalid)
+	}
+	for _, s := range samples {
+		last := len(res.Timestamps) - 1
+		switch {
+		case last >= 0 && s.start < res.Timestamps[last]:
+			continue // Overlaps a sample of another report.
+		case last < 0 || s.start != res.Timestamps[last]:
+			// The interval up to the start of the sample isn't covered.
+			add(s.start, 0, true)
+		}
+		add(s.end, s.value, !s.valid)
+	}
+	return res
+}
+
+// Log the duplicate counters merged by dedupCounters.
+func logDuplicates(ctx context.Context, duplicates int) {
+	if duplicates != 0 {
+		log.I(ctx, "%v duplicate counter reports merged", duplicates)
+	}
+}
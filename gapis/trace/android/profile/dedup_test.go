@@ -0,0 +1,63 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestDedupCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	vendor := counter("Busy", []uint64{10, 20, 30, 40, 45, 50}, []float64{0, 1, 2, 3, 4, 5})
+	generic := counter("Busy", []uint64{0, 5, 10, 35, 55, 60}, []float64{0, 7, 8, 9, 10, 11})
+	generic.Description = "From the generic producer"
+	other := counter("Idle", []uint64{0, 10}, []float64{0, 1})
+	otherUnit := counter("Busy", []uint64{0, 10}, []float64{0, 1})
+	otherUnit.Unit = "22"
+
+	unique := []*service.ProfilingData_Counter{vendor, other, otherUnit}
+	res, duplicates := dedupCounters(unique, &Options{})
+	assert.For(ctx, "unique").That(res).DeepEquals(unique)
+	assert.For(ctx, "no duplicates").That(duplicates).Equals(0)
+
+	res, duplicates = dedupCounters([]*service.ProfilingData_Counter{vendor, other, generic}, &Options{})
+	assert.For(ctx, "duplicates").That(duplicates).Equals(1)
+	assert.For(ctx, "order").That([]string{res[0].Name, res[1].Name}).DeepEquals([]string{"Busy", "Idle"})
+	merged := res[0]
+	// The vendor report comes first with as many samples. The generic samples
+	// out of its span complete it, the ones overlapping it are dropped, and
+	// the interval covered by none is invalid.
+	assert.For(ctx, "timestamps").That(merged.Timestamps).DeepEquals([]uint64{0, 5, 10, 20, 30, 40, 45, 50, 55, 60})
+	assert.For(ctx, "values").That(merged.Values).DeepEquals([]float64{0, 7, 8, 1, 2, 3, 4, 5, 0, 11})
+	assert.For(ctx, "invalid").That(merged.InvalidSamples).DeepEquals([]bool{true, false, false, false, false, false, false, false, true, false})
+	assert.For(ctx, "description").That(merged.Description).Equals("From the generic producer")
+}
+
+func TestDuplicateCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	duplicate := counter("Busy", []uint64{0, 20, 40}, []float64{0, 100, 100})
+	res, err := ComputeCounters(ctx, slices, append(counters, duplicate), nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	plain, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "metrics").That(res.Metrics).DeepEquals(plain.Metrics)
+	assert.For(ctx, "catalog").That(MetricCatalog(append(counters, duplicate), nil)).DeepEquals(plain.Metrics)
+	assertSameEntries(ctx, "entries", res, plain)
+}
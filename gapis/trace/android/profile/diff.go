@@ -0,0 +1,99 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"github.com/google/gapid/gapis/service"
+)
+
+// DiffCounters returns the differences of the performance of the commands of
+// two results, such as of two captures or of two replays of a capture. The
+// commands are matched by index and GPU, not by name, so that a command added
+// or removed in other shifts the commands after it, see ProfileDiff. The
+// metrics are matched by name, the metrics of the diff being the ones of base
+// also in other, with their ids in base. The commands are listed in the order of the entries of base, and the
+// values unavailable in either result left out. A change is significant if
+// the bounds of the two values don't overlap, the change exceeding the
+// uncertainty of the attribution.
+func DiffCounters(base, other *service.ProfilingData_GpuCounters) *service.ProfileDiff {
+	otherMetrics := make(map[string]int32, len(other.Metrics))
+	for _, metric := range other.Metrics {
+		if _, ok := otherMetrics[metric.Name]; !ok {
+			otherMetrics[metric.Name] = metric.Id
+		}
+	}
+	res := &service.ProfileDiff{}
+	ids := map[int32]int32{} // The ids of the metrics in other, by id in base.
+	for _, metric := range base.Metrics {
+		if id, ok := otherMetrics[metric.Name]; ok {
+			res.Metrics = append(res.Metrics, metric)
+			ids[metric.Id] = id
+		}
+	}
+
+	type key struct {
+		index string
+		gpu   int32
+	}
+	otherEntries := make(map[key]*service.ProfilingData_GpuCounters_Entry, len(other.Entries))
+	for _, entry := range other.Entries {
+		otherEntries[key{encodeIndex(entry.CommandIndex), entry.GpuId}] = entry
+	}
+	matched := map[key]bool{} // The entries of other matched, once each.
+	for _, entry := range base.Entries {
+		k := key{encodeIndex(entry.CommandIndex), entry.GpuId}
+		otherEntry, ok := otherEntries[k]
+		if !ok {
+			res.BaseOnly++
+			continue
+		}
+		matched[k] = true
+		command := &service.CommandDiff{
+			CommandIndex: entry.CommandIndex,
+			GpuId:        entry.GpuId,
+			MetricToDiff: map[int32]*service.MetricDiff{},
+		}
+		for _, metric := range res.Metrics {
+			a, ok := entry.MetricToValue[metric.Id]
+			if !ok || isUnavailable(a) {
+				continue
+			}
+			b, ok := otherEntry.MetricToValue[ids[metric.Id]]
+			if !ok || isUnavailable(b) {
+				continue
+			}
+			command.MetricToDiff[metric.Id] = diffPerf(a, b)
+		}
+		res.Commands = append(res.Commands, command)
+	}
+	if otherOnly := len(other.Entries) - len(matched); otherOnly > 0 {
+		res.OtherOnly = uint32(otherOnly)
+	}
+	return res
+}
+
+// Return the difference from the base performance to the other one.
+func diffPerf(base, other *service.ProfilingData_GpuCounters_Perf) *service.MetricDiff {
+	diff := &service.MetricDiff{
+		Base:        base.Estimate,
+		Other:       other.Estimate,
+		Delta:       other.Estimate - base.Estimate,
+		Significant: other.Min > base.Max || other.Max < base.Min,
+	}
+	if base.Estimate != 0 {
+		diff.Percent = 100 * diff.Delta / base.Estimate
+	}
+	return diff
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestDiffCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	base, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	// The second command takes twice as long, and a third one is added.
+	slices.Slices[1].Dur = 20
+	slices.Groups = append(slices.Groups, group(2, 1))
+	slices.Slices = append(slices.Slices, slice(2, 50, 5))
+	other, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	// The same result has no change.
+	for _, command := range DiffCounters(base, base).Commands {
+		for id, d := range command.MetricToDiff {
+			assert.For(ctx, "self %v", id).ThatFloat(d.Delta).Equals(0, 0)
+			assert.For(ctx, "self %v", id).That(d.Significant).Equals(false)
+		}
+	}
+
+	diff := DiffCounters(base, other)
+	assert.For(ctx, "metrics").ThatSlice(diff.Metrics).IsLength(len(base.Metrics))
+	assert.For(ctx, "commands").ThatSlice(diff.Commands).IsLength(len(base.Entries))
+	assert.For(ctx, "base only").That(diff.BaseOnly).Equals(uint32(0))
+	assert.For(ctx, "other only").That(diff.OtherOnly).Equals(uint32(1))
+	commands := map[string]*service.CommandDiff{}
+	for _, command := range diff.Commands {
+		commands[encodeIndex(command.CommandIndex)] = command
+	}
+	assert.For(ctx, "slower").That(commands["0,1"].MetricToDiff[gpuTimeMetricId]).DeepEquals(&service.MetricDiff{
+		Base: 10, Other: 20, Delta: 10, Percent: 100, Significant: true,
+	})
+	assert.For(ctx, "same").That(commands["0,0"].MetricToDiff[gpuTimeMetricId]).DeepEquals(&service.MetricDiff{
+		Base: 10, Other: 10,
+	})
+
+	// The metrics are matched by name.
+	renamed := *other
+	renamed.Metrics = []*service.ProfilingData_GpuCounters_Metric{{Id: gpuTimeMetricId, Name: "Renamed"}}
+	assert.For(ctx, "no metric").ThatSlice(DiffCounters(base, &renamed).Metrics).IsEmpty()
+
+	// An entry of other matched by several entries of base is counted once.
+	duplicated := *base
+	duplicated.Entries = append(append([]*service.ProfilingData_GpuCounters_Entry{}, base.Entries...), base.Entries...)
+	fewer := *other
+	fewer.Entries = other.Entries[:1]
+	diff = DiffCounters(&duplicated, &fewer)
+	assert.For(ctx, "duplicated commands").ThatSlice(diff.Commands).IsLength(2)
+	assert.For(ctx, "duplicated other only").That(diff.OtherOnly).Equals(uint32(0))
+}
+
+func TestDiffPerfBounds(t *testing.T) {
+	ctx := log.Testing(t)
+	base := &service.ProfilingData_GpuCounters_Perf{Estimate: 10, Min: 8, Max: 12}
+	overlapping := &service.ProfilingData_GpuCounters_Perf{Estimate: 13, Min: 11, Max: 15}
+	assert.For(ctx, "overlapping").That(diffPerf(base, overlapping).Significant).Equals(false)
+	lower := &service.ProfilingData_GpuCounters_Perf{Estimate: 5, Min: 4, Max: 7}
+	d := diffPerf(base, lower)
+	assert.For(ctx, "lower").That(d.Significant).Equals(true)
+	assert.For(ctx, "percent").ThatFloat(d.Percent).Equals(-50, 1e-9)
+	assert.For(ctx, "zero base").ThatFloat(diffPerf(perf(0), perf(3)).Percent).Equals(0, 0)
+}
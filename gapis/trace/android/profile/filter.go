@@ -0,0 +1,104 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"regexp"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// SliceFilter selects the GPU slices taken into account at all, such as to
+// leave out the vsync markers or the compositor work. Unlike the slices of
+// the groups left out of ComputeCommandCounters, the filtered out slices
+// don't count in the concurrency of the counter samples either. The zero
+// value keeps all the slices.
+type SliceFilter struct {
+	// TrackNames keeps only the slices on the tracks with those names. The
+	// slices on all the tracks are kept if empty.
+	TrackNames []string
+	// ExcludedLabels is a regular expression, the slices whose label it
+	// matches are left out. No slice is left out by label if empty.
+	ExcludedLabels string
+	// Start and End keep only the slices overlapping [Start, End), in
+	// nanoseconds. The range is unbounded on the side set to 0.
+	Start, End uint64
+	// Command keeps only the slices of the groups linked to the command or
+	// to its subcommands. The slices of all the groups are kept if nil.
+	Command []uint64
+}
+
+// Return the function telling whether a slice is kept by the filter, given
+// the tracks and groups of the slices, or an error if the filter is invalid.
+func (f SliceFilter) matcher(slices *service.ProfilingData_GpuSlices) (func(*service.ProfilingData_GpuSlices_Slice) bool, error) {
+	var excluded *regexp.Regexp
+	if f.ExcludedLabels != "" {
+		var err error
+		if excluded, err = regexp.Compile(f.ExcludedLabels); err != nil {
+			return nil, err
+		}
+	}
+	var tracks map[int32]bool
+	if len(f.TrackNames) != 0 {
+		names := make(map[string]bool, len(f.TrackNames))
+		for _, name := range f.TrackNames {
+			names[name] = true
+		}
+		tracks = map[int32]bool{}
+		for _, track := range slices.Tracks {
+			if names[track.Name] {
+				tracks[track.Id] = true
+			}
+		}
+	}
+	var groups map[int32]bool
+	if f.Command != nil {
+		groups = map[int32]bool{}
+		for _, group := range slices.Groups {
+			if inSubtree(group.Link.Indices, f.Command) {
+				groups[group.Id] = true
+			}
+		}
+	}
+	return func(slice *service.ProfilingData_GpuSlices_Slice) bool {
+		switch {
+		case tracks != nil && !tracks[slice.TrackId]:
+			return false
+		case excluded != nil && excluded.MatchString(slice.Label):
+			return false
+		case f.Start != 0 && slice.Ts+slice.Dur <= f.Start:
+			return false
+		case f.End != 0 && slice.Ts >= f.End:
+			return false
+		case groups != nil && !groups[slice.GroupId]:
+			return false
+		}
+		return true
+	}, nil
+}
+
+// Return whether the command index is the one of the command, or of one of
+// its subcommands.
+func inSubtree(indices, command []uint64) bool {
+	if len(indices) < len(command) {
+		return false
+	}
+	for i, v := range command {
+		if indices[i] != v {
+			return false
+		}
+	}
+	return true
+}
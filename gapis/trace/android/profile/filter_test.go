@@ -0,0 +1,88 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestSliceFilter(t *testing.T) {
+	ctx := log.Testing(t)
+	labeled := func(s *service.ProfilingData_GpuSlices_Slice, label string, trackId int32) *service.ProfilingData_GpuSlices_Slice {
+		s.Label, s.TrackId = label, trackId
+		return s
+	}
+	slices := &service.ProfilingData_GpuSlices{
+		Tracks: []*service.ProfilingData_GpuSlices_Track{{Id: 0, Name: "GPU Queue 0"}, {Id: 1, Name: "Compositor"}},
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			labeled(slice(0, 0, 10), "Render", 0),
+			labeled(slice(1, 20, 10), "Render", 0),
+			labeled(slice(1, 40, 10), "VSync", 0),
+			labeled(slice(2, 0, 50), "Compose", 1),
+		},
+	}
+	for _, test := range []struct {
+		name   string
+		filter SliceFilter
+		kept   []int
+	}{
+		{"none", SliceFilter{}, []int{0, 1, 2, 3}},
+		{"tracks", SliceFilter{TrackNames: []string{"GPU Queue 0"}}, []int{0, 1, 2}},
+		{"labels", SliceFilter{ExcludedLabels: "^V[Ss]ync$"}, []int{0, 1, 3}},
+		{"range", SliceFilter{Start: 10, End: 40}, []int{1, 3}},
+		{"command", SliceFilter{Command: []uint64{0}}, []int{0, 1, 2}},
+		{"subcommand", SliceFilter{Command: []uint64{0, 1}}, []int{1, 2}},
+	} {
+		keep, err := test.filter.matcher(slices)
+		assert.For(ctx, "%v err", test.name).ThatError(err).Succeeded()
+		kept := []int{}
+		for i, slice := range slices.Slices {
+			if keep(slice) {
+				kept = append(kept, i)
+			}
+		}
+		assert.For(ctx, "%v kept", test.name).That(kept).DeepEquals(test.kept)
+	}
+}
+
+func TestFilteredConcurrency(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0), group(1, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 100), slice(1, 0, 100)},
+	}
+	slices.Slices[1].Label = "VSync"
+	counters := []*service.ProfilingData_Counter{counter("Fragments", []uint64{0, 100}, []float64{0, 60})}
+	options := &Options{SummedCounters: []string{"Fragments"}}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "shared").ThatFloat(findEntry(res, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(30, 1e-9)
+
+	// The filtered out marker no longer takes half of the sample.
+	options.SliceFilter.ExcludedLabels = "VSync"
+	res, err = ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "filtered").ThatFloat(findEntry(res, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(60, 1e-9)
+	assert.For(ctx, "marker").That(findEntry(res, 1)).IsNil()
+
+	options.SliceFilter.ExcludedLabels = "("
+	_, err = ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "invalid").ThatError(err).Failed()
+}
@@ -0,0 +1,337 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// DerivedMetric is a metric computed, for each command, from the values of
+// other metrics by a formula, such as a read bandwidth from the bus reads and
+// the GPU time. Like the ratios, it is recomputed from the merged operands of
+// every command rather than merged from the leaf groups.
+//
+// The formula is an arithmetic expression of numbers, the + - * / operators,
+// parentheses and metric names between braces, such as
+//
+//	{Bus Reads} * 16 / {GPU Time}
+//
+// The metrics are found by name, or by counter name for the counter metrics.
+// A derived metric may refer to the derived metrics defined before it, but
+// not to the ratio metrics.
+type DerivedMetric struct {
+	Name    string
+	Unit    string
+	Formula string
+	// Polarity is the polarity of the metric unless overridden by
+	// Options.MetricPolarities.
+	Polarity service.ProfilingData_GpuCounters_Metric_Polarity
+}
+
+// vendorDerivedMetrics maps the vendors to the derived metrics of their GPU
+// families, see RegisterDerivedMetrics.
+var vendorDerivedMetrics = map[string][]DerivedMetric{}
+
+// RegisterDerivedMetrics registers the derived metrics computed for the
+// vendor's GPUs, see Options.Vendor, before the ones of the options. It is
+// illegal to register the same vendor twice.
+func RegisterDerivedMetrics(vendor string, metrics []DerivedMetric) {
+	if _, found := vendorDerivedMetrics[vendor]; found {
+		panic(fmt.Errorf("Derived metrics for vendor %v already registered", vendor))
+	}
+	vendorDerivedMetrics[vendor] = metrics
+}
+
+// Return the derived metrics computed with the options from the metrics: the
+// frequency metrics first, see frequencyMetrics, then the vendor's.
+func derivedMetrics(metrics []*service.ProfilingData_GpuCounters_Metric, options *Options) []DerivedMetric {
+	frequency, vendor := frequencyMetrics(metrics, options), vendorDerivedMetrics[options.Vendor]
+	if len(frequency)+len(vendor) == 0 {
+		return options.DerivedMetrics
+	}
+	return append(append(frequency, vendor...), options.DerivedMetrics...)
+}
+
+// Create the metadata of the i-th derived metric. Those metrics come right
+// before the ratio metrics, but their ids come after all the others.
+func derivedMetric(i int, derived DerivedMetric, ids *metricIds, options *Options) *service.ProfilingData_GpuCounters_Metric {
+	metric := &service.ProfilingData_GpuCounters_Metric{
+		Id:       ids.derived + int32(i),
+		Name:     derived.Name,
+		Unit:     derived.Unit,
+		Op:       service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		Polarity: metricPolarity(options, derived.Polarity, derived.Name),
+	}
+	metric.Category = metricCategory(metric, nil, options)
+	return metric
+}
+
+// Return the metadata of all the derived metrics of the options, computed from
+// the metrics.
+func derivedMetricList(metrics []*service.ProfilingData_GpuCounters_Metric, ids *metricIds, options *Options) []*service.ProfilingData_GpuCounters_Metric {
+	derived := derivedMetrics(metrics, options)
+	list := make([]*service.ProfilingData_GpuCounters_Metric, len(derived))
+	for i, d := range derived {
+		list[i] = derivedMetric(i, d, ids, options)
+	}
+	return list
+}
+
+// derivedFormula is a resolved derived metric: its id and its formula, whose
+// operands are metric ids. The formula is nil if it couldn't be resolved, the
+// metric being then unavailable.
+type derivedFormula struct {
+	id      int32
+	formula formula
+}
+
+// Parse the formulas of the derived metrics of the options, and resolve their
+// operands among the metrics, the ratio and derived metrics aside, the ids of
+// the derived metrics being the ones of their layout. The derived metrics
+// whose formula is invalid or refers to unknown metrics are reported
+// unavailable.
+func resolveDerived(ctx context.Context, metrics []*service.ProfilingData_GpuCounters_Metric, layout *metricIds, options *Options) []derivedFormula {
+	derived := derivedMetrics(metrics, options)
+	if len(derived) == 0 {
+		return nil
+	}
+	ids := map[string]int32{}
+	for _, metric := range metrics {
+		if _, ok := ids[metric.Name]; !ok && !layout.computed(metric.Id) {
+			ids[metric.Name] = metric.Id
+		}
+	}
+	for _, metric := range metrics {
+		if _, ok := ids[metric.CounterName]; !ok && metric.CounterName != "" && !layout.computed(metric.Id) {
+			ids[metric.CounterName] = metric.Id
+		}
+	}
+	formulas := make([]derivedFormula, len(derived))
+	for i, d := range derived {
+		formulas[i].id = layout.derived + int32(i)
+		f, err := parseFormula(d.Formula, ids)
+		if err != nil {
+			warn(ctx, service.ProfilingData_GpuCounters_Warning_InvalidFormula, d.Name, "Derived metric %v of invalid formula %v: %v", d.Name, d.Formula, err)
+		} else {
+			formulas[i].formula = f
+		}
+		if _, ok := ids[d.Name]; !ok {
+			ids[d.Name] = formulas[i].id
+		}
+	}
+	return formulas
+}
+
+// Calculate the derived metrics of the entry from its other metrics, in their
+// definition order.
+func setDerivedMetrics(formulas []derivedFormula, entry *service.ProfilingData_GpuCounters_Entry) {
+	for _, f := range formulas {
+		if f.formula == nil {
+			entry.MetricToValue[f.id] = unavailablePerf()
+			continue
+		}
+		entry.MetricToValue[f.id] = f.formula.eval(entry)
+	}
+}
+
+// formula is a node of a parsed derived metric formula.
+type formula interface {
+	// eval returns the value of the formula for the entry, unavailable if
+	// any of its operands is.
+	eval(entry *service.ProfilingData_GpuCounters_Entry) *service.ProfilingData_GpuCounters_Perf
+}
+
+// constant is a number of a formula.
+type constant float64
+
+func (c constant) eval(*service.ProfilingData_GpuCounters_Entry) *service.ProfilingData_GpuCounters_Perf {
+	return &service.ProfilingData_GpuCounters_Perf{Estimate: float64(c), Min: float64(c), Max: float64(c)}
+}
+
+// operand is a metric of a formula, by id.
+type operand int32
+
+func (o operand) eval(entry *service.ProfilingData_GpuCounters_Entry) *service.ProfilingData_GpuCounters_Perf {
+	if perf, ok := entry.MetricToValue[int32(o)]; ok {
+		return perf
+	}
+	return unavailablePerf()
+}
+
+// operation is a binary operation of a formula.
+type operation struct {
+	op          byte // One of + - * /.
+	left, right formula
+}
+
+// The range of the result spans the extreme results of the operands' ranges,
+// and is reduced to the estimate when dividing by a range including zero.
+func (o operation) eval(entry *service.ProfilingData_GpuCounters_Entry) *service.ProfilingData_GpuCounters_Perf {
+	a, b := o.left.eval(entry), o.right.eval(entry)
+	if isUnavailable(a) || isUnavailable(b) {
+		return unavailablePerf()
+	}
+	switch o.op {
+	case '+':
+		return &service.ProfilingData_GpuCounters_Perf{Estimate: a.Estimate + b.Estimate, Min: a.Min + b.Min, Max: a.Max + b.Max}
+	case '-':
+		return &service.ProfilingData_GpuCounters_Perf{Estimate: a.Estimate - b.Estimate, Min: a.Min - b.Max, Max: a.Max - b.Min}
+	case '*':
+		return boundedPerf(a.Estimate*b.Estimate, a.Min*b.Min, a.Min*b.Max, a.Max*b.Min, a.Max*b.Max)
+	}
+	if b.Estimate == 0 {
+		return unavailablePerf()
+	}
+	estimate := a.Estimate / b.Estimate
+	if b.Min <= 0 && b.Max >= 0 {
+		return &service.ProfilingData_GpuCounters_Perf{Estimate: estimate, Min: estimate, Max: estimate}
+	}
+	return boundedPerf(estimate, a.Min/b.Min, a.Min/b.Max, a.Max/b.Min, a.Max/b.Max)
+}
+
+// Return the performance of the estimate whose range spans the bounds.
+func boundedPerf(estimate float64, bounds ...float64) *service.ProfilingData_GpuCounters_Perf {
+	min, max := estimate, estimate
+	for _, bound := range bounds {
+		min, max = math.Min(min, bound), math.Max(max, bound)
+	}
+	return &service.ProfilingData_GpuCounters_Perf{Estimate: estimate, Min: min, Max: max}
+}
+
+// Parse the formula, resolving the metric names to their ids.
+func parseFormula(text string, ids map[string]int32) (formula, error) {
+	p := &formulaParser{text: text, ids: ids}
+	f, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpaces(); p.pos != len(p.text) {
+		return nil, fmt.Errorf("unexpected %q at offset %v", p.text[p.pos], p.pos)
+	}
+	return f, nil
+}
+
+// formulaParser is a recursive descent parser of the formulas:
+//
+//	expression = term {("+" | "-") term}
+//	term       = factor {("*" | "/") factor}
+//	factor     = number | "{" name "}" | "(" expression ")" | "-" factor
+type formulaParser struct {
+	text string
+	pos  int
+	ids  map[string]int32
+}
+
+func (p *formulaParser) skipSpaces() {
+	for p.pos < len(p.text) && p.text[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// Return the next operator, consumed, if it is one of ops.
+func (p *formulaParser) operator(ops string) (byte, bool) {
+	p.skipSpaces()
+	if p.pos < len(p.text) && strings.IndexByte(ops, p.text[p.pos]) >= 0 {
+		p.pos++
+		return p.text[p.pos-1], true
+	}
+	return 0, false
+}
+
+func (p *formulaParser) expression() (formula, error) {
+	left, err := p.term()
+	for err == nil {
+		op, ok := p.operator("+-")
+		if !ok {
+			return left, nil
+		}
+		var right formula
+		if right, err = p.term(); err == nil {
+			left = operation{op, left, right}
+		}
+	}
+	return nil, err
+}
+
+func (p *formulaParser) term() (formula, error) {
+	left, err := p.factor()
+	for err == nil {
+		op, ok := p.operator("*/")
+		if !ok {
+			return left, nil
+		}
+		var right formula
+		if right, err = p.factor(); err == nil {
+			left = operation{op, left, right}
+		}
+	}
+	return nil, err
+}
+
+func (p *formulaParser) factor() (formula, error) {
+	p.skipSpaces()
+	if p.pos == len(p.text) {
+		return nil, fmt.Errorf("unexpected end of formula")
+	}
+	switch c := p.text[p.pos]; {
+	case c == '-':
+		p.pos++
+		f, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return operation{'-', constant(0), f}, nil
+	case c == '(':
+		p.pos++
+		f, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.operator(")"); !ok {
+			return nil, fmt.Errorf("missing ) at offset %v", p.pos)
+		}
+		return f, nil
+	case c == '{':
+		end := strings.IndexByte(p.text[p.pos:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("missing } at offset %v", p.pos)
+		}
+		name := p.text[p.pos+1 : p.pos+end]
+		p.pos += end + 1
+		id, ok := p.ids[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown metric %v", name)
+		}
+		return operand(id), nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.text) && (p.text[p.pos] == '.' || (p.text[p.pos] >= '0' && p.text[p.pos] <= '9')) {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.text[start:p.pos], 64)
+		if err != nil {
+			return nil, err
+		}
+		return constant(v), nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at offset %v", c, p.pos)
+	}
+}
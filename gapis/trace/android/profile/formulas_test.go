@@ -0,0 +1,94 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestParseFormula(t *testing.T) {
+	ctx := log.Testing(t)
+	ids := map[string]int32{"Bus Reads": 1, "GPU Time": 2}
+	entry := &service.ProfilingData_GpuCounters_Entry{
+		MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{
+			1: {Estimate: 10, Min: 8, Max: 12},
+			2: {Estimate: 5, Min: 4, Max: 5},
+		},
+	}
+	for _, test := range []struct {
+		formula  string
+		expected *service.ProfilingData_GpuCounters_Perf
+	}{
+		{"{Bus Reads} * 16 / {GPU Time}", &service.ProfilingData_GpuCounters_Perf{Estimate: 32, Min: 8 * 16 / 5.0, Max: 12 * 16 / 4.0}},
+		{"1 + 2 * 3", perf(7)},
+		{"(1 + 2) * 3", perf(9)},
+		{"-{GPU Time} + 10", &service.ProfilingData_GpuCounters_Perf{Estimate: 5, Min: 5, Max: 6}},
+		{" {Bus Reads} - {GPU Time} ", &service.ProfilingData_GpuCounters_Perf{Estimate: 5, Min: 3, Max: 8}},
+		{"{Bus Reads} / ({GPU Time} - 5)", unavailablePerf()},
+		{"0.5 * {GPU Time}", &service.ProfilingData_GpuCounters_Perf{Estimate: 2.5, Min: 2, Max: 2.5}},
+	} {
+		f, err := parseFormula(test.formula, ids)
+		assert.For(ctx, "%v err", test.formula).ThatError(err).Succeeded()
+		assert.For(ctx, "%v", test.formula).That(f.eval(entry)).DeepEquals(test.expected)
+	}
+	for _, invalid := range []string{"", "1 +", "(1", "{Bus Reads", "{Unknown}", "1 2", "{GPU Time} % 2"} {
+		_, err := parseFormula(invalid, ids)
+		assert.For(ctx, "%q", invalid).ThatError(err).Failed()
+	}
+}
+
+func TestDerivedMetrics(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	RegisterDerivedMetrics("formula vendor", []DerivedMetric{
+		{Name: "Busy Time", Unit: "ns", Formula: "{Busy} * {GPU Time}"},
+	})
+	defer delete(vendorDerivedMetrics, "formula vendor")
+	options := &Options{
+		Vendor: "formula vendor",
+		DerivedMetrics: []DerivedMetric{
+			{Name: "Half Busy Time", Formula: "{Busy Time} / 2"},
+			{Name: "Broken", Formula: "{Missing} + 1"},
+		},
+		RatioMetrics: []RatioMetric{{Name: "Busy Time Ratio", Numerator: "Half Busy Time", Denominator: "GPU Time"}},
+	}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	// The ratio metrics come last, the derived metrics right before them.
+	metrics := res.Metrics
+	n := len(metrics)
+	assert.For(ctx, "ratio").That(metrics[n-1].Name).Equals("Busy Time Ratio")
+	base := newMetricIds(len(counters), options).derived
+	for i, name := range []string{"Busy Time", "Half Busy Time", "Broken"} {
+		assert.For(ctx, "name %v", i).That(metrics[n-4+i].Name).Equals(name)
+		assert.For(ctx, "id %v", i).That(metrics[n-4+i].Id).Equals(base + int32(i))
+	}
+	assert.For(ctx, "catalog").That(MetricCatalog(counters, options)).DeepEquals(metrics)
+
+	for _, indices := range [][]uint64{{0, 0}, {0, 1}, {0}} {
+		entry := findEntry(res, indices...)
+		busy := entry.MetricToValue[counterMetricIdOffset].Estimate
+		gpuTime := entry.MetricToValue[gpuTimeMetricId].Estimate
+		// The derived metrics of the parent command are recomputed from its merged values.
+		assert.For(ctx, "busy time %v", indices).ThatFloat(entry.MetricToValue[base].Estimate).Equals(busy*gpuTime, 1e-9)
+		assert.For(ctx, "half %v", indices).ThatFloat(entry.MetricToValue[base+1].Estimate).Equals(busy*gpuTime/2, 1e-9)
+		assert.For(ctx, "broken %v", indices).That(isUnavailable(entry.MetricToValue[base+2])).Equals(true)
+		assert.For(ctx, "ratio %v", indices).ThatFloat(entry.MetricToValue[metrics[n-1].Id].Estimate).Equals(busy/2, 1e-9)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// The name of the slice extra holding the id of the frame of the slice, as
+// set by the vendor profiling data.
+const frameExtraName = "frameId"
+
+// Return the frame of each group carrying one, the frameId extra of its
+// first slice at depth 0.
+func groupFrames(slices *service.ProfilingData_GpuSlices) map[int32]uint64 {
+	frames := map[int32]uint64{}
+	seen := map[int32]bool{}
+	for _, slice := range slices.Slices {
+		if slice.Depth != 0 || seen[slice.GroupId] {
+			continue
+		}
+		seen[slice.GroupId] = true
+		for _, extra := range slice.Extras {
+			if v, ok := extra.Value.(*service.ProfilingData_GpuSlices_Slice_Extra_IntValue); ok && extra.Name == frameExtraName {
+				frames[slice.GroupId] = v.IntValue
+				break
+			}
+		}
+	}
+	return frames
+}
+
+// Add the leaf entries of the groups to the leaf entries of their frames,
+// see groupFrames. The groups of no frame are left out.
+func addFrameLeaves(frameLeaves map[uint64]map[int32]*service.ProfilingData_GpuCounters_Entry, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry, frames map[int32]uint64) {
+	for groupId, entry := range groupToEntry {
+		frame, ok := frames[groupId]
+		if !ok {
+			continue
+		}
+		if frameLeaves[frame] == nil {
+			frameLeaves[frame] = map[int32]*service.ProfilingData_GpuCounters_Entry{}
+		}
+		frameLeaves[frame][groupId] = entry
+	}
+}
+
+// Return the entries of the frames, keyed by frame id, see
+// Options.FrameEntries: the leaf entries of the groups of each frame merged
+// like a command, from the leaf entries of the frames, see addFrameLeaves.
+// Nil is returned if no group has a frame.
+func frameEntries(ctx context.Context, metrics []*service.ProfilingData_GpuCounters_Metric, ids *metricIds, frameLeaves map[uint64]map[int32]*service.ProfilingData_GpuCounters_Entry, options *Options) map[uint64]*service.ProfilingData_GpuCounters_Entry {
+	if len(frameLeaves) == 0 {
+		return nil
+	}
+	res := make(map[uint64]*service.ProfilingData_GpuCounters_Entry, len(frameLeaves))
+	for frame, leaves := range frameLeaves {
+		_, res[frame] = mergeCommandTree(ctx, metrics, ids, leaves, options, true)
+	}
+	return res
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+// frameSlice builds a GPU slice of the frame of the given id.
+func frameSlice(groupId int32, ts, dur, frame uint64) *service.ProfilingData_GpuSlices_Slice {
+	s := slice(groupId, ts, dur)
+	s.Extras = []*service.ProfilingData_GpuSlices_Slice_Extra{{
+		Name:  "frameId",
+		Value: &service.ProfilingData_GpuSlices_Slice_Extra_IntValue{IntValue: frame},
+	}}
+	return s
+}
+
+func TestFrameEntries(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0), group(1, 1), group(2, 2), group(3, 3)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			frameSlice(0, 0, 10, 1),
+			frameSlice(1, 20, 10, 1),
+			frameSlice(2, 40, 20, 2),
+			slice(3, 70, 10), // Out of any frame.
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40, 50, 60, 70, 80}, []float64{0, 2, 0, 4, 0, 6, 6, 0, 8}),
+	}
+	res, err := ComputeCounters(ctx, slices, counters, &Options{FrameEntries: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "frames").ThatMap(res.FrameToEntry).IsLength(2)
+
+	first, second := res.FrameToEntry[1], res.FrameToEntry[2]
+	assert.For(ctx, "first time").ThatFloat(first.MetricToValue[gpuTimeMetricId].Estimate).Equals(20, 1e-9)
+	assert.For(ctx, "first busy").ThatFloat(first.MetricToValue[counterMetricIdOffset].Estimate).Equals(3, 1e-9)
+	// A frame of a single command has the performance of the command.
+	for _, id := range []int32{gpuTimeMetricId, gpuWallTimeMetricId, counterMetricIdOffset} {
+		assert.For(ctx, "second %v", id).That(second.MetricToValue[id]).DeepEquals(findEntry(res, 2).MetricToValue[id])
+	}
+
+	// The frames spanning several chunks are merged across them.
+	chunked, err := ComputeCounters(ctx, slices, counters, &Options{FrameEntries: true, ChunkGroups: 1})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "chunked").That(chunked.FrameToEntry).DeepEquals(res.FrameToEntry)
+}
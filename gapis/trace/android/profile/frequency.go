@@ -0,0 +1,120 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+const (
+	// GpuCyclesMetricName is the name of the derived metric counting the GPU
+	// clock cycles spent on each command, see frequencyMetrics.
+	GpuCyclesMetricName = "GPU Cycles"
+	// NormalizedGpuTimeMetricName is the name of the derived metric reporting
+	// the GPU time each command would take at the reference frequency.
+	NormalizedGpuTimeMetricName = "GPU Time (frequency normalized)"
+)
+
+// Hertz per frequency unit.
+var hertzPerUnit = map[device.GpuCounterDescriptor_MeasureUnit]float64{
+	device.GpuCounterDescriptor_HERTZ:     1,
+	device.GpuCounterDescriptor_KILOHERTZ: 1e3,
+	device.GpuCounterDescriptor_MEGAHERTZ: 1e6,
+	device.GpuCounterDescriptor_GIGAHERTZ: 1e9,
+	device.GpuCounterDescriptor_TERAHERTZ: 1e12,
+	device.GpuCounterDescriptor_PETAHERTZ: 1e15,
+}
+
+// Return the hertz per unit of the metric, and whether it is a frequency.
+func metricHertz(metric *service.ProfilingData_GpuCounters_Metric) (float64, bool) {
+	if len(metric.NumeratorUnits) != 1 || len(metric.DenominatorUnits) != 0 {
+		return 0, false
+	}
+	hz, ok := hertzPerUnit[metric.NumeratorUnits[0]]
+	return hz, ok
+}
+
+// Return the counter metric of the GPU frequency among the metrics, the one
+// of Options.FrequencyCounter or else the first counter metric in a frequency
+// unit, and its hertz per unit. The frequency counter must have known units.
+func frequencyMetric(metrics []*service.ProfilingData_GpuCounters_Metric, options *Options) (*service.ProfilingData_GpuCounters_Metric, float64, bool) {
+	for _, metric := range metrics {
+		// The counter metrics come before the other metrics of their counter.
+		if metric.CounterName == "" || options.FrequencyCounter != "" && metric.CounterName != options.FrequencyCounter {
+			continue
+		}
+		if hz, ok := metricHertz(metric); ok {
+			return metric, hz, true
+		}
+		if options.FrequencyCounter != "" {
+			break
+		}
+	}
+	return nil, 0, false
+}
+
+// Return the derived metrics normalizing the GPU time by the GPU frequency
+// if the metrics have a frequency counter: the GPU cycles of every command,
+// its GPU time multiplied by its time-weighted average frequency, and the GPU
+// time it would take at the reference frequency, Options.ReferenceFrequency
+// or else the peak value of the frequency counter. The latter is omitted if
+// there is no reference frequency. They are reported lower-is-better.
+func frequencyMetrics(metrics []*service.ProfilingData_GpuCounters_Metric, options *Options) []DerivedMetric {
+	if options.SkipFrequencyMetrics {
+		return nil
+	}
+	frequency, hz, ok := frequencyMetric(metrics, options)
+	if !ok || strings.ContainsAny(frequency.Name, "{}") {
+		return nil
+	}
+	var gpuTime *service.ProfilingData_GpuCounters_Metric
+	for _, metric := range metrics {
+		if metric.Id == gpuTimeMetricId {
+			gpuTime = metric
+		}
+	}
+	if gpuTime == nil || strings.ContainsAny(gpuTime.Name, "{}") {
+		return nil
+	}
+	ns := 1.0 // Nanoseconds per unit of the GPU time, see TimeMetricOverride.
+	if unit, err := strconv.Atoi(gpuTime.Unit); err == nil && nanosecondsPerUnit[device.GpuCounterDescriptor_MeasureUnit(unit)] != 0 {
+		ns = nanosecondsPerUnit[device.GpuCounterDescriptor_MeasureUnit(unit)]
+	}
+	number := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+
+	derived := []DerivedMetric{{
+		Name:     GpuCyclesMetricName,
+		Unit:     strconv.Itoa(int(device.GpuCounterDescriptor_NONE)),
+		Formula:  "{" + frequency.Name + "} * {" + gpuTime.Name + "} * " + number(hz*ns/1e9),
+		Polarity: service.ProfilingData_GpuCounters_Metric_LowerIsBetter,
+	}}
+	reference := options.ReferenceFrequency
+	if reference <= 0 && frequency.MaxValue > frequency.MinValue {
+		reference = frequency.MaxValue * hz
+	}
+	if reference > 0 {
+		derived = append(derived, DerivedMetric{
+			Name:     NormalizedGpuTimeMetricName,
+			Unit:     gpuTime.Unit,
+			Formula:  "{" + GpuCyclesMetricName + "} * " + number(1e9/(reference*ns)),
+			Polarity: service.ProfilingData_GpuCounters_Metric_LowerIsBetter,
+		})
+	}
+	return derived
+}
@@ -0,0 +1,87 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestFrequencyMetrics(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	// 500MHz over the first command, 250MHz over the second.
+	counters = append(counters, counter("Clock", []uint64{0, 10, 20, 30, 40}, []float64{0, 500, 500, 250, 250}))
+	descriptor := &device.GpuCounterDescriptor{Specs: []*device.GpuCounterDescriptor_GpuCounterSpec{{
+		Name:           "Clock",
+		NumeratorUnits: []device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_MEGAHERTZ},
+		PeakValue:      &device.GpuCounterDescriptor_GpuCounterSpec_IntPeakValue{IntPeakValue: 1000},
+	}}}
+	find := func(res *service.ProfilingData_GpuCounters, name string) int32 {
+		for _, metric := range res.Metrics {
+			if metric.Name == name {
+				return metric.Id
+			}
+		}
+		return -1
+	}
+
+	for _, test := range []struct {
+		name       string
+		options    *Options
+		normalized [3]float64
+	}{
+		{"peak", &Options{CounterDescriptor: descriptor}, [3]float64{5, 2.5, 7.5}},
+		{"reference", &Options{CounterDescriptor: descriptor, ReferenceFrequency: 500e6}, [3]float64{10, 5, 15}},
+		{"microseconds", &Options{
+			CounterDescriptor:   descriptor,
+			TimeMetricOverrides: map[string]TimeMetricOverride{"GPU Time": {Unit: device.GpuCounterDescriptor_MICROSECOND}},
+		}, [3]float64{5e-3, 2.5e-3, 7.5e-3}},
+	} {
+		res, err := ComputeCounters(ctx, slices, counters, test.options)
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		cyclesId, normalizedId := find(res, GpuCyclesMetricName), find(res, NormalizedGpuTimeMetricName)
+		assert.For(ctx, "%v cycles metric", test.name).That(cyclesId).NotEquals(int32(-1))
+		assert.For(ctx, "%v normalized metric", test.name).That(normalizedId).NotEquals(int32(-1))
+		for i, indices := range [][]uint64{{0, 0}, {0, 1}, {0}} {
+			entry := findEntry(res, indices...)
+			assert.For(ctx, "%v cycles %v", test.name, indices).ThatFloat(entry.MetricToValue[cyclesId].Estimate).Equals([]float64{5, 2.5, 7.5}[i], 1e-9)
+			assert.For(ctx, "%v normalized %v", test.name, indices).ThatFloat(entry.MetricToValue[normalizedId].Estimate).Equals(test.normalized[i], 1e-9)
+		}
+		assert.For(ctx, "%v catalog", test.name).That(MetricCatalog(counters, test.options)).DeepEquals(res.Metrics)
+	}
+
+	// Without a peak value nor a reference, only the cycles are known.
+	res, err := ComputeCounters(ctx, slices, counters, &Options{CounterDescriptor: &device.GpuCounterDescriptor{
+		Specs: []*device.GpuCounterDescriptor_GpuCounterSpec{{Name: "Clock", NumeratorUnits: descriptor.Specs[0].NumeratorUnits}},
+	}})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "cycles only").That(find(res, GpuCyclesMetricName)).NotEquals(int32(-1))
+	assert.For(ctx, "no normalized").That(find(res, NormalizedGpuTimeMetricName)).Equals(int32(-1))
+
+	for name, options := range map[string]*Options{
+		"no frequency": nil,
+		"skipped":      {CounterDescriptor: descriptor, SkipFrequencyMetrics: true},
+		"other":        {CounterDescriptor: descriptor, FrequencyCounter: "Busy"},
+	} {
+		res, err := ComputeCounters(ctx, slices, counters, options)
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "%v", name).That(find(res, GpuCyclesMetricName)).Equals(int32(-1))
+	}
+}
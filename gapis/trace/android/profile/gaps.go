@@ -0,0 +1,94 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"sort"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// Return a copy of the counter whose samples spanning more than threshold
+// times its sampling period are marked invalid, and the intervals of those
+// samples. Such a sample follows a gap in the timestamps, such as dropped
+// counter packets, its value being stale over most of its span. The
+// timestamps and values are shared with the original counter, which is
+// returned as is if it has no gap.
+func excludeGaps(counter *service.ProfilingData_Counter, threshold float64) (*service.ProfilingData_Counter, []interval) {
+	period := samplingPeriod(counter)
+	if period == 0 || threshold <= 0 {
+		return counter, nil
+	}
+	gaps := []interval{}
+	var invalid []bool
+	for i := 1; i < len(counter.Timestamps) && i < len(counter.Values); i++ {
+		start, end := counter.Timestamps[i-1], counter.Timestamps[i]
+		if end <= start || float64(end-start) <= threshold*float64(period) || !validSample(counter, i) {
+			continue
+		}
+		if invalid == nil {
+			invalid = make([]bool, len(counter.Values))
+			copy(invalid, counter.InvalidSamples)
+		}
+		invalid[i] = true
+		gaps = append(gaps, interval{start, end})
+	}
+	if len(gaps) == 0 {
+		return counter, nil
+	}
+	return withSamples(counter, counter.Timestamps, counter.Values, invalid), gaps
+}
+
+// Return whether any of the slices overlaps any of the gaps, sorted by start.
+func overlapsGaps(slices []*service.ProfilingData_GpuSlices_Slice, gaps []interval) bool {
+	for _, slice := range slices {
+		start, end := slice.Ts, slice.Ts+slice.Dur
+		i := sort.Search(len(gaps), func(i int) bool { return gaps[i].end > start })
+		if i < len(gaps) && gaps[i].start < end {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the gapped metrics of a merged command entry, the sorted union of the
+// ones of its leaf groups.
+func setMergedGappedMetrics(mergedEntry *service.ProfilingData_GpuCounters_Entry, leaves []int32, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry) {
+	gapped := map[int32]bool{}
+	for _, id := range leaves {
+		for _, metricId := range groupToEntry[id].GappedMetrics {
+			gapped[metricId] = true
+		}
+	}
+	if len(gapped) == 0 {
+		return
+	}
+	mergedEntry.GappedMetrics = make([]int32, 0, len(gapped))
+	for metricId := range gapped {
+		mergedEntry.GappedMetrics = append(mergedEntry.GappedMetrics, metricId)
+	}
+	sort.Slice(mergedEntry.GappedMetrics, func(i, j int) bool { return mergedEntry.GappedMetrics[i] < mergedEntry.GappedMetrics[j] })
+}
+
+// Add the metric to the sorted gapped metrics of the entry.
+func addGappedMetric(entry *service.ProfilingData_GpuCounters_Entry, metricId int32) {
+	i := sort.Search(len(entry.GappedMetrics), func(i int) bool { return entry.GappedMetrics[i] >= metricId })
+	if i < len(entry.GappedMetrics) && entry.GappedMetrics[i] == metricId {
+		return
+	}
+	entry.GappedMetrics = append(entry.GappedMetrics, 0)
+	copy(entry.GappedMetrics[i+1:], entry.GappedMetrics[i:])
+	entry.GappedMetrics[i] = metricId
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestExcludeGaps(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Busy", []uint64{0, 10, 20, 70, 80, 90}, []float64{0, 1, 1, 5, 1, 1})
+	res, gaps := excludeGaps(c, 2)
+	assert.For(ctx, "gaps").That(gaps).DeepEquals([]interval{{20, 70}})
+	assert.For(ctx, "invalid").That(res.InvalidSamples).DeepEquals([]bool{false, false, false, true, false, false})
+	assert.For(ctx, "original").That(c.InvalidSamples).IsNil()
+
+	same, gaps := excludeGaps(c, 10)
+	assert.For(ctx, "no gap").That(same).Equals(c)
+	assert.For(ctx, "no gaps").That(gaps).IsNil()
+}
+
+func TestGapThreshold(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 0, 2)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 5, 10), slice(1, 30, 30), slice(2, 65, 20)},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 70, 80, 90}, []float64{0, 1, 1, 5, 1, 1}),
+	}
+	plain, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	res, err := ComputeCounters(ctx, slices, counters, &Options{GapThreshold: 2})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	// The stale value of the sample after the gap is smeared over the third command.
+	assert.For(ctx, "smeared").That(findEntry(plain, 0, 2).MetricToValue[counterMetricIdOffset].Estimate > 1).Equals(true)
+	assert.For(ctx, "excluded").ThatFloat(findEntry(res, 0, 2).MetricToValue[counterMetricIdOffset].Estimate).Equals(1, 1e-9)
+	assert.For(ctx, "unaffected").That(findEntry(res, 0, 0).MetricToValue[counterMetricIdOffset]).DeepEquals(
+		findEntry(plain, 0, 0).MetricToValue[counterMetricIdOffset])
+
+	for _, test := range []struct {
+		indices []uint64
+		gapped  []int32
+	}{
+		{[]uint64{0, 0}, nil},
+		{[]uint64{0, 1}, []int32{counterMetricIdOffset}},
+		{[]uint64{0, 2}, []int32{counterMetricIdOffset}},
+		{[]uint64{0}, []int32{counterMetricIdOffset}},
+	} {
+		assert.For(ctx, "gapped %v", test.indices).That(findEntry(res, test.indices...).GappedMetrics).DeepEquals(test.gapped)
+		assert.For(ctx, "not detected %v", test.indices).That(findEntry(plain, test.indices...).GappedMetrics).IsNil()
+	}
+}
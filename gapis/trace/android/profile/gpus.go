@@ -0,0 +1,224 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// Return the ids of the GPUs of the slices, the GPUs of the tracks they run
+// on, and of the counters, sorted. The slices of an unknown track are on GPU
+// 0. The slices may be nil.
+func gpuIds(slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter) []int32 {
+	seen := map[int32]bool{}
+	if slices != nil {
+		trackGpus := trackGpuIds(slices)
+		for _, slice := range slices.Slices {
+			seen[trackGpus[slice.TrackId]] = true
+		}
+	}
+	for _, counter := range counters {
+		seen[counter.GpuId] = true
+	}
+	ids := make([]int32, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Return the GPU of each track of the slices.
+func trackGpuIds(slices *service.ProfilingData_GpuSlices) map[int32]int32 {
+	gpus := make(map[int32]int32, len(slices.Tracks))
+	for _, track := range slices.Tracks {
+		gpus[track.Id] = track.GpuId
+	}
+	return gpus
+}
+
+// Return the slices running on the GPU, with its tracks and all the groups,
+// the groups without slices on the GPU getting no entry.
+func gpuSlices(slices *service.ProfilingData_GpuSlices, gpu int32) *service.ProfilingData_GpuSlices {
+	trackGpus := trackGpuIds(slices)
+	res := &service.ProfilingData_GpuSlices{Groups: slices.Groups}
+	for _, track := range slices.Tracks {
+		if track.GpuId == gpu {
+			res.Tracks = append(res.Tracks, track)
+		}
+	}
+	for _, slice := range slices.Slices {
+		if trackGpus[slice.TrackId] == gpu {
+			res.Slices = append(res.Slices, slice)
+		}
+	}
+	return res
+}
+
+// Return the union of the counters of the GPUs, the first report of each
+// counter regardless of its GPU, and the counters of each GPU in the order of
+// the union, for the metrics to be the same on all the GPUs. The counters a
+// GPU doesn't report have no sample on it, their values being unavailable.
+func alignGpuCounters(counters []*service.ProfilingData_Counter, gpus []int32, options *Options) ([]*service.ProfilingData_Counter, map[int32][]*service.ProfilingData_Counter) {
+	union := []*service.ProfilingData_Counter{}
+	reports := map[counterIdentity]*service.ProfilingData_Counter{}
+	seen := map[counterIdentity]bool{} // The identities regardless of the GPU.
+	for _, counter := range counters {
+		id := identify(counter, options)
+		reports[id] = counter
+		if id.gpuId = 0; !seen[id] {
+			seen[id] = true
+			union = append(union, counter)
+		}
+	}
+	perGpu := make(map[int32][]*service.ProfilingData_Counter, len(gpus))
+	for _, gpu := range gpus {
+		aligned := make([]*service.ProfilingData_Counter, len(union))
+		for i, counter := range union {
+			id := identify(counter, options)
+			id.gpuId = gpu
+			if report, ok := reports[id]; ok {
+				aligned[i] = report
+				continue
+			}
+			aligned[i] = withSamples(counter, nil, nil, nil)
+			aligned[i].GpuId = gpu
+		}
+		perGpu[gpu] = aligned
+	}
+	return union, perGpu
+}
+
+// Compute the GPU counters of each of the GPUs separately, from the slices
+// and the counters of the GPU only, see computeSingleGpuCounters, and merge
+// the results, the entries being tagged with their GPU.
+func computeGpuCounters(ctx context.Context, slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter, gpus []int32, options *Options) (*service.ProfilingData_GpuCounters, error) {
+	_, perGpu := alignGpuCounters(counters, gpus, options)
+	res := &service.ProfilingData_GpuCounters{}
+	for _, gpu := range gpus {
+		gpuRes, err := computeSingleGpuCounters(ctx, gpuSlices(slices, gpu), perGpu[gpu], options)
+		if err != nil {
+			return nil, err
+		}
+		mergeGpuResult(ctx, res, gpuRes, gpu)
+	}
+	if options.IdleGaps > 0 {
+		sort.SliceStable(res.IdleGaps, func(i, j int) bool {
+			if res.IdleGaps[i].Dur != res.IdleGaps[j].Dur {
+				return res.IdleGaps[i].Dur > res.IdleGaps[j].Dur
+			}
+			return res.IdleGaps[i].Ts < res.IdleGaps[j].Ts
+		})
+		if len(res.IdleGaps) > options.IdleGaps {
+			res.IdleGaps = res.IdleGaps[:options.IdleGaps]
+		}
+	}
+	sortOutliers(res.Outliers)
+	return res, nil
+}
+
+// Merge the result of the GPU into the result, tagging its entries with the
+// GPU. The metrics are the same on all the GPUs. The entries keyed by group,
+// render pass, frame or label computed on several GPUs are merged from their
+// entries, see mergeGpuEntry, with a warning. The idle entry, of all the GPUs,
+// is merged without one.
+func mergeGpuResult(ctx context.Context, res, gpuRes *service.ProfilingData_GpuCounters, gpu int32) {
+	if res.Metrics == nil {
+		res.Metrics = gpuRes.Metrics
+	}
+	for _, entry := range gpuRes.Entries {
+		tagGpu(entry, gpu)
+		res.Entries = append(res.Entries, entry)
+	}
+	for groupId, entry := range gpuRes.GroupToEntry {
+		if res.GroupToEntry == nil {
+			res.GroupToEntry = map[int32]*service.ProfilingData_GpuCounters_Entry{}
+		}
+		name := fmt.Sprintf("group %v", groupId)
+		res.GroupToEntry[groupId] = mergeGpuEntry(ctx, res.Metrics, name, res.GroupToEntry[groupId], entry, gpu)
+	}
+	if gpuRes.IdleEntry != nil {
+		res.IdleEntry = mergeGpuEntry(ctx, res.Metrics, "", res.IdleEntry, gpuRes.IdleEntry, gpu)
+	}
+	merge := func(name string, to *map[uint64]*service.ProfilingData_GpuCounters_Entry, from map[uint64]*service.ProfilingData_GpuCounters_Entry) {
+		for key, entry := range from {
+			if *to == nil {
+				*to = map[uint64]*service.ProfilingData_GpuCounters_Entry{}
+			}
+			(*to)[key] = mergeGpuEntry(ctx, res.Metrics, fmt.Sprintf("%v %v", name, key), (*to)[key], entry, gpu)
+		}
+	}
+	merge("render pass", &res.RenderPassToEntry, gpuRes.RenderPassToEntry)
+	merge("frame", &res.FrameToEntry, gpuRes.FrameToEntry)
+	for label, entry := range gpuRes.LabelToEntry {
+		if res.LabelToEntry == nil {
+			res.LabelToEntry = map[string]*service.ProfilingData_GpuCounters_Entry{}
+		}
+		res.LabelToEntry[label] = mergeGpuEntry(ctx, res.Metrics, label, res.LabelToEntry[label], entry, gpu)
+	}
+	res.IdleGaps = append(res.IdleGaps, gpuRes.IdleGaps...)
+	res.Outliers = append(res.Outliers, gpuRes.Outliers...)
+}
+
+// Return the entry of the GPU tagged with it, if there is no entry of the same
+// key yet, or the entry merged from the entries of all the GPUs of the key
+// otherwise, which it holds by GPU, see Entry.gpu_to_entry. The merged entry
+// is on the first GPU of the key, and its values are the ones of the GPUs
+// merged like the leaves of a command, see mergeEntryValues. The merge is
+// warned about under the name, if any.
+func mergeGpuEntry(ctx context.Context, metrics []*service.ProfilingData_GpuCounters_Metric, name string, merged, entry *service.ProfilingData_GpuCounters_Entry, gpu int32) *service.ProfilingData_GpuCounters_Entry {
+	tagGpu(entry, gpu)
+	if merged == nil {
+		return entry
+	}
+	if name != "" {
+		warn(ctx, service.ProfilingData_GpuCounters_Warning_SeveralGpus, name, "The %v is on several GPUs, its entry is merged from theirs", name)
+	}
+	if merged.GpuToEntry == nil {
+		first := merged
+		merged = &service.ProfilingData_GpuCounters_Entry{
+			CommandIndex: first.CommandIndex,
+			GpuId:        first.GpuId,
+			GpuToEntry:   map[int32]*service.ProfilingData_GpuCounters_Entry{first.GpuId: first},
+		}
+	}
+	merged.GpuToEntry[gpu] = entry
+	gpus := make([]int32, 0, len(merged.GpuToEntry))
+	for id := range merged.GpuToEntry {
+		gpus = append(gpus, id)
+	}
+	sort.Slice(gpus, func(i, j int) bool { return gpus[i] < gpus[j] })
+	entries := make([]*service.ProfilingData_GpuCounters_Entry, len(gpus))
+	for i, id := range gpus {
+		entries[i] = merged.GpuToEntry[id]
+	}
+	merged.MetricToValue = mergeEntryValues(ctx, metrics, entries)
+	return merged
+}
+
+// Tag the entry, and its nested entries, with the GPU.
+func tagGpu(entry *service.ProfilingData_GpuCounters_Entry, gpu int32) {
+	entry.GpuId = gpu
+	for _, e := range entry.TrackToEntry {
+		tagGpu(e, gpu)
+	}
+	for _, e := range entry.StageToEntry {
+		tagGpu(e, gpu)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestMultipleGpus(t *testing.T) {
+	ctx := log.Testing(t)
+	second := slice(1, 5, 10)
+	second.TrackId = 1
+	slices := &service.ProfilingData_GpuSlices{
+		Tracks: []*service.ProfilingData_GpuSlices_Track{{Id: 0, GpuId: 0}, {Id: 1, GpuId: 1}},
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 5, 10), second},
+	}
+	busy := counter("Busy", []uint64{0, 10, 20}, []float64{0, 2, 2})
+	otherBusy := counter("Busy", []uint64{0, 10, 20}, []float64{0, 8, 8})
+	otherBusy.GpuId = 1
+	counters := []*service.ProfilingData_Counter{busy, otherBusy}
+
+	res, err := ComputeCounters(ctx, slices, counters, &Options{IncludeGroupEntries: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	// The same counter on both GPUs is a single metric.
+	assert.For(ctx, "metrics").That(res.Metrics).DeepEquals(MetricCatalog(counters, nil))
+	assert.For(ctx, "metric").That(res.Metrics[counterMetricIdOffset].Name).Equals("Busy")
+	for _, test := range []struct {
+		gpu      int32
+		indices  []uint64
+		expected float64
+	}{
+		{0, []uint64{0, 0}, 2},
+		{1, []uint64{0, 1}, 8},
+	} {
+		// The slices running at the same time on the two GPUs don't share
+		// the samples of the counters of the other.
+		var entry *service.ProfilingData_GpuCounters_Entry
+		for _, e := range res.Entries {
+			if e.GpuId == test.gpu && encodeIndex(e.CommandIndex) == encodeIndex(test.indices) {
+				entry = e
+			}
+		}
+		assert.For(ctx, "gpu %v", test.gpu).That(entry).NotEquals((*service.ProfilingData_GpuCounters_Entry)(nil))
+		assert.For(ctx, "gpu %v busy", test.gpu).ThatFloat(entry.MetricToValue[counterMetricIdOffset].Estimate).Equals(test.expected, 1e-9)
+		assert.For(ctx, "gpu %v time", test.gpu).ThatFloat(entry.MetricToValue[gpuTimeMetricId].Estimate).Equals(10, 1e-9)
+		assert.For(ctx, "gpu %v group", test.gpu).That(res.GroupToEntry[int32(test.gpu)].GpuId).Equals(test.gpu)
+
+		command, err := ComputeCommandCounters(ctx, slices, counters, test.indices, nil)
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "gpu %v command", test.gpu).That(command.GpuId).Equals(test.gpu)
+	}
+	// The parent command has an entry per GPU.
+	parents := 0
+	for _, e := range res.Entries {
+		if len(e.CommandIndex) == 1 {
+			parents++
+		}
+	}
+	assert.For(ctx, "parents").That(parents).Equals(2)
+}
+
+func TestAlignGpuCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	busy := counter("Busy", []uint64{0, 10}, []float64{0, 1})
+	idle := counter("Idle", []uint64{0, 10}, []float64{0, 1})
+	idle.GpuId = 1
+	union, perGpu := alignGpuCounters([]*service.ProfilingData_Counter{busy, idle}, []int32{0, 1}, &Options{})
+	assert.For(ctx, "union").That(union).DeepEquals([]*service.ProfilingData_Counter{busy, idle})
+	assert.For(ctx, "first").That(perGpu[0][0]).Equals(busy)
+	assert.For(ctx, "first missing").That(perGpu[0][1]).DeepEquals(&service.ProfilingData_Counter{Name: "Idle"})
+	assert.For(ctx, "second missing").That(perGpu[1][0]).DeepEquals(&service.ProfilingData_Counter{Name: "Busy", GpuId: 1})
+	assert.For(ctx, "second").That(perGpu[1][1]).Equals(idle)
+}
+
+func TestMultipleGpusKeys(t *testing.T) {
+	ctx := log.Testing(t)
+	onSecond := func(s *service.ProfilingData_GpuSlices_Slice) *service.ProfilingData_GpuSlices_Slice {
+		s.TrackId = 1
+		return s
+	}
+	// The command [0] has a subcommand on the first GPU only, and the group of
+	// [1] has slices on both GPUs.
+	slices := &service.ProfilingData_GpuSlices{
+		Tracks: []*service.ProfilingData_GpuSlices_Track{{Id: 0, GpuId: 0}, {Id: 1, GpuId: 1}},
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0), group(1, 0, 0), group(2, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(1, 0, 10),
+			onSecond(slice(0, 0, 20)),
+			slice(2, 30, 10),
+			onSecond(slice(2, 30, 10)),
+		},
+	}
+	res, err := ComputeCounters(ctx, slices, nil, &Options{IncludeGroupEntries: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	warned := false
+	for _, warning := range res.Warnings {
+		warned = warned || (warning.Kind == service.ProfilingData_GpuCounters_Warning_SeveralGpus && warning.Name == "group 2")
+	}
+	assert.For(ctx, "several gpus").That(warned).Equals(true)
+	merged := res.GroupToEntry[2]
+	assert.For(ctx, "first gpu group").That(merged.GpuId).Equals(int32(0))
+	assert.For(ctx, "merged gpu time").That(merged.MetricToValue[gpuTimeMetricId].Estimate).Equals(20.0)
+	assert.For(ctx, "gpus").That(len(merged.GpuToEntry)).Equals(2)
+	for _, gpu := range []int32{0, 1} {
+		entry := merged.GpuToEntry[gpu]
+		assert.For(ctx, "gpu entry").That(entry.GpuId).Equals(gpu)
+		assert.For(ctx, "gpu entry time").That(entry.MetricToValue[gpuTimeMetricId].Estimate).Equals(10.0)
+	}
+
+	// The command [0] is a parent on the first GPU only.
+	top, err := TopCommands(ctx, res, gpuTimeMetricId, -1)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	ranked := []string{}
+	for _, command := range top.Commands {
+		ranked = append(ranked, fmt.Sprintf("%v@%v", encodeIndex(command.Entry.CommandIndex), command.Entry.GpuId))
+	}
+	assert.For(ctx, "top").That(ranked).DeepEquals([]string{"0@1", "0,0@0", "1@0", "1@1"})
+
+	// The ranges are merged over the entries of a single GPU.
+	for _, test := range []struct {
+		gpu     int32
+		gpuTime float64
+	}{
+		{0, 10},
+		{1, 20},
+	} {
+		r, err := RangeCounters(ctx, res, test.gpu, []uint64{0}, []uint64{0}, []int32{gpuTimeMetricId})
+		assert.For(ctx, "gpu %v err", test.gpu).ThatError(err).Succeeded()
+		assert.For(ctx, "gpu %v commands", test.gpu).That(r.CommandCount).Equals(uint32(1))
+		assert.For(ctx, "gpu %v time", test.gpu).ThatFloat(r.MetricToValue[gpuTimeMetricId].Estimate).Equals(test.gpuTime, 1e-9)
+	}
+}
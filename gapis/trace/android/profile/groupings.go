@@ -0,0 +1,100 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// CommandGrouping labels a range of commands, such as the commands of the
+// shadow pass or of the UI, see Options.CommandGroupings.
+type CommandGrouping struct {
+	Label string
+	// First and Last are the indices of the first and the last commands of
+	// the range, the subcommands of Last included. An empty First starts the
+	// range at the first command, an empty Last ends it at the last one.
+	First, Last []uint64
+}
+
+// Return whether the command index is in the range of the grouping.
+func (g CommandGrouping) contains(index []uint64) bool {
+	last := index
+	if len(last) > len(g.Last) {
+		last = last[:len(g.Last)]
+	}
+	return compareIndices(index, g.First) >= 0 && compareIndices(last, g.Last) <= 0
+}
+
+// Compare the command indices in the order of the commands, a command coming
+// before its subcommands.
+func compareIndices(a, b []uint64) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// Return the labels of the groupings of each group in the range of one. The
+// groupings with an empty label are ignored, and the ones sharing a label
+// form a single grouping.
+func groupLabels(groups []*service.ProfilingData_GpuSlices_Group, groupings []CommandGrouping) map[int32][]string {
+	labels := map[int32][]string{}
+	for _, group := range groups {
+		seen := map[string]bool{}
+		for _, grouping := range groupings {
+			if grouping.Label == "" || seen[grouping.Label] || !grouping.contains(group.Link.Indices) {
+				continue
+			}
+			seen[grouping.Label] = true
+			labels[group.Id] = append(labels[group.Id], grouping.Label)
+		}
+	}
+	return labels
+}
+
+// Add the leaf entries of the groups to the leaf entries of their groupings,
+// see groupLabels.
+func addGroupingLeaves(labelLeaves map[string]map[int32]*service.ProfilingData_GpuCounters_Entry, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry, labels map[int32][]string) {
+	for groupId, entry := range groupToEntry {
+		for _, label := range labels[groupId] {
+			if labelLeaves[label] == nil {
+				labelLeaves[label] = map[int32]*service.ProfilingData_GpuCounters_Entry{}
+			}
+			labelLeaves[label][groupId] = entry
+		}
+	}
+}
+
+// Return the entries of the groupings, keyed by label, see
+// Options.CommandGroupings: the leaf entries of the groups of each grouping
+// merged like a command, from the leaf entries of the groupings, see
+// addGroupingLeaves. Nil is returned if no group is in a grouping.
+func groupingEntries(ctx context.Context, metrics []*service.ProfilingData_GpuCounters_Metric, ids *metricIds, labelLeaves map[string]map[int32]*service.ProfilingData_GpuCounters_Entry, options *Options) map[string]*service.ProfilingData_GpuCounters_Entry {
+	if len(labelLeaves) == 0 {
+		return nil
+	}
+	res := make(map[string]*service.ProfilingData_GpuCounters_Entry, len(labelLeaves))
+	for label, leaves := range labelLeaves {
+		_, res[label] = mergeCommandTree(ctx, metrics, ids, leaves, options, true)
+	}
+	return res
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestCommandGroupings(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0), group(1, 1), group(2, 1, 0), group(3, 2), group(4, 3)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10),
+			slice(1, 20, 10),
+			slice(2, 30, 10),
+			slice(3, 50, 10),
+			slice(4, 70, 10),
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40, 50, 60, 70, 80}, []float64{0, 2, 0, 4, 6, 0, 8, 0, 2}),
+	}
+	options := &Options{CommandGroupings: []CommandGrouping{
+		{Label: "shadow", First: []uint64{1}, Last: []uint64{2}},
+		{Label: "UI", First: []uint64{0}, Last: []uint64{0}},
+		{Label: "UI", First: []uint64{3}},
+		{Label: "nested", First: []uint64{1, 0}, Last: []uint64{1, 0}},
+		{First: []uint64{0}}, // Unlabelled.
+		{Label: "empty", First: []uint64{5}},
+	}}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "groupings").ThatMap(res.LabelToEntry).IsLength(3)
+
+	shadow, ui := res.LabelToEntry["shadow"], res.LabelToEntry["UI"]
+	assert.For(ctx, "shadow time").ThatFloat(shadow.MetricToValue[gpuTimeMetricId].Estimate).Equals(30, 1e-9)
+	assert.For(ctx, "shadow busy").ThatFloat(shadow.MetricToValue[counterMetricIdOffset].Estimate).Equals(6, 1e-9)
+	assert.For(ctx, "UI time").ThatFloat(ui.MetricToValue[gpuTimeMetricId].Estimate).Equals(20, 1e-9)
+	assert.For(ctx, "UI busy").ThatFloat(ui.MetricToValue[counterMetricIdOffset].Estimate).Equals(2, 1e-9)
+	// A grouping of a single command has the performance of the command.
+	for _, id := range []int32{gpuTimeMetricId, gpuWallTimeMetricId, counterMetricIdOffset} {
+		assert.For(ctx, "nested %v", id).That(res.LabelToEntry["nested"].MetricToValue[id]).DeepEquals(findEntry(res, 1, 0).MetricToValue[id])
+	}
+
+	// The groupings spanning several chunks are merged across them.
+	options.ChunkGroups = 1
+	chunked, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "chunked").That(chunked.LabelToEntry).DeepEquals(res.LabelToEntry)
+}
+
+func TestCompareIndices(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		a, b     []uint64
+		expected int
+	}{
+		{[]uint64{1}, []uint64{1}, 0},
+		{[]uint64{1}, []uint64{2}, -1},
+		{[]uint64{1}, []uint64{1, 0}, -1},
+		{[]uint64{2}, []uint64{1, 5}, 1},
+		{[]uint64{}, []uint64{0}, -1},
+	} {
+		sign := compareIndices(test.a, test.b)
+		switch {
+		case sign < 0:
+			sign = -1
+		case sign > 0:
+			sign = 1
+		}
+		assert.For(ctx, "%v vs %v", test.a, test.b).That(sign).Equals(test.expected)
+	}
+}
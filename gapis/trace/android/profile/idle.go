@@ -0,0 +1,86 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"sort"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// Return the idle gaps of the GPU queues, the tracks of the slices: the
+// periods between the busy intervals of the slices of each track, by
+// decreasing duration then increasing start time. The idle time of each
+// frame, see groupFrames, sums up the gaps between two slices of the frame. The
+// slices are expected to be sorted by start time, see sortSlices.
+func idleGaps(slices []*service.ProfilingData_GpuSlices_Slice, groups []*service.ProfilingData_GpuSlices_Group, frames map[int32]uint64) ([]*service.ProfilingData_GpuCounters_IdleGap, map[uint64]uint64) {
+	commands := make(map[int32][]uint64, len(groups))
+	for _, group := range groups {
+		commands[group.Id] = group.Link.Indices
+	}
+	type queue struct {
+		last *service.ProfilingData_GpuSlices_Slice // The slice ending the busy interval.
+		end  uint64
+	}
+	queues := map[int32]*queue{}
+	gaps := []*service.ProfilingData_GpuCounters_IdleGap{}
+	frameIdle := map[uint64]uint64{}
+	for _, slice := range slices {
+		end := slice.Ts + slice.Dur
+		q, ok := queues[slice.TrackId]
+		if !ok {
+			queues[slice.TrackId] = &queue{slice, end}
+			continue
+		}
+		if slice.Ts > q.end {
+			gap := &service.ProfilingData_GpuCounters_IdleGap{
+				TrackId:         slice.TrackId,
+				Ts:              q.end,
+				Dur:             slice.Ts - q.end,
+				PreviousCommand: commands[q.last.GroupId],
+				NextCommand:     commands[slice.GroupId],
+			}
+			gaps = append(gaps, gap)
+			previous, ok := frames[q.last.GroupId]
+			if next, found := frames[slice.GroupId]; ok && found && previous == next {
+				frameIdle[next] += gap.Dur
+			}
+		}
+		if end >= q.end {
+			q.last, q.end = slice, end
+		}
+	}
+	sort.SliceStable(gaps, func(i, j int) bool {
+		if gaps[i].Dur != gaps[j].Dur {
+			return gaps[i].Dur > gaps[j].Dur
+		}
+		return gaps[i].Ts < gaps[j].Ts
+	})
+	return gaps, frameIdle
+}
+
+// Set the longest idle gaps of the result, see Options.IdleGaps, and the idle
+// time of its frame entries. globalSlices are the attributed slices of all the
+// groups, sorted by start time.
+func setIdleGaps(res *service.ProfilingData_GpuCounters, slices *service.ProfilingData_GpuSlices, globalSlices []*service.ProfilingData_GpuSlices_Slice, options *Options) {
+	gaps, frameIdle := idleGaps(globalSlices, slices.Groups, groupFrames(slices))
+	if len(gaps) > options.IdleGaps {
+		gaps = gaps[:options.IdleGaps]
+	}
+	res.IdleGaps = gaps
+	for frame, entry := range res.FrameToEntry {
+		entry.IdleTime = frameIdle[frame]
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestIdleGaps(t *testing.T) {
+	ctx := log.Testing(t)
+	queued := func(groupId, track int32, ts, dur, frame uint64) *service.ProfilingData_GpuSlices_Slice {
+		s := frameSlice(groupId, ts, dur, frame)
+		s.TrackId = track
+		return s
+	}
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0), group(1, 1), group(2, 2), group(3, 3), group(4, 4)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			queued(0, 0, 0, 10, 1), queued(1, 0, 15, 5, 1), queued(2, 0, 40, 10, 2),
+			queued(3, 1, 5, 3, 1), queued(4, 1, 12, 18, 1),
+		},
+	}
+	res, err := ComputeCounters(ctx, slices, nil, &Options{IdleGaps: 2, FrameEntries: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "gaps").That(res.IdleGaps).DeepEquals([]*service.ProfilingData_GpuCounters_IdleGap{
+		{TrackId: 0, Ts: 20, Dur: 20, PreviousCommand: []uint64{1}, NextCommand: []uint64{2}},
+		{TrackId: 0, Ts: 10, Dur: 5, PreviousCommand: []uint64{0}, NextCommand: []uint64{1}},
+	})
+	// The gap between the frames is in neither.
+	assert.For(ctx, "first frame").That(res.FrameToEntry[1].IdleTime).Equals(uint64(9))
+	assert.For(ctx, "second frame").That(res.FrameToEntry[2].IdleTime).Equals(uint64(0))
+}
@@ -0,0 +1,212 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"hash/fnv"
+	"sort"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// metricIds is the layout of the positional metric ids of a computation, the
+// first id of each kind of metric computed from the counters. The ids are
+// allocated from a single counter, a block of consecutive ids per kind, in
+// the order of the counters or of the definitions of the options. The derived
+// metrics, whose number depends on the other metrics, take the ids after all
+// the others.
+type metricIds struct {
+	counter, nearest, pessimistic, ratio, dual, derived int32
+}
+
+// Return the layout of the ids of the metrics computed from the counters with
+// the options.
+func newMetricIds(counters int, options *Options) *metricIds {
+	next := counterMetricIdOffset
+	allocate := func(count int) int32 {
+		first := next
+		next += int32(count)
+		return first
+	}
+	return &metricIds{
+		counter:     allocate(counters),
+		nearest:     allocate(counters),
+		pessimistic: allocate(counters),
+		ratio:       allocate(len(options.RatioMetrics)),
+		dual:        allocate(counters),
+		derived:     next,
+	}
+}
+
+// Return whether the id is the one of a ratio or a derived metric, which are
+// recomputed from the other metrics rather than merged.
+func (ids *metricIds) computed(id int32) bool {
+	return id >= ids.ratio && id < ids.dual || id >= ids.derived
+}
+
+// The stable metric ids, see Options.StableMetricIds, of each kind of metric
+// span a range of 1 << stableIdBits ids, the first range being reserved for
+// the built-in time metrics. The upper half of a range holds the ids keyed by
+// name rather than by counter spec id.
+const stableIdBits = 24
+
+const (
+	counterIdRange int32 = iota + 1
+	nearestIdRange
+	pessimisticIdRange
+	dualIdRange
+	ratioIdRange
+	derivedIdRange
+)
+
+// Return the stable key of the counter within the range of a kind of metric:
+// the id of its descriptor spec, or the hash of its name if it has none.
+func counterIdKey(counter *service.ProfilingData_Counter, options *Options) uint32 {
+	if spec := counterSpec(counter, options); spec != nil && spec.CounterId < 1<<(stableIdBits-1) {
+		return spec.CounterId
+	}
+	return nameIdKey(counter.Name)
+}
+
+// Return the stable key of the metric name within the range of a kind of
+// metric, in the upper half of the range.
+func nameIdKey(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return 1<<(stableIdBits-1) | h.Sum32()&(1<<(stableIdBits-1)-1)
+}
+
+// Return the stable ids of the metrics, keyed by their positional id. The
+// built-in time metrics keep their ids. The ids of the counter metrics are
+// derived from their counter, see counterIdKey, and the ones of the ratio and
+// derived metrics from their name, in the range of their kind. The colliding
+// ids are moved to the next free id of the range, in the order of the metrics.
+func stableMetricIds(metrics []*service.ProfilingData_GpuCounters_Metric, counters []*service.ProfilingData_Counter, options *Options) map[int32]int32 {
+	layout := newMetricIds(len(counters), options)
+	ids := make(map[int32]int32, len(metrics))
+	used := make(map[int32]bool, len(metrics))
+	for _, metric := range metrics {
+		var idRange int32
+		var key uint32
+		switch id := metric.Id; {
+		case id < layout.counter:
+			ids[id] = id
+			continue
+		case id < layout.nearest:
+			idRange, key = counterIdRange, counterIdKey(counters[id-layout.counter], options)
+		case id < layout.pessimistic:
+			idRange, key = nearestIdRange, counterIdKey(counters[id-layout.nearest], options)
+		case id < layout.ratio:
+			idRange, key = pessimisticIdRange, counterIdKey(counters[id-layout.pessimistic], options)
+		case id < layout.dual:
+			idRange, key = ratioIdRange, nameIdKey(metric.Name)
+		case id < layout.derived:
+			idRange, key = dualIdRange, counterIdKey(counters[id-layout.dual], options)
+		default:
+			idRange, key = derivedIdRange, nameIdKey(metric.Name)
+		}
+		base, mask := idRange<<stableIdBits, int32(1<<stableIdBits-1)
+		id := base | int32(key)&mask
+		for used[id] {
+			id = base | (id+1)&mask
+		}
+		used[id] = true
+		ids[metric.Id] = id
+	}
+	return ids
+}
+
+// Replace the positional ids of the metrics with their stable ids.
+func remapMetrics(metrics []*service.ProfilingData_GpuCounters_Metric, ids map[int32]int32) {
+	for _, metric := range metrics {
+		metric.Id = ids[metric.Id]
+	}
+}
+
+// Replace the positional metric ids of the entry, and of its nested entries,
+// with their stable ids.
+func remapEntry(entry *service.ProfilingData_GpuCounters_Entry, ids map[int32]int32) {
+	if entry == nil {
+		return
+	}
+	remapPerfs := func(perfs map[int32]*service.ProfilingData_GpuCounters_Perf) map[int32]*service.ProfilingData_GpuCounters_Perf {
+		if perfs == nil {
+			return nil
+		}
+		res := make(map[int32]*service.ProfilingData_GpuCounters_Perf, len(perfs))
+		for id, perf := range perfs {
+			res[ids[id]] = perf
+		}
+		return res
+	}
+	remapValues := func(values map[int32]float64) map[int32]float64 {
+		if values == nil {
+			return nil
+		}
+		res := make(map[int32]float64, len(values))
+		for id, v := range values {
+			res[ids[id]] = v
+		}
+		return res
+	}
+	entry.MetricToValue = remapPerfs(entry.MetricToValue)
+	entry.MetricToPerInstanceValue = remapPerfs(entry.MetricToPerInstanceValue)
+	entry.MetricToNormalizedValue = remapValues(entry.MetricToNormalizedValue)
+	entry.MetricToConfidence = remapValues(entry.MetricToConfidence)
+	entry.MetricToCoverage = remapValues(entry.MetricToCoverage)
+	if entry.GappedMetrics != nil {
+		gapped := make([]int32, len(entry.GappedMetrics))
+		for i, id := range entry.GappedMetrics {
+			gapped[i] = ids[id]
+		}
+		sort.Slice(gapped, func(i, j int) bool { return gapped[i] < gapped[j] })
+		entry.GappedMetrics = gapped
+	}
+	for _, e := range entry.TrackToEntry {
+		remapEntry(e, ids)
+	}
+	for _, e := range entry.StageToEntry {
+		remapEntry(e, ids)
+	}
+	for _, e := range entry.GpuToEntry {
+		remapEntry(e, ids)
+	}
+}
+
+// Replace the positional metric ids of the result with their stable ids, see
+// Options.StableMetricIds.
+func remapResult(res *service.ProfilingData_GpuCounters, counters []*service.ProfilingData_Counter, options *Options) {
+	ids := stableMetricIds(res.Metrics, counters, options)
+	remapMetrics(res.Metrics, ids)
+	for _, entry := range res.Entries {
+		remapEntry(entry, ids)
+	}
+	for _, entry := range res.GroupToEntry {
+		remapEntry(entry, ids)
+	}
+	remapEntry(res.IdleEntry, ids)
+	for _, entry := range res.RenderPassToEntry {
+		remapEntry(entry, ids)
+	}
+	for _, entry := range res.FrameToEntry {
+		remapEntry(entry, ids)
+	}
+	for _, entry := range res.LabelToEntry {
+		remapEntry(entry, ids)
+	}
+	for _, outlier := range res.Outliers {
+		outlier.MetricId = ids[outlier.MetricId]
+	}
+}
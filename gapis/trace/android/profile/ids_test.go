@@ -0,0 +1,89 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestStableMetricIds(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, _ := twoCommandsFixture()
+	ts := []uint64{0, 10, 20, 30, 40}
+	busy := counter("Busy", ts, []float64{0, 2, 4, 6, 8})
+	reads := counter("Reads", ts, []float64{0, 1, 1, 1, 1})
+	writes := counter("Writes", ts, []float64{0, 3, 3, 3, 3})
+	options := func() *Options {
+		return &Options{
+			StableMetricIds:    true,
+			PessimisticMetrics: true,
+			CounterDescriptor: &device.GpuCounterDescriptor{Specs: []*device.GpuCounterDescriptor_GpuCounterSpec{
+				{CounterId: 5, Name: "Busy"},
+				{CounterId: 7, Name: "Reads"},
+			}},
+			RatioMetrics: []RatioMetric{{Name: "Read Share", Numerator: "Reads", Denominator: "Busy"}},
+		}
+	}
+	byName := func(res *service.ProfilingData_GpuCounters) map[string]int32 {
+		ids := map[string]int32{}
+		for _, metric := range res.Metrics {
+			ids[metric.Name] = metric.Id
+		}
+		return ids
+	}
+
+	first, err := ComputeCounters(ctx, slices, []*service.ProfilingData_Counter{busy, reads}, options())
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	second, err := ComputeCounters(ctx, slices, []*service.ProfilingData_Counter{writes, reads, busy}, options())
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	firstIds, secondIds := byName(first), byName(second)
+	for _, name := range []string{"GPU Time", "Busy", "Reads", "Reads (pessimistic upper bound)", "Read Share"} {
+		assert.For(ctx, "%v id", name).That(secondIds[name]).Equals(firstIds[name])
+		id := firstIds[name]
+		assert.For(ctx, "%v value", name).That(findEntry(second, 0, 0).MetricToValue[id]).DeepEquals(findEntry(first, 0, 0).MetricToValue[id])
+	}
+	// The time metrics keep their ids, the counter ones derive from the spec ids.
+	assert.For(ctx, "time").That(firstIds["GPU Time"]).Equals(gpuTimeMetricId)
+	assert.For(ctx, "spec").That(firstIds["Busy"]).Equals(int32(1<<stableIdBits + 5))
+	assert.For(ctx, "unique").ThatMap(secondIds).IsLength(len(second.Metrics))
+	assert.For(ctx, "catalog").That(MetricCatalog([]*service.ProfilingData_Counter{writes, reads, busy}, options())).DeepEquals(second.Metrics)
+
+	entry, err := ComputeCommandCounters(ctx, slices, []*service.ProfilingData_Counter{writes, reads, busy}, []uint64{0, 1}, options())
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "command").That(entry.MetricToValue).DeepEquals(findEntry(second, 0, 1).MetricToValue)
+}
+
+func TestStableMetricIdCollisions(t *testing.T) {
+	ctx := log.Testing(t)
+	metrics := []*service.ProfilingData_GpuCounters_Metric{
+		{Id: gpuTimeMetricId},
+		{Id: counterMetricIdOffset},
+		{Id: counterMetricIdOffset + 1},
+	}
+	counters := []*service.ProfilingData_Counter{counter("A", nil, nil), counter("B", nil, nil)}
+	options := &Options{CounterDescriptor: &device.GpuCounterDescriptor{Specs: []*device.GpuCounterDescriptor_GpuCounterSpec{
+		{CounterId: 3, Name: "A"},
+		{CounterId: 3, Name: "B"},
+	}}}
+	ids := stableMetricIds(metrics, counters, options)
+	assert.For(ctx, "time").That(ids[gpuTimeMetricId]).Equals(gpuTimeMetricId)
+	assert.For(ctx, "first").That(ids[counterMetricIdOffset]).Equals(int32(1<<stableIdBits + 3))
+	assert.For(ctx, "collision").That(ids[counterMetricIdOffset+1]).Equals(int32(1<<stableIdBits + 4))
+}
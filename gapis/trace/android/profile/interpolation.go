@@ -0,0 +1,166 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"math"
+	"sort"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// CounterInterpolation selects how the counter signal is reconstructed
+// within its samples when they are attributed to the GPU slices.
+type CounterInterpolation int
+
+const (
+	// StepInterpolation holds the value of each sample over its whole
+	// interval, a slice overlapping part of a sample getting its time overlap
+	// share of it.
+	StepInterpolation CounterInterpolation = iota
+	// LinearInterpolation reconstructs a piecewise-linear signal through the
+	// samples, and integrates it over the part of each sample a slice
+	// overlaps, see interpolateCounter.
+	LinearInterpolation
+)
+
+// knot is a point of the piecewise-linear counter signal.
+type knot struct {
+	t, y float64
+}
+
+// linearSignal is the piecewise-linear signal through its knots, sorted by
+// time, held constant before the first knot and after the last one.
+type linearSignal []knot
+
+// Return the value of the signal at t.
+func (s linearSignal) at(t float64) float64 {
+	i := sort.Search(len(s), func(i int) bool { return s[i].t > t })
+	switch {
+	case i == 0:
+		return s[0].y
+	case i == len(s):
+		return s[len(s)-1].y
+	}
+	a, b := s[i-1], s[i]
+	return a.y + (b.y-a.y)*(t-a.t)/(b.t-a.t)
+}
+
+// Return the integral of the signal over [start, end].
+func (s linearSignal) integrate(start, end float64) float64 {
+	sum := 0.0
+	t, y := start, s.at(start)
+	for i := sort.Search(len(s), func(i int) bool { return s[i].t > start }); i < len(s) && s[i].t < end; i++ {
+		sum += (s[i].t - t) * (y + s[i].y) / 2
+		t, y = s[i].t, s[i].y
+	}
+	return sum + (end-t)*(y+s.at(end))/2
+}
+
+// Return the sorted and deduplicated starts and ends of the slices.
+func sliceBoundaries(slices []*service.ProfilingData_GpuSlices_Slice) []uint64 {
+	boundaries := make([]uint64, 0, 2*len(slices))
+	for _, slice := range slices {
+		boundaries = append(boundaries, slice.Ts, slice.Ts+slice.Dur)
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+	unique := boundaries[:0]
+	for i, b := range boundaries {
+		if i == 0 || b != boundaries[i-1] {
+			unique = append(unique, b)
+		}
+	}
+	return unique
+}
+
+// Return a copy of the counter with its samples split at the slice boundaries
+// falling inside them, so that every piece is either entirely inside or
+// entirely outside of each slice. The value of a piece derives from the
+// piecewise-linear signal going through the value of each valid sample at the
+// middle of its interval, or through its rate if the counter is summed, its
+// values being counts. The pieces of a sample are rescaled to conserve the
+// sample's total, so that a slice covering a whole sample still gets exactly
+// its value. The invalid samples are kept whole.
+func interpolateCounter(counter *service.ProfilingData_Counter, boundaries []uint64, summed bool) *service.ProfilingData_Counter {
+	signal := linearSignal{}
+	for i := 1; i < len(counter.Timestamps); i++ {
+		start, end := counter.Timestamps[i-1], counter.Timestamps[i]
+		if end <= start || !validSample(counter, i) {
+			continue
+		}
+		y := counter.Values[i]
+		if summed {
+			y /= float64(end - start)
+		}
+		signal = append(signal, knot{float64(start+end) / 2, y})
+	}
+	if len(counter.Timestamps) == 0 || len(signal) == 0 {
+		return counter
+	}
+
+	res := withSamples(counter, []uint64{counter.Timestamps[0]}, []float64{counter.Values[0]}, nil)
+	flags := len(counter.InvalidSamples) != 0
+	if flags {
+		res.InvalidSamples = []bool{counter.InvalidSamples[0]}
+	}
+	add := func(ts uint64, value float64, invalid bool) {
+		res.Timestamps = append(res.Timestamps, ts)
+		res.Values = append(res.Values, value)
+		if flags {
+			res.InvalidSamples = append(res.InvalidSamples, invalid)
+		}
+	}
+	b := 0
+	for i := 1; i < len(counter.Timestamps); i++ {
+		start, end := counter.Timestamps[i-1], counter.Timestamps[i]
+		value := counter.Values[i]
+		for b < len(boundaries) && boundaries[b] <= start {
+			b++
+		}
+		if b == len(boundaries) || boundaries[b] >= end || !validSample(counter, i) {
+			add(end, value, !validSample(counter, i))
+			continue
+		}
+		edges := []uint64{start}
+		for ; b < len(boundaries) && boundaries[b] < end; b++ {
+			edges = append(edges, boundaries[b])
+		}
+		edges = append(edges, end)
+
+		integrals := make([]float64, len(edges)-1)
+		total := 0.0
+		for p := range integrals {
+			integrals[p] = signal.integrate(float64(edges[p]), float64(edges[p+1]))
+			total += integrals[p]
+		}
+		duration := float64(end - start)
+		target := value // The total of the sample, its count or its time integral.
+		if !summed {
+			target *= duration
+		}
+		for p, integral := range integrals {
+			length := float64(edges[p+1] - edges[p])
+			piece := length / duration * target // Step interpolation if the signal can't be rescaled.
+			if scaled := integral * target / total; total != 0 && !math.IsNaN(scaled) && !math.IsInf(scaled, 0) {
+				piece = scaled
+			}
+			if !summed {
+				piece /= length
+			}
+			add(edges[p+1], piece, false)
+		}
+	}
+	return res
+}
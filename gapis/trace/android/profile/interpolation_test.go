@@ -0,0 +1,78 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestLinearSignal(t *testing.T) {
+	ctx := log.Testing(t)
+	signal := linearSignal{{0, 0}, {10, 10}, {20, 0}}
+	assert.For(ctx, "at").ThatFloat(signal.at(5)).Equals(5, 1e-9)
+	assert.For(ctx, "before").ThatFloat(signal.at(-5)).Equals(0, 1e-9)
+	assert.For(ctx, "after").ThatFloat(signal.at(25)).Equals(0, 1e-9)
+	assert.For(ctx, "integral").ThatFloat(signal.integrate(0, 20)).Equals(100, 1e-9)
+	assert.For(ctx, "partial").ThatFloat(signal.integrate(5, 15)).Equals(75, 1e-9)
+	assert.For(ctx, "held").ThatFloat(signal.integrate(20, 30)).Equals(0, 1e-9)
+}
+
+func TestInterpolateCounter(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Busy", []uint64{0, 10, 20}, []float64{0, 0, 10})
+	res := interpolateCounter(c, []uint64{10, 15, 40}, false)
+	assert.For(ctx, "timestamps").That(res.Timestamps).DeepEquals([]uint64{0, 10, 15, 20})
+	// The signal rises from 5 to 10 over the first piece, and then stays at 10.
+	assert.For(ctx, "first").ThatFloat(res.Values[2]).Equals(60/7.0, 1e-9)
+	assert.For(ctx, "second").ThatFloat(res.Values[3]).Equals(80/7.0, 1e-9)
+	assert.For(ctx, "conserved").ThatFloat((res.Values[2]+res.Values[3])/2).Equals(10, 1e-9)
+
+	summed := interpolateCounter(c, []uint64{15}, true)
+	assert.For(ctx, "summed").ThatFloat(summed.Values[2]+summed.Values[3]).Equals(10, 1e-9)
+	assert.For(ctx, "summed second").ThatFloat(summed.Values[3]).Equals(40/7.0, 1e-9)
+
+	c.InvalidSamples = []bool{false, false, true}
+	invalid := interpolateCounter(c, []uint64{15}, false)
+	assert.For(ctx, "invalid").That(invalid.Timestamps).DeepEquals(c.Timestamps)
+	assert.For(ctx, "invalid flags").That(invalid.InvalidSamples).DeepEquals(c.InvalidSamples)
+}
+
+func TestLinearInterpolation(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0), group(1, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 15, 5), slice(1, 20, 20)},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40}, []float64{0, 0, 10, 10, 10}),
+	}
+	for _, test := range []struct {
+		interpolation CounterInterpolation
+		partial       float64
+	}{
+		{StepInterpolation, 10},
+		{LinearInterpolation, 80 / 7.0},
+	} {
+		res, err := ComputeCounters(ctx, slices, counters, &Options{Interpolation: test.interpolation})
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "partial %v", test.interpolation).ThatFloat(findEntry(res, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(test.partial, 1e-9)
+		// The samples covered entirely keep their value.
+		assert.For(ctx, "whole %v", test.interpolation).ThatFloat(findEntry(res, 1).MetricToValue[counterMetricIdOffset].Estimate).Equals(10, 1e-9)
+	}
+}
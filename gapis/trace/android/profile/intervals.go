@@ -0,0 +1,193 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"sort"
+
+	"github.com/google/gapid/core/math/u64"
+	"github.com/google/gapid/gapis/service"
+)
+
+// Calculate the exclusive (self) time of each slice: its duration minus the
+// durations of its child slices, which are the slices on the same track, one
+// depth deeper and temporally contained within it.
+func selfTimes(slices []*service.ProfilingData_GpuSlices_Slice) map[*service.ProfilingData_GpuSlices_Slice]uint64 {
+	sorted := make([]*service.ProfilingData_GpuSlices_Slice, len(slices))
+	copy(sorted, slices)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].TrackId != sorted[j].TrackId {
+			return sorted[i].TrackId < sorted[j].TrackId
+		}
+		if sorted[i].Ts != sorted[j].Ts {
+			return sorted[i].Ts < sorted[j].Ts
+		}
+		return sorted[i].Depth < sorted[j].Depth
+	})
+
+	self := make(map[*service.ProfilingData_GpuSlices_Slice]uint64, len(slices))
+	ancestors := []*service.ProfilingData_GpuSlices_Slice{} // The slices containing the current one, from the outermost.
+	for i, slice := range sorted {
+		self[slice] = slice.Dur
+		if i > 0 && sorted[i-1].TrackId != slice.TrackId {
+			ancestors = ancestors[:0]
+		}
+		for len(ancestors) > 0 {
+			parent := ancestors[len(ancestors)-1]
+			if parent.Depth < slice.Depth && parent.Ts+parent.Dur >= slice.Ts+slice.Dur {
+				break
+			}
+			ancestors = ancestors[:len(ancestors)-1]
+		}
+		if len(ancestors) > 0 {
+			if parent := ancestors[len(ancestors)-1]; parent.Depth == slice.Depth-1 {
+				self[parent] -= u64.Min(self[parent], slice.Dur)
+			}
+		}
+		ancestors = append(ancestors, slice)
+	}
+	return self
+}
+
+// MergeSlices consolidates the temporally overlapping or adjacent slices that
+// belong to the same group and depth into single slices spanning their union.
+// Slices separated by a gap are kept separate. A merged slice keeps the other
+// fields of its earliest slice. The input slices are not modified and the
+// result is sorted by start time.
+func MergeSlices(slices []*service.ProfilingData_GpuSlices_Slice) []*service.ProfilingData_GpuSlices_Slice {
+	sorted := make([]*service.ProfilingData_GpuSlices_Slice, len(slices))
+	copy(sorted, slices)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Ts < sorted[j].Ts
+	})
+
+	type key struct {
+		groupId int32
+		depth   int32
+	}
+	merged := []*service.ProfilingData_GpuSlices_Slice{}
+	last := map[key]*service.ProfilingData_GpuSlices_Slice{} // The latest merged slice of each group and depth.
+	for _, slice := range sorted {
+		k := key{slice.GroupId, slice.Depth}
+		if prev, ok := last[k]; ok && slice.Ts <= prev.Ts+prev.Dur {
+			prev.Dur = u64.Max(prev.Dur, slice.Ts+slice.Dur-prev.Ts)
+			continue
+		}
+		clone := withTimes(slice, slice.Ts, slice.Dur)
+		merged = append(merged, clone)
+		last[k] = clone
+	}
+	return merged
+}
+
+// Calculate the maximum number of slices executing simultaneously. Slices
+// that merely abut each other are not considered concurrent.
+func maxConcurrency(slices []*service.ProfilingData_GpuSlices_Slice) int {
+	type event struct {
+		ts    uint64
+		delta int
+	}
+	events := make([]event, 0, 2*len(slices))
+	for _, slice := range slices {
+		events = append(events, event{slice.Ts, 1}, event{slice.Ts + slice.Dur, -1})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].ts != events[j].ts {
+			return events[i].ts < events[j].ts
+		}
+		return events[i].delta < events[j].delta // Ends before starts.
+	})
+	concurrency, max := 0, 0
+	for _, e := range events {
+		concurrency += e.delta
+		if concurrency > max {
+			max = concurrency
+		}
+	}
+	return max
+}
+
+// Return the slices on the critical path of a group: the slices that extend
+// the union of the busy intervals, and thus determine its wall time. The
+// slices fully hidden under an earlier slice are left out. The slices are
+// expected to be sorted by start time, see sortSlices.
+func criticalPathSlices(slices []*service.ProfilingData_GpuSlices_Slice) []*service.ProfilingData_GpuSlices_Slice {
+	critical := make([]*service.ProfilingData_GpuSlices_Slice, 0, len(slices))
+	lastEnd := uint64(0)
+	for i, slice := range slices {
+		end := slice.Ts + slice.Dur
+		if i > 0 && end <= lastEnd {
+			continue // completely hidden under the previous slices.
+		}
+		critical = append(critical, slice)
+		lastEnd = end
+	}
+	return critical
+}
+
+// interval is a half-open time span [start, end), in nanoseconds.
+type interval struct {
+	start, end uint64
+}
+
+// Return the union of the spans of the slices as disjoint intervals, sorted
+// by start time. Overlapping and adjacent slices form a single interval. The
+// slices are expected to be sorted by start time, see sortSlices.
+func busyIntervals(slices []*service.ProfilingData_GpuSlices_Slice) []interval {
+	busy := []interval{}
+	for _, slice := range slices {
+		end := slice.Ts + slice.Dur
+		if n := len(busy); n > 0 && slice.Ts <= busy[n-1].end {
+			busy[n-1].end = u64.Max(busy[n-1].end, end)
+			continue
+		}
+		busy = append(busy, interval{slice.Ts, end})
+	}
+	return busy
+}
+
+// Calculate the global wall time of each group of the slices: the union of
+// its busy intervals, each instant split evenly between the groups busy at
+// the same time, on any GPU queue. The global wall times of all the groups
+// add up to the wall time of the GPU, the union of all the slices, each group
+// getting its contribution to the frame latency.
+func globalWallTimes(slices []*service.ProfilingData_GpuSlices_Slice) map[int32]float64 {
+	type event struct {
+		ts      uint64
+		groupId int32
+		delta   int
+	}
+	events := make([]event, 0, 2*len(slices))
+	for _, slice := range slices {
+		events = append(events, event{slice.Ts, slice.GroupId, 1}, event{slice.Ts + slice.Dur, slice.GroupId, -1})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ts < events[j].ts })
+	wallTimes := map[int32]float64{}
+	active := map[int32]int{} // Group id -> number of running slices.
+	last := uint64(0)
+	for _, e := range events {
+		if len(active) != 0 && e.ts > last {
+			share := float64(e.ts-last) / float64(len(active))
+			for groupId := range active {
+				wallTimes[groupId] += share
+			}
+		}
+		last = e.ts
+		if active[e.groupId] += e.delta; active[e.groupId] == 0 {
+			delete(active, e.groupId)
+		}
+	}
+	return wallTimes
+}
@@ -0,0 +1,238 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+const ms = uint64(1000000)
+
+// nestedSlice builds a GPU slice at the given depth of a track.
+func nestedSlice(groupId, trackId, depth int32, ts, dur uint64) *service.ProfilingData_GpuSlices_Slice {
+	return &service.ProfilingData_GpuSlices_Slice{Ts: ts, Dur: dur, GroupId: groupId, TrackId: trackId, Depth: depth}
+}
+
+func TestSelfTimes(t *testing.T) {
+	ctx := log.Testing(t)
+	parent := nestedSlice(0, 0, 0, 0, 10*ms)
+	child := nestedSlice(1, 0, 1, 2*ms, 4*ms)
+	grandChild := nestedSlice(1, 0, 2, 3*ms, 1*ms)
+	sibling := nestedSlice(1, 0, 1, 7*ms, 3*ms)
+	otherTrack := nestedSlice(2, 1, 0, 1*ms, 2*ms)
+	self := selfTimes([]*service.ProfilingData_GpuSlices_Slice{sibling, grandChild, otherTrack, child, parent})
+	assert.For(ctx, "parent").That(self[parent]).Equals(3 * ms)
+	assert.For(ctx, "child").That(self[child]).Equals(3 * ms)
+	assert.For(ctx, "grand child").That(self[grandChild]).Equals(1 * ms)
+	assert.For(ctx, "sibling").That(self[sibling]).Equals(3 * ms)
+	assert.For(ctx, "other track").That(self[otherTrack]).Equals(2 * ms)
+
+	parent = nestedSlice(0, 0, 0, 0, 10*ms)
+	child = nestedSlice(1, 0, 1, 0, 4*ms)
+	self = selfTimes([]*service.ProfilingData_GpuSlices_Slice{child, parent})
+	assert.For(ctx, "parent self time").That(self[parent]).Equals(6 * ms)
+	assert.For(ctx, "child self time").That(self[child]).Equals(4 * ms)
+}
+
+func TestGpuSelfTimeMetric(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			nestedSlice(0, 0, 0, 0, 10*ms),
+			nestedSlice(0, 0, 1, 3*ms, 4*ms),
+		},
+	}
+	res, err := ComputeCounters(ctx, slices, nil, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	entry := findEntry(res, 0)
+	assert.For(ctx, "inclusive").That(entry.MetricToValue[gpuTimeMetricId]).DeepEquals(perf(float64(10 * ms)))
+	assert.For(ctx, "exclusive").That(entry.MetricToValue[gpuSelfTimeMetricId]).DeepEquals(perf(float64(6 * ms)))
+}
+
+func TestMergeSlices(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		name     string
+		slices   []*service.ProfilingData_GpuSlices_Slice
+		expected []*service.ProfilingData_GpuSlices_Slice
+	}{
+		{"overlapping", []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 5, 10), slice(0, 0, 10), slice(0, 2, 3),
+		}, []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 15),
+		}},
+		{"adjacent", []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(0, 10, 10),
+		}, []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 20),
+		}},
+		{"gapped", []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(0, 11, 10),
+		}, []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(0, 11, 10),
+		}},
+		{"groups and depths", []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(1, 5, 10), nestedSlice(0, 0, 1, 5, 10), slice(0, 8, 4),
+		}, []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 12), slice(1, 5, 10), nestedSlice(0, 0, 1, 5, 10),
+		}},
+	} {
+		durations := make([]uint64, len(test.slices))
+		for i, s := range test.slices {
+			durations[i] = s.Dur
+		}
+		assert.For(ctx, test.name).That(MergeSlices(test.slices)).DeepEquals(test.expected)
+		for i, s := range test.slices {
+			assert.For(ctx, "%v input %d", test.name, i).That(s.Dur).Equals(durations[i])
+		}
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		name     string
+		slices   []*service.ProfilingData_GpuSlices_Slice
+		expected int
+	}{
+		{"pairwise overlapping", []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(0, 2, 10), slice(0, 4, 10),
+		}, 3},
+		{"sequential", []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(0, 20, 10),
+		}, 1},
+		{"abutting", []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(0, 10, 10),
+		}, 1},
+		{"empty", nil, 0},
+	} {
+		assert.For(ctx, test.name).That(maxConcurrency(test.slices)).Equals(test.expected)
+	}
+}
+
+func TestGpuMaxConcurrencyMetric(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(0, 2, 10), slice(0, 4, 10),
+			slice(1, 20, 10), slice(1, 30, 10),
+		},
+	}
+	res, err := ComputeCounters(ctx, slices, nil, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	entries := entriesByIndex(res)
+	assert.For(ctx, "overlapping").That(entries["0,0"][gpuMaxConcurrencyMetricId]).DeepEquals(perf(3))
+	assert.For(ctx, "sequential").That(entries["0,1"][gpuMaxConcurrencyMetricId]).DeepEquals(perf(1))
+	assert.For(ctx, "parent").That(entries["0"][gpuMaxConcurrencyMetricId]).DeepEquals(perf(3))
+}
+
+func TestCriticalPathSlices(t *testing.T) {
+	ctx := log.Testing(t)
+	a, b, c, d := slice(0, 0, 10), slice(0, 2, 3), slice(0, 8, 10), slice(0, 20, 5)
+	hidden := slice(0, 12, 6) // hidden under the union of a and c.
+	assert.For(ctx, "critical").That(criticalPathSlices([]*service.ProfilingData_GpuSlices_Slice{a, b, c, hidden, d})).
+		DeepEquals([]*service.ProfilingData_GpuSlices_Slice{a, c, d})
+}
+
+func TestBusyIntervals(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := []*service.ProfilingData_GpuSlices_Slice{
+		slice(0, 0, 10), slice(1, 2, 3), slice(0, 10, 5), slice(1, 20, 5), slice(0, 22, 10),
+	}
+	assert.For(ctx, "busy").That(busyIntervals(slices)).DeepEquals([]interval{{0, 15}, {20, 32}})
+	assert.For(ctx, "none").ThatSlice(busyIntervals(nil)).IsEmpty()
+}
+
+func TestGpuChildrenTimeMetric(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{
+			group(0, 0, 0), group(1, 0, 1), // Command 0 is a mere container.
+			group(2, 1), group(3, 1, 0), // Command 1 has GPU work of its own too.
+		},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10*ms), slice(1, 10*ms, 20*ms), slice(2, 30*ms, 5*ms), slice(3, 35*ms, 15*ms),
+		},
+	}
+	res, err := ComputeCounters(ctx, slices, nil, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	entries := entriesByIndex(res)
+	assert.For(ctx, "container").That(entries["0"][gpuChildrenTimeMetricId]).DeepEquals(perf(float64(30 * ms)))
+	assert.For(ctx, "container time").That(entries["0"][gpuTimeMetricId]).DeepEquals(perf(float64(30 * ms)))
+	assert.For(ctx, "parent").That(entries["1"][gpuChildrenTimeMetricId]).DeepEquals(perf(float64(15 * ms)))
+	for _, idx := range []string{"0,0", "0,1", "1,0"} {
+		assert.For(ctx, "%v leaf", idx).That(entries[idx][gpuChildrenTimeMetricId]).DeepEquals(perf(0))
+	}
+
+	// The children time follows the unit of its override, from the one of
+	// the GPU time.
+	res, err = ComputeCounters(ctx, slices, nil, &Options{TimeMetricOverrides: map[string]TimeMetricOverride{
+		"GPU Time":          {Unit: device.GpuCounterDescriptor_MICROSECOND},
+		"GPU Children Time": {Unit: device.GpuCounterDescriptor_MILLISECOND},
+	}})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "converted").ThatFloat(entriesByIndex(res)["1"][gpuChildrenTimeMetricId].Estimate).Equals(15, 1e-9)
+}
+
+func TestGpuLongestSliceMetric(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 3*ms), slice(0, 3*ms, 7*ms), slice(0, 10*ms, 5*ms),
+			slice(1, 20*ms, 9*ms), slice(1, 30*ms, 2*ms),
+		},
+	}
+	res, err := ComputeCounters(ctx, slices, nil, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	entries := entriesByIndex(res)
+	assert.For(ctx, "first").That(entries["0,0"][gpuLongestSliceMetricId]).DeepEquals(perf(float64(7 * ms)))
+	assert.For(ctx, "second").That(entries["0,1"][gpuLongestSliceMetricId]).DeepEquals(perf(float64(9 * ms)))
+	assert.For(ctx, "parent").That(entries["0"][gpuLongestSliceMetricId]).DeepEquals(perf(float64(9 * ms)))
+}
+
+func TestGpuGlobalWallTimeMetric(t *testing.T) {
+	ctx := log.Testing(t)
+	queued := func(groupId int32, track int32, ts, dur uint64) *service.ProfilingData_GpuSlices_Slice {
+		s := slice(groupId, ts, dur)
+		s.TrackId = track
+		return s
+	}
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 0, 2)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			queued(0, 0, 0, 10*ms), queued(0, 0, 2*ms, 4*ms),
+			queued(1, 1, 5*ms, 10*ms),
+			queued(2, 0, 20*ms, 10*ms),
+		},
+	}
+	res, err := ComputeCounters(ctx, slices, nil, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	entries := entriesByIndex(res)
+	// The overlap of the two queues is split between their commands.
+	assert.For(ctx, "first").That(entries["0,0"][gpuGlobalWallTimeMetricId]).DeepEquals(perf(float64(7*ms + ms/2)))
+	assert.For(ctx, "second").That(entries["0,1"][gpuGlobalWallTimeMetricId]).DeepEquals(perf(float64(7*ms + ms/2)))
+	assert.For(ctx, "alone").That(entries["0,2"][gpuGlobalWallTimeMetricId]).DeepEquals(perf(float64(10 * ms)))
+	// The global wall times add up to the wall time of the GPU.
+	assert.For(ctx, "parent").That(entries["0"][gpuGlobalWallTimeMetricId]).DeepEquals(perf(float64(25 * ms)))
+	assert.For(ctx, "wall time").That(entries["0,0"][gpuWallTimeMetricId]).DeepEquals(perf(float64(10 * ms)))
+}
@@ -0,0 +1,142 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"math"
+
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+// Descriptions of the built-in time metrics, keyed by default name.
+var timeMetricDescriptions = map[string]string{
+	"GPU Time":                  "Sum of the durations of the GPU slices of the command.",
+	"GPU Wall Time":             "Time the GPU spent busy with the command, the overlapping slices counted once.",
+	"GPU Busy Intervals":        "Number of disjoint intervals the GPU spent busy with the command.",
+	"GPU Self Time":             "GPU time of the command, excluding the time of its children.",
+	"GPU Max Concurrent Slices": "Largest number of slices of the command running at the same time.",
+	"GPU Slices":                "Number of GPU slices of the command.",
+	"GPU Time Frame Share":      "Share of the GPU time of its frame spent on the command.",
+	"GPU Children Time":         "GPU time of the children of the command.",
+	"GPU Longest Slice":         "Duration of the longest GPU slice of the command.",
+	"GPU Global Wall Time":      "Wall time of the command, each instant split between the commands busy at the same time on any GPU queue.",
+}
+
+// Return the descriptor spec of the counter, matched by name, nil if the
+// options have no descriptor or the descriptor doesn't describe the counter.
+func counterSpec(counter *service.ProfilingData_Counter, options *Options) *device.GpuCounterDescriptor_GpuCounterSpec {
+	if options.CounterDescriptor == nil {
+		return nil
+	}
+	for _, spec := range options.CounterDescriptor.Specs {
+		if spec.Name == counter.Name {
+			return spec
+		}
+	}
+	return nil
+}
+
+// Return the peak value of the spec, and whether it has one.
+func specPeakValue(spec *device.GpuCounterDescriptor_GpuCounterSpec) (float64, bool) {
+	switch peak := spec.GetPeakValue().(type) {
+	case *device.GpuCounterDescriptor_GpuCounterSpec_IntPeakValue:
+		return float64(peak.IntPeakValue), true
+	case *device.GpuCounterDescriptor_GpuCounterSpec_DoublePeakValue:
+		return peak.DoublePeakValue, true
+	}
+	return 0, false
+}
+
+// Return whether the units are a plain percentage.
+func isPercent(numerators, denominators []device.GpuCounterDescriptor_MeasureUnit) bool {
+	return len(numerators) == 1 && numerators[0] == device.GpuCounterDescriptor_PERCENT && len(denominators) == 0
+}
+
+// Return the polarity of the metric of the options, the first of the names
+// found in Options.MetricPolarities, or the fallback.
+func metricPolarity(options *Options, fallback service.ProfilingData_GpuCounters_Metric_Polarity, names ...string) service.ProfilingData_GpuCounters_Metric_Polarity {
+	for _, name := range names {
+		if polarity, ok := options.MetricPolarities[name]; ok {
+			return polarity
+		}
+	}
+	return fallback
+}
+
+// Set the description, the structured units, the expected range, the
+// polarity and the category of the metric of the counter. The description
+// and the units come from the counter's descriptor spec, the units being
+// dropped if the scale of the counter changes its unit, or are the canonical
+// units of the counter if they are normalized. The values of the averaged
+// counters range from 0 to the peak value of the spec, scaled like the
+// samples, or to 100 for the percentages. The summed counters have no
+// expected range, the sum of their samples growing with the commands.
+func setCounterMetadata(metric *service.ProfilingData_GpuCounters_Metric, counter *service.ProfilingData_Counter, options *Options) {
+	spec := counterSpec(counter, options)
+	scale, scaled := counterScale(counter, options)
+	_, explicit := options.CounterScales[counter.Name]
+
+	metric.Description = counter.Description
+	if spec != nil && spec.Description != "" {
+		metric.Description = spec.Description
+	}
+	switch {
+	case options.NormalizeUnits && !explicit:
+		metric.NumeratorUnits, metric.DenominatorUnits, _, _ = normalizedUnits(counter, options)
+	case spec != nil && (!scaled || scale.Unit == ""):
+		metric.NumeratorUnits = spec.NumeratorUnits
+		metric.DenominatorUnits = spec.DenominatorUnits
+	}
+	if metric.Op != service.ProfilingData_GpuCounters_Metric_Summation {
+		peak, ok := 0.0, false
+		if spec != nil {
+			peak, ok = specPeakValue(spec)
+		}
+		if !ok && isPercent(metric.NumeratorUnits, metric.DenominatorUnits) {
+			peak, ok = 100, true
+		}
+		if ok {
+			if scaled {
+				peak *= scale.Factor
+			}
+			metric.MinValue, metric.MaxValue = math.Min(0, peak), math.Max(0, peak)
+		}
+	}
+	metric.Polarity = metricPolarity(options, service.ProfilingData_GpuCounters_Metric_UnknownPolarity, counter.Name)
+	metric.Category = metricCategory(metric, spec, options)
+}
+
+// Set the description, the structured units, the expected range, the
+// polarity and the category of the built-in time metric of the given default
+// name, in the unit it is reported in. The durations are lower-is-better by
+// default, and all the time metrics are timings unless overridden.
+func setTimeMetricMetadata(metric *service.ProfilingData_GpuCounters_Metric, name string, unit device.GpuCounterDescriptor_MeasureUnit, options *Options) {
+	metric.Description = timeMetricDescriptions[name]
+	fallback := service.ProfilingData_GpuCounters_Metric_UnknownPolarity
+	switch {
+	case unit == device.GpuCounterDescriptor_PERCENT:
+		metric.NumeratorUnits = []device.GpuCounterDescriptor_MeasureUnit{unit}
+		metric.MinValue, metric.MaxValue = 0, 100
+	case nanosecondsPerUnit[unit] != 0:
+		metric.NumeratorUnits = []device.GpuCounterDescriptor_MeasureUnit{unit}
+		fallback = service.ProfilingData_GpuCounters_Metric_LowerIsBetter
+	}
+	metric.Polarity = metricPolarity(options, fallback, name)
+	metric.Category = TimingCategory
+	if category, ok := options.MetricCategories[name]; ok {
+		metric.Category = category
+	}
+}
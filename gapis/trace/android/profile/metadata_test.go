@@ -0,0 +1,110 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestCounterMetadata(t *testing.T) {
+	ctx := log.Testing(t)
+	units := func(units ...device.GpuCounterDescriptor_MeasureUnit) []device.GpuCounterDescriptor_MeasureUnit {
+		return units
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Utilization", nil, nil),
+		counter("Bandwidth", nil, nil),
+		counter("Bytes Written", nil, nil),
+		counter("Scaled", nil, nil),
+		{Name: "Undescribed", Description: "From the counter"},
+	}
+	options := &Options{
+		CounterDescriptor: &device.GpuCounterDescriptor{Specs: []*device.GpuCounterDescriptor_GpuCounterSpec{
+			{Name: "Utilization", Description: "Busy share", NumeratorUnits: units(device.GpuCounterDescriptor_PERCENT)},
+			{
+				Name:             "Bandwidth",
+				NumeratorUnits:   units(device.GpuCounterDescriptor_BYTE),
+				DenominatorUnits: units(device.GpuCounterDescriptor_SECOND),
+				PeakValue:        &device.GpuCounterDescriptor_GpuCounterSpec_IntPeakValue{IntPeakValue: 1000},
+			},
+			{
+				Name:           "Bytes Written",
+				NumeratorUnits: units(device.GpuCounterDescriptor_BYTE),
+				PeakValue:      &device.GpuCounterDescriptor_GpuCounterSpec_IntPeakValue{IntPeakValue: 1000},
+			},
+			{
+				Name:           "Scaled",
+				NumeratorUnits: units(device.GpuCounterDescriptor_KILOHERTZ),
+				PeakValue:      &device.GpuCounterDescriptor_GpuCounterSpec_DoublePeakValue{DoublePeakValue: 2000},
+			},
+		}},
+		CounterScales:    map[string]CounterScale{"Scaled": {Factor: 0.001, Unit: "MHz"}},
+		MetricPolarities: map[string]service.ProfilingData_GpuCounters_Metric_Polarity{"Bandwidth": service.ProfilingData_GpuCounters_Metric_HigherIsBetter},
+	}
+	metrics := map[string]*service.ProfilingData_GpuCounters_Metric{}
+	for i, c := range counters {
+		metric := counterMetric(i, c, options)
+		metrics[metric.Name] = metric
+	}
+
+	utilization := metrics["Utilization"]
+	assert.For(ctx, "description").That(utilization.Description).Equals("Busy share")
+	assert.For(ctx, "percent range").That([]float64{utilization.MinValue, utilization.MaxValue}).DeepEquals([]float64{0, 100})
+
+	bandwidth := metrics["Bandwidth"]
+	assert.For(ctx, "numerators").That(bandwidth.NumeratorUnits).DeepEquals(units(device.GpuCounterDescriptor_BYTE))
+	assert.For(ctx, "denominators").That(bandwidth.DenominatorUnits).DeepEquals(units(device.GpuCounterDescriptor_SECOND))
+	assert.For(ctx, "peak range").That(bandwidth.MaxValue).Equals(1000.0)
+	assert.For(ctx, "polarity").That(bandwidth.Polarity).Equals(service.ProfilingData_GpuCounters_Metric_HigherIsBetter)
+
+	// The sum of the samples isn't bounded by their peak.
+	written := metrics["Bytes Written"]
+	assert.For(ctx, "summed range").That(written.MaxValue).Equals(0.0)
+	assert.For(ctx, "unknown polarity").That(written.Polarity).Equals(service.ProfilingData_GpuCounters_Metric_UnknownPolarity)
+
+	// The scale converts the peak value, but replaces the units.
+	scaled := metrics["Scaled"]
+	assert.For(ctx, "scaled range").ThatFloat(scaled.MaxValue).Equals(2, 1e-9)
+	assert.For(ctx, "scaled units").That(len(scaled.NumeratorUnits)).Equals(0)
+
+	assert.For(ctx, "counter description").That(metrics["Undescribed"].Description).Equals("From the counter")
+	assert.For(ctx, "no range").That(metrics["Undescribed"].MaxValue).Equals(0.0)
+}
+
+func TestTimeMetricMetadata(t *testing.T) {
+	ctx := log.Testing(t)
+	metrics := timeMetrics(&Options{
+		TimeMetricOverrides: map[string]TimeMetricOverride{"GPU Time": {Unit: device.GpuCounterDescriptor_MICROSECOND}},
+		MetricPolarities:    map[string]service.ProfilingData_GpuCounters_Metric_Polarity{"GPU Slices": service.ProfilingData_GpuCounters_Metric_LowerIsBetter},
+	})
+	for _, metric := range metrics {
+		assert.For(ctx, "%v description", metric.Name).That(metric.Description).NotEquals("")
+	}
+	gpuTime := metrics[gpuTimeMetricId]
+	assert.For(ctx, "time units").That(gpuTime.NumeratorUnits).DeepEquals([]device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_MICROSECOND})
+	assert.For(ctx, "time polarity").That(gpuTime.Polarity).Equals(service.ProfilingData_GpuCounters_Metric_LowerIsBetter)
+
+	share := metrics[gpuFrameShareMetricId]
+	assert.For(ctx, "share range").That([]float64{share.MinValue, share.MaxValue}).DeepEquals([]float64{0, 100})
+	assert.For(ctx, "share polarity").That(share.Polarity).Equals(service.ProfilingData_GpuCounters_Metric_UnknownPolarity)
+
+	assert.For(ctx, "count units").That(len(metrics[gpuSliceCountMetricId].NumeratorUnits)).Equals(0)
+	assert.For(ctx, "count polarity").That(metrics[gpuSliceCountMetricId].Polarity).Equals(service.ProfilingData_GpuCounters_Metric_LowerIsBetter)
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// Return the slices and the counters with their timestamps rebased into a
+// monotonic domain, see monotonicSlices and monotonicCounter. The slices and
+// the counters are rebased independently, the regions after a jump, flagged
+// by a warning, only being as aligned as the rebased timestamps.
+func monotonicTimestamps(ctx context.Context, slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter) (*service.ProfilingData_GpuSlices, []*service.ProfilingData_Counter) {
+	rebased := make([]*service.ProfilingData_Counter, len(counters))
+	for i, counter := range counters {
+		rebased[i] = monotonicCounter(ctx, counter)
+	}
+	return monotonicSlices(ctx, slices), rebased
+}
+
+// Return a copy of the counter whose timestamps, in sampling order, are
+// rebased into a monotonic domain, see Options.MonotonicTimestamps: after each
+// jump backwards, wrap-around included, the later timestamps are shifted to
+// follow the sample before the jump by a sampling period. The sample spanning
+// the jump, whose interval is unknown, is marked invalid. The counter is
+// returned as is if its timestamps never decrease, or if it is malformed.
+func monotonicCounter(ctx context.Context, counter *service.ProfilingData_Counter) *service.ProfilingData_Counter {
+	if len(counter.Timestamps) != len(counter.Values) || (len(counter.InvalidSamples) != 0 && len(counter.InvalidSamples) != len(counter.Values)) {
+		return counter
+	}
+	var timestamps []uint64
+	var invalid []bool
+	period, offset := uint64(0), uint64(0)
+	for i := 1; i < len(counter.Timestamps); i++ {
+		previous, ts := counter.Timestamps[i-1]+offset, counter.Timestamps[i]+offset
+		if ts >= previous {
+			if timestamps != nil {
+				timestamps[i] = ts
+			}
+			continue
+		}
+		if timestamps == nil {
+			timestamps = append([]uint64{}, counter.Timestamps...)
+			invalid = make([]bool, len(counter.Values))
+			copy(invalid, counter.InvalidSamples)
+			period = samplingPeriod(counter)
+		}
+		offset += previous - ts + period
+		timestamps[i], invalid[i] = previous+period, true
+		warn(ctx, service.ProfilingData_GpuCounters_Warning_ClockDiscontinuity, counter.Name,
+			"Counter %v: the timestamps jumped back by %v ns after %v, the later samples are rebased", counter.Name, previous-ts, previous)
+	}
+	if timestamps == nil {
+		return counter
+	}
+	return withSamples(counter, timestamps, counter.Values, invalid)
+}
+
+// Return a copy of the slices whose timestamps, in the order of the slices
+// of each track, are rebased into a monotonic domain, see
+// Options.MonotonicTimestamps: after each jump backwards of the start of the
+// slices of a track, the later slices of the track are shifted to start at
+// the end of the slices before the jump. The slices are returned as is if
+// the starts of the slices of no track decrease.
+func monotonicSlices(ctx context.Context, slices *service.ProfilingData_GpuSlices) *service.ProfilingData_GpuSlices {
+	type track struct {
+		start, end, offset uint64 // The rebased start of the last slice, and the end of all.
+	}
+	tracks := map[int32]*track{}
+	var rebased []*service.ProfilingData_GpuSlices_Slice
+	for i, slice := range slices.Slices {
+		t, ok := tracks[slice.TrackId]
+		if !ok {
+			t = &track{}
+			tracks[slice.TrackId] = t
+		}
+		ts := slice.Ts + t.offset
+		if ok && ts < t.start {
+			warn(ctx, service.ProfilingData_GpuCounters_Warning_ClockDiscontinuity, trackName(slices, slice.TrackId),
+				"Track %v: the timestamps jumped back by %v ns after %v, the later slices are rebased", slice.TrackId, t.start-ts, t.start)
+			t.offset += t.end - ts
+			ts = t.end
+		}
+		if t.offset != 0 && rebased == nil {
+			rebased = append([]*service.ProfilingData_GpuSlices_Slice{}, slices.Slices...)
+		}
+		if t.offset != 0 {
+			rebased[i] = withTimes(slice, ts, slice.Dur)
+		}
+		t.start = ts
+		if end := ts + slice.Dur; end > t.end {
+			t.end = end
+		}
+	}
+	if rebased == nil {
+		return slices
+	}
+	return &service.ProfilingData_GpuSlices{
+		Slices: rebased,
+		Tracks: slices.Tracks,
+		Groups: slices.Groups,
+	}
+}
+
+// Return the name of the track of the given id, or its id if it has no name.
+func trackName(slices *service.ProfilingData_GpuSlices, id int32) string {
+	for _, track := range slices.Tracks {
+		if track.Id == id && track.Name != "" {
+			return track.Name
+		}
+	}
+	return fmt.Sprint(id)
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestMonotonicCounter(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Busy", []uint64{0, 10, 20, 5, 15}, []float64{0, 1, 2, 3, 4})
+	rebased := monotonicCounter(ctx, c)
+	assert.For(ctx, "timestamps").That(rebased.Timestamps).DeepEquals([]uint64{0, 10, 20, 30, 40})
+	assert.For(ctx, "invalid").That(rebased.InvalidSamples).DeepEquals([]bool{false, false, false, true, false})
+	assert.For(ctx, "values").That(rebased.Values).DeepEquals(c.Values)
+	assert.For(ctx, "original").That(c.Timestamps).DeepEquals([]uint64{0, 10, 20, 5, 15})
+
+	// A wrap-around, the timestamps restarting from 0.
+	wrapped := counter("Busy", []uint64{1<<32 - 20, 1<<32 - 10, 0, 10}, []float64{0, 1, 2, 3})
+	assert.For(ctx, "wrapped").That(monotonicCounter(ctx, wrapped).Timestamps).DeepEquals([]uint64{1<<32 - 20, 1<<32 - 10, 1 << 32, 1<<32 + 10})
+
+	monotonic := counter("Busy", []uint64{0, 10, 20}, []float64{0, 1, 2})
+	assert.For(ctx, "as is").That(monotonicCounter(ctx, monotonic)).Equals(monotonic)
+}
+
+func TestMonotonicTimestamps(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0), group(1, 1), group(2, 2)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 100, 10),
+			slice(1, 5, 10), // Jumped back.
+			slice(2, 20, 10),
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{90, 100, 110, 0, 10, 20, 30}, []float64{0, 1, 2, 3, 4, 5, 6}),
+	}
+	res, err := ComputeCounters(ctx, slices, counters, &Options{MonotonicTimestamps: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "original").That(slices.Slices[1].Ts).Equals(uint64(5))
+	discontinuities := []string{}
+	for _, warning := range res.Warnings {
+		if warning.Kind == service.ProfilingData_GpuCounters_Warning_ClockDiscontinuity {
+			discontinuities = append(discontinuities, warning.Name)
+		}
+	}
+	assert.For(ctx, "flagged").That(discontinuities).DeepEquals([]string{"Busy", "0"})
+
+	// As computed from the rebased timestamps.
+	rebased := &service.ProfilingData_GpuSlices{
+		Groups: slices.Groups,
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 100, 10), slice(1, 110, 10), slice(2, 125, 10)},
+	}
+	busy := counter("Busy", []uint64{90, 100, 110, 120, 130, 140, 150}, []float64{0, 1, 2, 3, 4, 5, 6})
+	busy.InvalidSamples = []bool{false, false, false, true, false, false, false}
+	expected, err := ComputeCounters(ctx, rebased, []*service.ProfilingData_Counter{busy}, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	res.Warnings = nil
+	assert.For(ctx, "rebased").That(res).DeepEquals(expected)
+}
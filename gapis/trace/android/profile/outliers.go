@@ -0,0 +1,146 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"math"
+	"sort"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// The minimum number of slices, or groups, of a label to tell their
+// outliers, the others of the label setting the expected value.
+const minOutlierPopulation = 3
+
+// The values of a label, and the slices and groups they are of.
+type outlierPopulation struct {
+	label  string
+	values []float64
+	slices []*service.ProfilingData_GpuSlices_Slice
+	groups []int32
+}
+
+// Append to outs the outliers of the population, the values more than sigma
+// standard deviations away from the mean of the other values, as the values
+// of the metric.
+func (p *outlierPopulation) outliers(outs []*service.ProfilingData_GpuCounters_Outlier, metricId int32, sigma float64) []*service.ProfilingData_GpuCounters_Outlier {
+	n := float64(len(p.values))
+	if len(p.values) < minOutlierPopulation {
+		return outs
+	}
+	sum, squares := 0.0, 0.0
+	for _, v := range p.values {
+		sum, squares = sum+v, squares+v*v
+	}
+	for i, v := range p.values {
+		mean := (sum - v) / (n - 1)
+		stdDev := math.Sqrt(math.Max((squares-v*v)/(n-1)-mean*mean, 0))
+		if stdDev == 0 || math.Abs(v-mean) <= sigma*stdDev {
+			continue
+		}
+		outs = append(outs, &service.ProfilingData_GpuCounters_Outlier{
+			SliceId:   p.slices[i].Id,
+			GroupId:   p.groups[i],
+			Label:     p.label,
+			MetricId:  metricId,
+			Value:     v,
+			Mean:      mean,
+			StdDev:    stdDev,
+			Deviation: (v - mean) / stdDev,
+		})
+	}
+	return outs
+}
+
+// Return the outliers of the slices and of the leaf groups, see
+// Options.OutlierSigma: the slices whose duration, in nanoseconds, deviates
+// from the ones of the other slices of the same label, reported as their GPU
+// time, and the groups whose value of a counter metric deviates from the ones
+// of the other groups of the same label, the label of their first slice. The
+// outliers are sorted by decreasing absolute deviation. The slices are the
+// attributed slices of all the groups, sorted by start time, and ids the
+// layout of the metric ids, for the counter metrics.
+func outliers(slices []*service.ProfilingData_GpuSlices_Slice, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry, metrics []*service.ProfilingData_GpuCounters_Metric, ids *metricIds, sigma float64) []*service.ProfilingData_GpuCounters_Outlier {
+	durations := map[string]*outlierPopulation{}
+	labels := []string{}
+	firstSlices := map[int32]*service.ProfilingData_GpuSlices_Slice{}
+	for _, slice := range slices {
+		p, ok := durations[slice.Label]
+		if !ok {
+			p = &outlierPopulation{label: slice.Label}
+			durations[slice.Label] = p
+			labels = append(labels, slice.Label)
+		}
+		p.values = append(p.values, float64(slice.Dur))
+		p.slices = append(p.slices, slice)
+		p.groups = append(p.groups, slice.GroupId)
+		if _, ok := firstSlices[slice.GroupId]; !ok {
+			firstSlices[slice.GroupId] = slice
+		}
+	}
+	outs := []*service.ProfilingData_GpuCounters_Outlier{}
+	for _, label := range labels {
+		outs = durations[label].outliers(outs, gpuTimeMetricId, sigma)
+	}
+
+	// The groups in the order of their first slice.
+	groupIds := []int32{}
+	for groupId := range groupToEntry {
+		if _, ok := firstSlices[groupId]; ok {
+			groupIds = append(groupIds, groupId)
+		}
+	}
+	sort.Slice(groupIds, func(i, j int) bool {
+		a, b := firstSlices[groupIds[i]], firstSlices[groupIds[j]]
+		return a.Ts < b.Ts || a.Ts == b.Ts && a.Id < b.Id
+	})
+	for _, metric := range metrics {
+		if metric.Id < ids.counter || metric.Id >= ids.nearest {
+			continue
+		}
+		values := map[string]*outlierPopulation{}
+		labels := []string{}
+		for _, groupId := range groupIds {
+			perf, ok := groupToEntry[groupId].MetricToValue[metric.Id]
+			if !ok || isUnavailable(perf) {
+				continue
+			}
+			slice := firstSlices[groupId]
+			p, ok := values[slice.Label]
+			if !ok {
+				p = &outlierPopulation{label: slice.Label}
+				values[slice.Label] = p
+				labels = append(labels, slice.Label)
+			}
+			p.values = append(p.values, perf.Estimate)
+			p.slices = append(p.slices, slice)
+			p.groups = append(p.groups, groupId)
+		}
+		for _, label := range labels {
+			outs = values[label].outliers(outs, metric.Id, sigma)
+		}
+	}
+	sortOutliers(outs)
+	return outs
+}
+
+// Sort the outliers by decreasing absolute deviation, the outliers tied
+// keeping their order.
+func sortOutliers(outs []*service.ProfilingData_GpuCounters_Outlier) {
+	sort.SliceStable(outs, func(i, j int) bool {
+		return math.Abs(outs[i].Deviation) > math.Abs(outs[j].Deviation)
+	})
+}
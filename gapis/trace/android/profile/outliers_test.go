@@ -0,0 +1,78 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+// labelledSlice builds a GPU slice of the given id and label.
+func labelledSlice(id uint64, groupId int32, ts, dur uint64, label string) *service.ProfilingData_GpuSlices_Slice {
+	s := slice(groupId, ts, dur)
+	s.Id, s.Label = id, label
+	return s
+}
+
+func TestOutliers(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{
+			group(0, 0), group(1, 1), group(2, 2), group(3, 3), group(4, 4), group(5, 5), group(6, 6),
+		},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			labelledSlice(10, 0, 0, 10, "draw"),
+			labelledSlice(11, 1, 20, 11, "draw"),
+			labelledSlice(12, 2, 40, 10, "draw"),
+			labelledSlice(13, 3, 60, 11, "draw"),
+			labelledSlice(14, 4, 80, 10, "draw"),
+			labelledSlice(15, 5, 100, 30, "draw"), // Too long.
+			labelledSlice(16, 6, 140, 50, "blit"), // Alone of its label.
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		// The samples of group 2 are much higher.
+		counter("Busy",
+			[]uint64{0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 110, 120, 130, 140, 190},
+			[]float64{0, 1, 0, 2, 0, 40, 0, 1, 0, 2, 0, 1, 2, 1, 0, 5}),
+	}
+	res, err := ComputeCounters(ctx, slices, counters, &Options{OutlierSigma: 3})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "count").ThatSlice(res.Outliers).IsLength(2)
+
+	duration, busy := res.Outliers[0], res.Outliers[1]
+	if duration.MetricId != gpuTimeMetricId {
+		duration, busy = busy, duration
+	}
+	assert.For(ctx, "duration slice").That(duration.SliceId).Equals(uint64(15))
+	assert.For(ctx, "duration label").That(duration.Label).Equals("draw")
+	assert.For(ctx, "duration value").ThatFloat(duration.Value).Equals(30, 1e-9)
+	assert.For(ctx, "duration mean").ThatFloat(duration.Mean).Equals(10.4, 1e-9)
+	assert.For(ctx, "duration sign").That(duration.Deviation > 3).Equals(true)
+	assert.For(ctx, "busy group").That(busy.GroupId).Equals(int32(2))
+	assert.For(ctx, "busy slice").That(busy.SliceId).Equals(uint64(12))
+	assert.For(ctx, "busy metric").That(busy.MetricId).Equals(counterMetricIdOffset)
+	assert.For(ctx, "busy sign").That(busy.Deviation > 3).Equals(true)
+	// By decreasing deviation.
+	assert.For(ctx, "sorted").That(res.Outliers[0].Deviation >= res.Outliers[1].Deviation).Equals(true)
+
+	// Chunked, the groups of all the chunks are compared.
+	chunked, err := ComputeCounters(ctx, slices, counters, &Options{OutlierSigma: 3, ChunkGroups: 2})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "chunked").That(chunked.Outliers).DeepEquals(res.Outliers)
+}
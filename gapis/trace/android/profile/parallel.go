@@ -0,0 +1,108 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// The values attributed to the groups from a single counter, kept apart from
+// the shared entries so the counters can be attributed concurrently, see
+// setGpuCounterMetrics.
+type counterAttribution struct {
+	entries   map[int32]*service.ProfilingData_GpuCounters_Entry
+	densities map[int32]float64
+}
+
+func newCounterAttribution() *counterAttribution {
+	return &counterAttribution{
+		entries:   map[int32]*service.ProfilingData_GpuCounters_Entry{},
+		densities: map[int32]float64{},
+	}
+}
+
+// Return the entry of the group holding the values of the counter.
+func (a *counterAttribution) entry(groupId int32) *service.ProfilingData_GpuCounters_Entry {
+	entry, ok := a.entries[groupId]
+	if !ok {
+		entry = &service.ProfilingData_GpuCounters_Entry{MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{}}
+		a.entries[groupId] = entry
+	}
+	return entry
+}
+
+// Record the sample density of the counter in the group.
+func (a *counterAttribution) density(groupId int32, d float64) {
+	if current, ok := a.densities[groupId]; !ok || d < current {
+		a.densities[groupId] = d
+	}
+}
+
+// Merge the values of the counter into the entries of the groups, and its
+// densities through the density callback.
+func (a *counterAttribution) mergeInto(groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry, density func(groupId int32, d float64)) {
+	for groupId, entry := range a.entries {
+		target := groupToEntry[groupId]
+		for id, perf := range entry.MetricToValue {
+			target.MetricToValue[id] = perf
+		}
+		for id, confidence := range entry.MetricToConfidence {
+			setConfidence(target, id, confidence)
+		}
+		for id, coverage := range entry.MetricToCoverage {
+			setCoverage(target, id, coverage)
+		}
+		for _, id := range entry.GappedMetrics {
+			addGappedMetric(target, id)
+		}
+	}
+	for groupId, d := range a.densities {
+		density(groupId, d)
+	}
+}
+
+// Call f for each index in [0, n), from at most GOMAXPROCS goroutines, and
+// return once all the calls returned.
+func forEachCounter(n int, f func(i int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	indices := make(chan int)
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
@@ -0,0 +1,63 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestForEachCounter(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, n := range []int{0, 1, 100} {
+		mutex := sync.Mutex{}
+		calls := map[int]int{}
+		forEachCounter(n, func(i int) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			calls[i]++
+		})
+		assert.For(ctx, "calls of %v", n).ThatMap(calls).IsLength(n)
+		for i, count := range calls {
+			assert.For(ctx, "calls of %v", i).That(count).Equals(1)
+		}
+	}
+}
+
+func TestParallelCounterMetrics(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, _ := twoCommandsFixture()
+	counters := []*service.ProfilingData_Counter{}
+	for i := 0; i < 16; i++ {
+		counters = append(counters, counter(fmt.Sprintf("Counter %v", i), []uint64{0, 10, 20, 30, 40}, []float64{0, float64(i), 4, float64(2 * i), 8}))
+	}
+	options := &Options{Confidence: true, Coverage: true, DensityConfidence: true, GapThreshold: 15}
+
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	serial, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	runtime.GOMAXPROCS(4)
+	for i := 0; i < 4; i++ {
+		parallel, err := ComputeCounters(ctx, slices, counters, options)
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "run %v", i).That(parallel).DeepEquals(serial)
+	}
+}
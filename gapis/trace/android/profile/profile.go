@@ -16,10 +16,14 @@ package profile
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/google/gapid/core/log"
 	"github.com/google/gapid/core/math/f64"
 	"github.com/google/gapid/core/math/u64"
@@ -28,145 +32,1890 @@ import (
 )
 
 const (
-	gpuTimeMetricId       int32 = 0
-	gpuWallTimeMetricId   int32 = 1
-	counterMetricIdOffset int32 = 2
+	gpuTimeMetricId           int32 = 0
+	gpuWallTimeMetricId       int32 = 1
+	gpuBusyIntervalsMetricId  int32 = 2
+	gpuSelfTimeMetricId       int32 = 3
+	gpuMaxConcurrencyMetricId int32 = 4
+	gpuSliceCountMetricId     int32 = 5
+	gpuFrameShareMetricId     int32 = 6
+	gpuChildrenTimeMetricId   int32 = 7
+	gpuLongestSliceMetricId   int32 = 8
+	gpuGlobalWallTimeMetricId int32 = 9
+	counterMetricIdOffset     int32 = 10
 )
 
+// CounterScale describes the conversion of a counter from the raw hardware
+// units reported by the vendor into its documented unit.
+type CounterScale struct {
+	Factor float64 // Multiplier applied to every sample value.
+	Unit   string  // Unit of the scaled values. Keeps the counter's unit if empty.
+}
+
+// TimeMetricOverride customizes a built-in time metric.
+type TimeMetricOverride struct {
+	Name string // Replaces the metric name if not empty.
+	// Unit is the time unit the nanosecond metrics are reported in, the values
+	// being converted accordingly. One of NANOSECOND, MICROSECOND,
+	// MILLISECOND or SECOND, any other unit keeps nanoseconds.
+	Unit device.GpuCounterDescriptor_MeasureUnit
+}
+
+// InstanceCount is the number of instances, or loop iterations, of the GPU
+// work issued by an instanced command.
+type InstanceCount struct {
+	CommandIndex []uint64
+	Count        uint64
+}
+
+// Nanoseconds per time unit, for the units the time metrics can be reported in.
+var nanosecondsPerUnit = map[device.GpuCounterDescriptor_MeasureUnit]float64{
+	device.GpuCounterDescriptor_NANOSECOND:  1,
+	device.GpuCounterDescriptor_MICROSECOND: 1e3,
+	device.GpuCounterDescriptor_MILLISECOND: 1e6,
+	device.GpuCounterDescriptor_SECOND:      1e9,
+}
+
+// RollupWeight selects how the leaf groups are weighted when their averaged
+// metrics are rolled up to their parent commands.
+type RollupWeight int
+
+const (
+	// RollupByGpuTime weights each leaf group by its GPU time.
+	RollupByGpuTime RollupWeight = iota
+	// RollupBySliceCount weights each leaf group by its number of slices, for
+	// counters where each slice is an equally important sample.
+	RollupBySliceCount
+)
+
+// Options customize how the GPU performance is computed.
+type Options struct {
+	// CounterAggregations maps counter names to their aggregation operator,
+	// such as Maximum for a temperature or a percentile for a bandwidth,
+	// overriding all the other choices of operator, see counterAggregation.
+	CounterAggregations map[string]service.ProfilingData_GpuCounters_Metric_AggregationOperator
+	// SummedCounters names the cumulative counters, whose samples count the
+	// events of their interval, such as the fragments shaded or the bytes
+	// written. They are aggregated with Summation, every command getting the
+	// share of each sample it overlaps, rather than averaged.
+	SummedCounters []string
+	// RunningTotalCounters names the counters reporting running totals, such
+	// as the bytes written since boot, rather than the counts of their
+	// intervals. Their samples are converted to the increments of the total
+	// before the attribution, see totalIncrements, and aggregated with
+	// Summation.
+	RunningTotalCounters []string
+	// DetectRunningTotals also treats as running totals the counters whose
+	// valid samples never decrease, see isRunningTotal. As the detection
+	// needs the samples, MetricCatalog only knows the RunningTotalCounters.
+	DetectRunningTotals bool
+	// CounterDescriptor describes the counters, matched by name, whose
+	// aggregation operator then derives from the units of their spec, see
+	// specAggregation.
+	CounterDescriptor *device.GpuCounterDescriptor
+	// Vendor, such as "adreno" or "mali", selects the aggregation operators
+	// registered for the vendor's counters, see RegisterVendorAggregations,
+	// which take precedence over the ones of the CounterDescriptor, and the
+	// vendor's derived metrics, see RegisterDerivedMetrics.
+	Vendor string
+	// CounterScales maps counter names to the scale applied to their sample
+	// values before aggregation.
+	CounterScales map[string]CounterScale
+	// NormalizeUnits converts the counters of known units, the ones of their
+	// descriptor spec or else their parsed unit, to their canonical units
+	// before aggregation, so that the counters reported with different
+	// multipliers by different vendors are comparable: the bits, bytes,
+	// hertz and watts without prefix, the nanoseconds, and the rates per
+	// second. The CounterScales take precedence.
+	NormalizeUnits bool
+	// CounterTimeOffset is the signed offset, in nanoseconds, added to the
+	// counter timestamps to align them with the clock domain of the GPU slices.
+	CounterTimeOffset int64
+	// IncludeGroupEntries adds the leaf entries of the GPU slice groups, keyed
+	// by group id, to the result.
+	IncludeGroupEntries bool
+	// NearestSampleMetrics adds a debug metric per counter, reporting the raw
+	// value of the counter sample nearest to the start of the command's first
+	// slice, without any weighting. Parent commands report the GPU time
+	// weighted average of their leaves' values.
+	NearestSampleMetrics bool
+	// WallTimeGapThreshold is the duration, in nanoseconds, under which the
+	// idle gaps between the slices of a group are still considered busy in
+	// the GPU wall time.
+	WallTimeGapThreshold uint64
+	// TrackIds restricts the computation to the slices on those tracks, each
+	// track being a GPU queue. All the tracks are used if empty.
+	TrackIds []int32
+	// SliceFilter selects the GPU slices taken into account, see SliceFilter.
+	SliceFilter SliceFilter
+	// QueueScopedCounters names the counters measured per GPU queue, the
+	// track of the slices, whose samples are then only shared among the
+	// slices on the same queue, see queueScopedAttribution. The slices on
+	// the other queues run genuinely concurrently and don't dilute them.
+	QueueScopedCounters []string
+	// RollupWeight is the weight of the leaf groups when rolling up averaged
+	// metrics to their parent commands.
+	RollupWeight RollupWeight
+	// CriticalPathOnly attributes the counter samples only to the slices on
+	// the critical path of each command, see criticalPathSlices. The slices
+	// hidden under others are ignored by the counter metrics, including the
+	// concurrency weighting, but still count in the time metrics.
+	CriticalPathOnly bool
+	// TimeMetricOverrides maps the default names of the built-in time metrics,
+	// such as "GPU Time", to their customization.
+	TimeMetricOverrides map[string]TimeMetricOverride
+	// PessimisticMetrics adds a metric per counter, reporting the worst case
+	// upper bound of the counter for each command: every sample overlapping
+	// the command's slices is attributed in full, regardless of concurrency.
+	// The bound of averaged counters is the largest such sample.
+	PessimisticMetrics bool
+	// SmoothingRadius smooths the counter samples before the attribution,
+	// replacing each value by the average of the valid samples up to
+	// SmoothingRadius samples before and after it. The window is truncated at
+	// the ends of the counter. The samples aren't smoothed if zero.
+	SmoothingRadius int
+	// Interpolation selects how the counter signal is reconstructed within
+	// the samples partially overlapping a slice. With LinearInterpolation,
+	// the samples are split at the slice boundaries, their pieces valued from
+	// the piecewise-linear signal through the samples, which estimates the
+	// commands of the high frequency counters better. The SampleCount of the
+	// values then counts the pieces. The DualAggregationCounters are never
+	// interpolated.
+	Interpolation CounterInterpolation
+	// Attribution names the strategy attributing the counter samples to the
+	// GPU slice groups, either one of the built-in ones, such as
+	// OverlapAttribution, or one registered with RegisterCounterAttributor.
+	// The samples are attributed proportionally if empty or unknown.
+	Attribution string
+	// ClockGatingCounter names the counter telling whether the GPU is active,
+	// its samples of value 0 or less denoting clock-gated periods. The samples
+	// of the other counters spent gated for more than half of their span are
+	// then excluded from the attribution to the commands, so that the gated
+	// state doesn't drag down the averages of the active commands.
+	ClockGatingCounter string
+	// DualAggregationCounters names the counters to also aggregate with the
+	// complement of their aggregation operator, Summation for the averaged
+	// counters and TimeWeightedAvg for the summed ones, as a second metric.
+	DualAggregationCounters []string
+	// MagnitudeWeightedCounters names the proportional counters whose samples
+	// are also weighted by their magnitude, see magnitudeWeights, so that the
+	// dominant samples of a command aren't diluted by the trivial ones.
+	MagnitudeWeightedCounters []string
+	// ChunkGroups, if positive, bounds the peak memory by attributing and
+	// merging the groups in chunks of whole top level commands of at most
+	// ChunkGroups groups, releasing the intermediate state of each chunk. The
+	// result is the same, at the cost of scanning all the slices and counter
+	// samples for every chunk. It is ignored with NormalizedValues, which
+	// needs all the groups at once.
+	ChunkGroups int
+	// TopSlices, if positive, adds to every entry its TopSlices longest GPU
+	// slices, so that the dominant slices of an expensive command are found
+	// directly.
+	TopSlices int
+	// SampleStatistics adds to the counter values the time-weighted standard
+	// deviation of their attributed samples and the number of those samples,
+	// see setSampleStatistics, telling how trustworthy each value is.
+	SampleStatistics bool
+	// SkipBands only computes the estimate of the counter metrics, their Min
+	// and Max being set to the estimate, which roughly halves the counter
+	// attribution work.
+	SkipBands bool
+	// DerivedMetrics are the metrics computed from the other metrics of every
+	// command by a formula, see DerivedMetric, after the ones registered for
+	// the Vendor.
+	DerivedMetrics []DerivedMetric
+	// RatioMetrics are the metrics derived by dividing the metrics of every
+	// command, see RatioMetric.
+	RatioMetrics []RatioMetric
+	// NormalizedValues adds to every entry its estimates normalized by the
+	// ones of the whole frame, merged from all the leaf groups like a command.
+	NormalizedValues bool
+	// IncludeIdleEntry adds the entry of the GPU counters performance over the
+	// idle periods, outside of the union of the GPU slices, to the result.
+	IncludeIdleEntry bool
+	// Confidence adds to every entry the confidence, in [0, 1], in the
+	// attribution of each counter, see attributionConfidence. The confidence
+	// of a command is merged from its leaf groups like a time-weighted
+	// average.
+	Confidence bool
+	// Coverage adds to every entry the fraction of its GPU time covered by
+	// valid samples of each counter, see sampleCoverage, for the clients to
+	// tell the metrics estimated from a small part of the command. The
+	// coverage of a command is merged from its leaf groups weighted by GPU
+	// time.
+	Coverage bool
+	// GapThreshold, if positive, detects the gaps in the counter samples,
+	// such as dropped counter packets: the samples spanning more than
+	// GapThreshold times the sampling period of their counter, see
+	// samplingPeriod, whose stale values would be smeared across the gap.
+	// They are left out of the attribution, like the invalid samples, and
+	// the entries whose slices they overlap list the counter metrics in their
+	// GappedMetrics.
+	GapThreshold float64
+	// DensityConfidence sets the density confidence of every entry, telling
+	// whether its least densely sampled counter covers at least one sampling
+	// period of the command, see sampleDensity. The commands shorter than the
+	// sampling period of a counter get values that are little more than
+	// guesses.
+	DensityConfidence bool
+	// QueueEntries adds to the entries of the commands whose leaf groups run
+	// on several GPU queues, the tracks of their slices, the entry of each
+	// queue merged from the groups on it only, like the command. A group is on
+	// the queue of its first slice.
+	QueueEntries bool
+	// StageEntries adds to the entries of the commands the entry of each of
+	// their render stages, such as binning or resolve, the nested slices at
+	// depth > 0 of their leaf groups, keyed by slice label, see
+	// setStageEntries.
+	StageEntries bool
+	// RenderPassEntries adds to the result the entry of each render pass, the
+	// slices carrying its handle as their renderPass extra, to tell the cost
+	// of the passes across the commands using them, see renderPassEntries.
+	RenderPassEntries bool
+	// FrameEntries adds to the result the entry of each frame, the groups whose
+	// first slice carries its id as their frameId extra, merged like a
+	// command, see frameEntries.
+	FrameEntries bool
+	// CommandGroupings adds to the result the entry of each grouping of
+	// commands, by label, the leaf groups of its commands merged like a
+	// command, in addition to the entries of the commands, see
+	// groupingEntries. A command may be in several groupings.
+	CommandGroupings []CommandGrouping
+	// StableMetricIds replaces the positional metric ids, which change with
+	// the counter set, with ids stable across captures, for the saved views
+	// and the diffs: the built-in time metrics keep their ids, the counter
+	// metrics get ids derived from the ids of their descriptor specs, or
+	// their names, and the ratio and derived metrics from their names, see
+	// stableMetricIds. The vendor producers set it.
+	StableMetricIds bool
+	// IdleGaps, if positive, adds to the result the IdleGaps longest periods
+	// a GPU queue, the track of the slices, spent idle between two slices,
+	// with the commands around them, and sets the idle time of the frame
+	// entries, see idleGaps. It tells whether the GPU is starved by the CPU.
+	IdleGaps int
+	// OutlierSigma, if positive, adds to the result the outliers, the slices
+	// whose duration and the groups whose counter metrics deviate by more
+	// than OutlierSigma standard deviations from the other slices, or groups,
+	// of the same label, to point at the jank, see outliers.
+	OutlierSigma float64
+	// MonotonicTimestamps rebases the timestamps of the counters and of the
+	// slices of each track that jump backwards, after a wrap-around or a
+	// suspend, into a monotonic domain before the computation, instead of
+	// assuming them increasing, and flags the jumps in the warnings, see
+	// monotonicTimestamps. The slices and the samples are expected in the
+	// order they were recorded, such as the one of their trace processor row
+	// ids, for the jumps not to be hidden by sorting them by time.
+	MonotonicTimestamps bool
+	// MaxCounterNameLength, if positive, truncates the counter names in the
+	// names of their metrics to that many characters. The control characters
+	// are always removed from them, see sanitizeCounterName.
+	MaxCounterNameLength int
+	// InstanceCounts adds to the entries of the instanced commands their
+	// summed metrics divided by the instance count, see setPerInstanceValues.
+	InstanceCounts []InstanceCount
+	// FrequencyCounter names the counter of the GPU clock frequency, from
+	// which the GPU cycles and the frequency normalized GPU time of the
+	// commands are derived, see frequencyMetrics. The first counter in a
+	// frequency unit is used if empty.
+	FrequencyCounter string
+	// ReferenceFrequency is the frequency, in hertz, the GPU time is
+	// normalized to. The peak value of the frequency counter is used if zero.
+	ReferenceFrequency float64
+	// SkipFrequencyMetrics leaves out the metrics derived from the frequency
+	// counter.
+	SkipFrequencyMetrics bool
+	// MetricPolarities maps the counter names, the default names of the
+	// built-in time metrics and the names of the ratio and derived metrics to
+	// whether their larger values are better or worse. The durations are
+	// lower-is-better by default, the other metrics of unknown polarity.
+	MetricPolarities map[string]service.ProfilingData_GpuCounters_Metric_Polarity
+	// MetricCategories maps the counter names, the default names of the
+	// built-in time metrics and the names of the ratio and derived metrics to
+	// their category, overriding the one of the descriptor groups of the
+	// counters and the built-in classification, see metricCategory.
+	MetricCategories map[string]string
+}
+
 // For CPU commands, calculate their summarized GPU performance.
-func ComputeCounters(ctx context.Context, slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter) (*service.ProfilingData_GpuCounters, error) {
-	metrics := []*service.ProfilingData_GpuCounters_Metric{}
+// The groups whose slices all carry the value of a counter, as an extra named
+// after the counter, get the aggregate of those values rather than of the
+// attributed counter samples. The counters reported by several producers are
+// merged first, see dedupCounters. On the devices with several GPUs, the
+// slices and the counters of each GPU are computed separately, and the
+// entries are tagged with their GPU, see computeGpuCounters.
+// The parts of the computation skipped, or done from partial data, are
+// listed in the warnings of the result, while an error is returned if the
+// counters can't be computed at all, such as for an aggregation operator
+// not implemented.
+// If options is nil then the default computation is performed.
+func ComputeCounters(ctx context.Context, slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter, options *Options) (*service.ProfilingData_GpuCounters, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	if _, err := options.SliceFilter.matcher(slices); err != nil {
+		return nil, log.Errf(ctx, err, "Invalid GPU slice filter")
+	}
+	if err := checkAggregations(ctx, counters, options); err != nil {
+		return nil, err
+	}
+	w := &warnings{}
+	res, err := computeCounters(putWarnings(ctx, w), slices, counters, options)
+	if err != nil {
+		return nil, err
+	}
+	res.Warnings = w.list
+	return res, nil
+}
+
+// Compute the GPU counters as ComputeCounters does, for the options checked.
+func computeCounters(ctx context.Context, slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter, options *Options) (*service.ProfilingData_GpuCounters, error) {
+	if options.MonotonicTimestamps {
+		slices, counters = monotonicTimestamps(ctx, slices, counters)
+	}
+	counters, duplicates := dedupCounters(counters, options)
+	logDuplicates(ctx, duplicates)
+	if gpus := gpuIds(slices, counters); len(gpus) > 1 {
+		return computeGpuCounters(ctx, slices, counters, gpus, options)
+	}
+	return computeSingleGpuCounters(ctx, slices, counters, options)
+}
+
+// Compute the GPU counters as computeCounters does, for the slices and the
+// counters prepared and of a single GPU.
+func computeSingleGpuCounters(ctx context.Context, slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter, options *Options) (*service.ProfilingData_GpuCounters, error) {
+	if options.ChunkGroups > 0 && !options.NormalizedValues {
+		if chunks := commandChunks(slices.Groups, options.ChunkGroups); len(chunks) > 1 {
+			res := computeChunkedCounters(ctx, slices, counters, chunks, options)
+			if options.StableMetricIds {
+				remapResult(res, counters, options)
+			}
+			return res, nil
+		}
+	}
+	metrics, groupToEntry, globalSlices := computeLeafEntries(ctx, slices, counters, nil, options)
+	ids := newMetricIds(len(counters), options)
+
+	// Merge and organize the leaf entries.
+	entries, frame := mergeCommandTree(ctx, metrics, ids, groupToEntry, options, options.NormalizedValues)
+	if options.NormalizedValues {
+		setNormalizedValues(entries, frame)
+	}
+	if options.QueueEntries {
+		setQueueEntries(ctx, metrics, ids, groupToEntry, globalSlices, entries, options)
+	}
+	if options.StageEntries {
+		setStageEntries(ctx, slices, counters, nil, entries, options)
+	}
+
+	res := &service.ProfilingData_GpuCounters{
+		Metrics: metrics,
+		Entries: entries,
+	}
+	if options.IncludeGroupEntries {
+		res.GroupToEntry = groupToEntry
+	}
+	if options.IncludeIdleEntry {
+		res.IdleEntry = idleCounterEntry(ctx, globalSlices, counters, options)
+	}
+	if options.RenderPassEntries {
+		res.RenderPassToEntry = renderPassEntries(ctx, slices, counters, options)
+	}
+	if options.FrameEntries {
+		frameLeaves := map[uint64]map[int32]*service.ProfilingData_GpuCounters_Entry{}
+		addFrameLeaves(frameLeaves, groupToEntry, groupFrames(slices))
+		res.FrameToEntry = frameEntries(ctx, metrics, ids, frameLeaves, options)
+	}
+	if len(options.CommandGroupings) != 0 {
+		labelLeaves := map[string]map[int32]*service.ProfilingData_GpuCounters_Entry{}
+		addGroupingLeaves(labelLeaves, groupToEntry, groupLabels(slices.Groups, options.CommandGroupings))
+		res.LabelToEntry = groupingEntries(ctx, metrics, ids, labelLeaves, options)
+	}
+	if options.IdleGaps > 0 {
+		setIdleGaps(res, slices, globalSlices, options)
+	}
+	if options.OutlierSigma > 0 {
+		res.Outliers = outliers(globalSlices, groupToEntry, metrics, ids, options.OutlierSigma)
+	}
+	if options.StableMetricIds {
+		remapResult(res, counters, options)
+	}
+	return res, nil
+}
+
+// Split the groups into chunks of whole top level commands, in the order of
+// the commands, each of at most size groups unless a single top level command
+// has more. The chunks map the ids of their groups to true.
+func commandChunks(groups []*service.ProfilingData_GpuSlices_Group, size int) []map[int32]bool {
+	topLevel := map[uint64][]int32{}
+	commands := []uint64{}
+	for _, group := range groups {
+		command := uint64(0) // The groups of the root go with the first command.
+		if len(group.Link.Indices) != 0 {
+			command = group.Link.Indices[0]
+		}
+		if _, ok := topLevel[command]; !ok {
+			commands = append(commands, command)
+		}
+		topLevel[command] = append(topLevel[command], group.Id)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i] < commands[j] })
+
+	chunks := []map[int32]bool{}
+	var chunk map[int32]bool
+	for _, command := range commands {
+		ids := topLevel[command]
+		if chunk == nil || len(chunk)+len(ids) > size {
+			chunk = make(map[int32]bool, size)
+			chunks = append(chunks, chunk)
+		}
+		for _, id := range ids {
+			chunk[id] = true
+		}
+	}
+	return chunks
+}
+
+// Compute the GPU counters one chunk of top level commands at a time, see
+// Options.ChunkGroups. Only the entries of a chunk are kept once merged.
+func computeChunkedCounters(ctx context.Context, slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter, chunks []map[int32]bool, options *Options) *service.ProfilingData_GpuCounters {
+	res := &service.ProfilingData_GpuCounters{}
+	if options.IncludeGroupEntries {
+		res.GroupToEntry = map[int32]*service.ProfilingData_GpuCounters_Entry{}
+	}
+	var globalSlices []*service.ProfilingData_GpuSlices_Slice
+	// The leaf entries of the frames, which may span several chunks.
+	var frames map[int32]uint64
+	frameLeaves := map[uint64]map[int32]*service.ProfilingData_GpuCounters_Entry{}
+	if options.FrameEntries {
+		frames = groupFrames(slices)
+	}
+	// The leaf entries of the command groupings, likewise.
+	labels := groupLabels(slices.Groups, options.CommandGroupings)
+	labelLeaves := map[string]map[int32]*service.ProfilingData_GpuCounters_Entry{}
+	// The leaf entries of all the chunks, for their outliers.
+	var leaves map[int32]*service.ProfilingData_GpuCounters_Entry
+	if options.OutlierSigma > 0 {
+		leaves = map[int32]*service.ProfilingData_GpuCounters_Entry{}
+	}
+	ids := newMetricIds(len(counters), options)
+	for _, chunk := range chunks {
+		inChunk := func(group *service.ProfilingData_GpuSlices_Group) bool { return chunk[group.Id] }
+		metrics, groupToEntry, filteredSlices := computeLeafEntries(ctx, slices, counters, inChunk, options)
+		entries, _ := mergeCommandTree(ctx, metrics, ids, groupToEntry, options, false)
+		if options.QueueEntries {
+			setQueueEntries(ctx, metrics, ids, groupToEntry, filteredSlices, entries, options)
+		}
+		if options.StageEntries {
+			setStageEntries(ctx, slices, counters, inChunk, entries, options)
+		}
+		res.Metrics, globalSlices = metrics, filteredSlices
+		res.Entries = append(res.Entries, entries...)
+		if options.FrameEntries {
+			addFrameLeaves(frameLeaves, groupToEntry, frames)
+		}
+		addGroupingLeaves(labelLeaves, groupToEntry, labels)
+		if options.OutlierSigma > 0 {
+			for groupId, entry := range groupToEntry {
+				leaves[groupId] = entry
+			}
+		}
+		if options.IncludeGroupEntries {
+			for groupId, entry := range groupToEntry {
+				res.GroupToEntry[groupId] = entry
+			}
+		}
+	}
+	if options.IncludeIdleEntry {
+		res.IdleEntry = idleCounterEntry(ctx, globalSlices, counters, options)
+	}
+	if options.RenderPassEntries {
+		res.RenderPassToEntry = renderPassEntries(ctx, slices, counters, options)
+	}
+	if options.FrameEntries {
+		res.FrameToEntry = frameEntries(ctx, res.Metrics, ids, frameLeaves, options)
+	}
+	res.LabelToEntry = groupingEntries(ctx, res.Metrics, ids, labelLeaves, options)
+	if options.IdleGaps > 0 {
+		setIdleGaps(res, slices, globalSlices, options)
+	}
+	if options.OutlierSigma > 0 {
+		res.Outliers = outliers(globalSlices, leaves, res.Metrics, ids, options.OutlierSigma)
+	}
+	return res
+}
+
+// ComputeCommandCounters calculates the summarized GPU performance of the
+// single command at commandIndex, as found in the entries of ComputeCounters
+// for the same slices, counters and options. Only the GPU slice groups of the
+// command are attributed, but all the slices are still accounted for when
+// weighting the counter samples by concurrency. On the devices with several
+// GPUs, the entry of the first GPU running the command is returned.
+// If options is nil then the default computation is performed.
+func ComputeCommandCounters(ctx context.Context, slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter, commandIndex []uint64, options *Options) (*service.ProfilingData_GpuCounters_Entry, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	if _, err := options.SliceFilter.matcher(slices); err != nil {
+		return nil, log.Errf(ctx, err, "Invalid GPU slice filter")
+	}
+	if err := checkAggregations(ctx, counters, options); err != nil {
+		return nil, err
+	}
+	if options.MonotonicTimestamps {
+		slices, counters = monotonicTimestamps(ctx, slices, counters)
+	}
+	counters, duplicates := dedupCounters(counters, options)
+	logDuplicates(ctx, duplicates)
+	if gpus := gpuIds(slices, counters); len(gpus) > 1 {
+		// The entry of the first GPU running the command.
+		_, perGpu := alignGpuCounters(counters, gpus, options)
+		for _, gpu := range gpus {
+			if entry, err := ComputeCommandCounters(ctx, gpuSlices(slices, gpu), perGpu[gpu], commandIndex, options); err == nil {
+				tagGpu(entry, gpu)
+				return entry, nil
+			}
+		}
+		return nil, log.Errf(ctx, nil, "No GPU slice found for command %v", commandIndex)
+	}
+	inCommand := func(group *service.ProfilingData_GpuSlices_Group) bool {
+		return inSubtree(group.Link.Indices, commandIndex)
+	}
+	metrics, groupToEntry, filteredSlices := computeLeafEntries(ctx, slices, counters, inCommand, options)
+	ids := newMetricIds(len(counters), options)
+
+	entries := mergeLeafEntries(ctx, metrics, ids, groupToEntry, options)
+	if options.QueueEntries {
+		setQueueEntries(ctx, metrics, ids, groupToEntry, filteredSlices, entries, options)
+	}
+	if options.StageEntries {
+		setStageEntries(ctx, slices, counters, inCommand, entries, options)
+	}
+	idx := encodeIndex(commandIndex)
+	for _, entry := range entries {
+		if encodeIndex(entry.CommandIndex) == idx {
+			if options.StableMetricIds {
+				remapEntry(entry, stableMetricIds(metrics, counters, options))
+			}
+			return entry, nil
+		}
+	}
+	return nil, log.Errf(ctx, nil, "No GPU slice found for command %v", commandIndex)
+}
+
+// Calculate the metrics metadata and the performance of the leaf GPU slice
+// groups, keyed by group id. If include is not nil, only the groups it
+// accepts get an entry, the slices of the other groups still contribute to
+// the counter samples concurrency. The attributed slices of all the groups
+// are returned too, sorted by start time.
+func computeLeafEntries(ctx context.Context, slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter, include func(*service.ProfilingData_GpuSlices_Group) bool, options *Options) ([]*service.ProfilingData_GpuCounters_Metric, map[int32]*service.ProfilingData_GpuCounters_Entry, []*service.ProfilingData_GpuSlices_Slice) {
+	metrics := make([]*service.ProfilingData_GpuCounters_Metric, 0, len(timeMetrics(options))+2*len(counters))
+	ids := newMetricIds(len(counters), options)
 
 	// Filter out the slices that are at depth 0 and belong to a command,
 	// then sort them based on the start time.
+	// Only the included groups get an entry, known holds all of them.
 	groupToEntry := map[int32]*service.ProfilingData_GpuCounters_Entry{}
+	known := make(map[int32]bool, len(slices.Groups))
 	for _, group := range slices.Groups {
-		groupToEntry[group.Id] = &service.ProfilingData_GpuCounters_Entry{
-			CommandIndex:  group.Link.Indices,
-			MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{},
+		known[group.Id] = true
+		if include == nil || include(group) {
+			groupToEntry[group.Id] = &service.ProfilingData_GpuCounters_Entry{
+				CommandIndex:  group.Link.Indices,
+				MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{},
+			}
 		}
 	}
+	tracks := map[int32]bool{}
+	for _, id := range options.TrackIds {
+		tracks[id] = true
+	}
+	// The filter is validated by the callers.
+	keep, _ := options.SliceFilter.matcher(slices)
 	filteredSlices := []*service.ProfilingData_GpuSlices_Slice{}
 	for i := 0; i < len(slices.Slices); i++ {
-		if slices.Slices[i].Depth == 0 && groupToEntry[slices.Slices[i].GroupId] != nil {
+		if len(tracks) != 0 && !tracks[slices.Slices[i].TrackId] || !keep(slices.Slices[i]) {
+			continue
+		}
+		if slices.Slices[i].Depth == 0 && known[slices.Slices[i].GroupId] {
 			filteredSlices = append(filteredSlices, slices.Slices[i])
 		}
 	}
-	sort.Slice(filteredSlices, func(i, j int) bool {
-		return filteredSlices[i].Ts < filteredSlices[j].Ts
-	})
+	sortSlices(filteredSlices)
 
 	// Group slices based on their group id.
 	groupToSlices := map[int32][]*service.ProfilingData_GpuSlices_Slice{}
 	for i := 0; i < len(filteredSlices); i++ {
 		groupId := filteredSlices[i].GroupId
-		groupToSlices[groupId] = append(groupToSlices[groupId], filteredSlices[i])
+		if groupToEntry[groupId] != nil {
+			groupToSlices[groupId] = append(groupToSlices[groupId], filteredSlices[i])
+		}
+	}
+	// Groups without any slice have no performance to report.
+	for groupId := range groupToEntry {
+		if _, ok := groupToSlices[groupId]; !ok {
+			delete(groupToEntry, groupId)
+		}
+	}
+
+	// The frame GPU time accounts for the slices of all the groups, including
+	// the ones left out.
+	frameGpuTime := uint64(0)
+	for _, slice := range filteredSlices {
+		frameGpuTime += slice.Dur
+	}
+
+	// Calculate GPU Time Performance and GPU Wall Time Performance for all leaf groups/commands.
+	setTimeMetrics(ctx, groupToSlices, selfTimes(slices.Slices), globalWallTimes(filteredSlices), frameGpuTime, options, &metrics, groupToEntry)
+
+	// Calculate GPU Counter Performances for all leaf groups/commands. This is
+	// skipped entirely when there is no counter, which is common for early
+	// profiling, so that only the time metrics are computed.
+	if len(counters) != 0 {
+		counterSlices := filteredSlices
+		if options.CriticalPathOnly {
+			groupToSlices, counterSlices = criticalPaths(filteredSlices, groupToSlices)
+		}
+		setGpuCounterMetrics(ctx, groupToSlices, counters, counterSlices, ids, options, &metrics, groupToEntry)
+		if options.NearestSampleMetrics {
+			setNearestSampleMetrics(ctx, groupToSlices, counters, ids, options, &metrics, groupToEntry)
+		}
+		if options.PessimisticMetrics {
+			setPessimisticMetrics(ctx, groupToSlices, counters, ids, options, &metrics, groupToEntry)
+		}
+		// The values of the dual aggregation metrics are set with the counters.
+		metrics = append(metrics, dualMetrics(counters, ids, options)...)
+	}
+
+	metrics = append(metrics, derivedMetricList(metrics, ids, options)...)
+	for i := range options.RatioMetrics {
+		metrics = append(metrics, ratioMetric(i, ids, options))
+	}
+	derived := resolveDerived(ctx, metrics, ids, options)
+	ratios := resolveRatios(ctx, metrics, ids, options)
+	for _, entry := range groupToEntry {
+		setDerivedMetrics(derived, entry)
+		setRatioMetrics(ratios, entry)
+	}
+	return metrics, groupToEntry, filteredSlices
+}
+
+// MetricCatalog returns the metrics metadata that ComputeCounters emits for
+// the given counters and options, in the same order, without computing any
+// performance value.
+// If options is nil then the default computation is assumed.
+func MetricCatalog(counters []*service.ProfilingData_Counter, options *Options) []*service.ProfilingData_GpuCounters_Metric {
+	if options == nil {
+		options = &Options{}
+	}
+	counters = catalogCounters(counters, options)
+	metrics := metricCatalog(counters, newMetricIds(len(counters), options), options)
+	if options.StableMetricIds {
+		remapMetrics(metrics, stableMetricIds(metrics, counters, options))
+	}
+	return metrics
+}
+
+// Return the counters the metrics are computed from, deduplicated and aligned
+// across the GPUs as ComputeCounters does.
+func catalogCounters(counters []*service.ProfilingData_Counter, options *Options) []*service.ProfilingData_Counter {
+	counters, _ = dedupCounters(counters, options)
+	if gpus := gpuIds(nil, counters); len(gpus) > 1 {
+		counters, _ = alignGpuCounters(counters, gpus, options)
+	}
+	return counters
+}
+
+// Return the metrics metadata computed from the counters, of their positional
+// ids.
+func metricCatalog(counters []*service.ProfilingData_Counter, ids *metricIds, options *Options) []*service.ProfilingData_GpuCounters_Metric {
+	metrics := timeMetrics(options)
+	for i, counter := range counters {
+		metrics = append(metrics, counterMetric(i, counter, options))
+	}
+	if options.NearestSampleMetrics {
+		for i, counter := range counters {
+			metrics = append(metrics, nearestSampleMetric(i, counter, ids, options))
+		}
+	}
+	if options.PessimisticMetrics {
+		for i, counter := range counters {
+			metrics = append(metrics, pessimisticMetric(i, counter, ids, options))
+		}
+	}
+	metrics = append(metrics, dualMetrics(counters, ids, options)...)
+	metrics = append(metrics, derivedMetricList(metrics, ids, options)...)
+	for i := range options.RatioMetrics {
+		metrics = append(metrics, ratioMetric(i, ids, options))
+	}
+	return metrics
+}
+
+// Restrict the slices of every group to their critical path. The global
+// slices, sorted by start time, only keep the critical ones of all the groups,
+// including the groups left out of groupToSlices.
+func criticalPaths(globalSlices []*service.ProfilingData_GpuSlices_Slice, groupToSlices map[int32][]*service.ProfilingData_GpuSlices_Slice) (map[int32][]*service.ProfilingData_GpuSlices_Slice, []*service.ProfilingData_GpuSlices_Slice) {
+	allGroups := map[int32][]*service.ProfilingData_GpuSlices_Slice{}
+	for _, slice := range globalSlices {
+		allGroups[slice.GroupId] = append(allGroups[slice.GroupId], slice)
+	}
+	critical := map[*service.ProfilingData_GpuSlices_Slice]bool{}
+	for _, slices := range allGroups {
+		for _, slice := range criticalPathSlices(slices) {
+			critical[slice] = true
+		}
+	}
+	criticalGroups := make(map[int32][]*service.ProfilingData_GpuSlices_Slice, len(groupToSlices))
+	for groupId, slices := range groupToSlices {
+		for _, slice := range slices {
+			if critical[slice] {
+				criticalGroups[groupId] = append(criticalGroups[groupId], slice)
+			}
+		}
+	}
+	criticalGlobal := make([]*service.ProfilingData_GpuSlices_Slice, 0, len(critical))
+	for _, slice := range globalSlices {
+		if critical[slice] {
+			criticalGlobal = append(criticalGlobal, slice)
+		}
+	}
+	return criticalGroups, criticalGlobal
+}
+
+// Create the metadata of the GPU time metrics, with the overrides of the
+// options applied.
+func timeMetrics(options *Options) []*service.ProfilingData_GpuCounters_Metric {
+	metrics := []*service.ProfilingData_GpuCounters_Metric{
+		{
+			Id:   gpuTimeMetricId,
+			Name: "GPU Time",
+			Unit: strconv.Itoa(int(device.GpuCounterDescriptor_NANOSECOND)),
+			Op:   service.ProfilingData_GpuCounters_Metric_Summation,
+		},
+		{
+			Id:   gpuWallTimeMetricId,
+			Name: "GPU Wall Time",
+			Unit: strconv.Itoa(int(device.GpuCounterDescriptor_NANOSECOND)),
+			Op:   service.ProfilingData_GpuCounters_Metric_Summation,
+		},
+		{
+			Id:   gpuBusyIntervalsMetricId,
+			Name: "GPU Busy Intervals",
+			Unit: strconv.Itoa(int(device.GpuCounterDescriptor_NONE)),
+			Op:   service.ProfilingData_GpuCounters_Metric_Summation,
+		},
+		{
+			Id:   gpuSelfTimeMetricId,
+			Name: "GPU Self Time",
+			Unit: strconv.Itoa(int(device.GpuCounterDescriptor_NANOSECOND)),
+			Op:   service.ProfilingData_GpuCounters_Metric_Summation,
+		},
+		{
+			Id:   gpuMaxConcurrencyMetricId,
+			Name: "GPU Max Concurrent Slices",
+			Unit: strconv.Itoa(int(device.GpuCounterDescriptor_NONE)),
+			Op:   service.ProfilingData_GpuCounters_Metric_Maximum,
+		},
+		{
+			Id:   gpuSliceCountMetricId,
+			Name: "GPU Slices",
+			Unit: strconv.Itoa(int(device.GpuCounterDescriptor_NONE)),
+			Op:   service.ProfilingData_GpuCounters_Metric_Summation,
+		},
+		{
+			Id:   gpuFrameShareMetricId,
+			Name: "GPU Time Frame Share",
+			Unit: strconv.Itoa(int(device.GpuCounterDescriptor_PERCENT)),
+			Op:   service.ProfilingData_GpuCounters_Metric_Summation,
+		},
+		{
+			Id:   gpuChildrenTimeMetricId,
+			Name: "GPU Children Time",
+			Unit: strconv.Itoa(int(device.GpuCounterDescriptor_NANOSECOND)),
+			Op:   service.ProfilingData_GpuCounters_Metric_Summation,
+		},
+		{
+			Id:   gpuLongestSliceMetricId,
+			Name: "GPU Longest Slice",
+			Unit: strconv.Itoa(int(device.GpuCounterDescriptor_NANOSECOND)),
+			Op:   service.ProfilingData_GpuCounters_Metric_Maximum,
+		},
+		{
+			Id:   gpuGlobalWallTimeMetricId,
+			Name: "GPU Global Wall Time",
+			Unit: strconv.Itoa(int(device.GpuCounterDescriptor_NANOSECOND)),
+			Op:   service.ProfilingData_GpuCounters_Metric_Summation,
+		},
+	}
+	for _, metric := range metrics {
+		name := metric.Name
+		unit, _ := strconv.Atoi(metric.Unit)
+		if override, ok := options.TimeMetricOverrides[name]; ok {
+			if _, ok := timeMetricScale(metric, override); ok {
+				metric.Unit = strconv.Itoa(int(override.Unit))
+				unit = int(override.Unit)
+			}
+			if override.Name != "" {
+				metric.Name = override.Name
+			}
+		}
+		setTimeMetricMetadata(metric, name, device.GpuCounterDescriptor_MeasureUnit(unit), options)
+	}
+	return metrics
+}
+
+// Return the factors dividing the nanosecond values of the built-in time
+// metrics converted by the overrides of the options, keyed by metric id.
+func timeMetricScales(options *Options) map[int32]float64 {
+	scales := map[int32]float64{} // metric id -> nanoseconds per reported unit.
+	for _, metric := range timeMetrics(&Options{}) {
+		if override, ok := options.TimeMetricOverrides[metric.Name]; ok {
+			if scale, ok := timeMetricScale(metric, override); ok {
+				scales[metric.Id] = scale
+			}
+		}
+	}
+	return scales
+}
+
+// Return the factor dividing the nanosecond values of the built-in time metric
+// to report them in the unit of the override, and whether the metric is
+// converted at all.
+func timeMetricScale(metric *service.ProfilingData_GpuCounters_Metric, override TimeMetricOverride) (float64, bool) {
+	if metric.Unit != strconv.Itoa(int(device.GpuCounterDescriptor_NANOSECOND)) {
+		return 1, false
+	}
+	ns, ok := nanosecondsPerUnit[override.Unit]
+	if !ok || ns == 1 {
+		return 1, false
+	}
+	return ns, true
+}
+
+// Create the metadata of the metric for the i-th GPU counter.
+func counterMetric(i int, counter *service.ProfilingData_Counter, options *Options) *service.ProfilingData_GpuCounters_Metric {
+	unit := counter.Unit
+	if scale, ok := counterScale(counter, options); ok && scale.Unit != "" {
+		unit = scale.Unit
+	}
+	metric := &service.ProfilingData_GpuCounters_Metric{
+		Id:          counterMetricIdOffset + int32(i),
+		Name:        sanitizeCounterName(counter.Name, options.MaxCounterNameLength),
+		Unit:        unit,
+		Op:          getCounterAggregationMethod(counter, options),
+		CounterName: counter.Name,
+	}
+	setCounterMetadata(metric, counter, options)
+	return metric
+}
+
+// Return the counter name fit for the metric names: the control characters
+// are removed, the whitespace ones, such as newlines, being replaced by
+// spaces, and the name is truncated to maxLength characters if positive.
+func sanitizeCounterName(name string, maxLength int) string {
+	sanitized := []rune(strings.Map(func(r rune) rune {
+		switch {
+		case !unicode.IsControl(r):
+			return r
+		case unicode.IsSpace(r):
+			return ' '
+		default:
+			return -1
+		}
+	}, name))
+	if maxLength > 0 && len(sanitized) > maxLength {
+		sanitized = sanitized[:maxLength]
+	}
+	return string(sanitized)
+}
+
+// Create the metadata of the nearest sample debug metric for the i-th GPU
+// counter. Those metrics come after all the counter metrics.
+func nearestSampleMetric(i int, counter *service.ProfilingData_Counter, ids *metricIds, options *Options) *service.ProfilingData_GpuCounters_Metric {
+	metric := counterMetric(i, counter, options)
+	metric.Id = ids.nearest + int32(i)
+	metric.Name = "[Debug] " + metric.Name + " (nearest raw sample)"
+	metric.Op = service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg
+	return metric
+}
+
+// Create the metadata of the pessimistic upper bound metric for the i-th GPU
+// counter. Those metrics come after the nearest sample debug metrics. The
+// bound of a summed counter is summed up the command tree, the bound of the
+// other counters is the maximum of the leaves' bounds.
+func pessimisticMetric(i int, counter *service.ProfilingData_Counter, ids *metricIds, options *Options) *service.ProfilingData_GpuCounters_Metric {
+	metric := counterMetric(i, counter, options)
+	metric.Id = ids.pessimistic + int32(i)
+	metric.Name = metric.Name + " (pessimistic upper bound)"
+	if metric.Op != service.ProfilingData_GpuCounters_Metric_Summation {
+		metric.Op = service.ProfilingData_GpuCounters_Metric_Maximum
+	}
+	return metric
+}
+
+// Return the k longest of the spans and the slices, by decreasing duration
+// then increasing start time.
+func topSlices(spans []*service.ProfilingData_GpuCounters_SliceSpan, slices []*service.ProfilingData_GpuSlices_Slice, k int) []*service.ProfilingData_GpuCounters_SliceSpan {
+	top := make([]*service.ProfilingData_GpuCounters_SliceSpan, 0, len(spans)+len(slices))
+	for _, span := range spans {
+		top = append(top, &service.ProfilingData_GpuCounters_SliceSpan{Id: span.Id, Ts: span.Ts, Dur: span.Dur})
+	}
+	for _, slice := range slices {
+		top = append(top, &service.ProfilingData_GpuCounters_SliceSpan{Id: slice.Id, Ts: slice.Ts, Dur: slice.Dur})
+	}
+	sort.SliceStable(top, func(i, j int) bool {
+		if top[i].Dur != top[j].Dur {
+			return top[i].Dur > top[j].Dur
+		}
+		return top[i].Ts < top[j].Ts
+	})
+	if len(top) > k {
+		top = top[:k]
+	}
+	return top
+}
+
+// Set the top slices of a merged command entry from the ones of its own leaf
+// groups and of its children.
+func setMergedTopSlices(mergedEntry *service.ProfilingData_GpuCounters_Entry, node *commandNode, childEntries []*service.ProfilingData_GpuCounters_Entry, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry, k int) {
+	spans := []*service.ProfilingData_GpuCounters_SliceSpan{}
+	for _, id := range node.groups {
+		spans = append(spans, groupToEntry[id].TopSlices...)
+	}
+	for _, child := range childEntries {
+		spans = append(spans, child.TopSlices...)
+	}
+	mergedEntry.TopSlices = topSlices(spans, nil, k)
+}
+
+// Create the metadata of the dual aggregation metric of the i-th GPU counter,
+// see Options.DualAggregationCounters. Those metrics come after the ratio
+// metrics in the ids, but before them in the metrics.
+func dualMetric(i int, counter *service.ProfilingData_Counter, ids *metricIds, options *Options) *service.ProfilingData_GpuCounters_Metric {
+	metric := counterMetric(i, counter, options)
+	metric.Id = ids.dual + int32(i)
+	// The range of the samples bounds neither their sum nor, for the counts,
+	// their rate.
+	metric.MinValue, metric.MaxValue = 0, 0
+	if metric.Op == service.ProfilingData_GpuCounters_Metric_Summation {
+		metric.Name = metric.Name + " (time-weighted average)"
+		metric.Op = service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg
+	} else {
+		metric.Name = metric.Name + " (sum)"
+		metric.Op = service.ProfilingData_GpuCounters_Metric_Summation
+	}
+	return metric
+}
+
+// Return the dual aggregation metrics of the options' counters, in the order
+// of the counters.
+func dualMetrics(counters []*service.ProfilingData_Counter, ids *metricIds, options *Options) []*service.ProfilingData_GpuCounters_Metric {
+	dual := map[string]bool{}
+	for _, name := range options.DualAggregationCounters {
+		dual[name] = true
+	}
+	metrics := []*service.ProfilingData_GpuCounters_Metric{}
+	for i, counter := range counters {
+		if dual[counter.Name] {
+			metrics = append(metrics, dualMetric(i, counter, ids, options))
+		}
+	}
+	return metrics
+}
+
+// Create GPU time metric metadata, calculate time performance for each GPU
+// slice group, and append the result to corresponding entries.
+// selfTime holds the exclusive time of the slices, see selfTimes, globalWallTime
+// the global wall time of the groups, see globalWallTimes, and frameGpuTime the
+// GPU time of all the slices, of which each group reports its share. Summed up
+// the command tree, the shares of the top level commands add up to 100%.
+func setTimeMetrics(ctx context.Context, groupToSlices map[int32][]*service.ProfilingData_GpuSlices_Slice, selfTime map[*service.ProfilingData_GpuSlices_Slice]uint64, globalWallTime map[int32]float64, frameGpuTime uint64, options *Options, metrics *[]*service.ProfilingData_GpuCounters_Metric, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry) {
+	*metrics = append(*metrics, timeMetrics(options)...)
+	scales := timeMetricScales(options)
+	for groupId, slices := range groupToSlices {
+		gpuTime, wallTime, intervals := gpuTimeForGroup(slices, options.WallTimeGapThreshold)
+		if checkTimeInvariants && options.WallTimeGapThreshold == 0 {
+			checkWallTime(ctx, groupId, slices, gpuTime, wallTime)
+		}
+		gpuSelfTime, longestSlice := uint64(0), uint64(0)
+		for _, slice := range slices {
+			gpuSelfTime += selfTime[slice]
+			longestSlice = u64.Max(longestSlice, slice.Dur)
+		}
+		entry := groupToEntry[groupId]
+		if options.TopSlices > 0 {
+			entry.TopSlices = topSlices(nil, slices, options.TopSlices)
+		}
+		entry.MetricToValue[gpuTimeMetricId] = &service.ProfilingData_GpuCounters_Perf{
+			Estimate: float64(gpuTime),
+			Min:      float64(gpuTime),
+			Max:      float64(gpuTime),
+		}
+		entry.MetricToValue[gpuWallTimeMetricId] = &service.ProfilingData_GpuCounters_Perf{
+			Estimate: float64(wallTime),
+			Min:      float64(wallTime),
+			Max:      float64(wallTime),
+		}
+		entry.MetricToValue[gpuBusyIntervalsMetricId] = &service.ProfilingData_GpuCounters_Perf{
+			Estimate: float64(intervals),
+			Min:      float64(intervals),
+			Max:      float64(intervals),
+		}
+		entry.MetricToValue[gpuSelfTimeMetricId] = &service.ProfilingData_GpuCounters_Perf{
+			Estimate: float64(gpuSelfTime),
+			Min:      float64(gpuSelfTime),
+			Max:      float64(gpuSelfTime),
+		}
+		concurrency := maxConcurrency(slices)
+		entry.MetricToValue[gpuMaxConcurrencyMetricId] = &service.ProfilingData_GpuCounters_Perf{
+			Estimate: float64(concurrency),
+			Min:      float64(concurrency),
+			Max:      float64(concurrency),
+		}
+		entry.MetricToValue[gpuSliceCountMetricId] = &service.ProfilingData_GpuCounters_Perf{
+			Estimate: float64(len(slices)),
+			Min:      float64(len(slices)),
+			Max:      float64(len(slices)),
+		}
+		entry.MetricToValue[gpuLongestSliceMetricId] = &service.ProfilingData_GpuCounters_Perf{
+			Estimate: float64(longestSlice),
+			Min:      float64(longestSlice),
+			Max:      float64(longestSlice),
+		}
+		entry.MetricToValue[gpuGlobalWallTimeMetricId] = &service.ProfilingData_GpuCounters_Perf{
+			Estimate: globalWallTime[groupId],
+			Min:      globalWallTime[groupId],
+			Max:      globalWallTime[groupId],
+		}
+		// A leaf group has no children commands, see mergeLeafEntries.
+		entry.MetricToValue[gpuChildrenTimeMetricId] = &service.ProfilingData_GpuCounters_Perf{}
+		share := float64(0)
+		if frameGpuTime != 0 {
+			share = 100 * float64(gpuTime) / float64(frameGpuTime)
+		}
+		entry.MetricToValue[gpuFrameShareMetricId] = &service.ProfilingData_GpuCounters_Perf{
+			Estimate: share,
+			Min:      share,
+			Max:      share,
+		}
+		for id, scale := range scales {
+			perf := entry.MetricToValue[id]
+			perf.Estimate /= scale
+			perf.Min /= scale
+			perf.Max /= scale
+		}
+	}
+}
+
+// Sort the slices based on their start time. The ties are broken by longest
+// duration first, then by group, track and slice id, so that the order, and
+// thus the results, are reproducible.
+func sortSlices(slices []*service.ProfilingData_GpuSlices_Slice) {
+	sort.Slice(slices, func(i, j int) bool {
+		a, b := slices[i], slices[j]
+		switch {
+		case a.Ts != b.Ts:
+			return a.Ts < b.Ts
+		case a.Dur != b.Dur:
+			return a.Dur > b.Dur
+		case a.GroupId != b.GroupId:
+			return a.GroupId < b.GroupId
+		case a.TrackId != b.TrackId:
+			return a.TrackId < b.TrackId
+		default:
+			return a.Id < b.Id
+		}
+	})
+}
+
+// checkTimeInvariants enables the consistency checks of the time metrics of
+// the groups, see checkWallTime. It is meant for tests and debugging.
+var checkTimeInvariants = false
+
+// Check that the wall time of a group, the union of its busy intervals, isn't
+// larger than its GPU time, the sum of its slice durations, logging an error
+// with the group's slices otherwise. It doesn't hold if the short gaps are
+// coalesced into the wall time, see Options.WallTimeGapThreshold.
+func checkWallTime(ctx context.Context, groupId int32, slices []*service.ProfilingData_GpuSlices_Slice, gpuTime, wallTime uint64) bool {
+	if wallTime <= gpuTime {
+		return true
+	}
+	spans := make([]string, len(slices))
+	for i, slice := range slices {
+		spans[i] = fmt.Sprintf("%d:[%d, %d)", slice.Id, slice.Ts, slice.Ts+slice.Dur)
+	}
+	log.Bind(ctx, log.V{
+		"group":     groupId,
+		"gpu_time":  gpuTime,
+		"wall_time": wallTime,
+		"slices":    spans,
+	}).E("GPU wall time larger than the GPU time")
+	return false
+}
+
+// Calculate GPU-time, wall-time and the number of distinct busy intervals
+// (after merging overlapping slices) for a specific GPU slice group. The
+// slices are expected to be sorted by start time. The gaps shorter than
+// gapThreshold are coalesced, counting as busy time.
+func gpuTimeForGroup(slices []*service.ProfilingData_GpuSlices_Slice, gapThreshold uint64) (uint64, uint64, int) {
+	gpuTime, wallTime := uint64(0), uint64(0)
+	intervals := 0
+	lastEnd := uint64(0)
+	for _, slice := range slices {
+		duration := slice.Dur
+		gpuTime += duration
+		if intervals > 0 && slice.Ts <= lastEnd {
+			if slice.Ts+slice.Dur <= lastEnd {
+				continue // completely contained within the other, can ignore it.
+			}
+			duration -= lastEnd - slice.Ts
+		} else if intervals > 0 && slice.Ts-lastEnd < gapThreshold {
+			duration += slice.Ts - lastEnd // coalesce the short gap.
+		} else {
+			intervals++ // starts a new busy interval.
+		}
+		wallTime += duration
+		lastEnd = slice.Ts + slice.Dur
+	}
+	return gpuTime, wallTime, intervals
+}
+
+// Create GPU counter metric metadata, calculate counter performance for each
+// GPU slice group, and append the result to corresponding entries.
+// globalSlices are all the slices running on the GPU, to weight the counter
+// samples by concurrency, see completeGlobalSlices.
+func setGpuCounterMetrics(ctx context.Context, groupToSlices map[int32][]*service.ProfilingData_GpuSlices_Slice, counters []*service.ProfilingData_Counter, globalSlices []*service.ProfilingData_GpuSlices_Slice, ids *metricIds, options *Options, metrics *[]*service.ProfilingData_GpuCounters_Metric, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry) {
+	globalSlices = completeGlobalSlices(ctx, globalSlices, groupToSlices)
+	gated := gatedIntervals(ctx, counters, options)
+	dual := map[string]bool{}
+	for _, name := range options.DualAggregationCounters {
+		dual[name] = true
+	}
+	magnitude := map[string]bool{}
+	for _, name := range options.MagnitudeWeightedCounters {
+		magnitude[name] = true
+	}
+	attributor, ok := attributors[attributionMode(options)]
+	if !ok {
+		warn(ctx, service.ProfilingData_GpuCounters_Warning_UnknownAttribution, options.Attribution, "Unknown counter attribution %v, the samples are attributed proportionally", options.Attribution)
+		attributor = attributors[ProportionalAttribution]
+	}
+	// The lowest density of the counters in each group, see Options.DensityConfidence.
+	densities := map[int32]float64{}
+	density := func(groupId int32, d float64) {
+		if current, ok := densities[groupId]; !ok || d < current {
+			densities[groupId] = d
+		}
+	}
+	queueScoped := map[string]bool{}
+	for _, name := range options.QueueScopedCounters {
+		queueScoped[name] = true
+	}
+	var boundaries []uint64
+	if options.Interpolation == LinearInterpolation {
+		boundaries = sliceBoundaries(globalSlices)
+	}
+	// The metrics are created in order, the counters attributed concurrently,
+	// each into its own entries merged in the order of the counters.
+	counterMetrics := make([]*service.ProfilingData_GpuCounters_Metric, len(counters))
+	for i, counter := range counters {
+		counterMetrics[i] = counterMetric(i, counter, options)
+		*metrics = append(*metrics, counterMetrics[i])
+	}
+	attributeCounter := func(i int, counter *service.ProfilingData_Counter) *counterAttribution {
+		result := newCounterAttribution()
+		metric := counterMetrics[i]
+		counter = prepareCounter(counter, options)
+		op := metric.Op
+		if _, ok := aggregators[op]; !ok {
+			warn(ctx, service.ProfilingData_GpuCounters_Warning_UnsupportedAggregation, metric.Name, "Counter aggregation method not implemented yet. Operation: %v", op)
+			return result
+		}
+		// The metrics computed from the counter, see Options.DualAggregationCounters.
+		outputs := []*service.ProfilingData_GpuCounters_Metric{metric}
+		if dual[counter.Name] {
+			outputs = append(outputs, dualMetric(i, counter, ids, options))
+		}
+		if len(counter.Timestamps) != len(counter.Values) || (len(counter.InvalidSamples) != 0 && len(counter.InvalidSamples) != len(counter.Values)) {
+			// Malformed counter, its samples can't be trusted.
+			warn(ctx, service.ProfilingData_GpuCounters_Warning_MalformedCounter, counter.Name, "Counter %v has %v timestamps, %v values and %v validity flags, its samples are ignored", counter.Name, len(counter.Timestamps), len(counter.Values), len(counter.InvalidSamples))
+			for groupId := range groupToSlices {
+				for _, output := range outputs {
+					result.entry(groupId).MetricToValue[output.Id] = unavailablePerf()
+					if options.Confidence {
+						setConfidence(result.entry(groupId), output.Id, 0)
+					}
+					if options.Coverage {
+						setCoverage(result.entry(groupId), output.Id, 0)
+					}
+				}
+				result.density(groupId, 0)
+			}
+			return result
+		}
+		if len(gated) != 0 && counter.Name != options.ClockGatingCounter {
+			counter = excludeGatedSamples(counter, gated)
+		}
+		var gaps []interval
+		if options.GapThreshold > 0 {
+			counter, gaps = excludeGaps(counter, options.GapThreshold)
+		}
+		if options.Interpolation == LinearInterpolation && !dual[counter.Name] {
+			counter = interpolateCounter(counter, boundaries, op == service.ProfilingData_GpuCounters_Metric_Summation)
+		}
+		log.Bind(ctx, log.V{
+			"counter":     counter.Name,
+			"op":          op,
+			"op_source":   getCounterAggregationSource(counter, options),
+			"attribution": attributionMode(options),
+			"critical":    options.CriticalPathOnly,
+			"bands":       !options.SkipBands,
+		}).D("Counter aggregation")
+		concurrentSlicesCount := scanConcurrency(globalSlices, counter)
+		var attribute GroupAttribution
+		if queueScoped[counter.Name] {
+			attribute = queueScopedAttribution(attributor, globalSlices, counter)
+		} else {
+			attribute = attributor.Attribute(globalSlices, counter, concurrentSlicesCount)
+		}
+		period := samplingPeriod(counter)
+		direct := 0
+		for groupId, slices := range groupToSlices {
+			if values, ok := directCounterValues(slices, counter.Name); ok {
+				// The values carried by the slices are authoritative.
+				if scale, ok := counterScale(counter, options); ok {
+					values = scaleCounter(values, scale)
+				}
+				for _, output := range outputs {
+					estimate := aggregateCounterSamples(directSampleWeights(values), values, output.Op)
+					perf := &service.ProfilingData_GpuCounters_Perf{
+						Estimate: estimate,
+						Min:      estimate,
+						Max:      estimate,
+					}
+					if options.SampleStatistics {
+						setSampleStatistics(perf, directSampleWeights(values), values)
+					}
+					result.entry(groupId).MetricToValue[output.Id] = perf
+					if options.Confidence {
+						setConfidence(result.entry(groupId), output.Id, 1)
+					}
+					if options.Coverage {
+						setCoverage(result.entry(groupId), output.Id, 1)
+					}
+				}
+				result.density(groupId, 1)
+				direct++
+				continue
+			}
+			estimateSet, minSet, maxSet := attribute(groupId, slices, !options.SkipBands)
+			if len(gaps) != 0 && overlapsGaps(slices, gaps) {
+				for _, output := range outputs {
+					addGappedMetric(result.entry(groupId), output.Id)
+				}
+			}
+			if options.DensityConfidence {
+				result.density(groupId, sampleDensity(slices, counter, period))
+			}
+			coverage := 0.0
+			if options.Coverage {
+				coverage = sampleCoverage(slices, counter)
+			}
+			// The statistics are of the samples as attributed, before any weighting by magnitude.
+			attributed := estimateSet
+			if magnitude[counter.Name] {
+				estimateSet = magnitudeWeights(estimateSet, counter)
+				minSet, maxSet = magnitudeWeights(minSet, counter), magnitudeWeights(maxSet, counter)
+			}
+			for _, output := range outputs {
+				var perf *service.ProfilingData_GpuCounters_Perf
+				if options.SkipBands {
+					estimate := aggregateCounterSamples(estimateSet, counter, output.Op)
+					perf = &service.ProfilingData_GpuCounters_Perf{
+						Estimate: estimate,
+						Min:      estimate,
+						Max:      estimate,
+					}
+				} else {
+					perf = aggregateCounterPerf(estimateSet, minSet, maxSet, counter, output.Op)
+				}
+				if options.SampleStatistics {
+					setSampleStatistics(perf, attributed, counter)
+				}
+				result.entry(groupId).MetricToValue[output.Id] = perf
+				if options.Confidence {
+					setConfidence(result.entry(groupId), output.Id, attributionConfidence(slices, counter, concurrentSlicesCount, perf))
+				}
+				if options.Coverage {
+					setCoverage(result.entry(groupId), output.Id, coverage)
+				}
+			}
+		}
+		if direct != 0 {
+			log.I(ctx, "Counter %v: the values carried by the slices of %v groups are used instead of the samples", counter.Name, direct)
+		}
+		return result
+	}
+	results := make([]*counterAttribution, len(counters))
+	forEachCounter(len(counters), func(i int) {
+		results[i] = attributeCounter(i, counters[i])
+	})
+	for _, result := range results {
+		result.mergeInto(groupToEntry, density)
+	}
+	if options.DensityConfidence {
+		for groupId, d := range densities {
+			groupToEntry[groupId].DensityConfidence = math.Min(d, 1)
+		}
+	}
+}
+
+// Return the values of the counter carried by the slices, as extras named
+// after the counter, if all the slices carry one. They are returned as a
+// counter whose sample 2i+1 spans the i-th slice, see directSampleWeights.
+func directCounterValues(slices []*service.ProfilingData_GpuSlices_Slice, name string) (*service.ProfilingData_Counter, bool) {
+	values := &service.ProfilingData_Counter{
+		Name:       name,
+		Timestamps: make([]uint64, 0, 2*len(slices)),
+		Values:     make([]float64, 0, 2*len(slices)),
+	}
+	for _, slice := range slices {
+		value, ok := sliceExtraValue(slice, name)
+		if !ok {
+			return nil, false
+		}
+		values.Timestamps = append(values.Timestamps, slice.Ts, slice.Ts+slice.Dur)
+		values.Values = append(values.Values, 0, value)
+	}
+	return values, len(slices) != 0
+}
+
+// Return the weights of the samples of the counter built by
+// directCounterValues: the samples spanning the slices have their full weight,
+// the gaps between the slices have none.
+func directSampleWeights(values *service.ProfilingData_Counter) map[int]float64 {
+	weights := make(map[int]float64, len(values.Values)/2)
+	for i := 1; i < len(values.Values); i += 2 {
+		weights[i] = 1
+	}
+	return weights
+}
+
+// Return the numeric value of the extra of the slice with the given name.
+func sliceExtraValue(slice *service.ProfilingData_GpuSlices_Slice, name string) (float64, bool) {
+	for _, extra := range slice.Extras {
+		if extra.Name != name {
+			continue
+		}
+		switch v := extra.Value.(type) {
+		case *service.ProfilingData_GpuSlices_Slice_Extra_DoubleValue:
+			return v.DoubleValue, true
+		case *service.ProfilingData_GpuSlices_Slice_Extra_IntValue:
+			return float64(v.IntValue), true
+		}
+	}
+	return 0, false
+}
+
+// Set the confidence of the metric of the entry.
+func setConfidence(entry *service.ProfilingData_GpuCounters_Entry, metricId int32, confidence float64) {
+	if entry.MetricToConfidence == nil {
+		entry.MetricToConfidence = map[int32]float64{}
+	}
+	entry.MetricToConfidence[metricId] = confidence
+}
+
+// Aggregate the best guess, minimum and maximum sets of counter samples to
+// the counter performance. The minimum and maximum sets hold the bounds of the
+// share of each overlapping sample that may truly belong to the group, a
+// sample missing from the minimum set possibly not belonging to it at all.
+// The bounds of the performance are the ones of the aggregation over all the
+// shares within those bounds, see boundCounterSamples, and contain the
+// estimate. The performance is unavailable if the estimate has no data.
+func aggregateCounterPerf(estimateSet, minSet, maxSet map[int]float64, counter *service.ProfilingData_Counter, op service.ProfilingData_GpuCounters_Metric_AggregationOperator) *service.ProfilingData_GpuCounters_Perf {
+	estimate := aggregateCounterSamples(estimateSet, counter, op)
+	min, max := boundCounterSamples(minSet, maxSet, counter, op)
+	switch {
+	case estimate == -1:
+		return unavailablePerf()
+	case min == -1:
+		min, max = estimate, estimate
+	default:
+		min, max = f64.MinOf(min, estimate), f64.MaxOf(max, estimate)
+	}
+	return &service.ProfilingData_GpuCounters_Perf{
+		Estimate: estimate,
+		Min:      min,
+		Max:      max,
+	}
+}
+
+// Return the smallest and the largest aggregations of the counter samples,
+// the share of each sample ranging from its weight in the minimum set, 0 if
+// missing, to its weight in the maximum set, or -1 if no share has data.
+//
+// The aggregations of the built-in operators only move one way as a share
+// moves, depending on whether the value of the sample is below or above the
+// result. Their extremes are thus reached with the lowest samples at their
+// largest share and the others at their smallest one, for the minimum, and
+// conversely for the maximum. Those configurations are all evaluated, one
+// per sample whose share isn't fixed, which bounds the aggregation exactly,
+// unlike aggregating the minimum and maximum sets alone. The free samples are
+// sorted once and swept in each order, the sums, the averages and the
+// extremes being updated as each share moves, while the other operators are
+// aggregated again for every configuration.
+func boundCounterSamples(minSet, maxSet map[int]float64, counter *service.ProfilingData_Counter, op service.ProfilingData_GpuCounters_Metric_AggregationOperator) (float64, float64) {
+	free := []int{}
+	for _, idx := range sortedSamples(maxSet) {
+		if minSet[idx] < maxSet[idx] {
+			free = append(free, idx)
+		}
+	}
+	sort.SliceStable(free, func(i, j int) bool {
+		return counter.Values[free[i]] < counter.Values[free[j]]
+	})
+	min, max := -1.0, -1.0
+	bound := func(order []int, better func(a, b float64) bool, res *float64) {
+		keep := func(value float64) {
+			if value != -1 && (*res == -1 || better(value, *res)) {
+				*res = value
+			}
+		}
+		if s, ok := newSampleSweep(minSet, counter, op); ok {
+			for k := 0; ; k++ {
+				keep(s.value())
+				if k == len(order) {
+					return
+				}
+				s.add(order[k], maxSet[order[k]]-minSet[order[k]])
+			}
+		}
+		weights := map[int]float64{}
+		for idx, weight := range minSet {
+			if weight > 0 {
+				weights[idx] = weight
+			}
+		}
+		for k := 0; ; k++ {
+			keep(aggregateCounterSamples(weights, counter, op))
+			if k == len(order) {
+				return
+			}
+			weights[order[k]] = maxSet[order[k]]
+		}
+	}
+	bound(free, func(a, b float64) bool { return a < b }, &min)
+	descending := make([]int, len(free))
+	for i, idx := range free {
+		descending[len(free)-1-i] = idx
+	}
+	bound(descending, func(a, b float64) bool { return a > b }, &max)
+	return min, max
+}
+
+// sampleSweep is the running aggregation of the counter samples by one of the
+// operators whose aggregation can be updated as the share of a sample grows:
+// the sum, the time-weighted average and the extremes.
+type sampleSweep struct {
+	counter *service.ProfilingData_Counter
+	op      service.ProfilingData_GpuCounters_Metric_AggregationOperator
+	// The sum of the values times their weights, and of the weights, which
+	// are the time-weighted ones for the average.
+	sum, weight float64
+	// The extreme value of the samples of positive share, if found.
+	extreme float64
+	found   bool
+}
+
+// Return the running aggregation of the samples of the weights, if the
+// operator is one of the sampleSweep's.
+func newSampleSweep(sampleWeight map[int]float64, counter *service.ProfilingData_Counter, op service.ProfilingData_GpuCounters_Metric_AggregationOperator) (*sampleSweep, bool) {
+	switch op {
+	case service.ProfilingData_GpuCounters_Metric_Summation,
+		service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		service.ProfilingData_GpuCounters_Metric_Maximum,
+		service.ProfilingData_GpuCounters_Metric_Minimum:
+	default:
+		return nil, false
+	}
+	if _, ok := aggregators[op]; !ok {
+		return nil, false
+	}
+	s := &sampleSweep{counter: counter, op: op}
+	for _, idx := range sortedSamples(sampleWeight) {
+		if sampleWeight[idx] > 0 {
+			s.add(idx, sampleWeight[idx])
+		}
+	}
+	return s, true
+}
+
+// Grow the share of the sample by the weight.
+func (s *sampleSweep) add(idx int, weight float64) {
+	value := s.counter.Values[idx]
+	switch s.op {
+	case service.ProfilingData_GpuCounters_Metric_Summation:
+		s.sum += value * weight
+	case service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg:
+		weight *= float64(s.counter.Timestamps[idx] - s.counter.Timestamps[idx-1])
+		s.sum += value * weight
+		s.weight += weight
+	case service.ProfilingData_GpuCounters_Metric_Maximum:
+		if !s.found || value > s.extreme {
+			s.extreme, s.found = value, true
+		}
+	case service.ProfilingData_GpuCounters_Metric_Minimum:
+		if !s.found || value < s.extreme {
+			s.extreme, s.found = value, true
+		}
+	}
+}
+
+// Return the aggregation of the samples, as aggregateCounterSamples would.
+func (s *sampleSweep) value() float64 {
+	switch s.op {
+	case service.ProfilingData_GpuCounters_Metric_Summation:
+		return s.sum
+	case service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg:
+		if s.weight < minTimeWeight {
+			return -1
+		}
+		return s.sum / s.weight
+	}
+	if !s.found {
+		return -1
+	}
+	return s.extreme
+}
+
+// Calculate the performance of each GPU counter over the idle periods, the
+// complement of the union of the global slices. Each counter sample is
+// weighted by the idle fraction of its span. The minimum set only holds the
+// samples entirely idle and the maximum set the samples partially idle.
+func idleCounterEntry(ctx context.Context, globalSlices []*service.ProfilingData_GpuSlices_Slice, counters []*service.ProfilingData_Counter, options *Options) *service.ProfilingData_GpuCounters_Entry {
+	entry := &service.ProfilingData_GpuCounters_Entry{
+		CommandIndex:  []uint64{},
+		MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{},
+	}
+	busy := busyIntervals(globalSlices)
+	for idx, counter := range counters {
+		metric := counterMetric(idx, counter, options)
+		counter = prepareCounter(counter, options)
+		if _, ok := aggregators[metric.Op]; !ok || len(counter.Timestamps) != len(counter.Values) {
+			entry.MetricToValue[metric.Id] = unavailablePerf()
+			continue
+		}
+		estimateSet, minSet, maxSet := map[int]float64{}, map[int]float64{}, map[int]float64{}
+		j := 0 // The first busy interval that may overlap the current sample.
+		for i := 1; i < len(counter.Timestamps); i++ {
+			cStart, cEnd := counter.Timestamps[i-1], counter.Timestamps[i]
+			if cEnd == cStart || !validSample(counter, i) {
+				continue
+			}
+			for j < len(busy) && busy[j].end <= cStart {
+				j++
+			}
+			busyTime := uint64(0)
+			for k := j; k < len(busy) && busy[k].start < cEnd; k++ {
+				busyTime += u64.Min(cEnd, busy[k].end) - u64.Max(cStart, busy[k].start)
+			}
+			if busyTime == cEnd-cStart {
+				continue // Sample entirely busy.
+			}
+			estimateSet[i] = float64(cEnd-cStart-busyTime) / float64(cEnd-cStart)
+			if busyTime == 0 {
+				minSet[i] = 1
+			}
+			maxSet[i] = 1
+		}
+		entry.MetricToValue[metric.Id] = aggregateCounterPerf(estimateSet, minSet, maxSet, counter, metric.Op)
+	}
+	return entry
+}
+
+// Create the nearest sample debug metric metadata of each GPU counter, find
+// the sample nearest to the start of each GPU slice group, and append its
+// value to corresponding entries.
+func setNearestSampleMetrics(ctx context.Context, groupToSlices map[int32][]*service.ProfilingData_GpuSlices_Slice, counters []*service.ProfilingData_Counter, ids *metricIds, options *Options, metrics *[]*service.ProfilingData_GpuCounters_Metric, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry) {
+	for i, counter := range counters {
+		metric := nearestSampleMetric(i, counter, ids, options)
+		*metrics = append(*metrics, metric)
+		counter = prepareCounter(counter, options)
+		for groupId, slices := range groupToSlices {
+			perf := unavailablePerf()
+			if idx := nearestSample(counter, slices[0].Ts); idx >= 0 {
+				value := counter.Values[idx]
+				perf = &service.ProfilingData_GpuCounters_Perf{Estimate: value, Min: value, Max: value}
+			}
+			groupToEntry[groupId].MetricToValue[metric.Id] = perf
+		}
+	}
+}
+
+// Create the pessimistic upper bound metric metadata of each GPU counter,
+// attribute in full every counter sample overlapping each GPU slice group,
+// and append the bound to corresponding entries.
+func setPessimisticMetrics(ctx context.Context, groupToSlices map[int32][]*service.ProfilingData_GpuSlices_Slice, counters []*service.ProfilingData_Counter, ids *metricIds, options *Options, metrics *[]*service.ProfilingData_GpuCounters_Metric, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry) {
+	for i, counter := range counters {
+		metric := pessimisticMetric(i, counter, ids, options)
+		*metrics = append(*metrics, metric)
+		counter = prepareCounter(counter, options)
+		if len(counter.Timestamps) != len(counter.Values) {
+			for groupId := range groupToSlices {
+				groupToEntry[groupId].MetricToValue[metric.Id] = unavailablePerf()
+			}
+			continue
+		}
+		noConcurrency := make([]int, len(counter.Timestamps))
+		for groupId, slices := range groupToSlices {
+			// The maximum set holds every overlapping sample with a full weight.
+			_, _, maxSet := mapCounterSamples(slices, counter, noConcurrency, true)
+			bound := aggregateCounterSamples(maxSet, counter, metric.Op)
+			groupToEntry[groupId].MetricToValue[metric.Id] = &service.ProfilingData_GpuCounters_Perf{
+				Estimate: bound,
+				Min:      bound,
+				Max:      bound,
+			}
+		}
+	}
+}
+
+// Return the index of the counter sample whose timestamp is the nearest to
+// ts, the earliest one if two are equally near, or -1 if the counter has no
+// usable sample.
+func nearestSample(counter *service.ProfilingData_Counter, ts uint64) int {
+	if len(counter.Timestamps) == 0 || len(counter.Timestamps) != len(counter.Values) {
+		return -1
+	}
+	n := len(counter.Timestamps)
+	i := sort.Search(n, func(i int) bool { return counter.Timestamps[i] >= ts })
+	// The nearest valid samples before and from ts.
+	before, after := i-1, i
+	for before >= 0 && !validSample(counter, before) {
+		before--
 	}
+	for after < n && !validSample(counter, after) {
+		after++
+	}
+	switch {
+	case before < 0 && after == n:
+		return -1
+	case before < 0:
+		return after
+	case after == n:
+		return before
+	case ts-counter.Timestamps[before] <= counter.Timestamps[after]-ts:
+		return before
+	default:
+		return after
+	}
+}
 
-	// Calculate GPU Time Performance and GPU Wall Time Performance for all leaf groups/commands.
-	setTimeMetrics(groupToSlices, &metrics, groupToEntry)
+// Return whether the i-th sample of the counter can be trusted, see
+// ProfilingData_Counter.InvalidSamples.
+func validSample(counter *service.ProfilingData_Counter, i int) bool {
+	return i >= len(counter.InvalidSamples) || !counter.InvalidSamples[i]
+}
 
-	// Calculate GPU Counter Performances for all leaf groups/commands.
-	setGpuCounterMetrics(ctx, groupToSlices, counters, filteredSlices, &metrics, groupToEntry)
+// Return a counter of the given samples with the metadata of the counter, its
+// id, name, description, unit, default flag and GPU.
+func withSamples(counter *service.ProfilingData_Counter, timestamps []uint64, values []float64, invalid []bool) *service.ProfilingData_Counter {
+	return &service.ProfilingData_Counter{
+		Id:             counter.Id,
+		Name:           counter.Name,
+		Description:    counter.Description,
+		Unit:           counter.Unit,
+		Default:        counter.Default,
+		GpuId:          counter.GpuId,
+		Timestamps:     timestamps,
+		Values:         values,
+		InvalidSamples: invalid,
+	}
+}
 
-	// Merge and organize the leaf entries.
-	entries := mergeLeafEntries(ctx, metrics, groupToEntry)
+// Return a slice of the given start timestamp and duration with the metadata
+// of the slice, its id, label, depth, extras, track and group.
+func withTimes(slice *service.ProfilingData_GpuSlices_Slice, ts, dur uint64) *service.ProfilingData_GpuSlices_Slice {
+	return &service.ProfilingData_GpuSlices_Slice{
+		Ts:      ts,
+		Dur:     dur,
+		Id:      slice.Id,
+		Label:   slice.Label,
+		Depth:   slice.Depth,
+		Extras:  slice.Extras,
+		TrackId: slice.TrackId,
+		GroupId: slice.GroupId,
+	}
+}
 
-	return &service.ProfilingData_GpuCounters{
-		Metrics: metrics,
-		Entries: entries,
-	}, nil
+// Return the counter as seen by the attribution, with the scale and the time
+// offset of the options applied.
+func prepareCounter(counter *service.ProfilingData_Counter, options *Options) *service.ProfilingData_Counter {
+	if runningTotal(counter, options) {
+		counter = totalIncrements(counter)
+	}
+	if scale, ok := counterScale(counter, options); ok {
+		counter = scaleCounter(counter, scale)
+	}
+	if options.SmoothingRadius > 0 {
+		counter = smoothCounter(counter, options.SmoothingRadius)
+	}
+	if options.CounterTimeOffset != 0 {
+		counter = shiftCounter(counter, options.CounterTimeOffset)
+	}
+	return counter
 }
 
-// Create GPU time metric metadata, calculate time performance for each GPU
-// slice group, and append the result to corresponding entries.
-func setTimeMetrics(groupToSlices map[int32][]*service.ProfilingData_GpuSlices_Slice, metrics *[]*service.ProfilingData_GpuCounters_Metric, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry) {
-	*metrics = append(*metrics, &service.ProfilingData_GpuCounters_Metric{
-		Id:   gpuTimeMetricId,
-		Name: "GPU Time",
-		Unit: strconv.Itoa(int(device.GpuCounterDescriptor_NANOSECOND)),
-		Op:   service.ProfilingData_GpuCounters_Metric_Summation,
-	})
-	*metrics = append(*metrics, &service.ProfilingData_GpuCounters_Metric{
-		Id:   gpuWallTimeMetricId,
-		Name: "GPU Wall Time",
-		Unit: strconv.Itoa(int(device.GpuCounterDescriptor_NANOSECOND)),
-		Op:   service.ProfilingData_GpuCounters_Metric_Summation,
-	})
-	for groupId, slices := range groupToSlices {
-		gpuTime, wallTime := gpuTimeForGroup(slices)
-		entry := groupToEntry[groupId]
-		entry.MetricToValue[gpuTimeMetricId] = &service.ProfilingData_GpuCounters_Perf{
-			Estimate: float64(gpuTime),
-			Min:      float64(gpuTime),
-			Max:      float64(gpuTime),
+// Return a copy of the counter with its sample values and unit converted by
+// the given scale. The timestamps are shared with the original counter.
+func scaleCounter(counter *service.ProfilingData_Counter, scale CounterScale) *service.ProfilingData_Counter {
+	values := make([]float64, len(counter.Values))
+	for i, v := range counter.Values {
+		values[i] = v * scale.Factor
+	}
+	res := withSamples(counter, counter.Timestamps, values, counter.InvalidSamples)
+	if scale.Unit != "" {
+		res.Unit = scale.Unit
+	}
+	return res
+}
+
+// Return a copy of the counter with its sample values smoothed by a centered
+// moving average over the valid samples, see Options.SmoothingRadius. The
+// timestamps and validity flags are shared with the original counter.
+func smoothCounter(counter *service.ProfilingData_Counter, radius int) *service.ProfilingData_Counter {
+	n := len(counter.Values)
+	// Prefix sums of the valid values and of their count.
+	sums, counts := make([]float64, n+1), make([]int, n+1)
+	for i, v := range counter.Values {
+		sums[i+1], counts[i+1] = sums[i], counts[i]
+		if validSample(counter, i) {
+			sums[i+1] += v
+			counts[i+1]++
 		}
-		entry.MetricToValue[gpuWallTimeMetricId] = &service.ProfilingData_GpuCounters_Perf{
-			Estimate: float64(wallTime),
-			Min:      float64(wallTime),
-			Max:      float64(wallTime),
+	}
+	values := make([]float64, n)
+	for i := range values {
+		start, end := i-radius, i+radius+1
+		if start < 0 {
+			start = 0
+		}
+		if end > n {
+			end = n
+		}
+		if count := counts[end] - counts[start]; count != 0 {
+			values[i] = (sums[end] - sums[start]) / float64(count)
+		} else {
+			values[i] = counter.Values[i]
 		}
 	}
+	return withSamples(counter, counter.Timestamps, values, counter.InvalidSamples)
 }
 
-// Calculate GPU-time and wall-time for a specific GPU slice group.
-func gpuTimeForGroup(slices []*service.ProfilingData_GpuSlices_Slice) (uint64, uint64) {
-	gpuTime, wallTime := uint64(0), uint64(0)
-	lastEnd := uint64(0)
-	for _, slice := range slices {
-		duration := slice.Dur
-		gpuTime += duration
-		if slice.Ts < lastEnd {
-			if slice.Ts+slice.Dur <= lastEnd {
-				continue // completely contained within the other, can ignore it.
-			}
-			duration -= lastEnd - slice.Ts
+// Return a copy of the counter with the offset added to its timestamps. The
+// timestamps saturate at zero. The values are shared with the original
+// counter.
+func shiftCounter(counter *service.ProfilingData_Counter, offset int64) *service.ProfilingData_Counter {
+	timestamps := make([]uint64, len(counter.Timestamps))
+	for i, ts := range counter.Timestamps {
+		if offset < 0 && ts < uint64(-offset) {
+			timestamps[i] = 0
+		} else {
+			timestamps[i] = uint64(int64(ts) + offset)
 		}
-		wallTime += duration
-		lastEnd = slice.Ts + slice.Dur
 	}
-	return gpuTime, wallTime
+	return withSamples(counter, timestamps, counter.Values, counter.InvalidSamples)
 }
 
-// Create GPU counter metric metadata, calculate counter performance for each
-// GPU slice group, and append the result to corresponding entries.
-func setGpuCounterMetrics(ctx context.Context, groupToSlices map[int32][]*service.ProfilingData_GpuSlices_Slice, counters []*service.ProfilingData_Counter, globalSlices []*service.ProfilingData_GpuSlices_Slice, metrics *[]*service.ProfilingData_GpuCounters_Metric, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry) {
-	for i, counter := range counters {
-		metricId := counterMetricIdOffset + int32(i)
-		op := getCounterAggregationMethod(counter)
-		*metrics = append(*metrics, &service.ProfilingData_GpuCounters_Metric{
-			Id:   metricId,
-			Name: counter.Name,
-			Unit: counter.Unit,
-			Op:   op,
-		})
-		if op != service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg {
-			log.E(ctx, "Counter aggregation method not implemented yet. Operation: %v", op)
+// Return the clock-gated periods of the GPU, see Options.ClockGatingCounter,
+// as disjoint intervals sorted by start time. The time offset of the options
+// applies to the gating counter like to the others.
+func gatedIntervals(ctx context.Context, counters []*service.ProfilingData_Counter, options *Options) []interval {
+	if options.ClockGatingCounter == "" {
+		return nil
+	}
+	var gating *service.ProfilingData_Counter
+	for _, counter := range counters {
+		if counter.Name == options.ClockGatingCounter {
+			gating = counter
+			break
+		}
+	}
+	if gating == nil {
+		warn(ctx, service.ProfilingData_GpuCounters_Warning_ClockGating, options.ClockGatingCounter, "Clock gating counter %v not found", options.ClockGatingCounter)
+		return nil
+	}
+	if len(gating.Timestamps) != len(gating.Values) {
+		warn(ctx, service.ProfilingData_GpuCounters_Warning_ClockGating, gating.Name, "Clock gating counter %v is malformed, gating is ignored", gating.Name)
+		return nil
+	}
+	if options.CounterTimeOffset != 0 {
+		gating = shiftCounter(gating, options.CounterTimeOffset)
+	}
+	gated := []interval{}
+	for i := 1; i < len(gating.Timestamps); i++ {
+		if gating.Values[i] > 0 || !validSample(gating, i) {
 			continue
 		}
-		concurrentSlicesCount := scanConcurrency(globalSlices, counter)
-		for groupId, slices := range groupToSlices {
-			estimateSet, minSet, maxSet := mapCounterSamples(slices, counter, concurrentSlicesCount)
-			estimate := aggregateCounterSamples(estimateSet, counter)
-			// Extra comparison here because minSet/maxSet only denote minimal/maximal
-			// number of counter samples inclusion strategy, the aggregation result
-			// may not be the smallest/largest actually.
-			min, max := estimate, estimate
-			if minSetRes := aggregateCounterSamples(minSet, counter); minSetRes != -1 {
-				min = f64.MinOf(min, minSetRes)
-				max = f64.MaxOf(max, minSetRes)
-			}
-			if maxSetRes := aggregateCounterSamples(maxSet, counter); maxSetRes != -1 {
-				min = f64.MinOf(min, maxSetRes)
-				max = f64.MaxOf(max, maxSetRes)
-			}
-			groupToEntry[groupId].MetricToValue[metricId] = &service.ProfilingData_GpuCounters_Perf{
-				Estimate: estimate,
-				Min:      min,
-				Max:      max,
+		start, end := gating.Timestamps[i-1], gating.Timestamps[i]
+		if last := len(gated) - 1; last >= 0 && gated[last].end == start {
+			gated[last].end = end
+		} else {
+			gated = append(gated, interval{start, end})
+		}
+	}
+	return gated
+}
+
+// Return a copy of the counter whose samples spent gated for more than half
+// of their span are marked invalid. The timestamps and values are shared with
+// the original counter.
+func excludeGatedSamples(counter *service.ProfilingData_Counter, gated []interval) *service.ProfilingData_Counter {
+	invalid := make([]bool, len(counter.Values))
+	copy(invalid, counter.InvalidSamples)
+	j := 0
+	for i := 1; i < len(counter.Timestamps) && i < len(invalid); i++ {
+		cStart, cEnd := counter.Timestamps[i-1], counter.Timestamps[i]
+		for j < len(gated) && gated[j].end <= cStart {
+			j++
+		}
+		overlap := uint64(0)
+		for k := j; k < len(gated) && gated[k].start < cEnd; k++ {
+			overlap += u64.Min(cEnd, gated[k].end) - u64.Max(cStart, gated[k].start)
+		}
+		if 2*overlap > cEnd-cStart {
+			invalid[i] = true
+		}
+	}
+	return withSamples(counter, counter.Timestamps, counter.Values, invalid)
+}
+
+// Return the global slices, completed with the attributed slices they miss.
+// The concurrency of the counter samples would otherwise be underestimated,
+// giving the attributed slices more than their share of the samples. The
+// global slices of the other groups can't be recovered though, so a warning
+// is logged.
+func completeGlobalSlices(ctx context.Context, globalSlices []*service.ProfilingData_GpuSlices_Slice, groupToSlices map[int32][]*service.ProfilingData_GpuSlices_Slice) []*service.ProfilingData_GpuSlices_Slice {
+	known := make(map[*service.ProfilingData_GpuSlices_Slice]bool, len(globalSlices))
+	for _, slice := range globalSlices {
+		known[slice] = true
+	}
+	missing := []*service.ProfilingData_GpuSlices_Slice{}
+	for _, slices := range groupToSlices {
+		for _, slice := range slices {
+			if !known[slice] {
+				missing = append(missing, slice)
 			}
 		}
 	}
+	if len(missing) == 0 {
+		return globalSlices
+	}
+	warn(ctx, service.ProfilingData_GpuCounters_Warning_MissingGlobalSlices, "", "%v attributed slices are missing from the global slices, the concurrency may be underestimated", len(missing))
+	complete := make([]*service.ProfilingData_GpuSlices_Slice, 0, len(globalSlices)+len(missing))
+	complete = append(complete, globalSlices...)
+	complete = append(complete, missing...)
+	sortSlices(complete)
+	return complete
 }
 
 // Scan global slices and count concurrent slices for each counter sample.
@@ -176,9 +1925,9 @@ func scanConcurrency(globalSlices []*service.ProfilingData_GpuSlices_Slice, coun
 		sStart, sEnd := slice.Ts, slice.Ts+slice.Dur
 		for i := 1; i < len(counter.Timestamps); i++ {
 			cStart, cEnd := counter.Timestamps[i-1], counter.Timestamps[i]
-			if cEnd < sStart { // Sample earlier than GPU slice's span.
+			if cEnd <= sStart { // Sample earlier than GPU slice's span.
 				continue
-			} else if cStart > sEnd { // Sample later than GPU slice's span.
+			} else if cStart >= sEnd { // Sample later than GPU slice's span.
 				break
 			} else { // Sample overlaps with GPU slice's span.
 				slicesCount[i]++
@@ -188,12 +1937,70 @@ func scanConcurrency(globalSlices []*service.ProfilingData_GpuSlices_Slice, coun
 	return slicesCount
 }
 
+// Find the GPU slice group overlapping the most of each valid counter sample,
+// and return the samples won by each group, with their full weight.
+func majorityWinners(globalSlices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter) map[int32]map[int]float64 {
+	overlaps := make([]map[int32]uint64, len(counter.Timestamps)) // sample index -> group id -> overlap.
+	for _, slice := range globalSlices {
+		sStart, sEnd := slice.Ts, slice.Ts+slice.Dur
+		for i := 1; i < len(counter.Timestamps); i++ {
+			cStart, cEnd := counter.Timestamps[i-1], counter.Timestamps[i]
+			if cEnd <= sStart || !validSample(counter, i) { // Sample earlier than GPU slice's span, or not trusted.
+				continue
+			} else if cStart >= sEnd { // Sample later than GPU slice's span.
+				break
+			}
+			if overlaps[i] == nil {
+				overlaps[i] = map[int32]uint64{}
+			}
+			overlaps[i][slice.GroupId] += u64.Min(cEnd, sEnd) - u64.Max(cStart, sStart)
+		}
+	}
+	winners := map[int32]map[int]float64{}
+	for i, groups := range overlaps {
+		if len(groups) == 0 {
+			continue
+		}
+		winner, max := int32(0), uint64(0)
+		found := false
+		for groupId, overlap := range groups {
+			if !found || overlap > max || (overlap == max && groupId < winner) {
+				winner, max, found = groupId, overlap, true
+			}
+		}
+		if winners[winner] == nil {
+			winners[winner] = map[int]float64{}
+		}
+		winners[winner][i] = 1
+	}
+	return winners
+}
+
 // Map counter samples to GPU slice. When collecting samples, three sets will
 // be maintained based on attribution strategy: the minimum set,
 // the best guess set, and the maximum set.
-// The returned results map {sample index} to {sample weight}.
-func mapCounterSamples(slices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter, concurrentSlicesCount []int) (map[int]float64, map[int]float64, map[int]float64) {
-	estimateSet, minSet, maxSet := map[int]float64{}, map[int]float64{}, map[int]float64{}
+// The returned results map {sample index} to {sample weight}. The minimum
+// and maximum sets bound the share of each sample truly owned by the slices:
+// a sample is only certainly owned in full when it is contained in a slice
+// running alone, and any overlapping sample may be owned in full.
+// The slices of one command may each overlap the same sample, their weights
+// are accumulated and then capped to 1, the sample's full weight, so that a
+// sample never contributes to one command more than it was measured. The
+// concurrency weight normally keeps the sum below 1 already, the cap guards
+// against concurrency counts computed from an incomplete slice set.
+// The invalid samples are left out of all the sets.
+// The minimum and maximum sets are nil if bands is false.
+// A sample spans (cStart, cEnd], between its previous timestamp and its own,
+// and a slice spans [sStart, sEnd). A sample only touching a slice at one of
+// its edges doesn't overlap it, and a sample whose edges match the slice's
+// edges is contained in it, so that abutting slices share the sample weight
+// without any loss or double counting.
+func mapCounterSamples(slices []*service.ProfilingData_GpuSlices_Slice, counter *service.ProfilingData_Counter, concurrentSlicesCount []int, bands bool) (map[int]float64, map[int]float64, map[int]float64) {
+	estimateSet := map[int]float64{}
+	var minSet, maxSet map[int]float64
+	if bands {
+		minSet, maxSet = map[int]float64{}, map[int]float64{}
+	}
 	for _, slice := range slices {
 		sStart, sEnd := slice.Ts, slice.Ts+slice.Dur
 		for i := 1; i < len(counter.Timestamps); i++ {
@@ -202,12 +2009,15 @@ func mapCounterSamples(slices []*service.ProfilingData_GpuSlices_Slice, counter
 			if concurrentSlicesCount[i] > 1 {
 				concurrencyWeight = 1 / float64(concurrentSlicesCount[i])
 			}
-			if cEnd < sStart { // Sample earlier than GPU slice's span.
+			if cEnd <= sStart || !validSample(counter, i) { // Sample earlier than GPU slice's span, or not trusted.
 				continue
-			} else if cStart > sEnd { // Sample later than GPU slice's span.
+			} else if cStart >= sEnd { // Sample later than GPU slice's span.
 				break
-			} else if cStart > sStart && cEnd < sEnd { // Sample is contained inside GPU slice's span.
-				estimateSet[i] = 1 * concurrencyWeight
+			} else if cStart >= sStart && cEnd <= sEnd { // Sample is contained inside GPU slice's span.
+				estimateSet[i] += 1 * concurrencyWeight
+				if !bands {
+					continue
+				}
 				// Only add to minSet when there's no concurrent slices, because of the
 				// possibility that the sample belongs entirely to one of the slices.
 				if concurrencyWeight == 1.0 {
@@ -220,106 +2030,546 @@ func mapCounterSamples(slices []*service.ProfilingData_GpuSlices_Slice, counter
 					percent = float64(u64.Min(cEnd, sEnd)-u64.Max(cStart, sStart)) / float64(cEnd-cStart) // Time overlap weight.
 					percent *= concurrencyWeight
 				}
-				if _, ok := estimateSet[i]; !ok {
-					estimateSet[i] = 0
-				}
 				estimateSet[i] += percent
-				maxSet[i] = 1
+				if bands {
+					maxSet[i] = 1
+				}
 			}
 		}
 	}
+	for i, weight := range estimateSet {
+		estimateSet[i] = f64.MinOf(weight, 1)
+	}
 	return estimateSet, minSet, maxSet
 }
 
-// Aggregate counter samples to a single value based on counter weight.
-func aggregateCounterSamples(sampleWeight map[int]float64, counter *service.ProfilingData_Counter) float64 {
-	switch getCounterAggregationMethod(counter) {
-	case service.ProfilingData_GpuCounters_Metric_Summation:
-		ValueSum := float64(0)
-		for idx, weight := range sampleWeight {
-			ValueSum += counter.Values[idx] * weight
-		}
-		return ValueSum
-	case service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg:
-		ValueSum, timeSum := float64(0), float64(0)
-		for idx, weight := range sampleWeight {
-			ValueSum += counter.Values[idx] * float64(counter.Timestamps[idx]-counter.Timestamps[idx-1]) * weight
-			timeSum += float64(counter.Timestamps[idx]-counter.Timestamps[idx-1]) * weight
-		}
-		if timeSum != 0 {
-			return ValueSum / timeSum
-		} else {
-			return -1
-		}
-	default:
-		return -1
+// Return the sample weights scaled by the magnitude of the samples relative to
+// their mean magnitude. With w the overlap weight of a sample and v its value:
+//
+//	w' = w × |v| / m, where m = Σ w|v| / Σ w
+//
+// The total weight is thus kept, but shifted to the larger samples: a
+// time-weighted average becomes Σ w|v|dv / Σ w|v|d, d being the sample
+// durations. The weights are returned unchanged if all the values are 0.
+func magnitudeWeights(sampleWeight map[int]float64, counter *service.ProfilingData_Counter) map[int]float64 {
+	if sampleWeight == nil {
+		return nil
+	}
+	mean := weightedMean{}
+	for _, idx := range sortedSamples(sampleWeight) {
+		mean.add(math.Abs(counter.Values[idx]), sampleWeight[idx])
+	}
+	if mean.mean == 0 {
+		return sampleWeight
+	}
+	weights := make(map[int]float64, len(sampleWeight))
+	for idx, weight := range sampleWeight {
+		weights[idx] = weight * math.Abs(counter.Values[idx]) / mean.mean
+	}
+	return weights
+}
+
+// Aggregate counter samples to a single value based on counter weight, using
+// the aggregator registered for the aggregation operator.
+func aggregateCounterSamples(sampleWeight map[int]float64, counter *service.ProfilingData_Counter, op service.ProfilingData_GpuCounters_Metric_AggregationOperator) float64 {
+	if aggregator, ok := aggregators[op]; ok {
+		return aggregator.Aggregate(sampleWeight, counter)
 	}
+	return -1
+}
+
+// commandNode is a command of the tree built from the leaf entries' indices.
+type commandNode struct {
+	index    []uint64
+	groups   []int32 // The leaf groups of the command itself.
+	children map[uint64]*commandNode
+	// The leaf groups of the command's subtree are [start, end) of the leaf
+	// groups listed in depth-first order.
+	start, end int
 }
 
 // Merge leaf group entries if they belong to the same command, and also derive
 // the parent command nodes' GPU performances based on the leaf entries.
-func mergeLeafEntries(ctx context.Context, metrics []*service.ProfilingData_GpuCounters_Metric, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry) []*service.ProfilingData_GpuCounters_Entry {
-	mergedEntries := []*service.ProfilingData_GpuCounters_Entry{}
+// The command tree is built once, and its leaf groups listed in depth-first
+// order, so that the leaves of every command are a contiguous range of them.
+// The commands with a single child and no leaf group of their own share the
+// child's performance, which keeps the work linear in deep narrow trees.
+func mergeLeafEntries(ctx context.Context, metrics []*service.ProfilingData_GpuCounters_Metric, ids *metricIds, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry, options *Options) []*service.ProfilingData_GpuCounters_Entry {
+	entries, _ := mergeCommandTree(ctx, metrics, ids, groupToEntry, options, false)
+	return entries
+}
+
+// Merge the leaf group entries as mergeLeafEntries does, and also return the
+// performance of the whole frame, merged from all the leaves, if frame is
+// true.
+func mergeCommandTree(ctx context.Context, metrics []*service.ProfilingData_GpuCounters_Metric, ids *metricIds, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry, options *Options, frame bool) ([]*service.ProfilingData_GpuCounters_Entry, *service.ProfilingData_GpuCounters_Entry) {
+	weightMetricId := gpuTimeMetricId
+	if options.RollupWeight == RollupBySliceCount {
+		weightMetricId = gpuSliceCountMetricId
+	}
 
-	// Find out all the self/parent command nodes that may need performance merging.
-	indexToGroups := map[string][]int32{} // string formatted command index -> a list of contained groups referenced by group id.
+	// Build the tree of the self/parent command nodes that may need performance merging.
+	root := &commandNode{children: map[uint64]*commandNode{}}
 	for groupId, entry := range groupToEntry {
-		// The performance of one leaf group/command contributes to itself and all the ancestors up to the root command node.
-		leafIdx := entry.CommandIndex
-		for end := len(leafIdx); end > 0; end-- {
-			mergedIdxStr := encodeIndex(leafIdx[0:end])
-			indexToGroups[mergedIdxStr] = append(indexToGroups[mergedIdxStr], groupId)
+		node := root
+		for i, v := range entry.CommandIndex {
+			child, ok := node.children[v]
+			if !ok {
+				child = &commandNode{index: entry.CommandIndex[:i+1], children: map[uint64]*commandNode{}}
+				node.children[v] = child
+			}
+			node = child
 		}
+		node.groups = append(node.groups, groupId)
+	}
+	leaves := []int32{}
+	var list func(node *commandNode)
+	list = func(node *commandNode) {
+		node.start = len(leaves)
+		sort.Slice(node.groups, func(i, j int) bool { return node.groups[i] < node.groups[j] })
+		leaves = append(leaves, node.groups...)
+		for _, child := range sortedChildren(node) {
+			list(child)
+		}
+		node.end = len(leaves)
+	}
+	list(root)
+
+	// The performance of one leaf group/command contributes to itself and all the ancestors up to the root command node.
+	// The metrics missing from a leaf, such as of a counter that couldn't be
+	// computed for its group, are merged as having no data, and the merged
+	// values are marked partial. incomplete[m][i] counts the leaves before the
+	// leaf i missing the metric m, or whose value is partial already.
+	weights := make([]float64, len(leaves))
+	for i, id := range leaves {
+		if perf, ok := groupToEntry[id].MetricToValue[weightMetricId]; ok {
+			weights[i] = perf.Estimate
+		}
+	}
+	perfs := make([][]*service.ProfilingData_GpuCounters_Perf, len(metrics))
+	incomplete := make([][]int, len(metrics))
+	missing := make([]int, len(metrics))
+	for m, metric := range metrics {
+		perfs[m] = make([]*service.ProfilingData_GpuCounters_Perf, len(leaves))
+		incomplete[m] = make([]int, len(leaves)+1)
+		for i, id := range leaves {
+			perf, ok := groupToEntry[id].MetricToValue[metric.Id]
+			if !ok {
+				perf = unavailablePerf()
+				missing[m]++
+			}
+			perfs[m][i] = perf
+			incomplete[m][i+1] = incomplete[m][i]
+			if !ok || perf.Partial {
+				incomplete[m][i+1]++
+			}
+		}
+	}
+
+	// The derived and ratio metrics and the children GPU time are recomputed
+	// rather than merged.
+	derived := resolveDerived(ctx, metrics, ids, options)
+	ratios := resolveRatios(ctx, metrics, ids, options)
+	recomputed := map[int32]bool{}
+	for _, f := range derived {
+		recomputed[f.id] = true
+	}
+	for _, ratio := range ratios {
+		recomputed[ratio.id] = true
+	}
+	for m, metric := range metrics {
+		if missing[m] != 0 && !recomputed[metric.Id] && metric.Id != gpuChildrenTimeMetricId {
+			warn(ctx, service.ProfilingData_GpuCounters_Warning_MissingMetric, metric.Name, "The metric %v is missing from some groups, merged as having no data", metric.Name)
+		}
+	}
+	// The children GPU time is converted from the unit of the GPU time.
+	childrenTimeScale := float64(1)
+	scales := timeMetricScales(options)
+	if scale, ok := scales[gpuTimeMetricId]; ok {
+		childrenTimeScale *= scale
+	}
+	if scale, ok := scales[gpuChildrenTimeMetricId]; ok {
+		childrenTimeScale /= scale
 	}
 
-	for commandIndex, leafGroupIds := range indexToGroups {
+	mergedEntries := []*service.ProfilingData_GpuCounters_Entry{}
+	var merge func(node *commandNode) *service.ProfilingData_GpuCounters_Entry
+	merge = func(node *commandNode) *service.ProfilingData_GpuCounters_Entry {
 		mergedEntry := &service.ProfilingData_GpuCounters_Entry{
-			CommandIndex:  decodeIndex(commandIndex),
+			CommandIndex:  append([]uint64{}, node.index...),
 			MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{},
 		}
-		for _, metric := range metrics {
-			estimate, min, max := float64(-1), float64(-1), float64(-1)
-			switch op := metric.Op; op {
-			case service.ProfilingData_GpuCounters_Metric_Summation:
-				estimate, min, max = float64(0), float64(0), float64(0)
-				for _, id := range leafGroupIds {
-					entry := groupToEntry[id]
-					estimate += entry.MetricToValue[metric.Id].Estimate
-					min += entry.MetricToValue[metric.Id].Min
-					max += entry.MetricToValue[metric.Id].Max
-				}
-			case service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg:
-				timeSum, estimateValueSum, minValueSum, maxValueSum := float64(0), float64(0), float64(0), float64(0)
-				for _, id := range leafGroupIds {
-					entry := groupToEntry[id]
-					gpuTime := entry.MetricToValue[gpuTimeMetricId].Estimate
-					timeSum += gpuTime
-					estimateValueSum += gpuTime * entry.MetricToValue[metric.Id].Estimate
-					minValueSum += gpuTime * entry.MetricToValue[metric.Id].Min
-					maxValueSum += gpuTime * entry.MetricToValue[metric.Id].Max
-				}
-				if timeSum != 0 {
-					estimate, min, max = estimateValueSum/timeSum, minValueSum/timeSum, maxValueSum/timeSum
+		if node != root {
+			mergedEntries = append(mergedEntries, mergedEntry)
+		}
+		children := sortedChildren(node)
+		childEntries := make([]*service.ProfilingData_GpuCounters_Entry, len(children))
+		for i, child := range children {
+			childEntries[i] = merge(child)
+		}
+		// A command with a single leaf group, such as in a single group trace,
+		// or with the same leaves as its only child shares the performance of
+		// that leaf or child, sparing the merge and its rounding.
+		var shared *service.ProfilingData_GpuCounters_Entry
+		if node.end-node.start == 1 {
+			shared = groupToEntry[leaves[node.start]]
+		} else if len(node.groups) == 0 && len(children) == 1 {
+			shared = childEntries[0]
+		}
+		if shared != nil {
+			shareEntryPerf(mergedEntry, shared, options)
+		}
+		for m, metric := range metrics {
+			if recomputed[metric.Id] || metric.Id == gpuChildrenTimeMetricId {
+				continue
+			}
+			if shared != nil {
+				if _, ok := mergedEntry.MetricToValue[metric.Id]; !ok {
+					mergedEntry.MetricToValue[metric.Id] = unavailablePerf()
 				}
-			default:
-				log.E(ctx, "Counter aggregation method not implemented yet. Operation: %v", op)
+				continue
+			}
+			aggregator, ok := aggregators[metric.Op]
+			if !ok {
+				warn(ctx, service.ProfilingData_GpuCounters_Warning_UnsupportedAggregation, metric.Name, "Counter aggregation method not implemented yet. Operation: %v", metric.Op)
+				mergedEntry.MetricToValue[metric.Id] = unavailablePerf()
+				continue
+			}
+			merged := aggregator.Merge(perfs[m][node.start:node.end], weights[node.start:node.end])
+			if options.SampleStatistics {
+				mergeSampleStatistics(merged, perfs[m][node.start:node.end], weights[node.start:node.end])
+			}
+			merged.Partial = incomplete[m][node.end] != incomplete[m][node.start] && !isUnavailable(merged)
+			mergedEntry.MetricToValue[metric.Id] = merged
+		}
+		if shared == nil {
+			setDerivedMetrics(derived, mergedEntry)
+			setRatioMetrics(ratios, mergedEntry)
+			if options.Confidence {
+				setMergedConfidence(mergedEntry, leaves[node.start:node.end], weights[node.start:node.end], groupToEntry)
+			}
+			if options.DensityConfidence {
+				setMergedDensityConfidence(mergedEntry, leaves[node.start:node.end], groupToEntry)
+			}
+			if options.Coverage {
+				setMergedCoverage(mergedEntry, leaves[node.start:node.end], groupToEntry)
+			}
+		}
+		setChildrenTime(mergedEntry, node, groupToEntry, len(children), childrenTimeScale)
+		if options.GapThreshold > 0 {
+			setMergedGappedMetrics(mergedEntry, leaves[node.start:node.end], groupToEntry)
+		}
+		if options.TopSlices > 0 {
+			setMergedTopSlices(mergedEntry, node, childEntries, groupToEntry, options.TopSlices)
+		}
+		return mergedEntry
+	}
+	var frameEntry *service.ProfilingData_GpuCounters_Entry
+	if frame {
+		frameEntry = merge(root)
+	} else {
+		for _, child := range sortedChildren(root) {
+			merge(child)
+		}
+	}
+	if len(options.InstanceCounts) != 0 {
+		setPerInstanceValues(metrics, mergedEntries, options.InstanceCounts)
+	}
+	return mergedEntries, frameEntry
+}
+
+// Set the summed values of the entries of the instanced commands divided by
+// their instance count. The averaged and maximum metrics don't depend on the
+// instance count and are left out. The values are unavailable if the count is
+// zero.
+func setPerInstanceValues(metrics []*service.ProfilingData_GpuCounters_Metric, entries []*service.ProfilingData_GpuCounters_Entry, instanceCounts []InstanceCount) {
+	counts := make(map[string]uint64, len(instanceCounts))
+	for _, instanceCount := range instanceCounts {
+		counts[encodeIndex(instanceCount.CommandIndex)] = instanceCount.Count
+	}
+	for _, entry := range entries {
+		count, ok := counts[encodeIndex(entry.CommandIndex)]
+		if !ok {
+			continue
+		}
+		entry.MetricToPerInstanceValue = map[int32]*service.ProfilingData_GpuCounters_Perf{}
+		for _, metric := range metrics {
+			perf, ok := entry.MetricToValue[metric.Id]
+			if !ok || metric.Op != service.ProfilingData_GpuCounters_Metric_Summation {
+				continue
+			}
+			if count == 0 || isUnavailable(perf) {
+				entry.MetricToPerInstanceValue[metric.Id] = unavailablePerf()
+				continue
+			}
+			entry.MetricToPerInstanceValue[metric.Id] = &service.ProfilingData_GpuCounters_Perf{
+				Estimate: perf.Estimate / float64(count),
+				Min:      perf.Min / float64(count),
+				Max:      perf.Max / float64(count),
+			}
+		}
+	}
+}
+
+// Set the entries of the queues of the merged entries, see
+// Options.QueueEntries, merging the leaf group entries of every queue
+// separately. slices are the slices of the groups sorted by start time, whose
+// tracks are the queues. The commands running on a single queue have none,
+// their queue entry being the same as theirs.
+func setQueueEntries(ctx context.Context, metrics []*service.ProfilingData_GpuCounters_Metric, ids *metricIds, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry, slices []*service.ProfilingData_GpuSlices_Slice, entries []*service.ProfilingData_GpuCounters_Entry, options *Options) {
+	trackToGroups := map[int32]map[int32]*service.ProfilingData_GpuCounters_Entry{}
+	queued := map[int32]bool{}
+	for _, slice := range slices {
+		entry, ok := groupToEntry[slice.GroupId]
+		if !ok || queued[slice.GroupId] {
+			continue
+		}
+		queued[slice.GroupId] = true
+		if trackToGroups[slice.TrackId] == nil {
+			trackToGroups[slice.TrackId] = map[int32]*service.ProfilingData_GpuCounters_Entry{}
+		}
+		trackToGroups[slice.TrackId][slice.GroupId] = entry
+	}
+	if len(trackToGroups) < 2 {
+		return
+	}
+
+	indexToEntry := make(map[string]*service.ProfilingData_GpuCounters_Entry, len(entries))
+	for _, entry := range entries {
+		indexToEntry[encodeIndex(entry.CommandIndex)] = entry
+	}
+	for trackId, queueGroups := range trackToGroups {
+		for _, queueEntry := range mergeLeafEntries(ctx, metrics, ids, queueGroups, options) {
+			entry := indexToEntry[encodeIndex(queueEntry.CommandIndex)]
+			if entry.TrackToEntry == nil {
+				entry.TrackToEntry = map[int32]*service.ProfilingData_GpuCounters_Entry{}
+			}
+			entry.TrackToEntry[trackId] = queueEntry
+		}
+	}
+	for _, entry := range entries {
+		if len(entry.TrackToEntry) < 2 {
+			entry.TrackToEntry = nil
+		}
+	}
+}
+
+// Set the entries of the render stages of the commands, see
+// Options.StageEntries. The nested slices, at depth > 0, of each group are
+// split by label into stage groups linked to the group's command. The stage
+// groups are attributed like the leaf groups, the stages of all the commands
+// competing for the counter samples, and then merged per label up to the
+// commands. If include is not nil, only the stages of the groups it accepts
+// get an entry.
+func setStageEntries(ctx context.Context, slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter, include func(*service.ProfilingData_GpuSlices_Group) bool, entries []*service.ProfilingData_GpuCounters_Entry, options *Options) {
+	type stageKey struct {
+		groupId int32
+		label   string
+	}
+	groups := make(map[int32]*service.ProfilingData_GpuSlices_Group, len(slices.Groups))
+	for _, group := range slices.Groups {
+		groups[group.Id] = group
+	}
+	stages := &service.ProfilingData_GpuSlices{Tracks: slices.Tracks}
+	stageIds := map[stageKey]int32{}
+	stageParents := []*service.ProfilingData_GpuSlices_Group{} // Stage group id -> leaf group.
+	stageLabels := []string{}                                  // Stage group id -> label.
+	for _, slice := range slices.Slices {
+		group, ok := groups[slice.GroupId]
+		if slice.Depth <= 0 || !ok {
+			continue
+		}
+		k := stageKey{slice.GroupId, stageLabel(slice)}
+		id, ok := stageIds[k]
+		if !ok {
+			id = int32(len(stageLabels))
+			stageIds[k] = id
+			stageParents = append(stageParents, group)
+			stageLabels = append(stageLabels, k.label)
+			stages.Groups = append(stages.Groups, &service.ProfilingData_GpuSlices_Group{
+				Id:     id,
+				Parent: group.Parent,
+				Link:   group.Link,
+			})
+		}
+		stages.Slices = append(stages.Slices, &service.ProfilingData_GpuSlices_Slice{
+			Ts:      slice.Ts,
+			Dur:     slice.Dur,
+			Id:      slice.Id,
+			Label:   slice.Label,
+			Extras:  slice.Extras,
+			TrackId: slice.TrackId,
+			GroupId: id,
+		})
+	}
+	if len(stageLabels) == 0 {
+		return
+	}
+	var includeStage func(*service.ProfilingData_GpuSlices_Group) bool
+	if include != nil {
+		includeStage = func(stage *service.ProfilingData_GpuSlices_Group) bool { return include(stageParents[stage.Id]) }
+	}
+	metrics, stageToEntry, _ := computeLeafEntries(ctx, stages, counters, includeStage, options)
+
+	labelToGroups := map[string]map[int32]*service.ProfilingData_GpuCounters_Entry{}
+	for id, entry := range stageToEntry {
+		label := stageLabels[id]
+		if labelToGroups[label] == nil {
+			labelToGroups[label] = map[int32]*service.ProfilingData_GpuCounters_Entry{}
+		}
+		labelToGroups[label][id] = entry
+	}
+	indexToEntry := make(map[string]*service.ProfilingData_GpuCounters_Entry, len(entries))
+	for _, entry := range entries {
+		indexToEntry[encodeIndex(entry.CommandIndex)] = entry
+	}
+	for label, labelGroups := range labelToGroups {
+		for _, stageEntry := range mergeLeafEntries(ctx, metrics, newMetricIds(len(counters), options), labelGroups, options) {
+			entry, ok := indexToEntry[encodeIndex(stageEntry.CommandIndex)]
+			if !ok {
+				continue
+			}
+			if entry.StageToEntry == nil {
+				entry.StageToEntry = map[string]*service.ProfilingData_GpuCounters_Entry{}
+			}
+			entry.StageToEntry[label] = stageEntry
+		}
+	}
+}
+
+// Return the name of the render stage of the nested slice, its label, or its
+// depth if it has none.
+func stageLabel(slice *service.ProfilingData_GpuSlices_Slice) string {
+	if slice.Label != "" {
+		return slice.Label
+	}
+	return fmt.Sprintf("Depth %v", slice.Depth)
+}
+
+// Set the values of the entries normalized by the ones of the frame. The
+// values are unavailable if either is, or if the frame's is zero.
+func setNormalizedValues(entries []*service.ProfilingData_GpuCounters_Entry, frame *service.ProfilingData_GpuCounters_Entry) {
+	for _, entry := range entries {
+		entry.MetricToNormalizedValue = make(map[int32]float64, len(entry.MetricToValue))
+		for id, perf := range entry.MetricToValue {
+			frameValue, ok := frame.MetricToValue[id]
+			if !ok || isUnavailable(frameValue) || isUnavailable(perf) || frameValue.Estimate == 0 {
+				entry.MetricToNormalizedValue[id] = -1
+				continue
 			}
-			mergedEntry.MetricToValue[metric.Id] = &service.ProfilingData_GpuCounters_Perf{
-				Estimate: estimate,
-				Min:      min,
-				Max:      max,
+			entry.MetricToNormalizedValue[id] = perf.Estimate / frameValue.Estimate
+		}
+	}
+}
+
+// Set the performance of a merged command entry to a copy of the one of the
+// entry of the same leaf groups, along with its confidences and coverages.
+func shareEntryPerf(mergedEntry, shared *service.ProfilingData_GpuCounters_Entry, options *Options) {
+	for id, perf := range shared.MetricToValue {
+		mergedEntry.MetricToValue[id] = proto.Clone(perf).(*service.ProfilingData_GpuCounters_Perf)
+	}
+	if options.Confidence && shared.MetricToConfidence != nil {
+		mergedEntry.MetricToConfidence = make(map[int32]float64, len(shared.MetricToConfidence))
+		for id, confidence := range shared.MetricToConfidence {
+			mergedEntry.MetricToConfidence[id] = confidence
+		}
+	}
+	if options.DensityConfidence {
+		mergedEntry.DensityConfidence = shared.DensityConfidence
+	}
+	if options.Coverage && shared.MetricToCoverage != nil {
+		mergedEntry.MetricToCoverage = make(map[int32]float64, len(shared.MetricToCoverage))
+		for id, coverage := range shared.MetricToCoverage {
+			mergedEntry.MetricToCoverage[id] = coverage
+		}
+	}
+}
+
+// Set the children GPU time of a merged command entry: its inclusive GPU time
+// minus the GPU time of its own leaf groups, converted by scale. Leaf commands
+// have none.
+func setChildrenTime(mergedEntry *service.ProfilingData_GpuCounters_Entry, node *commandNode, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry, children int, scale float64) {
+	gpuTime, ok := mergedEntry.MetricToValue[gpuTimeMetricId]
+	if !ok {
+		return
+	}
+	childrenTime := float64(0)
+	if children != 0 {
+		childrenTime = gpuTime.Estimate
+		for _, id := range node.groups {
+			if perf, ok := groupToEntry[id].MetricToValue[gpuTimeMetricId]; ok {
+				childrenTime -= perf.Estimate
 			}
 		}
-		mergedEntries = append(mergedEntries, mergedEntry)
+		childrenTime *= scale
 	}
+	mergedEntry.MetricToValue[gpuChildrenTimeMetricId] = &service.ProfilingData_GpuCounters_Perf{
+		Estimate: childrenTime,
+		Min:      childrenTime,
+		Max:      childrenTime,
+	}
+}
 
-	return mergedEntries
+// Return the children of the command node sorted by index.
+func sortedChildren(node *commandNode) []*commandNode {
+	children := make([]*commandNode, 0, len(node.children))
+	for _, child := range node.children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].index[len(children[i].index)-1] < children[j].index[len(children[j].index)-1]
+	})
+	return children
 }
 
 // Evaluate and return the appropriate aggregation method for a GPU counter.
-func getCounterAggregationMethod(counter *service.ProfilingData_Counter) service.ProfilingData_GpuCounters_Metric_AggregationOperator {
-	// TODO: Use time-weighted average to aggregate all counters for now. May need vendor's support. Bug tracked with b/158057709.
-	return service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg
+func getCounterAggregationMethod(counter *service.ProfilingData_Counter, options *Options) service.ProfilingData_GpuCounters_Metric_AggregationOperator {
+	op, _ := counterAggregation(counter, options)
+	return op
+}
+
+// Tell how the aggregation operator of the counter was chosen, for debugging.
+func getCounterAggregationSource(counter *service.ProfilingData_Counter, options *Options) string {
+	_, source := counterAggregation(counter, options)
+	return source
+}
+
+// Choose the aggregation operator of a GPU counter, and tell where it comes
+// from. In order of precedence, the operators and the summed counters of the
+// options, the running totals, the vendor's operators, the units of the
+// counter's descriptor spec, and the time-weighted average fallback.
+func counterAggregation(counter *service.ProfilingData_Counter, options *Options) (service.ProfilingData_GpuCounters_Metric_AggregationOperator, string) {
+	if op, ok := options.CounterAggregations[counter.Name]; ok {
+		return op, "options"
+	}
+	for _, name := range options.SummedCounters {
+		if name == counter.Name {
+			return service.ProfilingData_GpuCounters_Metric_Summation, "options"
+		}
+	}
+	if runningTotal(counter, options) {
+		// The increments of the total are summed.
+		return service.ProfilingData_GpuCounters_Metric_Summation, "running total"
+	}
+	if op, ok := vendorAggregations[options.Vendor][counter.Name]; ok {
+		return op, "vendor"
+	}
+	if spec := counterSpec(counter, options); spec != nil {
+		if op, ok := specAggregation(spec); ok {
+			return op, "descriptor"
+		}
+	}
+	// TODO: Use time-weighted average to aggregate the other counters for now. May need vendor's support. Bug tracked with b/158057709.
+	return service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg, "fallback"
+}
+
+// Name the attribution mode of the counter samples to the GPU slices, see
+// Options.Attribution.
+func attributionMode(options *Options) string {
+	if options.Attribution != "" {
+		return options.Attribution
+	}
+	return ProportionalAttribution
 }
 
 // Encode a command index, transform from array format to string format.
@@ -0,0 +1,1655 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/math/u64"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+	"github.com/google/gapid/gapis/service/path"
+)
+
+func init() {
+	// Any violation of the time invariants fails the test logging it.
+	checkTimeInvariants = true
+}
+
+// slice builds a depth 0 GPU slice for the given group.
+func slice(groupId int32, ts, dur uint64) *service.ProfilingData_GpuSlices_Slice {
+	return &service.ProfilingData_GpuSlices_Slice{Ts: ts, Dur: dur, GroupId: groupId}
+}
+
+// group builds a GPU slice group linked to the given command index.
+func group(id int32, indices ...uint64) *service.ProfilingData_GpuSlices_Group {
+	return &service.ProfilingData_GpuSlices_Group{Id: id, Link: &path.Command{Indices: indices}}
+}
+
+// counter builds a GPU counter from its sample timestamps and values.
+func counter(name string, timestamps []uint64, values []float64) *service.ProfilingData_Counter {
+	return &service.ProfilingData_Counter{Name: name, Timestamps: timestamps, Values: values}
+}
+
+// findEntry returns the entry of the given command index, or nil if absent.
+func findEntry(res *service.ProfilingData_GpuCounters, indices ...uint64) *service.ProfilingData_GpuCounters_Entry {
+	for _, entry := range res.Entries {
+		if encodeIndex(entry.CommandIndex) == encodeIndex(indices) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// entriesByIndex keys the result entries by their string formatted command
+// index, so results can be compared regardless of the entries order.
+func entriesByIndex(res *service.ProfilingData_GpuCounters) map[string]map[int32]*service.ProfilingData_GpuCounters_Perf {
+	entries := map[string]map[int32]*service.ProfilingData_GpuCounters_Perf{}
+	for _, entry := range res.Entries {
+		entries[encodeIndex(entry.CommandIndex)] = entry.MetricToValue
+	}
+	return entries
+}
+
+// assertSameEntries checks that two results have the same entries, up to the
+// float rounding differences caused by the order of the samples aggregation.
+func assertSameEntries(ctx context.Context, name string, got, expected *service.ProfilingData_GpuCounters) {
+	gotEntries, expectedEntries := entriesByIndex(got), entriesByIndex(expected)
+	assert.For(ctx, "%v entries", name).ThatMap(gotEntries).IsLength(len(expectedEntries))
+	for idx, values := range expectedEntries {
+		assert.For(ctx, "%v %v metrics", name, idx).ThatMap(gotEntries[idx]).IsLength(len(values))
+		for id, want := range values {
+			got, ok := gotEntries[idx][id]
+			if !assert.For(ctx, "%v %v metric %v", name, idx, id).That(ok).Equals(true) {
+				continue
+			}
+			assert.For(ctx, "%v %v metric %v estimate", name, idx, id).ThatFloat(got.Estimate).Equals(want.Estimate, 1e-9)
+			assert.For(ctx, "%v %v metric %v min", name, idx, id).ThatFloat(got.Min).Equals(want.Min, 1e-9)
+			assert.For(ctx, "%v %v metric %v max", name, idx, id).ThatFloat(got.Max).Equals(want.Max, 1e-9)
+		}
+	}
+}
+
+// twoCommandsFixture has two sequential commands, [0,0] and [0,1], each with
+// a single slice, and one counter sampled every 10ns from 0 to 40.
+func twoCommandsFixture() (*service.ProfilingData_GpuSlices, []*service.ProfilingData_Counter) {
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{
+			group(0, 0, 0),
+			group(1, 0, 1),
+		},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 5, 10),
+			slice(1, 25, 10),
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40}, []float64{0, 2, 4, 6, 8}),
+	}
+	return slices, counters
+}
+
+func TestGpuTimeForGroup(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		name      string
+		slices    []*service.ProfilingData_GpuSlices_Slice
+		gpuTime   uint64
+		wallTime  uint64
+		intervals int
+	}{
+		{"contiguous", []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(0, 10, 10), slice(0, 20, 5),
+		}, 25, 25, 1},
+		{"two bursts", []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(0, 5, 10), slice(0, 30, 10),
+		}, 30, 25, 2},
+		{"fully overlapping", []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 20), slice(0, 2, 5), slice(0, 10, 10),
+		}, 35, 20, 1},
+		{"empty", nil, 0, 0, 0},
+	} {
+		gpuTime, wallTime, intervals := gpuTimeForGroup(test.slices, 0)
+		assert.For(ctx, "%v gpu time", test.name).That(gpuTime).Equals(test.gpuTime)
+		assert.For(ctx, "%v wall time", test.name).That(wallTime).Equals(test.wallTime)
+		assert.For(ctx, "%v intervals", test.name).That(intervals).Equals(test.intervals)
+	}
+}
+
+func TestCounterScale(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	counterMetricId := counterMetricIdOffset
+
+	raw, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	unscaled, err := ComputeCounters(ctx, slices, counters, &Options{
+		CounterScales: map[string]CounterScale{"Busy": {Factor: 1}},
+	})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "scale of 1 metrics").That(unscaled.Metrics).DeepEquals(raw.Metrics)
+	assertSameEntries(ctx, "scale of 1", unscaled, raw)
+
+	scaled, err := ComputeCounters(ctx, slices, counters, &Options{
+		CounterScales: map[string]CounterScale{"Busy": {Factor: 1000, Unit: "kilo"}},
+	})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "unit").That(scaled.Metrics[counterMetricId].Unit).Equals("kilo")
+	for _, idx := range [][]uint64{{0}, {0, 0}, {0, 1}} {
+		want := findEntry(raw, idx...).MetricToValue[counterMetricId]
+		got := findEntry(scaled, idx...).MetricToValue[counterMetricId]
+		assert.For(ctx, "%v estimate", idx).ThatFloat(got.Estimate).Equals(want.Estimate*1000, 1e-9)
+		assert.For(ctx, "%v min", idx).ThatFloat(got.Min).Equals(want.Min*1000, 1e-9)
+		assert.For(ctx, "%v max", idx).ThatFloat(got.Max).Equals(want.Max*1000, 1e-9)
+	}
+	assert.For(ctx, "original values").That(counters[0].Values).DeepEquals([]float64{0, 2, 4, 6, 8})
+}
+
+func TestMapCounterSamplesCapsSampleWeight(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Busy", []uint64{10, 60}, []float64{0, 1})
+
+	// Two slices of the same command, separated by a gap, each overlapping 40%
+	// of the single [10, 60] sample.
+	slices := []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 30), slice(0, 40, 30)}
+	estimateSet, _, _ := mapCounterSamples(slices, c, scanConcurrency(slices, c), true)
+	assert.For(ctx, "gapped weight").ThatFloat(estimateSet[1]).Equals(0.4, 1e-9)
+	estimateSet, _, _ = mapCounterSamples(slices, c, []int{0, 1}, true)
+	assert.For(ctx, "undiluted gapped weight").ThatFloat(estimateSet[1]).Equals(0.8, 1e-9)
+
+	// Two overlapping slices of the same command, each overlapping 60% of the
+	// sample. Without concurrency dilution the weight is capped.
+	slices = []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 40), slice(0, 30, 40)}
+	estimateSet, _, _ = mapCounterSamples(slices, c, scanConcurrency(slices, c), true)
+	assert.For(ctx, "overlapping weight").ThatFloat(estimateSet[1]).Equals(0.6, 1e-9)
+	estimateSet, _, _ = mapCounterSamples(slices, c, []int{0, 1}, true)
+	assert.For(ctx, "capped weight").ThatFloat(estimateSet[1]).Equals(1, 1e-9)
+
+	// A command with both a contained sample and a partial overlap on the
+	// same sample accumulates both contributions.
+	slices = []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 15), slice(0, 5, 100)}
+	estimateSet, _, _ = mapCounterSamples(slices, c, scanConcurrency(slices, c), true)
+	assert.For(ctx, "accumulated weight").ThatFloat(estimateSet[1]).Equals(0.5+0.5*0.1, 1e-9)
+}
+
+func TestMetricCatalog(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	counters = append(counters, counter("Bytes", []uint64{0, 20, 40}, []float64{0, 10, 20}))
+	for _, options := range []*Options{
+		nil,
+		{CounterScales: map[string]CounterScale{"Bytes": {Factor: 1e-3, Unit: "kilobytes"}}},
+	} {
+		res, err := ComputeCounters(ctx, slices, counters, options)
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "catalog").That(MetricCatalog(counters, options)).DeepEquals(res.Metrics)
+	}
+}
+
+func TestComputeCountersWithoutCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	full, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	fast, err := ComputeCounters(ctx, slices, nil, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	assert.For(ctx, "metrics").That(fast.Metrics).DeepEquals(timeMetrics(&Options{}))
+	fastEntries, fullEntries := entriesByIndex(fast), entriesByIndex(full)
+	assert.For(ctx, "entries").ThatMap(fastEntries).IsLength(len(fullEntries))
+	for idx, values := range fullEntries {
+		for _, metric := range timeMetrics(&Options{}) {
+			assert.For(ctx, "%v %v", idx, metric.Name).That(fastEntries[idx][metric.Id]).DeepEquals(values[metric.Id])
+		}
+	}
+}
+
+// benchmarkFixture builds a frame of commands under a single root, where each
+// command has slicesPerCommand sequential slices.
+func benchmarkFixture(commands, slicesPerCommand int) *service.ProfilingData_GpuSlices {
+	slices := &service.ProfilingData_GpuSlices{}
+	ts := uint64(0)
+	for i := 0; i < commands; i++ {
+		slices.Groups = append(slices.Groups, group(int32(i), 0, uint64(i)))
+		for j := 0; j < slicesPerCommand; j++ {
+			slices.Slices = append(slices.Slices, slice(int32(i), ts, 100))
+			ts += 150
+		}
+	}
+	return slices
+}
+
+func BenchmarkComputeCountersWithoutCounters(b *testing.B) {
+	ctx := log.Testing(b)
+	slices := benchmarkFixture(1000, 10)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ComputeCounters(ctx, slices, nil, nil)
+	}
+}
+
+// deepTreeFixture builds the leaf entries of a deep and narrow command tree,
+// where all the leaves are the children of a single chain of depth commands.
+func deepTreeFixture(depth, leaves int) ([]*service.ProfilingData_GpuCounters_Metric, map[int32]*service.ProfilingData_GpuCounters_Entry) {
+	metrics := timeMetrics(&Options{})
+	groupToEntry := map[int32]*service.ProfilingData_GpuCounters_Entry{}
+	for i := 0; i < leaves; i++ {
+		entry := &service.ProfilingData_GpuCounters_Entry{
+			CommandIndex:  append(make([]uint64, depth), uint64(i)),
+			MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{},
+		}
+		for _, metric := range metrics {
+			entry.MetricToValue[metric.Id] = perf(float64(i%10 + 1))
+		}
+		groupToEntry[int32(i)] = entry
+	}
+	return metrics, groupToEntry
+}
+
+func TestMergeLeafEntriesDeepTree(t *testing.T) {
+	ctx := log.Testing(t)
+	metrics, groupToEntry := deepTreeFixture(3, 12)
+	entries := mergeLeafEntries(ctx, metrics, newMetricIds(0, &Options{}), groupToEntry, &Options{})
+	res := &service.ProfilingData_GpuCounters{Metrics: metrics, Entries: entries}
+	assert.For(ctx, "entries").ThatSlice(entries).IsLength(3 + 12)
+	// The leaves are valued 1 to 10, then 1 and 2.
+	for _, idx := range [][]uint64{{0}, {0, 0}, {0, 0, 0}} {
+		entry := findEntry(res, idx...)
+		assert.For(ctx, "%v gpu time", idx).That(entry.MetricToValue[gpuTimeMetricId]).DeepEquals(perf(58))
+		assert.For(ctx, "%v concurrency", idx).That(entry.MetricToValue[gpuMaxConcurrencyMetricId]).DeepEquals(perf(10))
+	}
+	assert.For(ctx, "leaf").That(findEntry(res, 0, 0, 0, 11).MetricToValue[gpuTimeMetricId]).DeepEquals(perf(2))
+	// The chain commands don't share their performance values.
+	findEntry(res, 0, 0).MetricToValue[gpuTimeMetricId].Estimate = 0
+	assert.For(ctx, "not shared").That(findEntry(res, 0).MetricToValue[gpuTimeMetricId]).DeepEquals(perf(58))
+}
+
+func TestMergeMissingMetrics(t *testing.T) {
+	ctx := log.Testing(t)
+	w := &warnings{}
+	ctx = putWarnings(ctx, w)
+	// The leaves are valued 1, 2 and 3.
+	metrics, groupToEntry := deepTreeFixture(1, 3)
+	delete(groupToEntry[1].MetricToValue, gpuMaxConcurrencyMetricId)
+	delete(groupToEntry[2].MetricToValue, gpuTimeMetricId)
+	entries := mergeLeafEntries(ctx, metrics, newMetricIds(0, &Options{}), groupToEntry, &Options{})
+	res := &service.ProfilingData_GpuCounters{Metrics: metrics, Entries: entries}
+
+	parent := findEntry(res, 0).MetricToValue
+	assert.For(ctx, "gpu time").That(parent[gpuTimeMetricId]).DeepEquals(&service.ProfilingData_GpuCounters_Perf{Estimate: 3, Min: 3, Max: 3, Partial: true})
+	assert.For(ctx, "concurrency").That(parent[gpuMaxConcurrencyMetricId]).DeepEquals(&service.ProfilingData_GpuCounters_Perf{Estimate: 3, Min: 3, Max: 3, Partial: true})
+	assert.For(ctx, "complete").That(parent[gpuSliceCountMetricId].Partial).Equals(false)
+	assert.For(ctx, "leaf").That(findEntry(res, 0, 1).MetricToValue[gpuMaxConcurrencyMetricId]).DeepEquals(unavailablePerf())
+	assert.For(ctx, "warnings").ThatSlice(w.list).IsLength(2)
+	assert.For(ctx, "warning").That(w.list[0].Kind).Equals(service.ProfilingData_GpuCounters_Warning_MissingMetric)
+}
+
+func BenchmarkMergeLeafEntriesDeepTree(b *testing.B) {
+	ctx := log.Testing(b)
+	metrics, groupToEntry := deepTreeFixture(100, 10000)
+	options := &Options{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mergeLeafEntries(ctx, metrics, newMetricIds(0, options), groupToEntry, options)
+	}
+}
+
+// benchmarkCounter builds a counter sampled every period over the slices.
+func benchmarkCounter(slices *service.ProfilingData_GpuSlices, period uint64) *service.ProfilingData_Counter {
+	last := slices.Slices[len(slices.Slices)-1]
+	c := &service.ProfilingData_Counter{Name: "Busy"}
+	for ts := uint64(0); ts <= last.Ts+last.Dur+period; ts += period {
+		c.Timestamps = append(c.Timestamps, ts)
+		c.Values = append(c.Values, float64(ts%7))
+	}
+	return c
+}
+
+func benchmarkComputeCounters(b *testing.B, options *Options) {
+	ctx := log.Testing(b)
+	slices := benchmarkFixture(200, 5)
+	counters := []*service.ProfilingData_Counter{benchmarkCounter(slices, 40)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ComputeCounters(ctx, slices, counters, options)
+	}
+}
+
+func BenchmarkComputeCounters(b *testing.B) {
+	benchmarkComputeCounters(b, nil)
+}
+
+func BenchmarkComputeCountersSkipBands(b *testing.B) {
+	benchmarkComputeCounters(b, &Options{SkipBands: true})
+}
+
+func TestSkipBands(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 5, 40), slice(1, 52, 5)},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40, 50, 60}, []float64{0, 1, 9, 3, 4, 5, 6}),
+	}
+	withBands, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	skipped, err := ComputeCounters(ctx, slices, counters, &Options{SkipBands: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	withBandsEntries := entriesByIndex(withBands)
+	for idx, values := range entriesByIndex(skipped) {
+		got, expected := values[counterMetricIdOffset], withBandsEntries[idx][counterMetricIdOffset]
+		assert.For(ctx, "%v estimate", idx).ThatFloat(got.Estimate).Equals(expected.Estimate, 1e-9)
+		assert.For(ctx, "%v min", idx).That(got.Min).Equals(got.Estimate)
+		assert.For(ctx, "%v max", idx).That(got.Max).Equals(got.Estimate)
+	}
+	// The slice contains some samples and straddles others, so the band isn't
+	// empty.
+	band := withBandsEntries["0,0"][counterMetricIdOffset]
+	assert.For(ctx, "band").That(band.Min < band.Max).Equals(true)
+}
+
+func TestMalformedCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	counters = append(counters,
+		counter("No values", []uint64{0, 10, 20, 30, 40}, nil),
+		counter("No timestamps", nil, []float64{0, 2, 4, 6, 8}),
+	)
+	res, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "metrics").That(res.Metrics).DeepEquals(MetricCatalog(counters, nil))
+	for _, entry := range res.Entries {
+		idx := entry.CommandIndex
+		assert.For(ctx, "%v valid counter", idx).That(isUnavailable(entry.MetricToValue[counterMetricIdOffset])).Equals(false)
+		assert.For(ctx, "%v nil values", idx).That(entry.MetricToValue[counterMetricIdOffset+1]).DeepEquals(unavailablePerf())
+		assert.For(ctx, "%v nil timestamps", idx).That(entry.MetricToValue[counterMetricIdOffset+2]).DeepEquals(unavailablePerf())
+	}
+}
+
+func TestCounterTimeOffset(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	aligned, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	// The same counter, sampled in a clock domain 1000ns ahead of the slices.
+	skewed := counter("Busy", []uint64{1000, 1010, 1020, 1030, 1040}, counters[0].Values)
+	res, err := ComputeCounters(ctx, slices, []*service.ProfilingData_Counter{skewed}, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "misaligned").That(findEntry(res, 0, 0).MetricToValue[counterMetricIdOffset]).DeepEquals(unavailablePerf())
+
+	res, err = ComputeCounters(ctx, slices, []*service.ProfilingData_Counter{skewed}, &Options{CounterTimeOffset: -1000})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assertSameEntries(ctx, "realigned", res, aligned)
+	assert.For(ctx, "original timestamps").That(skewed.Timestamps[0]).Equals(uint64(1000))
+
+	shifted := shiftCounter(counter("Busy", []uint64{5, 10, 20}, nil), -8)
+	assert.For(ctx, "saturated").That(shifted.Timestamps).DeepEquals([]uint64{0, 2, 12})
+}
+
+func TestGroupEntries(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	res, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "default").ThatMap(res.GroupToEntry).IsEmpty()
+
+	res, err = ComputeCounters(ctx, slices, counters, &Options{IncludeGroupEntries: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "groups").ThatMap(res.GroupToEntry).IsLength(len(slices.Groups))
+	for _, group := range slices.Groups {
+		entry := res.GroupToEntry[group.Id]
+		assert.For(ctx, "group %v index", group.Id).That(entry.CommandIndex).DeepEquals(group.Link.Indices)
+		leaf := findEntry(res, group.Link.Indices...)
+		assert.For(ctx, "group %v values", group.Id).That(entry.MetricToValue).DeepEquals(leaf.MetricToValue)
+	}
+}
+
+func TestNearestSampleMetrics(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 13, 10), // Between the samples at 10 and 20, nearer to 10.
+			slice(1, 27, 10), // Between the samples at 20 and 30, nearer to 30.
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40}, []float64{0, 2, 4, 6, 8}),
+	}
+	options := &Options{NearestSampleMetrics: true}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "metrics").That(res.Metrics).DeepEquals(MetricCatalog(counters, options))
+	debugMetric := res.Metrics[len(res.Metrics)-1]
+	assert.For(ctx, "name").ThatString(debugMetric.Name).HasPrefix("[Debug] Busy")
+	assert.For(ctx, "first").That(findEntry(res, 0, 0).MetricToValue[debugMetric.Id]).DeepEquals(perf(2))
+	assert.For(ctx, "second").That(findEntry(res, 0, 1).MetricToValue[debugMetric.Id]).DeepEquals(perf(6))
+
+	c := counters[0]
+	for ts, expected := range map[uint64]int{0: 0, 14: 1, 15: 1, 16: 2, 100: 4} {
+		assert.For(ctx, "nearest to %v", ts).That(nearestSample(c, ts)).Equals(expected)
+	}
+	assert.For(ctx, "no sample").That(nearestSample(counter("Empty", nil, nil), 10)).Equals(-1)
+}
+
+func TestWallTimeGapThreshold(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := []*service.ProfilingData_GpuSlices_Slice{
+		slice(0, 0, 10), slice(0, 14, 10), // 4ns gap.
+		slice(0, 30, 10), // 6ns gap.
+	}
+	for _, test := range []struct {
+		threshold uint64
+		wallTime  uint64
+		intervals int
+	}{
+		{0, 30, 3},
+		{4, 30, 3}, // Just at the shorter gap.
+		{5, 34, 2}, // Just above the shorter gap.
+		{6, 34, 2}, // Just at the longer gap.
+		{7, 40, 1}, // Just above the longer gap.
+	} {
+		gpuTime, wallTime, intervals := gpuTimeForGroup(slices, test.threshold)
+		assert.For(ctx, "threshold %v gpu time", test.threshold).That(gpuTime).Equals(uint64(30))
+		assert.For(ctx, "threshold %v wall time", test.threshold).That(wallTime).Equals(test.wallTime)
+		assert.For(ctx, "threshold %v intervals", test.threshold).That(intervals).Equals(test.intervals)
+	}
+}
+
+func TestTrackIds(t *testing.T) {
+	ctx := log.Testing(t)
+	groups := []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 0, 2)}
+	graphics := []*service.ProfilingData_GpuSlices_Slice{
+		nestedSlice(0, 0, 0, 5, 10),
+		nestedSlice(1, 0, 0, 20, 10),
+	}
+	compute := []*service.ProfilingData_GpuSlices_Slice{
+		nestedSlice(1, 1, 0, 8, 10), // Concurrent with group 0's graphics slice.
+		nestedSlice(2, 1, 0, 25, 10),
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40}, []float64{0, 2, 4, 6, 8}),
+	}
+
+	res, err := ComputeCounters(ctx, &service.ProfilingData_GpuSlices{
+		Groups: groups,
+		Slices: append(append([]*service.ProfilingData_GpuSlices_Slice{}, graphics...), compute...),
+	}, counters, &Options{TrackIds: []int32{0}})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	expected, err := ComputeCounters(ctx, &service.ProfilingData_GpuSlices{
+		Groups: groups,
+		Slices: graphics,
+	}, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assertSameEntries(ctx, "filtered", res, expected)
+	assert.For(ctx, "compute only command").That(findEntry(res, 0, 2)).IsNil()
+}
+
+func TestSortSlicesTies(t *testing.T) {
+	ctx := log.Testing(t)
+	a := &service.ProfilingData_GpuSlices_Slice{Ts: 10, Dur: 5, GroupId: 1, Id: 1}
+	b := &service.ProfilingData_GpuSlices_Slice{Ts: 10, Dur: 20, GroupId: 1, Id: 2}
+	c := &service.ProfilingData_GpuSlices_Slice{Ts: 10, Dur: 5, GroupId: 0, Id: 3}
+	d := &service.ProfilingData_GpuSlices_Slice{Ts: 10, Dur: 5, GroupId: 0, Id: 4}
+	e := &service.ProfilingData_GpuSlices_Slice{Ts: 0, Dur: 1, GroupId: 2, Id: 5}
+	expected := []*service.ProfilingData_GpuSlices_Slice{e, b, c, d, a}
+
+	groups := []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 0, 2)}
+	var wallTimes []*service.ProfilingData_GpuCounters_Perf
+	for _, order := range [][]*service.ProfilingData_GpuSlices_Slice{
+		{a, b, c, d, e},
+		{e, d, c, b, a},
+		{c, a, e, b, d},
+		{d, b, a, e, c},
+	} {
+		sorted := append([]*service.ProfilingData_GpuSlices_Slice{}, order...)
+		sortSlices(sorted)
+		assert.For(ctx, "sorted").That(sorted).DeepEquals(expected)
+
+		res, err := ComputeCounters(ctx, &service.ProfilingData_GpuSlices{Groups: groups, Slices: order}, nil, nil)
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		wallTimes = append(wallTimes, findEntry(res, 0).MetricToValue[gpuWallTimeMetricId])
+	}
+	for _, wallTime := range wallTimes {
+		assert.For(ctx, "wall time").That(wallTime).DeepEquals(wallTimes[0])
+	}
+}
+
+func TestRollupWeight(t *testing.T) {
+	ctx := log.Testing(t)
+	// Two children with equal slice counts, but skewed durations and values.
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 5, 90), slice(1, 150, 10)},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Occupancy", []uint64{0, 100, 200}, []float64{0, 10, 20}),
+	}
+	for _, test := range []struct {
+		weight   RollupWeight
+		expected float64
+	}{
+		{RollupByGpuTime, (90*10 + 10*20) / 100.0},
+		{RollupBySliceCount, (10 + 20) / 2.0},
+	} {
+		res, err := ComputeCounters(ctx, slices, counters, &Options{RollupWeight: test.weight})
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		entries := entriesByIndex(res)
+		assert.For(ctx, "%v first child", test.weight).ThatFloat(entries["0,0"][counterMetricIdOffset].Estimate).Equals(10, 1e-9)
+		assert.For(ctx, "%v second child", test.weight).ThatFloat(entries["0,1"][counterMetricIdOffset].Estimate).Equals(20, 1e-9)
+		assert.For(ctx, "%v parent", test.weight).ThatFloat(entries["0"][counterMetricIdOffset].Estimate).Equals(test.expected, 1e-9)
+		assert.For(ctx, "%v slice count", test.weight).That(entries["0"][gpuSliceCountMetricId]).DeepEquals(perf(2))
+	}
+}
+
+func TestComputeCommandCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	// The slices of the commands overlap, so that the counter samples are
+	// shared between commands by concurrency.
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 1, 0)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 5, 20), slice(1, 15, 20), slice(2, 30, 15)},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40, 50}, []float64{0, 2, 4, 6, 8, 10}),
+	}
+	options := &Options{WallTimeGapThreshold: 5}
+	full, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	for idx, expected := range entriesByIndex(full) {
+		entry, err := ComputeCommandCounters(ctx, slices, counters, decodeIndex(idx), options)
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "%v index", idx).That(encodeIndex(entry.CommandIndex)).Equals(idx)
+		assert.For(ctx, "%v metrics", idx).ThatMap(entry.MetricToValue).IsLength(len(expected))
+		for id, perf := range expected {
+			got := entry.MetricToValue[id]
+			assert.For(ctx, "%v metric %v estimate", idx, id).ThatFloat(got.Estimate).Equals(perf.Estimate, 1e-9)
+			assert.For(ctx, "%v metric %v min", idx, id).ThatFloat(got.Min).Equals(perf.Min, 1e-9)
+			assert.For(ctx, "%v metric %v max", idx, id).ThatFloat(got.Max).Equals(perf.Max, 1e-9)
+		}
+	}
+
+	_, err = ComputeCommandCounters(ctx, slices, counters, []uint64{2}, options)
+	assert.For(ctx, "unknown command").ThatError(err).Failed()
+}
+
+func TestCriticalPathOnly(t *testing.T) {
+	ctx := log.Testing(t)
+	visible, hidden := slice(0, 5, 40), slice(0, 15, 10)
+	withHidden := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{visible, hidden},
+	}
+	withoutHidden := &service.ProfilingData_GpuSlices{
+		Groups: withHidden.Groups,
+		Slices: []*service.ProfilingData_GpuSlices_Slice{visible},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40, 50}, []float64{0, 1, 2, 3, 4, 5}),
+	}
+	res, err := ComputeCounters(ctx, withHidden, counters, &Options{CriticalPathOnly: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	expected, err := ComputeCounters(ctx, withoutHidden, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	all, err := ComputeCounters(ctx, withHidden, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	got, want := entriesByIndex(res)["0,0"], entriesByIndex(expected)["0,0"]
+	assert.For(ctx, "counter").That(got[counterMetricIdOffset]).DeepEquals(want[counterMetricIdOffset])
+	// The hidden slice makes the contained samples concurrent, and thus
+	// changes the attribution, when it is not ignored.
+	assert.For(ctx, "all slices").That(entriesByIndex(all)["0,0"][counterMetricIdOffset]).DeepNotEquals(want[counterMetricIdOffset])
+	// The time metrics still account for the hidden slice.
+	assert.For(ctx, "gpu time").That(got[gpuTimeMetricId]).DeepEquals(perf(50))
+	assert.For(ctx, "slices").That(got[gpuSliceCountMetricId]).DeepEquals(perf(2))
+}
+
+func TestTimeMetricOverrides(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	options := &Options{TimeMetricOverrides: map[string]TimeMetricOverride{
+		"GPU Time":           {Name: "Temps GPU", Unit: device.GpuCounterDescriptor_MICROSECOND},
+		"GPU Wall Time":      {Unit: device.GpuCounterDescriptor_MICROSECOND},
+		"GPU Busy Intervals": {Unit: device.GpuCounterDescriptor_MICROSECOND}, // Not a time, kept as is.
+	}}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	defaults, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	microseconds := strconv.Itoa(int(device.GpuCounterDescriptor_MICROSECOND))
+	assert.For(ctx, "catalog").That(MetricCatalog(counters, options)).DeepEquals(res.Metrics)
+	assert.For(ctx, "gpu time name").That(res.Metrics[gpuTimeMetricId].Name).Equals("Temps GPU")
+	assert.For(ctx, "gpu time unit").That(res.Metrics[gpuTimeMetricId].Unit).Equals(microseconds)
+	assert.For(ctx, "wall time name").That(res.Metrics[gpuWallTimeMetricId].Name).Equals("GPU Wall Time")
+	assert.For(ctx, "wall time unit").That(res.Metrics[gpuWallTimeMetricId].Unit).Equals(microseconds)
+	assert.For(ctx, "intervals").That(res.Metrics[gpuBusyIntervalsMetricId]).DeepEquals(defaults.Metrics[gpuBusyIntervalsMetricId])
+
+	entries, defaultEntries := entriesByIndex(res), entriesByIndex(defaults)
+	for _, idx := range []string{"0", "0,0", "0,1"} {
+		for _, id := range []int32{gpuTimeMetricId, gpuWallTimeMetricId} {
+			assert.For(ctx, "%v metric %v", idx, id).ThatFloat(entries[idx][id].Estimate).Equals(defaultEntries[idx][id].Estimate/1e3, 1e-12)
+		}
+		assert.For(ctx, "%v self time", idx).That(entries[idx][gpuSelfTimeMetricId]).DeepEquals(defaultEntries[idx][gpuSelfTimeMetricId])
+		assert.For(ctx, "%v intervals", idx).That(entries[idx][gpuBusyIntervalsMetricId]).DeepEquals(defaultEntries[idx][gpuBusyIntervalsMetricId])
+		// The rollup weights are all scaled alike, the averages are kept.
+		assert.For(ctx, "%v counter", idx).ThatFloat(entries[idx][counterMetricIdOffset].Estimate).Equals(defaultEntries[idx][counterMetricIdOffset].Estimate, 1e-9)
+	}
+	assert.For(ctx, "parent gpu time").ThatFloat(entries["0"][gpuTimeMetricId].Estimate).Equals(0.02, 1e-12)
+}
+
+func TestIdleEntry(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 1, 8), slice(1, 31, 8)},
+	}
+	// The samples of values 100 and 3 are entirely idle, the others are
+	// mostly busy.
+	counters := []*service.ProfilingData_Counter{
+		counter("Power", []uint64{0, 10, 20, 30, 40}, []float64{0, 1, 100, 3, 4}),
+	}
+	res, err := ComputeCounters(ctx, slices, counters, &Options{IncludeIdleEntry: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	idle := res.IdleEntry.MetricToValue[counterMetricIdOffset]
+	assert.For(ctx, "idle estimate").ThatFloat(idle.Estimate).Equals((0.2*1+100+3+0.2*4)/2.4, 1e-9)
+	assert.For(ctx, "idle min").ThatFloat(idle.Min).Equals((1+100+3+4)/4.0, 1e-9)
+	assert.For(ctx, "idle max").ThatFloat(idle.Max).Equals((100+3)/2.0, 1e-9)
+	assert.For(ctx, "idle index").ThatSlice(res.IdleEntry.CommandIndex).IsEmpty()
+
+	// The idle samples aren't attributed to any command.
+	entries := entriesByIndex(res)
+	assert.For(ctx, "first command").That(entries["0,0"][counterMetricIdOffset]).DeepEquals(perf(1))
+	assert.For(ctx, "second command").That(entries["0,1"][counterMetricIdOffset]).DeepEquals(perf(4))
+
+	res, err = ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "no idle entry").That(res.IdleEntry).IsNil()
+}
+
+func TestGpuFrameShareMetric(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{
+			group(0, 0, 0, 0), group(1, 0, 0, 1), group(2, 0, 1), group(3, 1),
+		},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(1, 10, 30), slice(2, 40, 20), slice(3, 60, 40),
+		},
+	}
+	res, err := ComputeCounters(ctx, slices, nil, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	entries := entriesByIndex(res)
+	share := func(idx string) float64 { return entries[idx][gpuFrameShareMetricId].Estimate }
+	for idx, expected := range map[string]float64{
+		"0,0,0": 10, "0,0,1": 30, "0,0": 40, "0,1": 20, "0": 60, "1": 40,
+	} {
+		assert.For(ctx, "%v share", idx).ThatFloat(share(idx)).Equals(expected, 1e-9)
+	}
+	assert.For(ctx, "children of 0,0").ThatFloat(share("0,0,0")+share("0,0,1")).Equals(share("0,0"), 1e-9)
+	assert.For(ctx, "children of 0").ThatFloat(share("0,0")+share("0,1")).Equals(share("0"), 1e-9)
+	assert.For(ctx, "frame").ThatFloat(share("0")+share("1")).Equals(100, 1e-9)
+
+	// The share of a single command is relative to the whole frame too.
+	entry, err := ComputeCommandCounters(ctx, slices, nil, []uint64{0, 1}, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "single command").ThatFloat(entry.MetricToValue[gpuFrameShareMetricId].Estimate).Equals(20, 1e-9)
+}
+
+func TestPessimisticMetrics(t *testing.T) {
+	ctx := log.Testing(t)
+	// Three commands running concurrently over most of the samples.
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 1, 0)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 2, 35), slice(1, 8, 30), slice(2, 15, 22), slice(0, 41, 5),
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Occupancy", []uint64{0, 10, 20, 30, 40, 50}, []float64{0, 3, 9, 1, 7, 2}),
+	}
+	options := &Options{PessimisticMetrics: true}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "metrics").That(res.Metrics).DeepEquals(MetricCatalog(counters, options))
+	bound := res.Metrics[len(res.Metrics)-1]
+	assert.For(ctx, "name").That(bound.Name).Equals("Occupancy (pessimistic upper bound)")
+	assert.For(ctx, "op").That(bound.Op).Equals(service.ProfilingData_GpuCounters_Metric_Maximum)
+
+	for idx, values := range entriesByIndex(res) {
+		estimate := values[counterMetricIdOffset]
+		assert.For(ctx, "%v bound", idx).ThatFloat(values[bound.Id].Estimate).IsAtLeast(estimate.Estimate)
+		assert.For(ctx, "%v bound over max", idx).ThatFloat(values[bound.Id].Estimate).IsAtLeast(estimate.Max)
+	}
+	assert.For(ctx, "first").That(findEntry(res, 0, 0).MetricToValue[bound.Id]).DeepEquals(perf(9))
+	assert.For(ctx, "third").That(findEntry(res, 1, 0).MetricToValue[bound.Id]).DeepEquals(perf(9))
+	assert.For(ctx, "root").That(findEntry(res, 0).MetricToValue[bound.Id]).DeepEquals(perf(9))
+}
+
+func TestInvalidSamples(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 5, 40)},
+	}
+	c := counter("Busy", []uint64{0, 10, 20, 30, 40, 50}, []float64{0, 1, 100, 3, 4, 5})
+	c.InvalidSamples = []bool{false, false, true, false, false, false} // An overflow.
+	res, err := ComputeCounters(ctx, slices, []*service.ProfilingData_Counter{c}, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	busy := findEntry(res, 0, 0).MetricToValue[counterMetricIdOffset]
+	assert.For(ctx, "estimate").ThatFloat(busy.Estimate).Equals((0.5*1+3+4+0.5*5)/3, 1e-9)
+	assert.For(ctx, "max").ThatFloat(busy.Max).IsAtMost(5)
+
+	// The invalid sample doesn't cover the slice anymore.
+	coverage := func(sampleWeight map[int]float64) float64 {
+		covered := float64(0)
+		for i, weight := range sampleWeight {
+			covered += float64(c.Timestamps[i]-c.Timestamps[i-1]) * weight
+		}
+		return covered
+	}
+	estimateSet, minSet, maxSet := mapCounterSamples(slices.Slices, c, scanConcurrency(slices.Slices, c), true)
+	for name, set := range map[string]map[int]float64{"estimate": estimateSet, "min": minSet, "max": maxSet} {
+		_, found := set[2]
+		assert.For(ctx, "%v set", name).That(found).Equals(false)
+	}
+	assert.For(ctx, "coverage").ThatFloat(coverage(estimateSet)).Equals(30, 1e-9)
+	valid := counter("Busy", c.Timestamps, c.Values)
+	estimateSet, _, _ = mapCounterSamples(slices.Slices, valid, scanConcurrency(slices.Slices, valid), true)
+	assert.For(ctx, "valid coverage").ThatFloat(coverage(estimateSet)).Equals(40, 1e-9)
+
+	assert.For(ctx, "nearest").That(nearestSample(c, 19)).Equals(1)
+	assert.For(ctx, "nearest after").That(nearestSample(c, 21)).Equals(3)
+	c.InvalidSamples = []bool{true, true, true, true, true, true}
+	assert.For(ctx, "none valid").That(nearestSample(c, 21)).Equals(-1)
+
+	c.InvalidSamples = []bool{true}
+	res, err = ComputeCounters(ctx, slices, []*service.ProfilingData_Counter{c}, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "malformed flags").That(findEntry(res, 0, 0).MetricToValue[counterMetricIdOffset]).DeepEquals(unavailablePerf())
+}
+
+func TestIncompleteGlobalSlices(t *testing.T) {
+	ctx := log.Testing(t)
+	// Two concurrent commands sharing the samples.
+	a, b := slice(0, 5, 30), slice(1, 5, 30)
+	groupToSlices := map[int32][]*service.ProfilingData_GpuSlices_Slice{0: {a}, 1: {b}}
+	counters := []*service.ProfilingData_Counter{
+		counter("Bytes", []uint64{0, 10, 20, 30, 40}, []float64{0, 2, 4, 6, 8}),
+	}
+	compute := func(globalSlices []*service.ProfilingData_GpuSlices_Slice) map[int32]*service.ProfilingData_GpuCounters_Entry {
+		groupToEntry := map[int32]*service.ProfilingData_GpuCounters_Entry{}
+		for groupId := range groupToSlices {
+			groupToEntry[groupId] = &service.ProfilingData_GpuCounters_Entry{MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{}}
+		}
+		metrics := []*service.ProfilingData_GpuCounters_Metric{}
+		setGpuCounterMetrics(ctx, groupToSlices, counters, globalSlices, newMetricIds(len(counters), &Options{}), &Options{}, &metrics, groupToEntry)
+		return groupToEntry
+	}
+	full := compute([]*service.ProfilingData_GpuSlices_Slice{a, b})
+	assert.For(ctx, "subset").That(compute([]*service.ProfilingData_GpuSlices_Slice{a})).DeepEquals(full)
+	assert.For(ctx, "none").That(compute(nil)).DeepEquals(full)
+
+	complete := completeGlobalSlices(ctx, []*service.ProfilingData_GpuSlices_Slice{b}, groupToSlices)
+	assert.For(ctx, "completed").That(complete).DeepEquals([]*service.ProfilingData_GpuSlices_Slice{a, b})
+	global := []*service.ProfilingData_GpuSlices_Slice{a, b, slice(2, 0, 50)}
+	assert.For(ctx, "complete").That(completeGlobalSlices(ctx, global, groupToSlices)).DeepEquals(global)
+}
+
+func TestSmoothingRadius(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Busy", []uint64{0, 10, 20, 30, 40, 50}, []float64{2, 2, 2, 62, 2, 2})
+	assert.For(ctx, "smoothed").That(smoothCounter(c, 1).Values).DeepEquals([]float64{2, 2, 22, 22, 22, 2})
+	assert.For(ctx, "edges").That(smoothCounter(c, 2).Values).DeepEquals([]float64{2, 17, 14, 14, 17, 22})
+	assert.For(ctx, "raw").That(c.Values).DeepEquals([]float64{2, 2, 2, 62, 2, 2})
+	c.InvalidSamples = []bool{false, false, false, true, false, false}
+	assert.For(ctx, "invalid").That(smoothCounter(c, 1).Values).DeepEquals([]float64{2, 2, 2, 2, 2, 2})
+
+	// The spike dominates the raw estimate of the command spanning it.
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 21, 8)},
+	}
+	spiky := []*service.ProfilingData_Counter{counter("Busy", c.Timestamps, c.Values)}
+	raw, err := ComputeCounters(ctx, slices, spiky, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	smoothed, err := ComputeCounters(ctx, slices, spiky, &Options{SmoothingRadius: 1})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "raw estimate").ThatFloat(findEntry(raw, 0, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(62, 1e-9)
+	assert.For(ctx, "smoothed estimate").ThatFloat(findEntry(smoothed, 0, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(22, 1e-9)
+}
+
+func TestMapCounterSamplesBoundaries(t *testing.T) {
+	ctx := log.Testing(t)
+	// The samples span (0, 10], (10, 20] and (20, 30].
+	c := counter("Busy", []uint64{0, 10, 20, 30}, []float64{0, 1, 2, 3})
+	for _, test := range []struct {
+		name                  string
+		slice                 *service.ProfilingData_GpuSlices_Slice
+		estimate, minSet, max map[int]float64
+	}{
+		{"same edges", slice(0, 10, 10), map[int]float64{2: 1}, map[int]float64{2: 1}, map[int]float64{2: 1}},
+		{"same start, later end", slice(0, 10, 20), map[int]float64{2: 1, 3: 1}, map[int]float64{2: 1, 3: 1}, map[int]float64{2: 1, 3: 1}},
+		{"earlier start, same end", slice(0, 0, 20), map[int]float64{1: 1, 2: 1}, map[int]float64{1: 1, 2: 1}, map[int]float64{1: 1, 2: 1}},
+		{"same start, earlier end", slice(0, 10, 5), map[int]float64{2: 0.5}, map[int]float64{}, map[int]float64{2: 1}},
+		{"later start, same end", slice(0, 15, 5), map[int]float64{2: 0.5}, map[int]float64{}, map[int]float64{2: 1}},
+		{"ends at the sample start", slice(0, 5, 5), map[int]float64{1: 0.5}, map[int]float64{}, map[int]float64{1: 1}},
+		{"starts at the sample end", slice(0, 20, 5), map[int]float64{3: 0.5}, map[int]float64{}, map[int]float64{3: 1}},
+	} {
+		slices := []*service.ProfilingData_GpuSlices_Slice{test.slice}
+		estimateSet, minSet, maxSet := mapCounterSamples(slices, c, scanConcurrency(slices, c), true)
+		assert.For(ctx, "%v estimate", test.name).That(estimateSet).DeepEquals(test.estimate)
+		assert.For(ctx, "%v min", test.name).That(minSet).DeepEquals(test.minSet)
+		assert.For(ctx, "%v max", test.name).That(maxSet).DeepEquals(test.max)
+	}
+
+	// Commands abutting at a sample timestamp aren't concurrent, each gets the
+	// full weight of its samples.
+	first, second := slice(0, 0, 10), slice(1, 10, 20)
+	global := []*service.ProfilingData_GpuSlices_Slice{first, second}
+	assert.For(ctx, "concurrency").That(scanConcurrency(global, c)).DeepEquals([]int{0, 1, 1, 1})
+	estimateSet, _, _ := mapCounterSamples([]*service.ProfilingData_GpuSlices_Slice{first}, c, scanConcurrency(global, c), true)
+	assert.For(ctx, "first").That(estimateSet).DeepEquals(map[int]float64{1: 1})
+	estimateSet, _, _ = mapCounterSamples([]*service.ProfilingData_GpuSlices_Slice{second}, c, scanConcurrency(global, c), true)
+	assert.For(ctx, "second").That(estimateSet).DeepEquals(map[int]float64{2: 1, 3: 1})
+}
+
+func TestAggregateCounterPerfBounds(t *testing.T) {
+	ctx := log.Testing(t)
+	// The sample 2 is owned in full, the samples 1 and 3 partially overlap.
+	c := counter("Busy", []uint64{0, 10, 20, 30}, []float64{0, 0, 10, 20})
+	estimateSet := map[int]float64{1: 0.5, 2: 1, 3: 0.5}
+	minSet := map[int]float64{2: 1}
+	maxSet := map[int]float64{1: 1, 2: 1, 3: 1}
+	for _, test := range []struct {
+		op                 service.ProfilingData_GpuCounters_Metric_AggregationOperator
+		estimate, min, max float64
+	}{
+		// Owning the sample 1 but not the sample 3 lowers the average, which
+		// neither the minimum nor the maximum set alone reaches.
+		{service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg, 10, 5, 15},
+		{service.ProfilingData_GpuCounters_Metric_Summation, 20, 10, 30},
+		{service.ProfilingData_GpuCounters_Metric_Maximum, 20, 10, 20},
+		{service.ProfilingData_GpuCounters_Metric_Minimum, 0, 0, 10},
+	} {
+		perf := aggregateCounterPerf(estimateSet, minSet, maxSet, c, test.op)
+		assert.For(ctx, "%v estimate", test.op).That(perf.Estimate).Equals(test.estimate)
+		assert.For(ctx, "%v min", test.op).That(perf.Min).Equals(test.min)
+		assert.For(ctx, "%v max", test.op).That(perf.Max).Equals(test.max)
+	}
+
+	// Negative samples lower the sum when owned.
+	negative := counter("Delta", []uint64{0, 10, 20}, []float64{0, -5, 3})
+	perf := aggregateCounterPerf(map[int]float64{1: 0.5, 2: 1}, map[int]float64{2: 1}, map[int]float64{1: 1, 2: 1}, negative, service.ProfilingData_GpuCounters_Metric_Summation)
+	assert.For(ctx, "negative min").That(perf.Min).Equals(-2.0)
+	assert.For(ctx, "negative max").That(perf.Max).Equals(3.0)
+
+	perf = aggregateCounterPerf(map[int]float64{}, map[int]float64{}, map[int]float64{}, c, service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg)
+	assert.For(ctx, "no data").That(isUnavailable(perf)).Equals(true)
+}
+
+func TestNormalizedValues(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 1, 8), slice(1, 11, 8), slice(2, 21, 18)},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40}, []float64{0, 3, 9, 6, 6}),
+		counter("Idle", []uint64{0, 10, 20, 30, 40}, []float64{0, 0, 0, 0, 0}),
+	}
+	res, err := ComputeCounters(ctx, slices, counters, &Options{NormalizedValues: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	frameGpuTime := float64(8 + 8 + 18)
+	frameBusy := (8*3 + 8*9 + 18*6) / frameGpuTime
+	for _, idx := range [][]uint64{{0}, {0, 0}, {0, 1}, {1}} {
+		entry := findEntry(res, idx...)
+		gpuTime := entry.MetricToValue[gpuTimeMetricId].Estimate
+		busy := entry.MetricToValue[counterMetricIdOffset].Estimate
+		assert.For(ctx, "%v gpu time", idx).ThatFloat(entry.MetricToNormalizedValue[gpuTimeMetricId]).Equals(gpuTime/frameGpuTime, 1e-9)
+		assert.For(ctx, "%v busy", idx).ThatFloat(entry.MetricToNormalizedValue[counterMetricIdOffset]).Equals(busy/frameBusy, 1e-9)
+		assert.For(ctx, "%v zero frame", idx).That(entry.MetricToNormalizedValue[counterMetricIdOffset+1]).Equals(-1.0)
+	}
+	assert.For(ctx, "second root").ThatFloat(findEntry(res, 1).MetricToNormalizedValue[counterMetricIdOffset]).Equals(6/frameBusy, 1e-9)
+
+	res, err = ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "not requested").ThatMap(findEntry(res, 0).MetricToNormalizedValue).IsEmpty()
+}
+
+func TestMajorityAttribution(t *testing.T) {
+	ctx := log.Testing(t)
+	// The sample (10, 20] is split 70/30 between the sequential commands.
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 17), slice(1, 17, 13)},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30}, []float64{0, 2, 10, 4}),
+	}
+	split, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	majority, err := ComputeCounters(ctx, slices, counters, &Options{Attribution: MajorityAttribution})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	estimate := func(res *service.ProfilingData_GpuCounters, indices ...uint64) float64 {
+		return findEntry(res, indices...).MetricToValue[counterMetricIdOffset].Estimate
+	}
+	assert.For(ctx, "split first").ThatFloat(estimate(split, 0, 0)).IsAtMost(estimate(majority, 0, 0))
+	assert.For(ctx, "split second").ThatFloat(estimate(split, 0, 1)).IsAtLeast(estimate(majority, 0, 1))
+	assert.For(ctx, "majority first").ThatFloat(estimate(majority, 0, 0)).Equals((2+10)/2.0, 1e-9)
+	assert.For(ctx, "majority second").ThatFloat(estimate(majority, 0, 1)).Equals(4, 1e-9)
+
+	winners := majorityWinners(slices.Slices, counters[0])
+	assert.For(ctx, "winners").That(winners).DeepEquals(map[int32]map[int]float64{0: {1: 1, 2: 1}, 1: {3: 1}})
+	// A tie goes to the lowest group id.
+	tie := []*service.ProfilingData_GpuSlices_Slice{slice(1, 10, 5), slice(0, 15, 5)}
+	assert.For(ctx, "tie").That(majorityWinners(tie, counters[0])).DeepEquals(map[int32]map[int]float64{0: {2: 1}})
+}
+
+func TestAggregationLogging(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	counters = append(counters, counter("Second", counters[0].Timestamps, counters[0].Values))
+	messages := []*log.Message{}
+	capture := log.NewHandler(func(m *log.Message) {
+		if m.Text == "Counter aggregation" {
+			messages = append(messages, m)
+		}
+	}, nil)
+
+	debugCtx := log.PutFilter(log.PutHandler(ctx, capture), log.SeverityFilter(log.Debug))
+	_, err := ComputeCounters(debugCtx, slices, counters, &Options{Attribution: MajorityAttribution, SkipBands: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "messages").ThatSlice(messages).IsLength(2)
+	for i, m := range messages {
+		values := map[string]interface{}{}
+		for _, v := range m.Values {
+			values[v.Name] = v.Value
+		}
+		assert.For(ctx, "decisions").That(values).DeepEquals(map[string]interface{}{
+			"counter":     counters[i].Name,
+			"op":          service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+			"op_source":   "fallback",
+			"attribution": "majority",
+			"critical":    false,
+			"bands":       false,
+		})
+	}
+
+	messages = messages[:0]
+	infoCtx := log.PutFilter(log.PutHandler(ctx, capture), log.SeverityFilter(log.Info))
+	_, err = ComputeCounters(infoCtx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "silent").ThatSlice(messages).IsEmpty()
+}
+
+func TestClockGatingCounter(t *testing.T) {
+	ctx := log.Testing(t)
+	// The GPU is gated over (10, 30], between the two commands.
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 12), slice(1, 28, 12)},
+	}
+	timestamps := []uint64{0, 5, 10, 15, 20, 25, 30, 35, 40, 45}
+	counters := []*service.ProfilingData_Counter{
+		counter("Active", timestamps, []float64{1, 1, 1, 0, 0, 0, 0, 1, 1, 1}),
+		counter("Busy", timestamps, []float64{10, 10, 10, 0, 0, 0, 0, 10, 10, 10}),
+	}
+	ungated, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	gated, err := ComputeCounters(ctx, slices, counters, &Options{ClockGatingCounter: "Active"})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	busyId := counterMetricIdOffset + 1
+	for _, indices := range [][]uint64{{0, 0}, {0, 1}} {
+		assert.For(ctx, "ungated %v", indices).ThatFloat(findEntry(ungated, indices...).MetricToValue[busyId].Estimate).IsAtMost(9)
+		assert.For(ctx, "gated %v", indices).That(findEntry(gated, indices...).MetricToValue[busyId]).DeepEquals(perf(10))
+	}
+	// The gating counter itself isn't excluded.
+	assert.For(ctx, "active").ThatFloat(findEntry(gated, 0, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(
+		findEntry(ungated, 0, 0).MetricToValue[counterMetricIdOffset].Estimate, 1e-9)
+
+	assert.For(ctx, "intervals").That(gatedIntervals(ctx, counters, &Options{ClockGatingCounter: "Active"})).DeepEquals([]interval{{10, 30}})
+}
+
+func TestDirectCounterValues(t *testing.T) {
+	ctx := log.Testing(t)
+	// Each slice spans whole samples of constant values, so the values carried
+	// by the slices match the attributed samples.
+	withExtra := func(s *service.ProfilingData_GpuSlices_Slice, value float64) *service.ProfilingData_GpuSlices_Slice {
+		s.Extras = []*service.ProfilingData_GpuSlices_Slice_Extra{
+			{Name: "label", Value: &service.ProfilingData_GpuSlices_Slice_Extra_StringValue{StringValue: "draw"}},
+			{Name: "Busy", Value: &service.ProfilingData_GpuSlices_Slice_Extra_DoubleValue{DoubleValue: value}},
+		}
+		return s
+	}
+	groups := []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40}, []float64{0, 3, 3, 7, 7}),
+	}
+	interpolated, err := ComputeCounters(ctx, &service.ProfilingData_GpuSlices{
+		Groups: groups,
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 20), slice(1, 20, 20)},
+	}, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	direct, err := ComputeCounters(ctx, &service.ProfilingData_GpuSlices{
+		Groups: groups,
+		Slices: []*service.ProfilingData_GpuSlices_Slice{withExtra(slice(0, 0, 20), 3), withExtra(slice(1, 20, 20), 7)},
+	}, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assertSameEntries(ctx, "direct", direct, interpolated)
+	assert.For(ctx, "value").That(findEntry(direct, 0, 1).MetricToValue[counterMetricIdOffset]).DeepEquals(perf(7))
+
+	// The direct values are preferred over the samples, averaged by duration.
+	direct, err = ComputeCounters(ctx, &service.ProfilingData_GpuSlices{
+		Groups: groups[:1],
+		Slices: []*service.ProfilingData_GpuSlices_Slice{withExtra(slice(0, 0, 10), 1), withExtra(slice(0, 20, 30), 5)},
+	}, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "preferred").That(findEntry(direct, 0, 0).MetricToValue[counterMetricIdOffset]).DeepEquals(perf((10*1 + 30*5) / 40.0))
+
+	// A group with a slice lacking the value uses the samples.
+	_, ok := directCounterValues([]*service.ProfilingData_GpuSlices_Slice{withExtra(slice(0, 0, 10), 1), slice(0, 20, 10)}, "Busy")
+	assert.For(ctx, "partial").That(ok).Equals(false)
+}
+
+func TestDualAggregationCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	options := &Options{DualAggregationCounters: []string{"Busy"}}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	plain, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	sumId := counterMetricIdOffset + 3
+	assert.For(ctx, "metrics").That(res.Metrics[len(res.Metrics)-2:]).DeepEquals([]*service.ProfilingData_GpuCounters_Metric{
+		{Id: counterMetricIdOffset, Name: "Busy", Op: service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg, CounterName: "Busy", Category: OtherCategory},
+		{Id: sumId, Name: "Busy (sum)", Op: service.ProfilingData_GpuCounters_Metric_Summation, CounterName: "Busy", Category: OtherCategory},
+	})
+	assert.For(ctx, "catalog").That(MetricCatalog(counters, options)).DeepEquals(res.Metrics)
+
+	// Each command overlaps half of two samples: 2 and 4, then 6 and 8.
+	for _, test := range []struct {
+		indices  []uint64
+		avg, sum float64
+	}{
+		{[]uint64{0, 0}, 3, 0.5*2 + 0.5*4},
+		{[]uint64{0, 1}, 7, 0.5*6 + 0.5*8},
+		{[]uint64{0}, 5, 3 + 7},
+	} {
+		entry := findEntry(res, test.indices...)
+		assert.For(ctx, "avg %v", test.indices).ThatFloat(entry.MetricToValue[counterMetricIdOffset].Estimate).Equals(test.avg, 1e-9)
+		assert.For(ctx, "sum %v", test.indices).ThatFloat(entry.MetricToValue[sumId].Estimate).Equals(test.sum, 1e-9)
+		assert.For(ctx, "plain %v", test.indices).That(entry.MetricToValue[counterMetricIdOffset]).DeepEquals(
+			findEntry(plain, test.indices...).MetricToValue[counterMetricIdOffset])
+	}
+}
+
+func TestSingleGroup(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 2)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 10), slice(0, 20, 10)},
+	}
+	// Each slice contains one sample, 4 then 8.
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30}, []float64{0, 4, 6, 8}),
+	}
+	res, err := ComputeCounters(ctx, slices, counters, &Options{RatioMetrics: []RatioMetric{{Name: "Busy per ns", Numerator: "Busy", Denominator: "GPU Time"}}})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "entries").ThatSlice(res.Entries).IsLength(2)
+	assert.For(ctx, "parent").That(res.Entries[0].CommandIndex).DeepEquals([]uint64{0})
+	assert.For(ctx, "leaf").That(res.Entries[1].CommandIndex).DeepEquals([]uint64{0, 2})
+	for _, entry := range res.Entries {
+		assert.For(ctx, "gpu time %v", entry.CommandIndex).That(entry.MetricToValue[gpuTimeMetricId]).DeepEquals(perf(20))
+		assert.For(ctx, "wall time %v", entry.CommandIndex).That(entry.MetricToValue[gpuWallTimeMetricId]).DeepEquals(perf(20))
+		assert.For(ctx, "slice count %v", entry.CommandIndex).That(entry.MetricToValue[gpuSliceCountMetricId]).DeepEquals(perf(2))
+		assert.For(ctx, "share %v", entry.CommandIndex).That(entry.MetricToValue[gpuFrameShareMetricId]).DeepEquals(perf(100))
+		assert.For(ctx, "busy %v", entry.CommandIndex).That(entry.MetricToValue[counterMetricIdOffset]).DeepEquals(perf(6))
+		assert.For(ctx, "ratio %v", entry.CommandIndex).That(entry.MetricToValue[counterMetricIdOffset+3]).DeepEquals(perf(6.0 / 20))
+	}
+	assert.For(ctx, "parent children time").That(res.Entries[0].MetricToValue[gpuChildrenTimeMetricId]).DeepEquals(perf(20))
+	assert.For(ctx, "leaf children time").That(res.Entries[1].MetricToValue[gpuChildrenTimeMetricId]).DeepEquals(perf(0))
+}
+
+func TestMagnitudeWeightedCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	// The slice contains one large and three tiny samples.
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 40)},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40}, []float64{0, 1, 100, 1, 1}),
+	}
+	plain, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	weighted, err := ComputeCounters(ctx, slices, counters, &Options{MagnitudeWeightedCounters: []string{"Busy"}})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	assert.For(ctx, "plain").ThatFloat(findEntry(plain, 0, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(103.0/4, 1e-9)
+	// Σ v² / Σ v, the large sample dominates.
+	assert.For(ctx, "weighted").ThatFloat(findEntry(weighted, 0, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(10003.0/103, 1e-9)
+
+	// The total weight is kept.
+	weights := magnitudeWeights(map[int]float64{1: 1, 2: 1, 3: 0.5}, counters[0])
+	assert.For(ctx, "total").ThatFloat(weights[1]+weights[2]+weights[3]).Equals(2.5, 1e-9)
+	zeros := counter("Zero", []uint64{0, 10, 20}, []float64{0, 0, 0})
+	assert.For(ctx, "zeros").That(magnitudeWeights(map[int]float64{1: 1, 2: 0.5}, zeros)).DeepEquals(map[int]float64{1: 1, 2: 0.5})
+}
+
+func TestChunkGroups(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{
+			group(0, 0, 0), group(1, 0, 1), group(2, 1, 0), group(3, 2, 0, 0), group(4, 2, 0, 1), group(5, 3),
+		},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10), slice(1, 5, 10), slice(2, 20, 10), slice(3, 25, 20), slice(4, 40, 10), slice(5, 55, 5),
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40, 50, 60}, []float64{0, 2, 4, 6, 8, 10, 12}),
+	}
+	assert.For(ctx, "chunks").That(commandChunks(slices.Groups, 2)).DeepEquals([]map[int32]bool{
+		{0: true, 1: true}, {2: true}, {3: true, 4: true}, {5: true},
+	})
+	assert.For(ctx, "oversized").That(commandChunks(slices.Groups, 1)).DeepEquals([]map[int32]bool{
+		{0: true, 1: true}, {2: true}, {3: true, 4: true}, {5: true},
+	})
+
+	options := &Options{IncludeGroupEntries: true, IncludeIdleEntry: true, RatioMetrics: []RatioMetric{{Name: "Ratio", Numerator: "Busy", Denominator: "GPU Time"}}}
+	single, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	for _, size := range []int{1, 2, 3, 100} {
+		options.ChunkGroups = size
+		chunked, err := ComputeCounters(ctx, slices, counters, options)
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "chunked %v", size).That(chunked).DeepEquals(single)
+	}
+}
+
+func BenchmarkComputeCountersChunked(b *testing.B) {
+	for _, size := range []int{0, 50} {
+		b.Run(fmt.Sprintf("ChunkGroups=%v", size), func(b *testing.B) {
+			// No logging, whose buffered output would count in the heap.
+			ctx := context.Background()
+			slices := benchmarkFixture(1000, 5)
+			for i, g := range slices.Groups {
+				g.Link.Indices = []uint64{uint64(i / 10), uint64(i % 10)} // 100 top level commands.
+			}
+			counters := []*service.ProfilingData_Counter{benchmarkCounter(slices, 40)}
+			options := &Options{ChunkGroups: size}
+			b.ReportAllocs()
+			b.ResetTimer()
+			peak := uint64(0)
+			for i := 0; i < b.N; i++ {
+				peak = u64.Max(peak, peakHeap(func() { ComputeCounters(ctx, slices, counters, options) }))
+			}
+			b.ReportMetric(float64(peak), "peak-heap-B")
+		})
+	}
+}
+
+// peakHeap returns the peak heap growth, in bytes, while running f, sampled
+// every millisecond.
+func peakHeap(f func()) uint64 {
+	runtime.GC()
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+	base, peak := stats.HeapAlloc, stats.HeapAlloc
+	done := make(chan struct{})
+	sampled := make(chan uint64)
+	go func() {
+		max := uint64(0)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				sampled <- max
+				return
+			case <-ticker.C:
+				s := runtime.MemStats{}
+				runtime.ReadMemStats(&s)
+				max = u64.Max(max, s.HeapAlloc)
+			}
+		}
+	}()
+	f()
+	close(done)
+	peak = u64.Max(peak, <-sampled)
+	return peak - base
+}
+
+func TestTopSlices(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+	}
+	ts := uint64(0)
+	for i, dur := range []uint64{5, 30, 10, 30, 1, 20} {
+		s := slice(0, ts, dur)
+		s.Id = uint64(i)
+		slices.Slices = append(slices.Slices, s)
+		ts += 100
+	}
+	other := slice(1, ts, 25)
+	other.Id = 6
+	slices.Slices = append(slices.Slices, other)
+	span := func(id, ts, dur uint64) *service.ProfilingData_GpuCounters_SliceSpan {
+		return &service.ProfilingData_GpuCounters_SliceSpan{Id: id, Ts: ts, Dur: dur}
+	}
+
+	res, err := ComputeCounters(ctx, slices, nil, &Options{TopSlices: 3})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "command").That(findEntry(res, 0, 0).TopSlices).DeepEquals([]*service.ProfilingData_GpuCounters_SliceSpan{
+		span(1, 100, 30), span(3, 300, 30), span(5, 500, 20),
+	})
+	assert.For(ctx, "short command").That(findEntry(res, 0, 1).TopSlices).DeepEquals([]*service.ProfilingData_GpuCounters_SliceSpan{
+		span(6, 600, 25),
+	})
+	assert.For(ctx, "parent").That(findEntry(res, 0).TopSlices).DeepEquals([]*service.ProfilingData_GpuCounters_SliceSpan{
+		span(1, 100, 30), span(3, 300, 30), span(6, 600, 25),
+	})
+
+	res, err = ComputeCounters(ctx, slices, nil, &Options{TopSlices: 10})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "all").ThatSlice(findEntry(res, 0).TopSlices).IsLength(7)
+
+	res, err = ComputeCounters(ctx, slices, nil, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "not requested").ThatSlice(findEntry(res, 0).TopSlices).IsEmpty()
+}
+
+func TestInstanceCounts(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	sumId := counterMetricIdOffset + 3
+	options := &Options{
+		DualAggregationCounters: []string{"Busy"},
+		InstanceCounts:          []InstanceCount{{[]uint64{0, 0}, 4}, {[]uint64{0, 1}, 0}},
+	}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	instanced := findEntry(res, 0, 0)
+	for _, id := range []int32{gpuTimeMetricId, gpuWallTimeMetricId, sumId} {
+		total, perInstance := instanced.MetricToValue[id], instanced.MetricToPerInstanceValue[id]
+		assert.For(ctx, "estimate %v", id).ThatFloat(perInstance.Estimate).Equals(total.Estimate/4, 1e-9)
+		assert.For(ctx, "min %v", id).ThatFloat(perInstance.Min).Equals(total.Min/4, 1e-9)
+		assert.For(ctx, "max %v", id).ThatFloat(perInstance.Max).Equals(total.Max/4, 1e-9)
+	}
+	_, ok := instanced.MetricToPerInstanceValue[counterMetricIdOffset]
+	assert.For(ctx, "averaged").That(ok).Equals(false)
+
+	assert.For(ctx, "zero count").That(findEntry(res, 0, 1).MetricToPerInstanceValue[sumId]).DeepEquals(unavailablePerf())
+	assert.For(ctx, "not instanced").ThatMap(findEntry(res, 0).MetricToPerInstanceValue).IsEmpty()
+}
+
+func TestWallTimeInvariant(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		name   string
+		slices []*service.ProfilingData_GpuSlices_Slice
+	}{
+		{"disjoint", []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 10), slice(0, 20, 10)}},
+		{"overlapping", []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 10), slice(0, 5, 10)}},
+		{"nested", []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 30), slice(0, 10, 5), slice(0, 12, 5)}},
+		{"adjacent", []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 10), slice(0, 10, 10)}},
+		{"empty", []*service.ProfilingData_GpuSlices_Slice{slice(0, 0, 0), slice(0, 5, 0)}},
+	} {
+		gpuTime, wallTime, _ := gpuTimeForGroup(test.slices, 0)
+		assert.For(ctx, "%v holds", test.name).That(checkWallTime(ctx, 0, test.slices, gpuTime, wallTime)).Equals(true)
+	}
+}
+
+func TestWallTimeInvariantViolation(t *testing.T) {
+	ctx := log.Testing(t)
+	messages := []*log.Message{}
+	capture := log.NewHandler(func(m *log.Message) { messages = append(messages, m) }, nil)
+	captureCtx := log.PutHandler(ctx, capture)
+
+	slices := []*service.ProfilingData_GpuSlices_Slice{slice(3, 0, 10), slice(3, 5, 10)}
+	slices[1].Id = 1
+	gpuTime, _, _ := gpuTimeForGroup(slices, 0)
+	// A broken wall time, larger than the sum of the slice durations.
+	assert.For(ctx, "broken").That(checkWallTime(captureCtx, 3, slices, gpuTime, gpuTime+5)).Equals(false)
+	assert.For(ctx, "messages").ThatSlice(messages).IsLength(1)
+	values := map[string]interface{}{}
+	for _, v := range messages[0].Values {
+		values[v.Name] = v.Value
+	}
+	assert.For(ctx, "severity").That(messages[0].Severity).Equals(log.Error)
+	assert.For(ctx, "values").That(values).DeepEquals(map[string]interface{}{
+		"group":     int32(3),
+		"gpu_time":  uint64(20),
+		"wall_time": uint64(25),
+		"slices":    []string{"0:[0, 10)", "1:[5, 15)"},
+	})
+}
+
+func TestQueueEntries(t *testing.T) {
+	ctx := log.Testing(t)
+	onTrack := func(s *service.ProfilingData_GpuSlices_Slice, trackId int32) *service.ProfilingData_GpuSlices_Slice {
+		s.TrackId = trackId
+		return s
+	}
+	// Command 0,0 has a leaf group on each queue, command 0,1 only one.
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 0), group(2, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			onTrack(slice(0, 5, 10), 0),
+			onTrack(slice(1, 20, 20), 1),
+			onTrack(slice(2, 40, 10), 0),
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40, 50}, []float64{0, 2, 4, 6, 8, 10}),
+	}
+	sumId := counterMetricIdOffset + 3
+	options := &Options{QueueEntries: true, DualAggregationCounters: []string{"Busy"}}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	for _, indices := range [][]uint64{{0, 0}, {0}} {
+		combined := findEntry(res, indices...)
+		assert.For(ctx, "queues %v", indices).ThatMap(combined.TrackToEntry).IsLength(2)
+		queues := []*service.ProfilingData_GpuCounters_Entry{combined.TrackToEntry[0], combined.TrackToEntry[1]}
+		for _, queue := range queues {
+			assert.For(ctx, "queue index %v", indices).That(queue.CommandIndex).DeepEquals(combined.CommandIndex)
+		}
+		value := func(entry *service.ProfilingData_GpuCounters_Entry, id int32) float64 {
+			return entry.MetricToValue[id].Estimate
+		}
+		// Summation, time-weighted average and maximum.
+		gpuTime := value(queues[0], gpuTimeMetricId) + value(queues[1], gpuTimeMetricId)
+		assert.For(ctx, "time %v", indices).ThatFloat(value(combined, gpuTimeMetricId)).Equals(gpuTime, 1e-9)
+		assert.For(ctx, "sum %v", indices).ThatFloat(value(combined, sumId)).Equals(value(queues[0], sumId)+value(queues[1], sumId), 1e-9)
+		avg := (value(queues[0], counterMetricIdOffset)*value(queues[0], gpuTimeMetricId) +
+			value(queues[1], counterMetricIdOffset)*value(queues[1], gpuTimeMetricId)) / gpuTime
+		assert.For(ctx, "avg %v", indices).ThatFloat(value(combined, counterMetricIdOffset)).Equals(avg, 1e-9)
+		longest := math.Max(value(queues[0], gpuLongestSliceMetricId), value(queues[1], gpuLongestSliceMetricId))
+		assert.For(ctx, "longest %v", indices).ThatFloat(value(combined, gpuLongestSliceMetricId)).Equals(longest, 0)
+	}
+	queue := findEntry(res, 0, 0).TrackToEntry[1]
+	assert.For(ctx, "queue time").ThatFloat(queue.MetricToValue[gpuTimeMetricId].Estimate).Equals(20, 0)
+	assert.For(ctx, "queue avg").ThatFloat(queue.MetricToValue[counterMetricIdOffset].Estimate).Equals(7, 1e-9)
+	assert.For(ctx, "single queue").ThatMap(findEntry(res, 0, 1).TrackToEntry).IsEmpty()
+
+	res, err = ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "not requested").ThatMap(findEntry(res, 0, 0).TrackToEntry).IsEmpty()
+}
+
+func TestStageEntries(t *testing.T) {
+	ctx := log.Testing(t)
+	stage := func(groupId int32, label string, ts, dur uint64) *service.ProfilingData_GpuSlices_Slice {
+		s := nestedSlice(groupId, 0, 1, ts, dur)
+		s.Label = label
+		return s
+	}
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 100), stage(0, "Binning", 0, 40), stage(0, "Resolve", 60, 40),
+			slice(1, 100, 100), stage(1, "Binning", 100, 50),
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 40, 60, 100, 150, 200}, []float64{0, 4, 6, 10, 15, 20}),
+	}
+	res, err := ComputeCounters(ctx, slices, counters, &Options{StageEntries: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	value := func(entry *service.ProfilingData_GpuCounters_Entry, id int32) float64 {
+		return entry.MetricToValue[id].Estimate
+	}
+	// The stages don't change the values of the commands themselves.
+	first := findEntry(res, 0, 0)
+	assert.For(ctx, "command").ThatFloat(value(first, counterMetricIdOffset)).Equals(6.8, 1e-9)
+	assert.For(ctx, "stages").ThatMap(first.StageToEntry).IsLength(2)
+	binning, resolve := first.StageToEntry["Binning"], first.StageToEntry["Resolve"]
+	assert.For(ctx, "binning index").That(binning.CommandIndex).DeepEquals([]uint64{0, 0})
+	assert.For(ctx, "binning time").ThatFloat(value(binning, gpuTimeMetricId)).Equals(40, 0)
+	assert.For(ctx, "binning").ThatFloat(value(binning, counterMetricIdOffset)).Equals(4, 1e-9)
+	assert.For(ctx, "resolve").ThatFloat(value(resolve, counterMetricIdOffset)).Equals(10, 1e-9)
+	assert.For(ctx, "second stages").ThatMap(findEntry(res, 0, 1).StageToEntry).IsLength(1)
+
+	// The stages of the parent command are merged from its leaf groups.
+	parent := findEntry(res, 0).StageToEntry["Binning"]
+	assert.For(ctx, "parent time").ThatFloat(value(parent, gpuTimeMetricId)).Equals(90, 0)
+	assert.For(ctx, "parent").ThatFloat(value(parent, counterMetricIdOffset)).Equals((4*40+15*50)/90.0, 1e-9)
+
+	entry, err := ComputeCommandCounters(ctx, slices, counters, []uint64{0, 1}, &Options{StageEntries: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "command binning").ThatFloat(value(entry.StageToEntry["Binning"], counterMetricIdOffset)).Equals(15, 1e-9)
+
+	res, err = ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "not requested").ThatMap(findEntry(res, 0, 0).StageToEntry).IsEmpty()
+}
+
+func TestSanitizedCounterNames(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	multiline := "Busy\nCycles\t(%)\x00"
+	overlong := strings.Repeat("Long", 20)
+	counters = []*service.ProfilingData_Counter{
+		counter(multiline, counters[0].Timestamps, counters[0].Values),
+		counter(overlong, counters[0].Timestamps, counters[0].Values),
+	}
+	options := &Options{
+		MaxCounterNameLength:    16,
+		PessimisticMetrics:      true,
+		DualAggregationCounters: []string{overlong},
+		RatioMetrics:            []RatioMetric{{Name: "Ratio", Numerator: multiline, Denominator: overlong}},
+	}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	names, counterNames := map[int32]string{}, map[int32]string{}
+	for _, metric := range res.Metrics {
+		names[metric.Id], counterNames[metric.Id] = metric.Name, metric.CounterName
+	}
+	// See dualMetric and ratioMetric for the ids of the two counters.
+	pessimisticId, ratioId, dualId := counterMetricIdOffset+4, counterMetricIdOffset+6, counterMetricIdOffset+8
+	assert.For(ctx, "multiline").That(names[counterMetricIdOffset]).Equals("Busy Cycles (%)")
+	assert.For(ctx, "multiline original").That(counterNames[counterMetricIdOffset]).Equals(multiline)
+	assert.For(ctx, "overlong").That(names[counterMetricIdOffset+1]).Equals("LongLongLongLong")
+	assert.For(ctx, "overlong original").That(counterNames[counterMetricIdOffset+1]).Equals(overlong)
+	assert.For(ctx, "pessimistic").That(names[pessimisticId]).Equals("Busy Cycles (%) (pessimistic upper bound)")
+	assert.For(ctx, "dual").That(names[dualId]).Equals("LongLongLongLong (sum)")
+	assert.For(ctx, "dual original").That(counterNames[dualId]).Equals(overlong)
+	assert.For(ctx, "time").That(counterNames[gpuTimeMetricId]).Equals("")
+
+	// The ratio refers to the counters by their original names.
+	entry := findEntry(res, 0, 0)
+	assert.For(ctx, "ratio").ThatFloat(entry.MetricToValue[ratioId].Estimate).Equals(1, 1e-9)
+
+	res, err = ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "untruncated").That(res.Metrics[len(res.Metrics)-1].Name).Equals(overlong)
+}
+
+func TestSummedCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	counters = append(counters, counter("Fragments", counters[0].Timestamps, []float64{0, 20, 40, 60, 80}))
+	options := &Options{SummedCounters: []string{"Fragments"}}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	fragmentsId := counterMetricIdOffset + 1
+	assert.For(ctx, "op").That(res.Metrics[len(res.Metrics)-1].Op).Equals(service.ProfilingData_GpuCounters_Metric_Summation)
+	assert.For(ctx, "averaged op").That(res.Metrics[len(res.Metrics)-2].Op).Equals(service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg)
+	// Each command overlaps half of two samples: 20 and 40, then 60 and 80.
+	// The minimum holds no whole sample, the maximum both of them.
+	for _, test := range []struct {
+		indices            []uint64
+		estimate, min, max float64
+	}{
+		{[]uint64{0, 0}, 0.5*20 + 0.5*40, 0, 20 + 40},
+		{[]uint64{0, 1}, 0.5*60 + 0.5*80, 0, 60 + 80},
+		{[]uint64{0}, 30 + 70, 0, 60 + 140},
+	} {
+		perf := findEntry(res, test.indices...).MetricToValue[fragmentsId]
+		assert.For(ctx, "estimate %v", test.indices).ThatFloat(perf.Estimate).Equals(test.estimate, 1e-9)
+		assert.For(ctx, "min %v", test.indices).ThatFloat(perf.Min).Equals(test.min, 1e-9)
+		assert.For(ctx, "max %v", test.indices).ThatFloat(perf.Max).Equals(test.max, 1e-9)
+	}
+	assert.For(ctx, "averaged").ThatFloat(findEntry(res, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(5, 1e-9)
+}
+
+func TestCounterAggregations(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	options := &Options{CounterAggregations: map[string]service.ProfilingData_GpuCounters_Metric_AggregationOperator{
+		"Busy": service.ProfilingData_GpuCounters_Metric_Minimum,
+	}}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "op").That(res.Metrics[len(res.Metrics)-1].Op).Equals(service.ProfilingData_GpuCounters_Metric_Minimum)
+	// Each command overlaps half of two samples: 2 and 4, then 6 and 8.
+	assert.For(ctx, "first").ThatFloat(findEntry(res, 0, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(2, 0)
+	assert.For(ctx, "second").ThatFloat(findEntry(res, 0, 1).MetricToValue[counterMetricIdOffset].Estimate).Equals(6, 0)
+	assert.For(ctx, "parent").ThatFloat(findEntry(res, 0).MetricToValue[counterMetricIdOffset].Estimate).Equals(2, 0)
+}
+
+func TestSampleStatistics(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	res, err := ComputeCounters(ctx, slices, counters, &Options{SampleStatistics: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	// Each command overlaps half of two samples: 2 and 4, then 6 and 8.
+	for _, test := range []struct {
+		indices []uint64
+		count   uint64
+	}{
+		{[]uint64{0, 0}, 2},
+		{[]uint64{0, 1}, 2},
+		{[]uint64{0}, 4},
+	} {
+		perf := findEntry(res, test.indices...).MetricToValue[counterMetricIdOffset]
+		assert.For(ctx, "count %v", test.indices).That(perf.SampleCount).Equals(test.count)
+		assert.For(ctx, "std dev %v", test.indices).ThatFloat(perf.StdDev).Equals(1, 1e-9)
+	}
+	assert.For(ctx, "time").That(findEntry(res, 0, 0).MetricToValue[gpuTimeMetricId].SampleCount).Equals(uint64(0))
+
+	res, err = ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "not requested").That(findEntry(res, 0).MetricToValue[counterMetricIdOffset].SampleCount).Equals(uint64(0))
+}
+
+func TestOptInOutputs(t *testing.T) {
+	ctx := log.Testing(t)
+	// Each command has a draw in the render pass of its parity, the first three
+	// are in the first frame, the others in the second, with 10ns of gap
+	// between them. The last one is too long and the first has a stage.
+	draw := func(groupId int32, ts, dur uint64) *service.ProfilingData_GpuSlices_Slice {
+		s := labelledSlice(uint64(10+groupId), groupId, ts, dur, "draw")
+		s.Extras = []*service.ProfilingData_GpuSlices_Slice_Extra{
+			{Name: "renderPass", Value: &service.ProfilingData_GpuSlices_Slice_Extra_IntValue{IntValue: uint64(groupId % 2)}},
+			{Name: "frameId", Value: &service.ProfilingData_GpuSlices_Slice_Extra_IntValue{IntValue: uint64(groupId / 3)}},
+		}
+		return s
+	}
+	binning := nestedSlice(0, 0, 1, 0, 5)
+	binning.Label = "Binning"
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{
+			group(0, 0, 0), group(1, 0, 1), group(2, 0, 2), group(3, 0, 3), group(4, 0, 4), group(5, 0, 5),
+		},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			draw(0, 0, 10), binning, draw(1, 20, 11), draw(2, 40, 10), draw(3, 60, 11), draw(4, 80, 10), draw(5, 100, 30),
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy",
+			[]uint64{0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 110, 120, 130},
+			[]float64{0, 1, 0, 2, 0, 1, 0, 1, 0, 2, 0, 1, 2, 1}),
+	}
+	for _, test := range []struct {
+		name      string
+		options   *Options
+		requested func(res *service.ProfilingData_GpuCounters) bool
+	}{
+		{"coverage", &Options{Coverage: true}, func(res *service.ProfilingData_GpuCounters) bool {
+			return len(findEntry(res, 0, 0).MetricToCoverage) != 0
+		}},
+		{"confidence", &Options{Confidence: true}, func(res *service.ProfilingData_GpuCounters) bool {
+			return len(findEntry(res, 0, 0).MetricToConfidence) != 0
+		}},
+		{"normalized values", &Options{NormalizedValues: true}, func(res *service.ProfilingData_GpuCounters) bool {
+			return len(findEntry(res, 0, 0).MetricToNormalizedValue) != 0
+		}},
+		{"top slices", &Options{TopSlices: 1}, func(res *service.ProfilingData_GpuCounters) bool {
+			return len(findEntry(res, 0).TopSlices) != 0
+		}},
+		{"group entries", &Options{IncludeGroupEntries: true}, func(res *service.ProfilingData_GpuCounters) bool {
+			return len(res.GroupToEntry) != 0
+		}},
+		{"idle entry", &Options{IncludeIdleEntry: true}, func(res *service.ProfilingData_GpuCounters) bool {
+			return res.IdleEntry != nil
+		}},
+		{"stage entries", &Options{StageEntries: true}, func(res *service.ProfilingData_GpuCounters) bool {
+			return len(findEntry(res, 0, 0).StageToEntry) != 0
+		}},
+		{"render pass entries", &Options{RenderPassEntries: true}, func(res *service.ProfilingData_GpuCounters) bool {
+			return len(res.RenderPassToEntry) != 0
+		}},
+		{"frame entries", &Options{FrameEntries: true}, func(res *service.ProfilingData_GpuCounters) bool {
+			return len(res.FrameToEntry) != 0
+		}},
+		{"command groupings", &Options{CommandGroupings: []CommandGrouping{{Label: "all", First: []uint64{0}}}}, func(res *service.ProfilingData_GpuCounters) bool {
+			return len(res.LabelToEntry) != 0
+		}},
+		{"idle gaps", &Options{IdleGaps: 1}, func(res *service.ProfilingData_GpuCounters) bool {
+			return len(res.IdleGaps) != 0
+		}},
+		{"frame idle time", &Options{IdleGaps: 1, FrameEntries: true}, func(res *service.ProfilingData_GpuCounters) bool {
+			return res.FrameToEntry[0].IdleTime != 0
+		}},
+		{"outliers", &Options{OutlierSigma: 2}, func(res *service.ProfilingData_GpuCounters) bool {
+			return len(res.Outliers) != 0
+		}},
+	} {
+		res, err := ComputeCounters(ctx, slices, counters, test.options)
+		assert.For(ctx, "%v err", test.name).ThatError(err).Succeeded()
+		assert.For(ctx, "%v requested", test.name).That(test.requested(res)).Equals(true)
+
+		// Not requested, the other outputs needed for the check being kept.
+		options := &Options{FrameEntries: test.options.FrameEntries && test.options.IdleGaps != 0}
+		res, err = ComputeCounters(ctx, slices, counters, options)
+		assert.For(ctx, "%v err", test.name).ThatError(err).Succeeded()
+		assert.For(ctx, "%v not requested", test.name).That(test.requested(res)).Equals(false)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+// RangeCounters returns the performance of the commands from first to last,
+// see CommandGrouping, merged from the entries of the result on the GPU of the
+// given id, see Entry.gpu_id, for the metrics of the given ids, or all of them
+// but the children GPU time if none is given. The entries of the commands on
+// several GPUs are only merged with the ones of the same GPU. The entries
+// merged are the outermost ones entirely in the range, weighted by their GPU
+// time: the own groups of the commands only partly in it, the ancestors of
+// last, are left out. The derived and ratio metrics, recomputed rather than
+// merged by ComputeCounters, are merged by their operator like the counters,
+// which only approximates them. The values merged from entries missing the
+// metric are partial.
+func RangeCounters(ctx context.Context, counters *service.ProfilingData_GpuCounters, gpu int32, first, last []uint64, metricIds []int32) (*service.RangeCounters, error) {
+	metrics := []*service.ProfilingData_GpuCounters_Metric{}
+	if len(metricIds) == 0 {
+		for _, metric := range counters.Metrics {
+			if metric.Id != gpuChildrenTimeMetricId {
+				metrics = append(metrics, metric)
+			}
+		}
+	}
+	for _, id := range metricIds {
+		var found *service.ProfilingData_GpuCounters_Metric
+		for _, metric := range counters.Metrics {
+			if metric.Id == id {
+				found = metric
+			}
+		}
+		if found == nil {
+			return nil, log.Errf(ctx, nil, "No GPU counters metric of id %v", id)
+		}
+		metrics = append(metrics, found)
+	}
+
+	grouping := CommandGrouping{First: first, Last: last}
+	inRange := func(index []uint64) bool {
+		ancestor := len(index) < len(last) && compareIndices(index, last[:len(index)]) == 0
+		return grouping.contains(index) && !ancestor
+	}
+	entries := []*service.ProfilingData_GpuCounters_Entry{}
+	for _, entry := range counters.Entries {
+		n := len(entry.CommandIndex)
+		if n != 0 && entry.GpuId == gpu && inRange(entry.CommandIndex) && (n == 1 || !inRange(entry.CommandIndex[:n-1])) {
+			entries = append(entries, entry)
+		}
+	}
+	weights := make([]float64, len(entries))
+	for i, entry := range entries {
+		if perf, ok := entry.MetricToValue[gpuTimeMetricId]; ok && !isUnavailable(perf) {
+			weights[i] = perf.Estimate
+		}
+	}
+
+	res := &service.RangeCounters{
+		Metrics:       metrics,
+		MetricToValue: make(map[int32]*service.ProfilingData_GpuCounters_Perf, len(metrics)),
+		CommandCount:  uint32(len(entries)),
+	}
+	for _, metric := range metrics {
+		aggregator, ok := aggregators[metric.Op]
+		if !ok || len(entries) == 0 {
+			res.MetricToValue[metric.Id] = unavailablePerf()
+			continue
+		}
+		perfs := make([]*service.ProfilingData_GpuCounters_Perf, len(entries))
+		partial := false
+		for i, entry := range entries {
+			perf, ok := entry.MetricToValue[metric.Id]
+			if !ok {
+				perf = unavailablePerf()
+			}
+			partial = partial || !ok || perf.Partial
+			perfs[i] = perf
+		}
+		merged := aggregator.Merge(perfs, weights)
+		merged.Partial = partial && !isUnavailable(merged)
+		res.MetricToValue[metric.Id] = merged
+	}
+	return res, nil
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+)
+
+func TestRangeCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	res, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	for _, test := range []struct {
+		name        string
+		first, last []uint64
+		commands    uint32
+		gpuTime     float64
+	}{
+		{"all", nil, nil, 1, 20},
+		{"single", []uint64{0, 1}, []uint64{0, 1}, 1, 10},
+		{"children", []uint64{0, 0}, []uint64{0}, 2, 20},
+		// The parent of the last command is only partly in the range.
+		{"partial parent", nil, []uint64{0, 0}, 1, 10},
+		{"empty", []uint64{1}, nil, 0, -1},
+	} {
+		r, err := RangeCounters(ctx, res, 0, test.first, test.last, []int32{gpuTimeMetricId})
+		assert.For(ctx, "%v err", test.name).ThatError(err).Succeeded()
+		assert.For(ctx, "%v metrics", test.name).ThatSlice(r.Metrics).IsLength(1)
+		assert.For(ctx, "%v commands", test.name).That(r.CommandCount).Equals(test.commands)
+		assert.For(ctx, "%v gpu time", test.name).ThatFloat(r.MetricToValue[gpuTimeMetricId].Estimate).Equals(test.gpuTime, 1e-9)
+	}
+
+	all, err := RangeCounters(ctx, res, 0, nil, nil, nil)
+	assert.For(ctx, "all err").ThatError(err).Succeeded()
+	assert.For(ctx, "all metrics").ThatSlice(all.Metrics).IsLength(len(res.Metrics) - 1)
+	_, ok := all.MetricToValue[gpuChildrenTimeMetricId]
+	assert.For(ctx, "children time").That(ok).Equals(false)
+
+	_, err = RangeCounters(ctx, res, 0, nil, nil, []int32{-42})
+	assert.For(ctx, "unknown metric").ThatError(err).Failed()
+
+	// The values merged from an entry missing the metric are partial.
+	delete(findEntry(res, 0, 1).MetricToValue, counterMetricIdOffset)
+	r, err := RangeCounters(ctx, res, 0, []uint64{0, 0}, []uint64{0, 1}, []int32{counterMetricIdOffset, gpuTimeMetricId})
+	assert.For(ctx, "partial err").ThatError(err).Succeeded()
+	assert.For(ctx, "partial").That(r.MetricToValue[counterMetricIdOffset].Partial).Equals(true)
+	assert.For(ctx, "complete").That(r.MetricToValue[gpuTimeMetricId].Partial).Equals(false)
+}
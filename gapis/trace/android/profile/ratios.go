@@ -0,0 +1,120 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// RatioMetric is a metric derived, for each command, by dividing the
+// aggregated value of a metric by the one of another metric, such as a cache
+// hit rate from the hits and accesses counters. Unlike the counters, the
+// ratio isn't merged from the leaf groups but recomputed from the merged
+// numerator and denominator of every command.
+type RatioMetric struct {
+	Name        string
+	Unit        string
+	Numerator   string // The name of the numerator metric.
+	Denominator string // The name of the denominator metric.
+}
+
+// ratioIds are the metric ids of a resolved ratio metric.
+type ratioIds struct {
+	id, numerator, denominator int32
+}
+
+// Create the metadata of the i-th ratio metric of the options. Those metrics
+// come after all the other metrics.
+func ratioMetric(i int, ids *metricIds, options *Options) *service.ProfilingData_GpuCounters_Metric {
+	ratio := options.RatioMetrics[i]
+	metric := &service.ProfilingData_GpuCounters_Metric{
+		Id:       ids.ratio + int32(i),
+		Name:     ratio.Name,
+		Unit:     ratio.Unit,
+		Op:       service.ProfilingData_GpuCounters_Metric_TimeWeightedAvg,
+		Polarity: metricPolarity(options, service.ProfilingData_GpuCounters_Metric_UnknownPolarity, ratio.Name),
+	}
+	metric.Category = metricCategory(metric, nil, options)
+	return metric
+}
+
+// Find the ids of the numerator and the denominator of the ratio metrics of
+// the options among the metrics, the ids of the ratio metrics being the ones
+// of their layout. The ratios whose numerator or denominator isn't found are
+// reported unavailable. The metrics are found by name, or by counter name for
+// the counter metrics.
+func resolveRatios(ctx context.Context, metrics []*service.ProfilingData_GpuCounters_Metric, layout *metricIds, options *Options) []ratioIds {
+	if len(options.RatioMetrics) == 0 {
+		return nil
+	}
+	ids := map[string]int32{}
+	for _, metric := range metrics {
+		if _, ok := ids[metric.Name]; !ok {
+			ids[metric.Name] = metric.Id
+		}
+	}
+	// The counters are also found by their exact names, before sanitization.
+	for _, metric := range metrics {
+		if _, ok := ids[metric.CounterName]; !ok && metric.CounterName != "" {
+			ids[metric.CounterName] = metric.Id
+		}
+	}
+	ratios := make([]ratioIds, len(options.RatioMetrics))
+	for i, ratio := range options.RatioMetrics {
+		ratios[i] = ratioIds{layout.ratio + int32(i), -1, -1}
+		numerator, okNumerator := ids[ratio.Numerator]
+		denominator, okDenominator := ids[ratio.Denominator]
+		if !okNumerator || !okDenominator {
+			warn(ctx, service.ProfilingData_GpuCounters_Warning_UnknownRatioMetric, ratio.Name, "Ratio metric %v of unknown metrics %v / %v", ratio.Name, ratio.Numerator, ratio.Denominator)
+			continue
+		}
+		ratios[i].numerator, ratios[i].denominator = numerator, denominator
+	}
+	return ratios
+}
+
+// Calculate the ratio metrics of the entry from its other metrics.
+func setRatioMetrics(ratios []ratioIds, entry *service.ProfilingData_GpuCounters_Entry) {
+	for _, ratio := range ratios {
+		numerator, okNumerator := entry.MetricToValue[ratio.numerator]
+		denominator, okDenominator := entry.MetricToValue[ratio.denominator]
+		if !okNumerator || !okDenominator {
+			entry.MetricToValue[ratio.id] = unavailablePerf()
+			continue
+		}
+		entry.MetricToValue[ratio.id] = ratioPerf(numerator, denominator)
+	}
+}
+
+// Divide the numerator performance by the denominator performance. The ratio
+// is unavailable if either is, or if the denominator is zero. Its range
+// spans the extreme ratios of the operands' ranges when they're positive,
+// and is reduced to the estimate otherwise.
+func ratioPerf(numerator, denominator *service.ProfilingData_GpuCounters_Perf) *service.ProfilingData_GpuCounters_Perf {
+	if isUnavailable(numerator) || isUnavailable(denominator) || denominator.Estimate == 0 {
+		return unavailablePerf()
+	}
+	estimate := numerator.Estimate / denominator.Estimate
+	if numerator.Min < 0 || denominator.Min <= 0 {
+		return &service.ProfilingData_GpuCounters_Perf{Estimate: estimate, Min: estimate, Max: estimate}
+	}
+	return &service.ProfilingData_GpuCounters_Perf{
+		Estimate: estimate,
+		Min:      numerator.Min / denominator.Max,
+		Max:      numerator.Max / denominator.Min,
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestRatioMetrics(t *testing.T) {
+	ctx := log.Testing(t)
+	// Each command spans a single sample of the counters.
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 0, 2)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 1, 8), slice(1, 11, 8), slice(2, 21, 8)},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Hits", []uint64{0, 10, 20, 30}, []float64{0, 3, 9, 0}),
+		counter("Accesses", []uint64{0, 10, 20, 30}, []float64{0, 4, 10, 0}),
+	}
+	options := &Options{RatioMetrics: []RatioMetric{
+		{Name: "Hit Rate", Numerator: "Hits", Denominator: "Accesses"},
+		{Name: "Unknown", Numerator: "Hits", Denominator: "Misses"},
+	}}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "metrics").That(res.Metrics).DeepEquals(MetricCatalog(counters, options))
+	hitRate, unknown := res.Metrics[len(res.Metrics)-2], res.Metrics[len(res.Metrics)-1]
+	assert.For(ctx, "name").That(hitRate.Name).Equals("Hit Rate")
+
+	entries := entriesByIndex(res)
+	assert.For(ctx, "first").That(entries["0,0"][hitRate.Id]).DeepEquals(perf(0.75))
+	assert.For(ctx, "second").That(entries["0,1"][hitRate.Id]).DeepEquals(perf(0.9))
+	assert.For(ctx, "no accesses").That(entries["0,2"][hitRate.Id]).DeepEquals(unavailablePerf())
+	// The parent's ratio is the one of its merged counters, not the average
+	// of its children's ratios.
+	parent := entries["0"]
+	assert.For(ctx, "parent").ThatFloat(parent[hitRate.Id].Estimate).Equals(
+		parent[counterMetricIdOffset].Estimate/parent[counterMetricIdOffset+1].Estimate, 1e-12)
+	assert.For(ctx, "parent value").ThatFloat(parent[hitRate.Id].Estimate).Equals(12.0/14, 1e-12)
+	for idx, values := range entries {
+		assert.For(ctx, "%v unknown", idx).That(values[unknown.Id]).DeepEquals(unavailablePerf())
+	}
+
+	// The ratio metrics are found by their ids, wherever they are listed.
+	ids := newMetricIds(len(counters), options)
+	reordered := append([]*service.ProfilingData_GpuCounters_Metric{hitRate, unknown}, res.Metrics[:len(res.Metrics)-2]...)
+	assert.For(ctx, "reordered").That(resolveRatios(ctx, reordered, ids, options)).DeepEquals(
+		[]ratioIds{{hitRate.Id, counterMetricIdOffset, counterMetricIdOffset + 1}, {unknown.Id, -1, -1}})
+}
+
+func TestRatioPerf(t *testing.T) {
+	ctx := log.Testing(t)
+	numerator := &service.ProfilingData_GpuCounters_Perf{Estimate: 6, Min: 4, Max: 8}
+	denominator := &service.ProfilingData_GpuCounters_Perf{Estimate: 2, Min: 1, Max: 4}
+	assert.For(ctx, "range").That(ratioPerf(numerator, denominator)).DeepEquals(
+		&service.ProfilingData_GpuCounters_Perf{Estimate: 3, Min: 1, Max: 8})
+	denominator.Min = 0
+	assert.For(ctx, "zero min").That(ratioPerf(numerator, denominator)).DeepEquals(perf(3))
+	assert.For(ctx, "zero").That(ratioPerf(numerator, perf(0))).DeepEquals(unavailablePerf())
+	assert.For(ctx, "unavailable").That(ratioPerf(unavailablePerf(), denominator)).DeepEquals(unavailablePerf())
+}
@@ -0,0 +1,99 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+
+	"github.com/google/gapid/gapis/service"
+	"github.com/google/gapid/gapis/service/path"
+)
+
+// The name of the slice extra holding the render pass handle of the slice, as
+// set by the vendor profiling data.
+const renderPassExtraName = "renderPass"
+
+// Return the render pass handle of the slice, and whether it has one. The null
+// handle is no render pass.
+func sliceRenderPass(slice *service.ProfilingData_GpuSlices_Slice) (uint64, bool) {
+	for _, extra := range slice.Extras {
+		if extra.Name != renderPassExtraName {
+			continue
+		}
+		if v, ok := extra.Value.(*service.ProfilingData_GpuSlices_Slice_Extra_IntValue); ok && v.IntValue != 0 {
+			return v.IntValue, true
+		}
+		return 0, false
+	}
+	return 0, false
+}
+
+// Return the entries of the render passes, keyed by render pass handle, see
+// Options.RenderPassEntries. The slices of the groups are regrouped by the
+// render pass they carry, across all the commands using the pass, and the
+// render pass groups are attributed like the leaf groups. The slices outside
+// of any render pass, such as the compute dispatches, go to a group with no
+// entry, still competing for the counter samples. The entries are linked to
+// no command. Nil is returned if no slice carries a render pass.
+func renderPassEntries(ctx context.Context, slices *service.ProfilingData_GpuSlices, counters []*service.ProfilingData_Counter, options *Options) map[uint64]*service.ProfilingData_GpuCounters_Entry {
+	known := make(map[int32]bool, len(slices.Groups))
+	for _, group := range slices.Groups {
+		known[group.Id] = true
+	}
+	const noPassId = 0
+	passes := &service.ProfilingData_GpuSlices{
+		Tracks: slices.Tracks,
+		Groups: []*service.ProfilingData_GpuSlices_Group{{Id: noPassId, Link: &path.Command{}}},
+	}
+	passIds := map[uint64]int32{}
+	handles := []uint64{0} // Render pass group id -> handle.
+	for _, slice := range slices.Slices {
+		if slice.Depth != 0 || !known[slice.GroupId] {
+			continue
+		}
+		id := int32(noPassId)
+		if handle, ok := sliceRenderPass(slice); ok {
+			if id, ok = passIds[handle]; !ok {
+				id = int32(len(handles))
+				passIds[handle] = id
+				handles = append(handles, handle)
+				passes.Groups = append(passes.Groups, &service.ProfilingData_GpuSlices_Group{
+					Id:   id,
+					Link: &path.Command{},
+				})
+			}
+		}
+		passes.Slices = append(passes.Slices, &service.ProfilingData_GpuSlices_Slice{
+			Ts:      slice.Ts,
+			Dur:     slice.Dur,
+			Id:      slice.Id,
+			Label:   slice.Label,
+			Extras:  slice.Extras,
+			TrackId: slice.TrackId,
+			GroupId: id,
+		})
+	}
+	if len(passIds) == 0 {
+		return nil
+	}
+	include := func(group *service.ProfilingData_GpuSlices_Group) bool { return group.Id != noPassId }
+	_, passToEntry, _ := computeLeafEntries(ctx, passes, counters, include, options)
+
+	res := make(map[uint64]*service.ProfilingData_GpuCounters_Entry, len(passToEntry))
+	for id, entry := range passToEntry {
+		res[handles[id]] = entry
+	}
+	return res
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+// passSlice builds a GPU slice of the render pass of the given handle.
+func passSlice(groupId int32, ts, dur, handle uint64) *service.ProfilingData_GpuSlices_Slice {
+	s := slice(groupId, ts, dur)
+	s.Extras = []*service.ProfilingData_GpuSlices_Slice_Extra{{
+		Name:  "renderPass",
+		Value: &service.ProfilingData_GpuSlices_Slice_Extra_IntValue{IntValue: handle},
+	}}
+	return s
+}
+
+func TestRenderPassEntries(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 0, 2), group(3, 0, 3)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			passSlice(0, 0, 10, 7),
+			passSlice(1, 20, 10, 9),
+			passSlice(2, 40, 10, 7),
+			slice(3, 60, 10), // A compute dispatch, out of any render pass.
+		},
+	}
+	counters := []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20, 30, 40, 50, 60, 70}, []float64{0, 2, 0, 4, 0, 6, 0, 8}),
+	}
+	res, err := ComputeCounters(ctx, slices, counters, &Options{RenderPassEntries: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "passes").ThatMap(res.RenderPassToEntry).IsLength(2)
+
+	first, second := res.RenderPassToEntry[7], res.RenderPassToEntry[9]
+	assert.For(ctx, "command").That(first.CommandIndex).IsNil()
+	// The pass used by two commands adds up their GPU time and averages their counters.
+	assert.For(ctx, "first time").ThatFloat(first.MetricToValue[gpuTimeMetricId].Estimate).Equals(20, 1e-9)
+	assert.For(ctx, "first busy").ThatFloat(first.MetricToValue[counterMetricIdOffset].Estimate).Equals(4, 1e-9)
+	assert.For(ctx, "second time").ThatFloat(second.MetricToValue[gpuTimeMetricId].Estimate).Equals(10, 1e-9)
+	assert.For(ctx, "second busy").That(second.MetricToValue[counterMetricIdOffset]).DeepEquals(
+		findEntry(res, 0, 1).MetricToValue[counterMetricIdOffset])
+
+	// No render pass.
+	plain, _ := twoCommandsFixture()
+	res, err = ComputeCounters(ctx, plain, counters, &Options{RenderPassEntries: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "no pass").That(res.RenderPassToEntry).IsNil()
+}
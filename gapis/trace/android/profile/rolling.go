@@ -0,0 +1,185 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// RollingCounters aggregates the GPU counters of the last frames, such as for
+// a live HUD. Once it holds capacity frames, pushing a frame evicts the oldest
+// one. The commands of the frames are matched by command index.
+type RollingCounters struct {
+	capacity int
+	frames   [][]rollingValue                  // Ring buffer of the values of the held frames.
+	oldest   int                               // Index of the oldest frame in frames.
+	pushed   uint64                            // Number of frames pushed so far.
+	stats    map[string]map[int32]*rollingStat // command -> metric id -> aggregate.
+}
+
+// rollingKey identifies a metric of a command across the frames.
+type rollingKey struct {
+	command string // See encodeIndex.
+	metric  int32
+}
+
+// rollingValue is the value of one frame for a metric of a command.
+type rollingValue struct {
+	key   rollingKey
+	value float64
+}
+
+// rollingSample is a value of a min/max queue, tagged with its frame.
+type rollingSample struct {
+	frame uint64
+	value float64
+}
+
+// rollingStat is the running aggregate of a metric of a command. The sum is
+// compensated, see accumulate, so that it doesn't drift from the one of the
+// held frames over the additions and evictions of a long session. mins and
+// maxs are monotonic queues whose head is the minimum, respectively maximum,
+// value of the held frames, so that the eviction of a frame is O(1) amortized.
+type rollingStat struct {
+	sum   float64
+	comp  float64 // The low-order bits lost by sum.
+	count int
+	mins  []rollingSample // Increasing values.
+	maxs  []rollingSample // Decreasing values.
+}
+
+// NewRollingCounters returns a RollingCounters holding the last capacity
+// frames, or an error if the capacity isn't positive.
+func NewRollingCounters(capacity int) (*RollingCounters, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("RollingCounters capacity must be positive, got %v", capacity)
+	}
+	return &RollingCounters{
+		capacity: capacity,
+		frames:   make([][]rollingValue, 0, capacity),
+		stats:    map[string]map[int32]*rollingStat{},
+	}, nil
+}
+
+// Push adds the GPU counters of a new frame, evicting the oldest frame if the
+// capacity is reached. The unavailable values, see unavailablePerf, are not
+// aggregated.
+func (r *RollingCounters) Push(counters *service.ProfilingData_GpuCounters) {
+	frame := r.pushed
+	r.pushed++
+	if len(r.frames) == r.capacity {
+		r.evict(frame - uint64(r.capacity))
+	}
+
+	values := []rollingValue{}
+	for _, entry := range counters.Entries {
+		command := encodeIndex(entry.CommandIndex)
+		for metricId, perf := range entry.MetricToValue {
+			if isUnavailable(perf) {
+				continue
+			}
+			key := rollingKey{command, metricId}
+			values = append(values, rollingValue{key, perf.Estimate})
+			r.add(key, frame, perf.Estimate)
+		}
+	}
+	if len(r.frames) < r.capacity {
+		r.frames = append(r.frames, values)
+	} else {
+		r.frames[r.oldest] = values
+		r.oldest = (r.oldest + 1) % r.capacity
+	}
+}
+
+// Len returns the number of frames held.
+func (r *RollingCounters) Len() int {
+	return len(r.frames)
+}
+
+// Get returns the rolling performance of the command over the held frames,
+// mapping the metric ids to the mean of their estimates, and the minimum and
+// maximum estimates. The metrics not available in any held frame are omitted.
+func (r *RollingCounters) Get(commandIndex []uint64) map[int32]*service.ProfilingData_GpuCounters_Perf {
+	metricToValue := map[int32]*service.ProfilingData_GpuCounters_Perf{}
+	for metricId, stat := range r.stats[encodeIndex(commandIndex)] {
+		metricToValue[metricId] = &service.ProfilingData_GpuCounters_Perf{
+			Estimate: (stat.sum + stat.comp) / float64(stat.count),
+			Min:      stat.mins[0].value,
+			Max:      stat.maxs[0].value,
+		}
+	}
+	return metricToValue
+}
+
+func (r *RollingCounters) add(key rollingKey, frame uint64, value float64) {
+	metrics, ok := r.stats[key.command]
+	if !ok {
+		metrics = map[int32]*rollingStat{}
+		r.stats[key.command] = metrics
+	}
+	stat, ok := metrics[key.metric]
+	if !ok {
+		stat = &rollingStat{}
+		metrics[key.metric] = stat
+	}
+	stat.accumulate(value)
+	stat.count++
+	for len(stat.mins) > 0 && stat.mins[len(stat.mins)-1].value >= value {
+		stat.mins = stat.mins[:len(stat.mins)-1]
+	}
+	stat.mins = append(stat.mins, rollingSample{frame, value})
+	for len(stat.maxs) > 0 && stat.maxs[len(stat.maxs)-1].value <= value {
+		stat.maxs = stat.maxs[:len(stat.maxs)-1]
+	}
+	stat.maxs = append(stat.maxs, rollingSample{frame, value})
+}
+
+// Remove the values of the oldest frame from the aggregates.
+func (r *RollingCounters) evict(frame uint64) {
+	for _, v := range r.frames[r.oldest] {
+		metrics := r.stats[v.key.command]
+		stat := metrics[v.key.metric]
+		stat.count--
+		if stat.count == 0 {
+			delete(metrics, v.key.metric)
+			if len(metrics) == 0 {
+				delete(r.stats, v.key.command)
+			}
+			continue
+		}
+		stat.accumulate(-v.value)
+		for len(stat.mins) > 0 && stat.mins[0].frame == frame {
+			stat.mins = stat.mins[1:]
+		}
+		for len(stat.maxs) > 0 && stat.maxs[0].frame == frame {
+			stat.maxs = stat.maxs[1:]
+		}
+	}
+}
+
+// Add the value to the sum with the Neumaier compensated summation, keeping
+// the low-order bits lost by the sum in comp.
+func (s *rollingStat) accumulate(value float64) {
+	sum := s.sum + value
+	if math.Abs(s.sum) >= math.Abs(value) {
+		s.comp += (s.sum - sum) + value
+	} else {
+		s.comp += (value - sum) + s.sum
+	}
+	s.sum = sum
+}
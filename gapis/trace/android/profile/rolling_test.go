@@ -0,0 +1,89 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+// frameCounters builds the GPU counters of a frame holding a command whose GPU
+// time is gpuTime.
+func frameCounters(gpuTime float64, indices ...uint64) *service.ProfilingData_GpuCounters {
+	return &service.ProfilingData_GpuCounters{
+		Entries: []*service.ProfilingData_GpuCounters_Entry{
+			{
+				CommandIndex:  indices,
+				MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{gpuTimeMetricId: perf(gpuTime)},
+			},
+		},
+	}
+}
+
+func TestRollingCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	rolling, err := NewRollingCounters(3)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "empty").ThatMap(rolling.Get([]uint64{0})).IsEmpty()
+
+	// Push capacity + 2 frames, the two first ones holding outliers.
+	for _, gpuTime := range []float64{1000, 1, 20, 30, 10} {
+		rolling.Push(frameCounters(gpuTime, 0))
+	}
+	assert.For(ctx, "len").That(rolling.Len()).Equals(3)
+	assert.For(ctx, "rolling").That(rolling.Get([]uint64{0})[gpuTimeMetricId]).DeepEquals(
+		&service.ProfilingData_GpuCounters_Perf{Estimate: 20, Min: 10, Max: 30})
+
+	// A command missing from the recent frames is evicted with its frames.
+	rolling.Push(frameCounters(5, 1))
+	assert.For(ctx, "partial").That(rolling.Get([]uint64{0})[gpuTimeMetricId]).DeepEquals(
+		&service.ProfilingData_GpuCounters_Perf{Estimate: 20, Min: 10, Max: 30})
+	rolling.Push(frameCounters(5, 1))
+	rolling.Push(unavailableFrame(0))
+	assert.For(ctx, "evicted").ThatMap(rolling.Get([]uint64{0})).IsEmpty()
+	assert.For(ctx, "other").That(rolling.Get([]uint64{1})[gpuTimeMetricId]).DeepEquals(perf(5))
+}
+
+func TestRollingCountersCapacity(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, capacity := range []int{0, -1} {
+		_, err := NewRollingCounters(capacity)
+		assert.For(ctx, "capacity %v", capacity).ThatError(err).Failed()
+	}
+}
+
+func TestRollingCountersDrift(t *testing.T) {
+	ctx := log.Testing(t)
+	rolling, err := NewRollingCounters(3)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	// The rounding errors of the additions and evictions of values of
+	// different magnitudes add up over a long session.
+	value := func(i int) float64 { return float64(i%13)*0.37 + 1e6*float64(i%3) }
+	const frames = 100000
+	for i := 0; i < frames; i++ {
+		rolling.Push(frameCounters(value(i), 0))
+	}
+	mean := (value(frames-3) + value(frames-2) + value(frames-1)) / 3
+	assert.For(ctx, "mean").ThatFloat(rolling.Get([]uint64{0})[gpuTimeMetricId].Estimate).Equals(mean, 1e-9)
+}
+
+func unavailableFrame(indices ...uint64) *service.ProfilingData_GpuCounters {
+	counters := frameCounters(0, indices...)
+	counters.Entries[0].MetricToValue[gpuTimeMetricId] = unavailablePerf()
+	return counters
+}
@@ -0,0 +1,196 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/gapid/gapis/service"
+)
+
+// groupEntryJSON is the JSON form of the leaf entry of a GPU slice group.
+type groupEntryJSON struct {
+	GroupId      int32             `json:"group_id"`
+	CommandIndex []uint64          `json:"command_index"`
+	Metrics      []metricValueJSON `json:"metrics"`
+}
+
+// metricValueJSON is the JSON form of the performance value of a metric.
+type metricValueJSON struct {
+	MetricId int32   `json:"metric_id"`
+	Estimate float64 `json:"estimate"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+}
+
+// MarshalGroupEntries encodes the leaf entries of the GPU slice groups, keyed
+// by group id as returned with Options.IncludeGroupEntries, to JSON. The
+// groups and their metrics are sorted by id so that the encoding is stable.
+func MarshalGroupEntries(groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry) ([]byte, error) {
+	groups := make([]groupEntryJSON, 0, len(groupToEntry))
+	for groupId, entry := range groupToEntry {
+		metrics := make([]metricValueJSON, 0, len(entry.MetricToValue))
+		for metricId, perf := range entry.MetricToValue {
+			metrics = append(metrics, metricValueJSON{metricId, perf.Estimate, perf.Min, perf.Max})
+		}
+		sort.Slice(metrics, func(i, j int) bool { return metrics[i].MetricId < metrics[j].MetricId })
+		groups = append(groups, groupEntryJSON{groupId, entry.CommandIndex, metrics})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].GroupId < groups[j].GroupId })
+	return json.Marshal(groups)
+}
+
+// UnmarshalGroupEntries decodes the leaf entries of the GPU slice groups
+// encoded by MarshalGroupEntries.
+func UnmarshalGroupEntries(data []byte) (map[int32]*service.ProfilingData_GpuCounters_Entry, error) {
+	groups := []groupEntryJSON{}
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, err
+	}
+	groupToEntry := make(map[int32]*service.ProfilingData_GpuCounters_Entry, len(groups))
+	for _, group := range groups {
+		entry := &service.ProfilingData_GpuCounters_Entry{
+			CommandIndex:  group.CommandIndex,
+			MetricToValue: make(map[int32]*service.ProfilingData_GpuCounters_Perf, len(group.Metrics)),
+		}
+		for _, m := range group.Metrics {
+			entry.MetricToValue[m.MetricId] = &service.ProfilingData_GpuCounters_Perf{
+				Estimate: m.Estimate,
+				Min:      m.Min,
+				Max:      m.Max,
+			}
+		}
+		groupToEntry[group.GroupId] = entry
+	}
+	return groupToEntry, nil
+}
+
+// MergeGroupEntries derives the command entries from the leaf entries of the
+// GPU slice groups, as ComputeCounters does after the attribution. counters
+// are the counters the leaf entries were computed from, whose metrics are the
+// ones of MetricCatalog.
+// If options is nil then the default computation is performed.
+func MergeGroupEntries(ctx context.Context, counters []*service.ProfilingData_Counter, groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry, options *Options) []*service.ProfilingData_GpuCounters_Entry {
+	if options == nil {
+		options = &Options{}
+	}
+	counters = catalogCounters(counters, options)
+	ids := newMetricIds(len(counters), options)
+	metrics := metricCatalog(counters, ids, options)
+	if !options.StableMetricIds {
+		return mergeLeafEntries(ctx, metrics, ids, groupToEntry, options)
+	}
+	// The leaf entries are merged on their positional ids.
+	stable := stableMetricIds(metrics, counters, options)
+	positional := make(map[int32]int32, len(stable))
+	for id, stableId := range stable {
+		positional[stableId] = id
+	}
+	leaves := make(map[int32]*service.ProfilingData_GpuCounters_Entry, len(groupToEntry))
+	for groupId, entry := range groupToEntry {
+		leaves[groupId] = proto.Clone(entry).(*service.ProfilingData_GpuCounters_Entry)
+		remapEntry(leaves[groupId], positional)
+	}
+	entries := mergeLeafEntries(ctx, metrics, ids, leaves, options)
+	for _, entry := range entries {
+		remapEntry(entry, stable)
+	}
+	return entries
+}
+
+// Quantize rounds the value to the given number of significant digits, so
+// that the values differing only in their low-order bits, such as across
+// platforms, compare and encode identically.
+func Quantize(v float64, digits int) float64 {
+	q, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', digits, 64), 64)
+	return q
+}
+
+// QuantizePerf returns a copy of the performance value with its estimate, min,
+// max and standard deviation quantized, see Quantize. The Min <= Estimate <=
+// Max ordering is preserved, and so are the unavailable values.
+func QuantizePerf(perf *service.ProfilingData_GpuCounters_Perf, digits int) *service.ProfilingData_GpuCounters_Perf {
+	quantized := proto.Clone(perf).(*service.ProfilingData_GpuCounters_Perf)
+	quantizePerf(quantized, digits)
+	return quantized
+}
+
+// Quantize the performance value in place, see QuantizePerf.
+func quantizePerf(perf *service.ProfilingData_GpuCounters_Perf, digits int) {
+	estimate := Quantize(perf.Estimate, digits)
+	min, max := Quantize(perf.Min, digits), Quantize(perf.Max, digits)
+	if perf.Min <= perf.Estimate && min > estimate {
+		min = estimate
+	}
+	if perf.Max >= perf.Estimate && max < estimate {
+		max = estimate
+	}
+	perf.Estimate, perf.Min, perf.Max = estimate, min, max
+	perf.StdDev = Quantize(perf.StdDev, digits)
+}
+
+// FormatPerf formats the performance value, quantized to the given number of
+// significant digits, as "estimate [min, max]".
+func FormatPerf(perf *service.ProfilingData_GpuCounters_Perf, digits int) string {
+	q := QuantizePerf(perf, digits)
+	format := func(v float64) string { return strconv.FormatFloat(v, 'g', digits, 64) }
+	return fmt.Sprintf("%s [%s, %s]", format(q.Estimate), format(q.Min), format(q.Max))
+}
+
+// QuantizeEntry returns a copy of the entry whose values, and the ones of its
+// nested entries, are quantized to the given number of significant digits,
+// see QuantizePerf.
+func QuantizeEntry(entry *service.ProfilingData_GpuCounters_Entry, digits int) *service.ProfilingData_GpuCounters_Entry {
+	quantized := proto.Clone(entry).(*service.ProfilingData_GpuCounters_Entry)
+	quantizeEntry(quantized, digits)
+	return quantized
+}
+
+// Quantize the entry, and its nested entries, in place, see QuantizeEntry.
+func quantizeEntry(entry *service.ProfilingData_GpuCounters_Entry, digits int) {
+	for _, perf := range entry.MetricToValue {
+		quantizePerf(perf, digits)
+	}
+	for _, values := range []map[int32]float64{entry.MetricToNormalizedValue, entry.MetricToConfidence, entry.MetricToCoverage} {
+		for id, v := range values {
+			values[id] = Quantize(v, digits)
+		}
+	}
+	for _, e := range entry.TrackToEntry {
+		quantizeEntry(e, digits)
+	}
+	for _, e := range entry.StageToEntry {
+		quantizeEntry(e, digits)
+	}
+	for _, e := range entry.GpuToEntry {
+		quantizeEntry(e, digits)
+	}
+}
+
+// MarshalQuantizedGroupEntries encodes the leaf entries of the GPU slice
+// groups like MarshalGroupEntries, with their values quantized to the given
+// number of significant digits, for an encoding stable across platforms.
+func MarshalQuantizedGroupEntries(groupToEntry map[int32]*service.ProfilingData_GpuCounters_Entry, digits int) ([]byte, error) {
+	quantized := make(map[int32]*service.ProfilingData_GpuCounters_Entry, len(groupToEntry))
+	for groupId, entry := range groupToEntry {
+		quantized[groupId] = QuantizeEntry(entry, digits)
+	}
+	return MarshalGroupEntries(quantized)
+}
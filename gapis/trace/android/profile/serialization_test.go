@@ -0,0 +1,132 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestGroupEntriesRoundTrip(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	// Values that aren't exactly representable in decimal must survive too.
+	counters[0].Values = []float64{0, 0.1, 1.0 / 3, 2e-17, 12345.6789}
+	res, err := ComputeCounters(ctx, slices, counters, &Options{IncludeGroupEntries: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	data, err := MarshalGroupEntries(res.GroupToEntry)
+	assert.For(ctx, "marshal").ThatError(err).Succeeded()
+	again, err := MarshalGroupEntries(res.GroupToEntry)
+	assert.For(ctx, "marshal").ThatError(err).Succeeded()
+	assert.For(ctx, "stable").ThatString(string(again)).Equals(string(data))
+
+	groupToEntry, err := UnmarshalGroupEntries(data)
+	assert.For(ctx, "unmarshal").ThatError(err).Succeeded()
+	assert.For(ctx, "group entries").That(groupToEntry).DeepEquals(res.GroupToEntry)
+
+	// Merging the reloaded entries gives the same entries as the full run.
+	merged := &service.ProfilingData_GpuCounters{
+		Metrics: res.Metrics,
+		Entries: MergeGroupEntries(ctx, counters, groupToEntry, nil),
+	}
+	assertSameEntries(ctx, "entries", merged, res)
+
+	// The entries of stable metric ids are merged likewise.
+	options := &Options{
+		IncludeGroupEntries: true,
+		StableMetricIds:     true,
+		RatioMetrics:        []RatioMetric{{Name: "Busy Ratio", Numerator: "Busy", Denominator: "GPU Time"}},
+	}
+	stable, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	merged = &service.ProfilingData_GpuCounters{
+		Metrics: stable.Metrics,
+		Entries: MergeGroupEntries(ctx, counters, stable.GroupToEntry, options),
+	}
+	assertSameEntries(ctx, "stable entries", merged, stable)
+}
+
+func TestUnmarshalGroupEntriesInvalid(t *testing.T) {
+	ctx := log.Testing(t)
+	_, err := UnmarshalGroupEntries([]byte(`{"group_id": 0}`))
+	assert.For(ctx, "err").ThatError(err).Failed()
+}
+
+func TestQuantizePerf(t *testing.T) {
+	ctx := log.Testing(t)
+	// Values differing only in their low-order bits.
+	a := &service.ProfilingData_GpuCounters_Perf{Estimate: 1.0 / 3, Min: 0.1 + 0.2, Max: 12345.678901}
+	b := &service.ProfilingData_GpuCounters_Perf{Estimate: 0.3333333333333333 * (1 + 1e-15), Min: 0.3, Max: 12345.678901 * (1 - 1e-15)}
+	assert.For(ctx, "different").That(a).DeepNotEquals(b)
+	assert.For(ctx, "quantized").That(QuantizePerf(a, 9)).DeepEquals(QuantizePerf(b, 9))
+	assert.For(ctx, "format").ThatString(FormatPerf(a, 6)).Equals("0.333333 [0.3, 12345.7]")
+	assert.For(ctx, "stable format").ThatString(FormatPerf(b, 6)).Equals(FormatPerf(a, 6))
+	assert.For(ctx, "unavailable").That(QuantizePerf(unavailablePerf(), 3)).DeepEquals(unavailablePerf())
+
+	// The ordering survives rounding across a decade.
+	for _, p := range []*service.ProfilingData_GpuCounters_Perf{
+		{Estimate: 9.96, Min: 9.94, Max: 10.04},
+		{Estimate: 9.949, Min: 9.949, Max: 9.951},
+		{Estimate: -0.0996, Min: -0.101, Max: -0.0994},
+	} {
+		q := QuantizePerf(p, 2)
+		assert.For(ctx, "%v min", p).ThatFloat(q.Min).IsAtMost(q.Estimate)
+		assert.For(ctx, "%v max", p).ThatFloat(q.Max).IsAtLeast(q.Estimate)
+	}
+}
+
+func TestQuantizeEntry(t *testing.T) {
+	ctx := log.Testing(t)
+	partial := &service.ProfilingData_GpuCounters_Perf{Estimate: 0.1 + 0.2, Min: 0.1, Max: 0.5, Partial: true}
+	entry := &service.ProfilingData_GpuCounters_Entry{
+		CommandIndex:  []uint64{1},
+		MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{gpuTimeMetricId: partial},
+		GpuId:         1,
+		GappedMetrics: []int32{gpuTimeMetricId},
+		TrackToEntry: map[int32]*service.ProfilingData_GpuCounters_Entry{
+			2: {CommandIndex: []uint64{1}, MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{gpuTimeMetricId: perf(0.1 + 0.2)}},
+		},
+		StageToEntry: map[string]*service.ProfilingData_GpuCounters_Entry{
+			"fragment": {CommandIndex: []uint64{1}, MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{gpuTimeMetricId: perf(0.1 + 0.2)}},
+		},
+	}
+	q := QuantizeEntry(entry, 6)
+	assert.For(ctx, "partial").That(q.MetricToValue[gpuTimeMetricId].Partial).Equals(true)
+	assert.For(ctx, "estimate").That(q.MetricToValue[gpuTimeMetricId].Estimate).Equals(0.3)
+	assert.For(ctx, "gpu").That(q.GpuId).Equals(int32(1))
+	assert.For(ctx, "gapped").That(q.GappedMetrics).DeepEquals([]int32{gpuTimeMetricId})
+	assert.For(ctx, "track").That(q.TrackToEntry[2].MetricToValue[gpuTimeMetricId].Estimate).Equals(0.3)
+	assert.For(ctx, "stage").That(q.StageToEntry["fragment"].MetricToValue[gpuTimeMetricId].Estimate).Equals(0.3)
+	assert.For(ctx, "copy").That(entry.MetricToValue[gpuTimeMetricId].Estimate).Equals(0.1 + 0.2)
+}
+
+func TestMarshalQuantizedGroupEntries(t *testing.T) {
+	ctx := log.Testing(t)
+	entry := func(v float64) map[int32]*service.ProfilingData_GpuCounters_Entry {
+		return map[int32]*service.ProfilingData_GpuCounters_Entry{
+			0: {CommandIndex: []uint64{0}, MetricToValue: map[int32]*service.ProfilingData_GpuCounters_Perf{gpuTimeMetricId: perf(v)}},
+		}
+	}
+	a, err := MarshalQuantizedGroupEntries(entry(0.1+0.2), 12)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	b, err := MarshalQuantizedGroupEntries(entry(0.3), 12)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "stable").ThatString(string(a)).Equals(string(b))
+	assert.For(ctx, "golden").ThatString(string(a)).Equals(`[{"group_id":0,"command_index":[0],"metrics":[{"metric_id":0,"estimate":0.3,"min":0.3,"max":0.3}]}]`)
+}
@@ -0,0 +1,203 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/math/u64"
+	"github.com/google/gapid/gapis/service"
+)
+
+// StreamingCounters computes the leaf entries of the GPU slice groups of a
+// trace too long to be held whole, consuming its slices and counter samples
+// in time order. A group is closed, and its entry emitted, once the stream
+// advanced window past the end of its last slice. Only the slices and the
+// samples still overlapping the open groups are held. The emitted entries can
+// be merged into the command entries at any time, for early results, with
+// MergeGroupEntries and the declared counters, the metrics being the ones of
+// Metrics. The frame share of a group is relative to the slices held when it
+// is closed.
+type StreamingCounters struct {
+	groups    []*service.ProfilingData_GpuSlices_Group
+	tracks    []*service.ProfilingData_GpuSlices_Track
+	counters  []*service.ProfilingData_Counter // The declared counters, holding their buffered samples.
+	ids       map[counterIdentity]int          // Counter identity -> index in counters.
+	options   *Options
+	window    uint64
+	slices    []*service.ProfilingData_GpuSlices_Slice // The buffered slices.
+	starts    map[int32]uint64                         // Open group id -> earliest start of its slices.
+	ends      map[int32]uint64                         // Open group id -> latest end of its slices.
+	closed    map[int32]bool
+	watermark uint64
+}
+
+// NewStreamingCounters returns a StreamingCounters for the groups and tracks
+// of the slices and the declared counters, whose metadata give the metrics,
+// see Metrics. The samples of the declared counters, if any, are the first
+// samples of the stream. If options is nil then the default computation is
+// performed.
+func NewStreamingCounters(ctx context.Context, groups []*service.ProfilingData_GpuSlices_Group, tracks []*service.ProfilingData_GpuSlices_Track, counters []*service.ProfilingData_Counter, window uint64, options *Options) (*StreamingCounters, error) {
+	if options == nil {
+		options = &Options{}
+	}
+	if _, err := options.SliceFilter.matcher(&service.ProfilingData_GpuSlices{Groups: groups, Tracks: tracks}); err != nil {
+		return nil, log.Errf(ctx, err, "Invalid GPU slice filter")
+	}
+	if err := checkAggregations(ctx, counters, options); err != nil {
+		return nil, err
+	}
+	s := &StreamingCounters{
+		groups:  groups,
+		tracks:  tracks,
+		ids:     map[counterIdentity]int{},
+		options: options,
+		window:  window,
+		starts:  map[int32]uint64{},
+		ends:    map[int32]uint64{},
+		closed:  map[int32]bool{},
+	}
+	for _, counter := range counters {
+		id := identify(counter, options)
+		if _, ok := s.ids[id]; ok {
+			return nil, log.Errf(ctx, nil, "Counter %v declared twice", counter.Name)
+		}
+		s.ids[id] = len(s.counters)
+		s.counters = append(s.counters, withSamples(counter, nil, nil, nil))
+		s.AddSamples(ctx, counter)
+	}
+	return s, nil
+}
+
+// Metrics returns the metrics metadata of the emitted entries.
+func (s *StreamingCounters) Metrics() []*service.ProfilingData_GpuCounters_Metric {
+	return MetricCatalog(s.counters, s.options)
+}
+
+// AddSlices adds the next slices of the stream. The slices of the closed
+// groups are dropped.
+func (s *StreamingCounters) AddSlices(ctx context.Context, slices ...*service.ProfilingData_GpuSlices_Slice) {
+	dropped := 0
+	for _, slice := range slices {
+		if s.closed[slice.GroupId] {
+			dropped++
+			continue
+		}
+		s.slices = append(s.slices, slice)
+		if start, ok := s.starts[slice.GroupId]; !ok || slice.Ts < start {
+			s.starts[slice.GroupId] = slice.Ts
+		}
+		s.ends[slice.GroupId] = u64.Max(s.ends[slice.GroupId], slice.Ts+slice.Dur)
+	}
+	if dropped != 0 {
+		log.W(ctx, "%v slices of already closed groups dropped", dropped)
+	}
+}
+
+// AddSamples appends the samples of the counter to the ones of the declared
+// counter of the same identity, see counterIdentity. The samples of the
+// undeclared or malformed counters are dropped.
+func (s *StreamingCounters) AddSamples(ctx context.Context, counter *service.ProfilingData_Counter) {
+	i, ok := s.ids[identify(counter, s.options)]
+	if !ok {
+		log.W(ctx, "Samples of the undeclared counter %v dropped", counter.Name)
+		return
+	}
+	if len(counter.Timestamps) != len(counter.Values) || (len(counter.InvalidSamples) != 0 && len(counter.InvalidSamples) != len(counter.Values)) {
+		log.W(ctx, "Counter %v has %v timestamps, %v values and %v validity flags, its samples are dropped", counter.Name, len(counter.Timestamps), len(counter.Values), len(counter.InvalidSamples))
+		return
+	}
+	buffered := s.counters[i]
+	buffered.Timestamps = append(buffered.Timestamps, counter.Timestamps...)
+	buffered.Values = append(buffered.Values, counter.Values...)
+	if len(counter.InvalidSamples) != 0 {
+		buffered.InvalidSamples = append(buffered.InvalidSamples, counter.InvalidSamples...)
+	} else {
+		buffered.InvalidSamples = append(buffered.InvalidSamples, make([]bool, len(counter.Values))...)
+	}
+}
+
+// Advance declares that all the slices starting, and the samples ending,
+// before ts were added, and returns the entries of the groups it closes,
+// keyed by group id.
+func (s *StreamingCounters) Advance(ctx context.Context, ts uint64) map[int32]*service.ProfilingData_GpuCounters_Entry {
+	s.watermark = u64.Max(s.watermark, ts)
+	closing := map[int32]bool{}
+	for groupId, end := range s.ends {
+		if end+s.window <= s.watermark {
+			closing[groupId] = true
+		}
+	}
+	return s.close(ctx, closing)
+}
+
+// Flush closes all the open groups at the end of the stream and returns their
+// entries, keyed by group id.
+func (s *StreamingCounters) Flush(ctx context.Context) map[int32]*service.ProfilingData_GpuCounters_Entry {
+	closing := make(map[int32]bool, len(s.ends))
+	for groupId := range s.ends {
+		closing[groupId] = true
+	}
+	return s.close(ctx, closing)
+}
+
+// Compute the entries of the closing groups from the buffered slices and
+// samples, then drop the ones no open group overlaps.
+func (s *StreamingCounters) close(ctx context.Context, closing map[int32]bool) map[int32]*service.ProfilingData_GpuCounters_Entry {
+	var entries map[int32]*service.ProfilingData_GpuCounters_Entry
+	if len(closing) != 0 {
+		slices := &service.ProfilingData_GpuSlices{
+			Slices: append([]*service.ProfilingData_GpuSlices_Slice{}, s.slices...),
+			Tracks: s.tracks,
+			Groups: s.groups,
+		}
+		include := func(group *service.ProfilingData_GpuSlices_Group) bool { return closing[group.Id] }
+		_, entries, _ = computeLeafEntries(ctx, slices, s.counters, include, s.options)
+		for groupId := range closing {
+			s.closed[groupId] = true
+			delete(s.starts, groupId)
+			delete(s.ends, groupId)
+		}
+	}
+	s.prune()
+	return entries
+}
+
+// Drop the buffered slices and samples ending before the earliest start of
+// the open groups, or before the watermark if there is none.
+func (s *StreamingCounters) prune() {
+	horizon := s.watermark
+	for _, start := range s.starts {
+		horizon = u64.Min(horizon, start)
+	}
+	kept := s.slices[:0]
+	for _, slice := range s.slices {
+		if _, open := s.ends[slice.GroupId]; open || slice.Ts+slice.Dur > horizon {
+			kept = append(kept, slice)
+		}
+	}
+	s.slices = kept
+	for _, counter := range s.counters {
+		// The first sample ending after the horizon is kept with its start.
+		k := sort.Search(len(counter.Timestamps), func(i int) bool { return counter.Timestamps[i] > horizon })
+		if k > 1 {
+			counter.Timestamps = append([]uint64{}, counter.Timestamps[k-1:]...)
+			counter.Values = append([]float64{}, counter.Values[k-1:]...)
+			counter.InvalidSamples = append([]bool{}, counter.InvalidSamples[k-1:]...)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestStreamingCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 0, 2)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{slice(0, 5, 10), slice(1, 25, 10), slice(2, 45, 10)},
+	}
+	busy := counter("Busy", []uint64{0, 10, 20, 30, 40, 50, 60}, []float64{0, 2, 4, 6, 8, 10, 12})
+	res, err := ComputeCounters(ctx, slices, []*service.ProfilingData_Counter{busy}, &Options{IncludeGroupEntries: true})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	s, err := NewStreamingCounters(ctx, slices.Groups, nil, []*service.ProfilingData_Counter{
+		counter("Busy", []uint64{0, 10, 20}, []float64{0, 2, 4}),
+	}, 0, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	emitted := map[int32]*service.ProfilingData_GpuCounters_Entry{}
+	emit := func(name string, entries map[int32]*service.ProfilingData_GpuCounters_Entry, expected ...int32) {
+		assert.For(ctx, "%v count", name).ThatMap(entries).IsLength(len(expected))
+		for _, groupId := range expected {
+			entry := entries[groupId]
+			for _, id := range []int32{gpuTimeMetricId, gpuWallTimeMetricId, counterMetricIdOffset} {
+				assert.For(ctx, "%v group %v metric %v", name, groupId, id).That(entry.MetricToValue[id]).DeepEquals(res.GroupToEntry[groupId].MetricToValue[id])
+			}
+			emitted[groupId] = entry
+		}
+	}
+
+	s.AddSlices(ctx, slices.Slices[0])
+	emit("open", s.Advance(ctx, 10))
+	emit("first", s.Advance(ctx, 20), 0)
+	s.AddSlices(ctx, slices.Slices[1])
+	s.AddSamples(ctx, counter("Busy", []uint64{30, 40}, []float64{6, 8}))
+	emit("second", s.Advance(ctx, 40), 1)
+	// Nothing overlaps the closed groups anymore.
+	assert.For(ctx, "pruned slices").ThatSlice(s.slices).IsEmpty()
+	assert.For(ctx, "pruned samples").That(s.counters[0].Timestamps).DeepEquals([]uint64{40})
+
+	// The late slices of a closed group are dropped.
+	s.AddSlices(ctx, slice(0, 40, 5), slices.Slices[2])
+	s.AddSamples(ctx, counter("Busy", []uint64{50, 60}, []float64{10, 12}))
+	emit("flush", s.Flush(ctx), 2)
+
+	merged := MergeGroupEntries(ctx, s.counters, emitted, nil)
+	for _, indices := range [][]uint64{{0}, {0, 1}} {
+		for _, entry := range merged {
+			if encodeIndex(entry.CommandIndex) == encodeIndex(indices) {
+				assert.For(ctx, "merged %v", indices).That(entry.MetricToValue[counterMetricIdOffset]).DeepEquals(
+					findEntry(res, indices...).MetricToValue[counterMetricIdOffset])
+			}
+		}
+	}
+	assert.For(ctx, "metrics").That(s.Metrics()).DeepEquals(res.Metrics)
+
+	_, err = NewStreamingCounters(ctx, slices.Groups, nil, []*service.ProfilingData_Counter{busy, busy}, 0, nil)
+	assert.For(ctx, "declared twice").ThatError(err).Failed()
+}
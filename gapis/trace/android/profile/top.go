@@ -0,0 +1,84 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+// TopCommands returns the count most expensive commands of the result by the
+// metric of the given id, by decreasing value of the metric, the commands
+// tied keeping their order. Only the innermost commands, those without the
+// entry of a subcommand on the same GPU, are ranked, their parents adding them
+// up, and the commands whose value is unavailable are left out. The entries of
+// a command on several GPUs are ranked separately. The share of each command
+// is of the GPU time of all the top level commands.
+func TopCommands(ctx context.Context, counters *service.ProfilingData_GpuCounters, metricId int32, count int) (*service.TopCommands, error) {
+	found := false
+	for _, metric := range counters.Metrics {
+		found = found || metric.Id == metricId
+	}
+	if !found {
+		return nil, log.Errf(ctx, nil, "No GPU counters metric of id %v", metricId)
+	}
+
+	type key struct {
+		index string
+		gpu   int32
+	}
+	parents := map[key]bool{}
+	frameTime := 0.0
+	for _, entry := range counters.Entries {
+		if n := len(entry.CommandIndex); n > 1 {
+			parents[key{encodeIndex(entry.CommandIndex[:n-1]), entry.GpuId}] = true
+		}
+		if perf, ok := entry.MetricToValue[gpuTimeMetricId]; ok && len(entry.CommandIndex) == 1 && !isUnavailable(perf) {
+			frameTime += perf.Estimate
+		}
+	}
+	ranked := []*service.ProfilingData_GpuCounters_Entry{}
+	for _, entry := range counters.Entries {
+		if perf, ok := entry.MetricToValue[metricId]; ok && !isUnavailable(perf) && !parents[key{encodeIndex(entry.CommandIndex), entry.GpuId}] {
+			ranked = append(ranked, entry)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i].MetricToValue[metricId].Estimate, ranked[j].MetricToValue[metricId].Estimate
+		if a != b {
+			return a > b
+		}
+		if c := compareIndices(ranked[i].CommandIndex, ranked[j].CommandIndex); c != 0 {
+			return c < 0
+		}
+		return ranked[i].GpuId < ranked[j].GpuId
+	})
+	if count >= 0 && count < len(ranked) {
+		ranked = ranked[:count]
+	}
+
+	res := &service.TopCommands{Commands: make([]*service.TopCommand, len(ranked))}
+	for i, entry := range ranked {
+		share := 0.0
+		if perf, ok := entry.MetricToValue[gpuTimeMetricId]; ok && frameTime > 0 && !isUnavailable(perf) {
+			share = perf.Estimate / frameTime
+		}
+		res.Commands[i] = &service.TopCommand{Entry: entry, FrameShare: share}
+	}
+	return res, nil
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestTopCommands(t *testing.T) {
+	ctx := log.Testing(t)
+	slices := &service.ProfilingData_GpuSlices{
+		Groups: []*service.ProfilingData_GpuSlices_Group{group(0, 0, 0), group(1, 0, 1), group(2, 1), group(3, 2)},
+		Slices: []*service.ProfilingData_GpuSlices_Slice{
+			slice(0, 0, 10),
+			slice(1, 20, 30),
+			slice(2, 60, 20),
+			slice(3, 90, 20),
+		},
+	}
+	res, err := ComputeCounters(ctx, slices, nil, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	top, err := TopCommands(ctx, res, gpuTimeMetricId, 3)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	indices, shares := [][]uint64{}, []float64{}
+	for _, command := range top.Commands {
+		indices = append(indices, command.Entry.CommandIndex)
+		shares = append(shares, command.FrameShare)
+	}
+	// The parent [0] isn't ranked, the tied [1] and [2] keep their order.
+	assert.For(ctx, "indices").That(indices).DeepEquals([][]uint64{{0, 1}, {1}, {2}})
+	assert.For(ctx, "shares").That(shares).DeepEquals([]float64{0.375, 0.25, 0.25})
+
+	all, err := TopCommands(ctx, res, gpuTimeMetricId, 10)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "all").ThatSlice(all.Commands).IsLength(4)
+
+	_, err = TopCommands(ctx, res, 1000, 3)
+	assert.For(ctx, "unknown metric").ThatError(err).Failed()
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"github.com/google/gapid/gapis/service"
+)
+
+// The minimum number of valid samples of a counter detected as a running
+// total, see isRunningTotal.
+const minRunningTotalSamples = 3
+
+// Return whether the counter reports a running total, such as the bytes
+// written since boot: either named by Options.RunningTotalCounters or, with
+// Options.DetectRunningTotals, detected by isRunningTotal.
+func runningTotal(counter *service.ProfilingData_Counter, options *Options) bool {
+	for _, name := range options.RunningTotalCounters {
+		if name == counter.Name {
+			return true
+		}
+	}
+	return options.DetectRunningTotals && isRunningTotal(counter)
+}
+
+// Return whether the values of the valid samples of the counter, at least
+// minRunningTotalSamples of them, never decrease and end higher than they
+// start, as the running totals do, the rates and the gauges going up and
+// down.
+func isRunningTotal(counter *service.ProfilingData_Counter) bool {
+	if len(counter.Timestamps) != len(counter.Values) {
+		return false
+	}
+	count, first, last := 0, 0.0, 0.0
+	for i, v := range counter.Values {
+		if !validSample(counter, i) {
+			continue
+		}
+		if count != 0 && v < last {
+			return false
+		}
+		if count == 0 {
+			first = v
+		}
+		count, last = count+1, v
+	}
+	return count >= minRunningTotalSamples && last > first
+}
+
+// Return a copy of the running total counter whose samples are the
+// increments of the total over their interval, the first sample only marking
+// the start of the next one. The samples following an invalid sample, whose
+// increment is unknown, and the ones where the total decreases, as it was
+// reset or wrapped, are marked invalid. The timestamps are shared with the
+// original counter, which is returned as is if it is malformed.
+func totalIncrements(counter *service.ProfilingData_Counter) *service.ProfilingData_Counter {
+	if len(counter.Timestamps) != len(counter.Values) || len(counter.Values) == 0 {
+		return counter
+	}
+	values := make([]float64, len(counter.Values))
+	invalid := make([]bool, len(counter.Values))
+	invalid[0] = !validSample(counter, 0)
+	for i := 1; i < len(values); i++ {
+		delta := counter.Values[i] - counter.Values[i-1]
+		if !validSample(counter, i) || !validSample(counter, i-1) || delta < 0 {
+			invalid[i] = true
+			continue
+		}
+		values[i] = delta
+	}
+	return withSamples(counter, counter.Timestamps, values, invalid)
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestIsRunningTotal(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		name     string
+		counter  *service.ProfilingData_Counter
+		expected bool
+	}{
+		{"total", counter("Total", []uint64{0, 10, 20, 30}, []float64{100, 100, 150, 300}), true},
+		{"rate", counter("Rate", []uint64{0, 10, 20, 30}, []float64{1, 2, 1, 2}), false},
+		{"constant", counter("Constant", []uint64{0, 10, 20}, []float64{5, 5, 5}), false},
+		{"short", counter("Short", []uint64{0, 10}, []float64{1, 2}), false},
+	} {
+		assert.For(ctx, test.name).That(isRunningTotal(test.counter)).Equals(test.expected)
+	}
+	invalid := counter("Invalid", []uint64{0, 10, 20, 30}, []float64{1, 0, 2, 3})
+	invalid.InvalidSamples = []bool{false, true, false, false}
+	assert.For(ctx, "invalid ignored").That(isRunningTotal(invalid)).Equals(true)
+}
+
+func TestTotalIncrements(t *testing.T) {
+	ctx := log.Testing(t)
+	c := counter("Total", []uint64{0, 10, 20, 30, 40, 50}, []float64{100, 110, 130, 5, 15, 25})
+	c.InvalidSamples = []bool{false, false, false, false, true, false}
+	res := totalIncrements(c)
+	assert.For(ctx, "values").That(res.Values).DeepEquals([]float64{0, 10, 20, 0, 0, 0})
+	// The reset and the samples around the invalid one are invalid.
+	assert.For(ctx, "invalid").That(res.InvalidSamples).DeepEquals([]bool{false, false, false, true, true, true})
+	assert.For(ctx, "timestamps").That(res.Timestamps).DeepEquals(c.Timestamps)
+}
+
+func TestRunningTotalCounters(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, _ := twoCommandsFixture()
+	// The increments of the running total are the samples of the summed counter.
+	increments := counter("Bytes", []uint64{0, 10, 20, 30, 40}, []float64{0, 2, 4, 6, 8})
+	total := counter("Bytes", []uint64{0, 10, 20, 30, 40}, []float64{1000, 1002, 1006, 1012, 1020})
+	summed, err := ComputeCounters(ctx, slices, []*service.ProfilingData_Counter{increments}, &Options{SummedCounters: []string{"Bytes"}})
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	for name, options := range map[string]*Options{
+		"named":    {RunningTotalCounters: []string{"Bytes"}},
+		"detected": {DetectRunningTotals: true},
+	} {
+		res, err := ComputeCounters(ctx, slices, []*service.ProfilingData_Counter{total}, options)
+		assert.For(ctx, "err").ThatError(err).Succeeded()
+		assert.For(ctx, "%v op", name).That(res.Metrics[counterMetricIdOffset].Op).Equals(service.ProfilingData_GpuCounters_Metric_Summation)
+		for _, indices := range [][]uint64{{0, 0}, {0, 1}, {0}} {
+			assert.For(ctx, "%v %v", name, indices).ThatFloat(findEntry(res, indices...).MetricToValue[counterMetricIdOffset].Estimate).Equals(
+				findEntry(summed, indices...).MetricToValue[counterMetricIdOffset].Estimate, 1e-9)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+// unitConversion converts a unit to its canonical unit, the values in the
+// unit being multiplied by the factor.
+type unitConversion struct {
+	unit   device.GpuCounterDescriptor_MeasureUnit
+	factor float64
+}
+
+// The canonical units of the numerators. The prefixes are decimal, a kilobyte
+// being 1000 bytes. The durations are in nanoseconds, like the time metrics.
+var canonicalUnits = map[device.GpuCounterDescriptor_MeasureUnit]unitConversion{
+	device.GpuCounterDescriptor_KILOBIT:     {device.GpuCounterDescriptor_BIT, 1e3},
+	device.GpuCounterDescriptor_MEGABIT:     {device.GpuCounterDescriptor_BIT, 1e6},
+	device.GpuCounterDescriptor_GIGABIT:     {device.GpuCounterDescriptor_BIT, 1e9},
+	device.GpuCounterDescriptor_TERABIT:     {device.GpuCounterDescriptor_BIT, 1e12},
+	device.GpuCounterDescriptor_PETABIT:     {device.GpuCounterDescriptor_BIT, 1e15},
+	device.GpuCounterDescriptor_KILOBYTE:    {device.GpuCounterDescriptor_BYTE, 1e3},
+	device.GpuCounterDescriptor_MEGABYTE:    {device.GpuCounterDescriptor_BYTE, 1e6},
+	device.GpuCounterDescriptor_GIGABYTE:    {device.GpuCounterDescriptor_BYTE, 1e9},
+	device.GpuCounterDescriptor_TERABYTE:    {device.GpuCounterDescriptor_BYTE, 1e12},
+	device.GpuCounterDescriptor_PETABYTE:    {device.GpuCounterDescriptor_BYTE, 1e15},
+	device.GpuCounterDescriptor_KILOHERTZ:   {device.GpuCounterDescriptor_HERTZ, 1e3},
+	device.GpuCounterDescriptor_MEGAHERTZ:   {device.GpuCounterDescriptor_HERTZ, 1e6},
+	device.GpuCounterDescriptor_GIGAHERTZ:   {device.GpuCounterDescriptor_HERTZ, 1e9},
+	device.GpuCounterDescriptor_TERAHERTZ:   {device.GpuCounterDescriptor_HERTZ, 1e12},
+	device.GpuCounterDescriptor_PETAHERTZ:   {device.GpuCounterDescriptor_HERTZ, 1e15},
+	device.GpuCounterDescriptor_MICROSECOND: {device.GpuCounterDescriptor_NANOSECOND, 1e3},
+	device.GpuCounterDescriptor_MILLISECOND: {device.GpuCounterDescriptor_NANOSECOND, 1e6},
+	device.GpuCounterDescriptor_SECOND:      {device.GpuCounterDescriptor_NANOSECOND, 1e9},
+	device.GpuCounterDescriptor_MINUTE:      {device.GpuCounterDescriptor_NANOSECOND, 60e9},
+	device.GpuCounterDescriptor_HOUR:        {device.GpuCounterDescriptor_NANOSECOND, 3600e9},
+	device.GpuCounterDescriptor_MILLIWATT:   {device.GpuCounterDescriptor_WATT, 1e-3},
+}
+
+// The canonical units of the denominators, where the durations are in
+// seconds so that the rates stay per second.
+var canonicalDenominatorUnits = map[device.GpuCounterDescriptor_MeasureUnit]unitConversion{
+	device.GpuCounterDescriptor_NANOSECOND:  {device.GpuCounterDescriptor_SECOND, 1e-9},
+	device.GpuCounterDescriptor_MICROSECOND: {device.GpuCounterDescriptor_SECOND, 1e-6},
+	device.GpuCounterDescriptor_MILLISECOND: {device.GpuCounterDescriptor_SECOND, 1e-3},
+	device.GpuCounterDescriptor_SECOND:      {device.GpuCounterDescriptor_SECOND, 1},
+	device.GpuCounterDescriptor_MINUTE:      {device.GpuCounterDescriptor_SECOND, 60},
+	device.GpuCounterDescriptor_HOUR:        {device.GpuCounterDescriptor_SECOND, 3600},
+}
+
+// Return the conversion of the unit to its canonical unit, among the
+// conversions, the unit being kept if it has none.
+func canonicalUnit(unit device.GpuCounterDescriptor_MeasureUnit, conversions map[device.GpuCounterDescriptor_MeasureUnit]unitConversion) unitConversion {
+	if conversion, ok := conversions[unit]; ok {
+		return conversion
+	}
+	if conversion, ok := canonicalUnits[unit]; ok {
+		return conversion
+	}
+	return unitConversion{unit, 1}
+}
+
+// Parse a counter unit, formatted as the colon separated numerator units,
+// optionally followed by a slash and the colon separated denominator units,
+// see numeratorUnits. It fails if the unit is empty or malformed.
+func parseUnit(unit string) (numerators, denominators []device.GpuCounterDescriptor_MeasureUnit, ok bool) {
+	parse := func(s string) ([]device.GpuCounterDescriptor_MeasureUnit, bool) {
+		units := []device.GpuCounterDescriptor_MeasureUnit{}
+		for _, u := range strings.Split(s, ":") {
+			v, err := strconv.Atoi(strings.TrimSpace(u))
+			if err != nil {
+				return nil, false
+			}
+			units = append(units, device.GpuCounterDescriptor_MeasureUnit(v))
+		}
+		return units, true
+	}
+	if strings.TrimSpace(unit) == "" {
+		return nil, nil, false
+	}
+	parts := strings.Split(unit, "/")
+	if len(parts) > 2 {
+		return nil, nil, false
+	}
+	if numerators, ok = parse(parts[0]); !ok {
+		return nil, nil, false
+	}
+	if len(parts) == 2 {
+		if denominators, ok = parse(parts[1]); !ok {
+			return nil, nil, false
+		}
+	}
+	return numerators, denominators, true
+}
+
+// Format the units like the counter units, see parseUnit.
+func formatUnit(numerators, denominators []device.GpuCounterDescriptor_MeasureUnit) string {
+	format := func(units []device.GpuCounterDescriptor_MeasureUnit) string {
+		s := make([]string, len(units))
+		for i, u := range units {
+			s[i] = strconv.Itoa(int(u))
+		}
+		return strings.Join(s, ":")
+	}
+	if len(denominators) == 0 {
+		return format(numerators)
+	}
+	return format(numerators) + "/" + format(denominators)
+}
+
+// Return the units of the counter, the ones of its descriptor spec or else
+// its parsed unit, and whether they are known.
+func counterUnits(counter *service.ProfilingData_Counter, options *Options) (numerators, denominators []device.GpuCounterDescriptor_MeasureUnit, ok bool) {
+	if spec := counterSpec(counter, options); spec != nil && len(spec.NumeratorUnits)+len(spec.DenominatorUnits) != 0 {
+		return spec.NumeratorUnits, spec.DenominatorUnits, true
+	}
+	return parseUnit(counter.Unit)
+}
+
+// Return the canonical units of the counter, and the factor converting its
+// values to them, see Options.NormalizeUnits. It fails if the units of the
+// counter are unknown.
+func normalizedUnits(counter *service.ProfilingData_Counter, options *Options) (numerators, denominators []device.GpuCounterDescriptor_MeasureUnit, factor float64, ok bool) {
+	num, den, ok := counterUnits(counter, options)
+	if !ok {
+		return nil, nil, 1, false
+	}
+	factor = 1
+	for _, unit := range num {
+		conversion := canonicalUnit(unit, nil)
+		numerators = append(numerators, conversion.unit)
+		factor *= conversion.factor
+	}
+	for _, unit := range den {
+		conversion := canonicalUnit(unit, canonicalDenominatorUnits)
+		denominators = append(denominators, conversion.unit)
+		factor /= conversion.factor
+	}
+	return numerators, denominators, factor, true
+}
+
+// Return the scale applied to the counter, the one of the options' scales or,
+// with Options.NormalizeUnits, the one converting it to its canonical units,
+// and whether the counter is scaled at all.
+func counterScale(counter *service.ProfilingData_Counter, options *Options) (CounterScale, bool) {
+	if scale, ok := options.CounterScales[counter.Name]; ok {
+		return scale, true
+	}
+	if !options.NormalizeUnits {
+		return CounterScale{}, false
+	}
+	numerators, denominators, factor, ok := normalizedUnits(counter, options)
+	if !ok {
+		return CounterScale{}, false
+	}
+	unit := formatUnit(numerators, denominators)
+	if factor == 1 && unit == counter.Unit {
+		return CounterScale{}, false
+	}
+	return CounterScale{Factor: factor, Unit: unit}, true
+}
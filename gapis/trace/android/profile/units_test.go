@@ -0,0 +1,97 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/core/os/device"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestParseUnit(t *testing.T) {
+	ctx := log.Testing(t)
+	for _, test := range []struct {
+		unit         string
+		numerators   []device.GpuCounterDescriptor_MeasureUnit
+		denominators []device.GpuCounterDescriptor_MeasureUnit
+		ok           bool
+	}{
+		{"7", []device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_BYTE}, nil, true},
+		{"8/20", []device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_KILOBYTE}, []device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_MICROSECOND}, true},
+		{"25:26", []device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_VERTEX, device.GpuCounterDescriptor_PIXEL}, nil, true},
+		{"", nil, nil, false},
+		{"bytes", nil, nil, false},
+		{"7/22/22", nil, nil, false},
+	} {
+		numerators, denominators, ok := parseUnit(test.unit)
+		assert.For(ctx, "ok %v", test.unit).That(ok).Equals(test.ok)
+		assert.For(ctx, "numerators %v", test.unit).That(numerators).DeepEquals(test.numerators)
+		assert.For(ctx, "denominators %v", test.unit).That(denominators).DeepEquals(test.denominators)
+		if ok {
+			assert.For(ctx, "format %v", test.unit).That(formatUnit(numerators, denominators)).Equals(test.unit)
+		}
+	}
+}
+
+func TestNormalizeUnits(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	kilobytes := counter("Written", counters[0].Timestamps, counters[0].Values)
+	kilobytes.Unit = formatUnit([]device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_KILOBYTE}, nil)
+	rate := counter("Rate", counters[0].Timestamps, counters[0].Values)
+	rate.Unit = "garbage" // The spec's units take precedence.
+	counters = []*service.ProfilingData_Counter{counters[0], kilobytes, rate}
+	options := &Options{
+		NormalizeUnits: true,
+		CounterDescriptor: &device.GpuCounterDescriptor{Specs: []*device.GpuCounterDescriptor_GpuCounterSpec{{
+			Name:             "Rate",
+			NumeratorUnits:   []device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_MEGABYTE},
+			DenominatorUnits: []device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_MILLISECOND},
+			PeakValue:        &device.GpuCounterDescriptor_GpuCounterSpec_IntPeakValue{IntPeakValue: 10},
+		}}},
+	}
+	res, err := ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	plain, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+
+	busyId, writtenId, rateId := counterMetricIdOffset, counterMetricIdOffset+1, counterMetricIdOffset+2
+	written := res.Metrics[writtenId]
+	assert.For(ctx, "bytes unit").That(written.Unit).Equals(formatUnit([]device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_BYTE}, nil))
+	assert.For(ctx, "bytes units").That(written.NumeratorUnits).DeepEquals([]device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_BYTE})
+	bytesPerSecond := res.Metrics[rateId]
+	assert.For(ctx, "rate unit").That(bytesPerSecond.Unit).Equals(formatUnit(
+		[]device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_BYTE},
+		[]device.GpuCounterDescriptor_MeasureUnit{device.GpuCounterDescriptor_SECOND}))
+	assert.For(ctx, "rate range").ThatFloat(bytesPerSecond.MaxValue).Equals(1e10, 1e-9)
+	assert.For(ctx, "unknown unit").That(res.Metrics[busyId].Unit).Equals("")
+	assert.For(ctx, "catalog").That(MetricCatalog(counters, options)).DeepEquals(res.Metrics)
+
+	for _, indices := range [][]uint64{{0, 0}, {0, 1}, {0}} {
+		entry, raw := findEntry(res, indices...), findEntry(plain, indices...)
+		assert.For(ctx, "busy %v", indices).That(entry.MetricToValue[busyId]).DeepEquals(raw.MetricToValue[busyId])
+		assert.For(ctx, "bytes %v", indices).ThatFloat(entry.MetricToValue[writtenId].Estimate).Equals(raw.MetricToValue[writtenId].Estimate*1e3, 1e-6)
+		assert.For(ctx, "rate %v", indices).ThatFloat(entry.MetricToValue[rateId].Estimate).Equals(raw.MetricToValue[rateId].Estimate*1e9, 1e-3)
+	}
+
+	// The explicit scales take precedence.
+	options.CounterScales = map[string]CounterScale{"Written": {Factor: 1}}
+	res, err = ComputeCounters(ctx, slices, counters, options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "explicit").ThatFloat(findEntry(res, 0).MetricToValue[writtenId].Estimate).Equals(findEntry(plain, 0).MetricToValue[writtenId].Estimate, 1e-9)
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"sort"
+
+	"github.com/google/gapid/gapis/service"
+)
+
+// DepthViolation is a slice whose depth is inconsistent with the slices of its
+// group, see ValidateSliceDepths.
+type DepthViolation struct {
+	Slice  *service.ProfilingData_GpuSlices_Slice
+	Reason string
+}
+
+// ValidateSliceDepths checks the depths of the slices, which select the leaf
+// slices attributed by ComputeCounters. A depth must not be negative, and a
+// slice of depth k > 0 must be temporally contained within a slice of depth
+// k-1 of the same group. The violations are returned in the order of the
+// slices.
+func ValidateSliceDepths(slices []*service.ProfilingData_GpuSlices_Slice) []DepthViolation {
+	type key struct {
+		groupId int32
+		depth   int32
+	}
+	byDepth := map[key][]*service.ProfilingData_GpuSlices_Slice{}
+	for _, slice := range slices {
+		k := key{slice.GroupId, slice.Depth}
+		byDepth[k] = append(byDepth[k], slice)
+	}
+
+	violations := []DepthViolation{}
+	for _, slice := range slices {
+		switch {
+		case slice.Depth < 0:
+			violations = append(violations, DepthViolation{slice, "negative depth"})
+		case slice.Depth > 0 && !containedIn(slice, byDepth[key{slice.GroupId, slice.Depth - 1}]):
+			violations = append(violations, DepthViolation{slice, "not contained in a parent slice"})
+		}
+	}
+	return violations
+}
+
+// Tell whether the slice is temporally contained within one of the parents.
+func containedIn(slice *service.ProfilingData_GpuSlices_Slice, parents []*service.ProfilingData_GpuSlices_Slice) bool {
+	for _, parent := range parents {
+		if parent.Ts <= slice.Ts && slice.Ts+slice.Dur <= parent.Ts+parent.Dur {
+			return true
+		}
+	}
+	return false
+}
+
+// RepairSliceDepths returns copies of the slices whose depths are recomputed
+// from the temporal nesting of the slices of each group: a slice is one level
+// deeper than the innermost slice of its group containing it. Of identical
+// spans, the first slice is the parent. The input slices are not modified and
+// the result keeps their order.
+func RepairSliceDepths(slices []*service.ProfilingData_GpuSlices_Slice) []*service.ProfilingData_GpuSlices_Slice {
+	repaired := make([]*service.ProfilingData_GpuSlices_Slice, len(slices))
+	for i, s := range slices {
+		repaired[i] = withTimes(s, s.Ts, s.Dur)
+	}
+
+	sorted := make([]*service.ProfilingData_GpuSlices_Slice, len(repaired))
+	copy(sorted, repaired)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		switch {
+		case a.GroupId != b.GroupId:
+			return a.GroupId < b.GroupId
+		case a.Ts != b.Ts:
+			return a.Ts < b.Ts
+		default:
+			return a.Dur > b.Dur
+		}
+	})
+	ancestors := []*service.ProfilingData_GpuSlices_Slice{} // The slices containing the current one, from the outermost.
+	for i, slice := range sorted {
+		if i > 0 && sorted[i-1].GroupId != slice.GroupId {
+			ancestors = ancestors[:0]
+		}
+		for len(ancestors) > 0 {
+			if parent := ancestors[len(ancestors)-1]; parent.Ts+parent.Dur >= slice.Ts+slice.Dur {
+				break
+			}
+			ancestors = ancestors[:len(ancestors)-1]
+		}
+		slice.Depth = int32(len(ancestors))
+		ancestors = append(ancestors, slice)
+	}
+	return repaired
+}
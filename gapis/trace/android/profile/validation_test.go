@@ -0,0 +1,56 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+// depthSlice builds a GPU slice of the given group and depth.
+func depthSlice(groupId, depth int32, ts, dur uint64) *service.ProfilingData_GpuSlices_Slice {
+	s := slice(groupId, ts, dur)
+	s.Depth = depth
+	return s
+}
+
+func TestValidateSliceDepths(t *testing.T) {
+	ctx := log.Testing(t)
+	parent := depthSlice(0, 0, 0, 100)
+	child := depthSlice(0, 1, 10, 20)
+	orphan := depthSlice(0, 1, 90, 20)     // Ends after its parent.
+	otherGroup := depthSlice(1, 1, 10, 20) // No parent in its group.
+	negative := depthSlice(0, -1, 30, 10)
+	slices := []*service.ProfilingData_GpuSlices_Slice{parent, child, orphan, otherGroup, negative}
+
+	assert.For(ctx, "violations").That(ValidateSliceDepths(slices)).DeepEquals([]DepthViolation{
+		{orphan, "not contained in a parent slice"},
+		{otherGroup, "not contained in a parent slice"},
+		{negative, "negative depth"},
+	})
+	assert.For(ctx, "valid").ThatSlice(ValidateSliceDepths(slices[:2])).IsEmpty()
+
+	repaired := RepairSliceDepths(slices)
+	depths := []int32{}
+	for _, s := range repaired {
+		depths = append(depths, s.Depth)
+	}
+	assert.For(ctx, "depths").That(depths).DeepEquals([]int32{0, 1, 0, 0, 1})
+	assert.For(ctx, "repaired").ThatSlice(ValidateSliceDepths(repaired)).IsEmpty()
+	assert.For(ctx, "input").That(negative.Depth).Equals(int32(-1))
+}
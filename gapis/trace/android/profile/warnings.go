@@ -0,0 +1,83 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/gapid/core/context/keys"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+type warningsKeyTy string
+
+const warningsKey = warningsKeyTy("profileWarnings")
+
+// The warnings of a computation, each kept once, in the order they were
+// found. The counters being attributed concurrently, it is safe for
+// concurrent use.
+type warnings struct {
+	mutex sync.Mutex
+	list  []*service.ProfilingData_GpuCounters_Warning
+	seen  map[string]bool // The kinds, names and messages of the list.
+}
+
+// Attach the warnings collecting the ones of the computation to a Context.
+func putWarnings(ctx context.Context, w *warnings) context.Context {
+	return keys.WithValue(ctx, warningsKey, w)
+}
+
+// Add the warning to the warnings of the computation of the context, if
+// any, unless it was already added.
+func addWarning(ctx context.Context, warning *service.ProfilingData_GpuCounters_Warning) {
+	w, ok := ctx.Value(warningsKey).(*warnings)
+	if !ok {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.seen == nil {
+		w.seen = map[string]bool{}
+	}
+	key := fmt.Sprintf("%v\x00%v\x00%v", warning.Kind, warning.Name, warning.Message)
+	if w.seen[key] {
+		return
+	}
+	w.seen[key] = true
+	w.list = append(w.list, warning)
+}
+
+// Log the warning about the counter, the metric or the entry of the given
+// name and add it to the warnings of the computation, see addWarning.
+func warn(ctx context.Context, kind service.ProfilingData_GpuCounters_Warning_Kind, name string, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.W(ctx, "%v", message)
+	addWarning(ctx, &service.ProfilingData_GpuCounters_Warning{Kind: kind, Name: name, Message: message})
+}
+
+// Return an error if the aggregation operator of the metric of one of the
+// counters isn't implemented, see RegisterAggregator.
+func checkAggregations(ctx context.Context, counters []*service.ProfilingData_Counter, options *Options) error {
+	for i, counter := range counters {
+		op := counterMetric(i, counter, options).Op
+		if _, ok := aggregators[op]; !ok {
+			return log.Errf(ctx, nil, "Aggregation operator %v of counter %v not implemented", op, counter.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"testing"
+
+	"github.com/google/gapid/core/assert"
+	"github.com/google/gapid/core/log"
+	"github.com/google/gapid/gapis/service"
+)
+
+func TestWarnings(t *testing.T) {
+	ctx := log.Testing(t)
+	slices, counters := twoCommandsFixture()
+	res, err := ComputeCounters(ctx, slices, counters, nil)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	assert.For(ctx, "no warning").ThatSlice(res.Warnings).IsEmpty()
+
+	malformed := counter("Broken", []uint64{0, 10, 20}, []float64{1, 2})
+	options := &Options{Attribution: "unknown", ChunkGroups: 1}
+	res, err = ComputeCounters(ctx, slices, append(counters, malformed), options)
+	assert.For(ctx, "err").ThatError(err).Succeeded()
+	kinds := map[service.ProfilingData_GpuCounters_Warning_Kind]string{}
+	for _, warning := range res.Warnings {
+		_, seen := kinds[warning.Kind]
+		assert.For(ctx, "%v once", warning.Kind).That(seen).Equals(false)
+		kinds[warning.Kind] = warning.Name
+	}
+	// Once, although each chunk is computed separately.
+	assert.For(ctx, "warnings").That(kinds).DeepEquals(map[service.ProfilingData_GpuCounters_Warning_Kind]string{
+		service.ProfilingData_GpuCounters_Warning_UnknownAttribution: "unknown",
+		service.ProfilingData_GpuCounters_Warning_MalformedCounter:   "Broken",
+	})
+	// Still computed.
+	assert.For(ctx, "busy").That(findEntry(res, 0).MetricToValue[counterMetricIdOffset]).IsNotNil()
+
+	// An aggregation operator not implemented is an error.
+	unsupported := &Options{CounterAggregations: map[string]service.ProfilingData_GpuCounters_Metric_AggregationOperator{
+		"Busy": service.ProfilingData_GpuCounters_Metric_AggregationOperator(42),
+	}}
+	_, err = ComputeCounters(ctx, slices, counters, unsupported)
+	assert.For(ctx, "unsupported").ThatError(err).Failed()
+	_, err = ComputeCommandCounters(ctx, slices, counters, []uint64{0}, unsupported)
+	assert.For(ctx, "command unsupported").ThatError(err).Failed()
+}
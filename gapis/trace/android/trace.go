@@ -125,7 +125,7 @@ func (t *androidTracer) GetDevice() bind.Device {
 	return t.b
 }
 
-func (t *androidTracer) ProcessProfilingData(ctx context.Context, buffer *bytes.Buffer, capture *path.Capture, handleMappings *map[uint64][]service.VulkanHandleMappingItem, syncData *sync.Data) (*service.ProfilingData, error) {
+func (t *androidTracer) ProcessProfilingData(ctx context.Context, buffer *bytes.Buffer, capture *path.Capture, handleMappings *map[uint64][]service.VulkanHandleMappingItem, syncData *sync.Data, attribution string) (*service.ProfilingData, error) {
 	// Load Perfetto trace and create trace processor.
 	rawData := make([]byte, buffer.Len())
 	_, err := buffer.Read(rawData)
@@ -142,9 +142,9 @@ func (t *androidTracer) ProcessProfilingData(ctx context.Context, buffer *bytes.
 	desc := conf.GetPerfettoCapability().GetGpuProfiling().GetGpuCounterDescriptor()
 	gpuName := gpu.GetName()
 	if strings.Contains(gpuName, "Adreno") {
-		return adreno.ProcessProfilingData(ctx, processor, capture, desc, handleMappings, syncData)
+		return adreno.ProcessProfilingData(ctx, processor, capture, desc, handleMappings, syncData, attribution)
 	} else if strings.Contains(gpuName, "Mali") {
-		return mali.ProcessProfilingData(ctx, processor, capture, desc, handleMappings, syncData)
+		return mali.ProcessProfilingData(ctx, processor, capture, desc, handleMappings, syncData, attribution)
 	}
 	return nil, log.Errf(ctx, nil, "Failed to process Perfetto trace for device %v", gpuName)
 }
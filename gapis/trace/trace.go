@@ -107,12 +107,12 @@ func TraceConfiguration(ctx context.Context, device *path.Device) (*service.Devi
 	return t.TraceConfiguration(ctx)
 }
 
-func ProcessProfilingData(ctx context.Context, device *path.Device, capture *path.Capture, buffer *bytes.Buffer, handleMapping *map[uint64][]service.VulkanHandleMappingItem, syncData *sync.Data) (*service.ProfilingData, error) {
+func ProcessProfilingData(ctx context.Context, device *path.Device, capture *path.Capture, buffer *bytes.Buffer, handleMapping *map[uint64][]service.VulkanHandleMappingItem, syncData *sync.Data, attribution string) (*service.ProfilingData, error) {
 	t, err := GetTracer(ctx, device)
 	if err != nil {
 		return nil, err
 	}
-	return t.ProcessProfilingData(ctx, buffer, capture, handleMapping, syncData)
+	return t.ProcessProfilingData(ctx, buffer, capture, handleMapping, syncData, attribution)
 }
 
 func Validate(ctx context.Context, device *path.Device) error {